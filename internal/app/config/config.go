@@ -1,29 +1,379 @@
 package config
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/shortcode"
 )
 
-// Config - конфиг структура по файлу .env
+// настройки приложения, слои (каждый следующий перекрывает предыдущий):
+// 1 значения по умолчанию (Default)
+// 2 файл .env (KEY=VALUE) из флага -config или env CONFIG_FILE
+// 3 переменные окружения
+// 4 флаги командной строки
+// секреты (пароли) задаются только файлом или env, чтобы их не было видно в списке процессов
+
+// redacted - value of secret in log
+const redacted = "*****"
+
+// Redis - redis server of cache
+type Redis struct {
+	Addr     string `envconfig:"ADDR"`
+	Password string `envconfig:"PASSWORD"`
+	DB       int    `envconfig:"DB"`
+}
+
+// Cache - cache of service: 'redis' (shared by instances) or 'memory' (of process, up to Size keys for TTL),
+// Workers - number of cache write back workers, QueueSize - capacity of queue of them,
+// Policy - what to do when queue is full: 'block' (request waits for place), 'reject' (503)
+// or 'spill' (task is kept in SpillJournal until queue has room),
+// InvalidateChannel - redis channel of deleted keys, so instances evict them from local cache (” - off),
+// RedirectTTL - time to keep resolved shortlink (0 - opens are not cached), NegativeTTL - time to keep unknown shortlink,
+// UserTTL - time to keep profile of user (role, balance) and uid of superuser (0 - they are not cached),
+// SessionTTL - time to keep alive sessions of user, logged out session is dead at once, revoked otherwise - after it
+type Cache struct {
+	Backend           string        `envconfig:"BACKEND"`
+	Size              int           `envconfig:"SIZE"`
+	TTL               time.Duration `envconfig:"TTL"`
+	Workers           int           `envconfig:"WORKERS"`
+	QueueSize         int           `envconfig:"QUEUE_SIZE"`
+	Policy            string        `envconfig:"POLICY"`
+	SpillJournal      string        `envconfig:"SPILL_JOURNAL"`
+	InvalidateChannel string        `envconfig:"INVALIDATE_CHANNEL"`
+	RedirectTTL       time.Duration `envconfig:"REDIRECT_TTL"`
+	NegativeTTL       time.Duration `envconfig:"NEGATIVE_TTL"`
+	UserTTL           time.Duration `envconfig:"USER_TTL"`
+	SessionTTL        time.Duration `envconfig:"SESSION_TTL"`
+}
+
+// Redirs - counters of opens of links, they are added to repo every FlushInterval,
+// counters are kept in redis of cache under keys of Prefix (in process if cache is 'memory')
+type Redirs struct {
+	FlushInterval time.Duration `envconfig:"FLUSH_INTERVAL"`
+	Prefix        string        `envconfig:"PREFIX"`
+}
+
+// WriteBack - journal of links put by write back service, failed write is retried MaxAttempts times
+// after RetryDelay, doubled every attempt up to MaxRetryDelay
+type WriteBack struct {
+	Journal       string        `envconfig:"JOURNAL"`
+	MaxAttempts   int           `envconfig:"MAX_ATTEMPTS"`
+	RetryDelay    time.Duration `envconfig:"RETRY_DELAY"`
+	MaxRetryDelay time.Duration `envconfig:"MAX_RETRY_DELAY"`
+}
+
+// Pg - pool of pg connections
+type Pg struct {
+	MaxConns int `envconfig:"MAX_CONNS"`
+	MinConns int `envconfig:"MIN_CONNS"`
+}
+
+// OTLP - trace exporter, empty Endpoint - traces are not exported
+type OTLP struct {
+	Endpoint string `envconfig:"ENDPOINT"`
+	Insecure bool   `envconfig:"INSECURE"`
+}
+
+// JWT - signing keys of tokens, KeysDir is required
+// DevSecret - without KeysDir tokens are signed by built-in HS256 secret of older versions (development only),
+// the secret is public, so anybody can sign token of any user with it
+type JWT struct {
+	KeysDir   string `envconfig:"KEYS_DIR"`
+	KID       string `envconfig:"KID"`
+	DevSecret bool   `envconfig:"DEV_SECRET"`
+}
+
+// OIDC - identity provider of OpenID Connect login, empty Issuer - no oidc login
+type OIDC struct {
+	Issuer       string `envconfig:"ISSUER"`
+	ClientID     string `envconfig:"CLIENT_ID"`
+	ClientSecret string `envconfig:"CLIENT_SECRET"`
+	RedirectURL  string `envconfig:"REDIRECT_URL"`
+}
+
+// RateLimit - rate limits of routes
+// TrustedProxies - comma separated networks (cidr) or ips of reverse proxies whose IPHeader is taken
+type RateLimit struct {
+	Enabled        bool   `envconfig:"ENABLED"`
+	IPHeader       string `envconfig:"IP_HEADER"`
+	TrustedProxies string `envconfig:"TRUSTED_PROXIES"`
+}
+
+// Proxies - networks of TrustedProxies, ip is network of one address
+func (rl RateLimit) Proxies() ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, proxy := range strings.Split(rl.TrustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q should be ip or cidr", proxy)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// Config - конфиг приложения
+// StorageName - pg url, json or bolt file of StorageType ('file', 'pg' or 'bolt')
+// ShutdownTimeout, SweepInterval - seconds
 type Config struct {
-	PORT string `envconfig:"PORT" required:"true"`
+	Port            string `envconfig:"PORT"`
+	StorageType     string `envconfig:"STORAGE_TYPE"`
+	StorageName     string `envconfig:"REPO"`
+	ShutdownTimeout int64  `envconfig:"SHUTDOWN_TIMEOUT"`
+	SweepInterval   int64  `envconfig:"SWEEP_INTERVAL"`
+	Migrate         bool   `envconfig:"MIGRATE"`
+	CodeLength      int    `envconfig:"CODE_LENGTH"`
+	CodeAlphabet    string `envconfig:"CODE_ALPHABET"`
+	Policy          string `envconfig:"POLICY"`
+
+	Cache     Cache     `envconfig:"CACHE"`
+	WriteBack WriteBack `envconfig:"WRITEBACK"`
+	Redirs    Redirs    `envconfig:"REDIRS"`
+	Redis     Redis     `envconfig:"REDIS"`
+	Pg        Pg        `envconfig:"PG"`
+	OTLP      OTLP      `envconfig:"OTLP"`
+	JWT       JWT       `envconfig:"JWT"`
+	OIDC      OIDC      `envconfig:"OIDC"`
+	RateLimit RateLimit `envconfig:"RATELIMIT"`
 }
 
-// New - cоздание конфига из файла .env
-func New(cfgFile string) (*Config, error) {
-	err := godotenv.Load(cfgFile)
-	if err != nil {
-		return nil, fmt.Errorf("load config file %q %w", cfgFile, err)
+// Default - значения по умолчанию
+// services are on localhost, there are no credentials: StorageName (pg url with user and password) is required
+func Default() Config {
+	return Config{
+		Port:            "8000",
+		StorageType:     "pg",
+		ShutdownTimeout: 3,
+		SweepInterval:   60,
+		Migrate:         true,
+		CodeLength:      shortcode.DefaultLength,
+		CodeAlphabet:    shortcode.DefaultAlphabet,
+		Cache: Cache{Backend: "redis", Size: 10000, TTL: time.Hour, Workers: 2, QueueSize: 64, Policy: "block", SpillJournal: "spill.journal",
+			InvalidateChannel: "weblink:cache:invalidate", RedirectTTL: 10 * time.Minute, NegativeTTL: 30 * time.Second,
+			UserTTL: 30 * time.Second, SessionTTL: 5 * time.Second},
+		WriteBack: WriteBack{Journal: "writeback.journal", MaxAttempts: 8, RetryDelay: 500 * time.Millisecond, MaxRetryDelay: time.Minute},
+		Redirs:    Redirs{FlushInterval: 5 * time.Second, Prefix: "weblink:redirs:"},
+		Redis:     Redis{Addr: "localhost:6379"},
+		Pg:        Pg{MaxConns: 8, MinConns: 4},
+		OTLP:      OTLP{Insecure: true},
+		RateLimit: RateLimit{Enabled: true},
 	}
+}
+
+// flags - флаги настроек, значения по умолчанию - значения cfg
+func (cfg *Config) flags(name string, output io.Writer) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] [migrate up|down|status]\n", name)
+		fs.PrintDefaults()
+	}
+
+	cfgFile := fs.String("config", os.Getenv("CONFIG_FILE"), "file of settings KEY=VALUE (.env), env vars and flags override it. Also, it can be set as env CONFIG_FILE.")
+	fs.StringVar(&cfg.Port, "port", cfg.Port, "Port. Also, it can be set as env PORT.")
+	fs.StringVar(&cfg.StorageType, "storage_type", cfg.StorageType, "data storage type: 'file', 'pg' or 'bolt'")
+	fs.StringVar(&cfg.StorageName, "storage_name", cfg.StorageName,
+		"pg: 'postgres://dbuser:dbpasswd@ip_address:port/dbname'  file: 'storage.json' bolt: 'storage.db', it is required. It can be also set as REPO.")
+	fs.Int64Var(&cfg.ShutdownTimeout, "shutdown_timeout", cfg.ShutdownTimeout, "shutdown timeout")
+	fs.Int64Var(&cfg.SweepInterval, "sweep_interval", cfg.SweepInterval, "interval (seconds) of marking expired links inactive")
+	fs.IntVar(&cfg.CodeLength, "code_length", cfg.CodeLength, "length of generated short codes")
+	fs.StringVar(&cfg.CodeAlphabet, "code_alphabet", cfg.CodeAlphabet, "chars of generated short codes")
+	fs.BoolVar(&cfg.Migrate, "migrate", cfg.Migrate, "pg: apply pending schema migrations on start")
+	fs.StringVar(&cfg.Policy, "policy", cfg.Policy, "json file of actions allowed to user roles: {\"ROLE\": [\"link.create\", ...]}; empty - built-in policy")
+
+	fs.StringVar(&cfg.Cache.Backend, "cache", cfg.Cache.Backend, "cache of service: 'redis' (shared by instances) or 'memory' (of process)")
+	fs.IntVar(&cfg.Cache.Size, "cache_size", cfg.Cache.Size, "memory cache: max number of keys")
+	fs.DurationVar(&cfg.Cache.TTL, "cache_ttl", cfg.Cache.TTL, "memory cache: max time to keep key")
+	fs.IntVar(&cfg.Cache.Workers, "cache_workers", cfg.Cache.Workers, "number of cache write back workers")
+	fs.StringVar(&cfg.Cache.InvalidateChannel, "cache_invalidate_channel", cfg.Cache.InvalidateChannel, "redis cache: pub/sub channel of deleted keys, so other instances evict them from local cache; empty - off")
+	fs.DurationVar(&cfg.Cache.RedirectTTL, "cache_redirect_ttl", cfg.Cache.RedirectTTL, "time to keep resolved shortlink in cache, so opens of it do not touch repo; 0 - off")
+	fs.DurationVar(&cfg.Cache.NegativeTTL, "cache_negative_ttl", cfg.Cache.NegativeTTL, "time to keep unknown shortlink in cache")
+	fs.DurationVar(&cfg.Cache.UserTTL, "cache_user_ttl", cfg.Cache.UserTTL, "time to keep profile of user (role, balance) in cache, so requests do not read it from repo; 0 - off")
+	fs.DurationVar(&cfg.Cache.SessionTTL, "cache_session_ttl", cfg.Cache.SessionTTL, "time to keep alive sessions of user in cache, access token of session revoked by reuse of refresh token works until it is over; 0 - off")
+	fs.IntVar(&cfg.Cache.QueueSize, "cache_queue", cfg.Cache.QueueSize, "capacity of queue of cache workers")
+	fs.StringVar(&cfg.Cache.Policy, "cache_policy", cfg.Cache.Policy, "when queue of cache workers is full: 'block' (request waits for place), 'reject' (503) or 'spill' (task waits in spill journal)")
+	fs.StringVar(&cfg.Cache.SpillJournal, "cache_spill_journal", cfg.Cache.SpillJournal, "file of journal of tasks of cache workers spilled as queue is full (policy 'spill')")
+	fs.StringVar(&cfg.WriteBack.Journal, "writeback_journal", cfg.WriteBack.Journal, "file of journal of links which are not yet written to storage")
+	fs.IntVar(&cfg.WriteBack.MaxAttempts, "writeback_max_attempts", cfg.WriteBack.MaxAttempts, "attempts to write link to storage, then it is dead letter")
+	fs.DurationVar(&cfg.WriteBack.RetryDelay, "writeback_retry_delay", cfg.WriteBack.RetryDelay, "delay of retry of failed write, doubled every attempt")
+	fs.DurationVar(&cfg.WriteBack.MaxRetryDelay, "writeback_max_retry_delay", cfg.WriteBack.MaxRetryDelay, "max delay of retry of failed write")
+	fs.DurationVar(&cfg.Redirs.FlushInterval, "redirs_flush_interval", cfg.Redirs.FlushInterval, "how often counted opens of links are added to repo")
+	fs.StringVar(&cfg.Redirs.Prefix, "redirs_prefix", cfg.Redirs.Prefix, "redis cache: prefix of keys of counters of opens")
+	fs.StringVar(&cfg.Redis.Addr, "redis_addr", cfg.Redis.Addr, "redis of cache host:port (password is env REDIS_PASSWORD)")
+	fs.IntVar(&cfg.Redis.DB, "redis_db", cfg.Redis.DB, "redis database of cache")
+	fs.IntVar(&cfg.Pg.MaxConns, "pg_max_conns", cfg.Pg.MaxConns, "pg: max connections of pool")
+	fs.IntVar(&cfg.Pg.MinConns, "pg_min_conns", cfg.Pg.MinConns, "pg: min connections of pool")
+	fs.StringVar(&cfg.OTLP.Endpoint, "otlp_endpoint", cfg.OTLP.Endpoint, "OTLP HTTP host:port of traces; empty - traces are not exported")
+	fs.BoolVar(&cfg.OTLP.Insecure, "otlp_insecure", cfg.OTLP.Insecure, "OTLP without TLS")
+
+	fs.StringVar(&cfg.JWT.KeysDir, "jwt_keys_dir", cfg.JWT.KeysDir, "dir of jwt keys: <kid>.pem (RSA/EC) and <kid>.secret (HS256), it is required unless jwt_dev_secret is set")
+	fs.StringVar(&cfg.JWT.KID, "jwt_kid", cfg.JWT.KID, "kid of jwt key which signs new tokens, other keys of jwt_keys_dir only verify")
+	fs.BoolVar(&cfg.JWT.DevSecret, "jwt_dev_secret", cfg.JWT.DevSecret, "without jwt_keys_dir sign tokens by built-in public HS256 secret; development only, never in production")
+
+	fs.StringVar(&cfg.OIDC.Issuer, "oidc_issuer", cfg.OIDC.Issuer, "OpenID Connect issuer url of login by identity provider; empty - no oidc login")
+	fs.StringVar(&cfg.OIDC.ClientID, "oidc_client_id", cfg.OIDC.ClientID, "client id of this api at identity provider (secret is env OIDC_CLIENT_SECRET)")
+	fs.StringVar(&cfg.OIDC.RedirectURL, "oidc_redirect_url", cfg.OIDC.RedirectURL, "/user/oidc/callback url of this api registered at identity provider")
+
+	fs.BoolVar(&cfg.RateLimit.Enabled, "ratelimit", cfg.RateLimit.Enabled, "rate limits of login routes (by ip) and link opens (by user), shared by instances through redis of cache")
+	fs.StringVar(&cfg.RateLimit.IPHeader, "ratelimit_ip_header", cfg.RateLimit.IPHeader, "header of client ip set by reverse proxy, e.g. X-Real-IP; empty - ip of connection")
+	fs.StringVar(&cfg.RateLimit.TrustedProxies, "ratelimit_trusted_proxies", cfg.RateLimit.TrustedProxies, "comma separated ips or cidrs of reverse proxies, ratelimit_ip_header is taken only from them; empty - from any peer")
+	return fs, cfgFile
+}
 
-	config := new(Config)
-	err = envconfig.Process("", config)
-	if err != nil {
-		return nil, fmt.Errorf("get config from env variables: %w", err)
+// Load - конфиг из значений по умолчанию, файла, env и флагов args (без имени программы)
+// returns config and args which are not flags (e.g. migrate up), -h gives flag.ErrHelp
+func Load(name string, args []string, output io.Writer) (*Config, []string, error) {
+	cfg := Default()
+	fs, cfgFile := cfg.flags(name, output)
+	// first parse - name of config file
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
 	}
 
-	return config, nil
+	if *cfgFile != "" {
+		// file does not override env
+		if err := godotenv.Load(*cfgFile); err != nil {
+			return nil, nil, fmt.Errorf("load config file %q %w", *cfgFile, err)
+		}
+	}
+	if err := envconfig.Process("", &cfg); err != nil {
+		return nil, nil, fmt.Errorf("get config from env variables: %w", err)
+	}
+	// second parse - flags override file and env
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return &cfg, fs.Args(), nil
+}
+
+// Validate - all errors of settings
+func (cfg Config) Validate() error {
+	var errs []error
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("port %q should be 1..65535", cfg.Port))
+	}
+	switch cfg.StorageType {
+	case "file", "pg", "bolt":
+	default:
+		errs = append(errs, fmt.Errorf("storage type %q should be 'file', 'pg' or 'bolt'", cfg.StorageType))
+	}
+	if cfg.StorageName == "" {
+		errs = append(errs, errors.New("storage name is empty"))
+	}
+	if cfg.ShutdownTimeout < 1 {
+		errs = append(errs, fmt.Errorf("shutdown timeout %d should be positive", cfg.ShutdownTimeout))
+	}
+	if cfg.SweepInterval < 1 {
+		errs = append(errs, fmt.Errorf("sweep interval %d should be positive", cfg.SweepInterval))
+	}
+	switch cfg.Cache.Backend {
+	case "redis":
+		if cfg.Redis.Addr == "" {
+			errs = append(errs, errors.New("redis address of cache is empty"))
+		}
+	case "memory":
+		if cfg.Cache.Size < 1 || cfg.Cache.TTL <= 0 {
+			errs = append(errs, fmt.Errorf("memory cache size %d and ttl %v should be positive", cfg.Cache.Size, cfg.Cache.TTL))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("cache %q should be 'redis' or 'memory'", cfg.Cache.Backend))
+	}
+	if cfg.Cache.Workers < 1 {
+		errs = append(errs, fmt.Errorf("cache workers %d should be positive", cfg.Cache.Workers))
+	}
+	if cfg.Cache.QueueSize < 0 {
+		errs = append(errs, fmt.Errorf("cache queue %d should not be negative", cfg.Cache.QueueSize))
+	}
+	switch cfg.Cache.Policy {
+	case "block", "reject":
+	case "spill":
+		if cfg.Cache.SpillJournal == "" {
+			errs = append(errs, errors.New("cache spill journal is empty"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("cache policy %q should be 'block', 'reject' or 'spill'", cfg.Cache.Policy))
+	}
+	if cfg.Cache.RedirectTTL < 0 || cfg.Cache.NegativeTTL < 0 {
+		errs = append(errs, fmt.Errorf("cache redirect ttl %v and negative ttl %v should not be negative", cfg.Cache.RedirectTTL, cfg.Cache.NegativeTTL))
+	}
+	if cfg.Cache.UserTTL < 0 || cfg.Cache.SessionTTL < 0 {
+		errs = append(errs, fmt.Errorf("cache user ttl %v and session ttl %v should not be negative", cfg.Cache.UserTTL, cfg.Cache.SessionTTL))
+	}
+	if cfg.WriteBack.Journal == "" {
+		errs = append(errs, errors.New("write back journal is empty"))
+	}
+	if cfg.WriteBack.MaxAttempts < 1 || cfg.WriteBack.RetryDelay <= 0 || cfg.WriteBack.MaxRetryDelay < cfg.WriteBack.RetryDelay {
+		errs = append(errs, fmt.Errorf("write back max attempts %d, retry delay %v, max retry delay %v: should be positive, max >= retry delay",
+			cfg.WriteBack.MaxAttempts, cfg.WriteBack.RetryDelay, cfg.WriteBack.MaxRetryDelay))
+	}
+	if cfg.Redirs.FlushInterval <= 0 || cfg.Redirs.Prefix == "" {
+		errs = append(errs, fmt.Errorf("redirs flush interval %v should be positive, prefix %q should not be empty", cfg.Redirs.FlushInterval, cfg.Redirs.Prefix))
+	}
+	if cfg.Redis.DB < 0 {
+		errs = append(errs, fmt.Errorf("redis db %d should not be negative", cfg.Redis.DB))
+	}
+	if cfg.Pg.MaxConns < 1 || cfg.Pg.MinConns < 0 || cfg.Pg.MinConns > cfg.Pg.MaxConns {
+		errs = append(errs, fmt.Errorf("pg pool min %d, max %d connections: should be 0 <= min <= max, max > 0", cfg.Pg.MinConns, cfg.Pg.MaxConns))
+	}
+	if cfg.JWT.KID != "" && cfg.JWT.KeysDir == "" {
+		errs = append(errs, errors.New("jwt kid is set without jwt keys dir"))
+	}
+	if cfg.JWT.KeysDir == "" && !cfg.JWT.DevSecret {
+		errs = append(errs, errors.New("jwt keys dir is empty (built-in secret of development is used only with jwt dev secret flag)"))
+	}
+	if cfg.OIDC.Issuer != "" && (cfg.OIDC.ClientID == "" || cfg.OIDC.RedirectURL == "") {
+		errs = append(errs, errors.New("oidc issuer is set without client id or redirect url"))
+	}
+	if _, err := cfg.RateLimit.Proxies(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	return nil
+}
+
+// Redacted - config with secrets hidden, e.g. to log it
+func (cfg Config) Redacted() Config {
+	if u, err := url.Parse(cfg.StorageName); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			cfg.StorageName = u.String()
+		}
+	}
+	if cfg.Redis.Password != "" {
+		cfg.Redis.Password = redacted
+	}
+	if cfg.OIDC.ClientSecret != "" {
+		cfg.OIDC.ClientSecret = redacted
+	}
+	return cfg
 }
@@ -30,12 +30,22 @@ var (
 		10:  "Internal repo problem",
 		11:  "No shorturl in data",
 		12:  "Login error, provide username password",
+		13:  "The shortlink has expired",
+		14:  "The shortlink has reached its maximum number of opens",
+		15:  "The session is revoked, please authenticate again",
+		16:  "Unknown, revoked or expired api key",
+		17:  "OpenID Connect login failed, please log in again",
+		18:  "Too many requests, please retry later",
+		19:  "Service is overloaded, please retry later",
+		20:  "User with this email is registered by password, please log in by password",
 		400: "Bad request",
 		401: "Unauthorized",
 		402: "Payment required",
 		403: "Forbidden",
 		404: "Not found",
 		405: "Method not allowed",
+		429: "Too many requests",
+		503: "Service unavailable",
 	}
 )
 
@@ -0,0 +1,135 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/policy"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
+)
+
+// api keys of users - long-lived keys for programmatic access without jwt login and refresh
+// key is given only once when it is created, it works only for actions of its scopes
+// (and of user role), /user/apikeys creates, lists and revokes keys
+
+// apiKeyPrefix - prefix of api keys, so they are easy to find in configs and logs
+const apiKeyPrefix = "wl_"
+
+// apiKeyRequest - body of new api key request, zero expires_at - key does not expire
+type apiKeyRequest struct {
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// newAPIKeySecret - random api key
+func newAPIKeySecret() (string, error) {
+	first, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	second, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + first + second, nil
+}
+
+// postAPIKey - create api key of user, answer has the key itself (it is not shown any more)
+func postAPIKey(svc linkSvc) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, request *http.Request) {
+		contentType := request.Header.Get("Content-Type")
+		if contentType != "application/json" {
+			ResponseAPIError(w, 9, http.StatusBadRequest)
+			return
+		}
+		var keyRequest apiKeyRequest
+		if err := json.NewDecoder(request.Body).Decode(&keyRequest); err != nil {
+			ResponseAPIError(w, 400, http.StatusBadRequest)
+			return
+		}
+		now := time.Now().UTC()
+		if len(keyRequest.Scopes) == 0 || (!keyRequest.ExpiresAt.IsZero() && !keyRequest.ExpiresAt.After(now)) {
+			ResponseAPIError(w, 400, http.StatusBadRequest)
+			return
+		}
+		for _, scope := range keyRequest.Scopes {
+			if !policy.Known(policy.Action(scope)) {
+				ResponseAPIError(w, 400, http.StatusBadRequest)
+				return
+			}
+		}
+
+		id, err := newTokenID()
+		if err != nil {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		secret, err := newAPIKeySecret()
+		if err != nil {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		key := model.APIKey{
+			ID:        id,
+			UID:       tokenClaim(request, "uid"),
+			Name:      keyRequest.Name,
+			Key:       secret,
+			Scopes:    keyRequest.Scopes,
+			CreatedAt: now,
+			ExpiresAt: keyRequest.ExpiresAt.UTC(),
+		}
+		if err = svc.PutAPIKey(request.Context(), key); err != nil {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		log.Printf("api key %s (%s) of user %s is created, scopes: %v", key.ID, key.Name, key.UID, key.Scopes)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(key)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// getAPIKeys - alive api keys of user, without keys themselves
+func getAPIKeys(svc linkSvc) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, request *http.Request) {
+		keys, err := svc.ListAPIKeys(request.Context(), tokenClaim(request, "uid"))
+		if err != nil {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(model.APIKeys{Data: keys})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// delAPIKey - revoke api key of user by id
+func delAPIKey(svc linkSvc) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, request *http.Request) {
+		id := mux.Vars(request)["id"]
+		err := svc.RevokeAPIKey(request.Context(), tokenClaim(request, "uid"), id)
+		if errors.Is(err, repository.ErrNoAPIKey) {
+			ResponseAPIError(w, 404, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,254 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/jwtkeys"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/policy"
+)
+
+// OpenID Connect login (authorization code flow with PKCE) next to username/password one
+// /user/oidc/login redirects to identity provider, it redirects back to /user/oidc/callback with code
+// identity (iss, sub) of id token is mapped to user, then usual token pair is given.
+// new identity is linked by verified email: to new user with role USER or to user created by oidc before;
+// user registered by password is not linked - email of registration is not verified, anybody could register it
+
+var (
+	// errOIDCUnverified - new identity has no verified email, it can not be linked to user
+	errOIDCUnverified = errors.New("oidc identity has no verified email")
+	// errOIDCLocalUser - user with email of new identity is registered by password
+	errOIDCLocalUser = errors.New("user with email of oidc identity is registered by password")
+)
+
+// oidcCookie - state, nonce and PKCE verifier of login which is in progress
+const oidcCookie = "weblink_oidc"
+
+// oidcLoginTTL - time to log in at identity provider
+const oidcLoginTTL = 10 * time.Minute
+
+// OIDCConfig - identity provider settings, provider endpoints are discovered by Issuer/.well-known/openid-configuration
+// RedirectURL - /user/oidc/callback url of this api which is registered at provider
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// OIDC - identity provider of login
+type OIDC struct {
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDC - provider of cfg, ctx is used for discovery and may carry http client (oidc.ClientContext)
+func NewOIDC(ctx context.Context, cfg OIDCConfig) (*OIDC, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery of %s: %w", cfg.Issuer, err)
+	}
+	return &OIDC{
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+// getOIDCLogin - redirect to identity provider, state of login is kept in cookie
+func getOIDCLogin(provider *OIDC) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, request *http.Request) {
+		if provider == nil {
+			ResponseAPIError(w, 404, http.StatusNotFound)
+			return
+		}
+		state, err := newTokenID()
+		if err != nil {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		nonce, err := newTokenID()
+		if err != nil {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		verifier := oauth2.GenerateVerifier()
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcCookie,
+			Value:    strings.Join([]string{state, nonce, verifier}, ":"),
+			Path:     "/user/oidc",
+			MaxAge:   int(oidcLoginTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   request.TLS != nil,
+			// cookie has to come back with redirect of provider
+			SameSite: http.SameSiteLaxMode,
+		})
+		authURL := provider.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+		http.Redirect(w, request, authURL, http.StatusFound)
+	}
+}
+
+// getOIDCCallback - finish login: exchange code, verify id token and give token pair of its user
+func getOIDCCallback(svc linkSvc, keys *jwtkeys.KeySet, provider *OIDC) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, request *http.Request) {
+		if provider == nil {
+			ResponseAPIError(w, 404, http.StatusNotFound)
+			return
+		}
+		ctx := request.Context()
+		query := request.URL.Query()
+
+		cookie, err := request.Cookie(oidcCookie)
+		if err != nil {
+			ResponseAPIError(w, 17, http.StatusBadRequest)
+			return
+		}
+		// login state is used once
+		http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/user/oidc", MaxAge: -1})
+		parts := strings.Split(cookie.Value, ":")
+		if len(parts) != 3 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(query.Get("state"))) != 1 {
+			ResponseAPIError(w, 17, http.StatusBadRequest)
+			return
+		}
+		nonce, verifier := parts[1], parts[2]
+		if errText := query.Get("error"); errText != "" {
+			log.Printf("oidc login is rejected by provider: %s %s", errText, query.Get("error_description"))
+			ResponseAPIError(w, 17, http.StatusUnauthorized)
+			return
+		}
+
+		token, err := provider.oauth.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(verifier))
+		if err != nil {
+			log.Printf("oidc code exchange error: %v", err)
+			ResponseAPIError(w, 17, http.StatusUnauthorized)
+			return
+		}
+		rawIDToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			log.Printf("oidc token answer has no id_token")
+			ResponseAPIError(w, 17, http.StatusUnauthorized)
+			return
+		}
+		idToken, err := provider.verifier.Verify(ctx, rawIDToken)
+		if err != nil {
+			log.Printf("oidc id token is not valid: %v", err)
+			ResponseAPIError(w, 17, http.StatusUnauthorized)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+			ResponseAPIError(w, 17, http.StatusUnauthorized)
+			return
+		}
+		var claims struct {
+			Email         string `json:"email"`
+			EmailVerified bool   `json:"email_verified"`
+		}
+		if err = idToken.Claims(&claims); err != nil {
+			log.Printf("oidc id token claims error: %v", err)
+			ResponseAPIError(w, 17, http.StatusUnauthorized)
+			return
+		}
+
+		identity := model.Identity{Issuer: idToken.Issuer, Subject: idToken.Subject, Email: claims.Email}
+		UID, err := oidcUser(ctx, svc, identity, claims.EmailVerified)
+		switch {
+		case errors.Is(err, errOIDCUnverified):
+			log.Printf("oidc identity %s of %s has no verified email", identity.Subject, identity.Issuer)
+			ResponseAPIError(w, 17, http.StatusUnauthorized)
+			return
+		case errors.Is(err, errOIDCLocalUser):
+			log.Printf("oidc identity %s of %s is not linked to user %s registered by password", identity.Subject, identity.Issuer, identity.Email)
+			ResponseAPIError(w, 20, http.StatusConflict)
+			return
+		case err != nil:
+			log.Printf("oidc user of %s is not found or created, err: %v", identity.Subject, err)
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		log.Printf("USER %s Logged in by oidc.\n", UID)
+		jsonTokens, err := newSession(ctx, svc, keys, request, UID)
+		if err != nil {
+			log.Printf("session of %s is not started, err: %v\n", UID, err)
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		writeTokens(w, jsonTokens)
+	}
+}
+
+// oidcUser - uid of user of identity, new identity is linked to user by verified email
+func oidcUser(ctx context.Context, svc linkSvc, identity model.Identity, verified bool) (string, error) {
+	UID, err := svc.FindIdentity(ctx, identity.Issuer, identity.Subject)
+	if err != nil || UID != "" {
+		return UID, err
+	}
+	if identity.Email == "" || !verified {
+		return "", errOIDCUnverified
+	}
+	UID, err = svc.FindUserByEmail(identity.Email)
+	if err != nil {
+		return "", err
+	}
+	if UID == "" {
+		return newOIDCUser(ctx, svc, identity)
+	}
+	// user has identity of some provider - it is created by oidc, its email is verified
+	identities, err := svc.ListIdentities(ctx, UID)
+	if err != nil {
+		return "", err
+	}
+	if len(identities) == 0 {
+		return "", errOIDCLocalUser
+	}
+	identity.UID, identity.CreatedAt = UID, time.Now()
+	if err = svc.PutIdentity(ctx, identity); err != nil {
+		return "", err
+	}
+	log.Printf("USER %s is linked to oidc identity %s of %s", UID, identity.Subject, identity.Issuer)
+	return UID, nil
+}
+
+// newOIDCUser - user with role USER and its identity, created on first login
+// password of created user is random, so it logs in only by oidc
+func newOIDCUser(ctx context.Context, svc linkSvc, identity model.Identity) (string, error) {
+	passwd, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	UID, err := svc.PutUser(model.User{
+		Name:    identity.Email,
+		Passwd:  passwd,
+		Email:   identity.Email,
+		Balance: openingBalance,
+		Role:    policy.User,
+	})
+	if err != nil {
+		return "", err
+	}
+	identity.UID, identity.CreatedAt = UID, time.Now()
+	if err = svc.PutIdentity(ctx, identity); err != nil {
+		// user without identity would be taken for user registered by password
+		if errDel := svc.DelUser(UID); errDel != nil {
+			log.Printf("oidc user %s without identity is not deleted, err: %v", UID, errDel)
+		}
+		return "", err
+	}
+	log.Printf("NEW USER %s (UID=%s) is registered by oidc", identity.Email, UID)
+	return UID, nil
+}
@@ -0,0 +1,244 @@
+package endpoint_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/app/endpoint"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/jwtkeys"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
+)
+
+// stubIssuer - OpenID Connect provider of tests: authorize gives code at once (user is logged in already),
+// token gives id token of subject and email
+type stubIssuer struct {
+	*httptest.Server
+	keys     *jwtkeys.KeySet
+	clientID string
+
+	sync.Mutex
+	subject  string
+	email    string
+	verified bool
+	// codes - nonce and PKCE challenge of codes which are not exchanged yet
+	codes map[string][2]string
+}
+
+func newStubIssuer(t *testing.T, clientID string) *stubIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err := jwtkeys.NewPrivateKey("stub", rsaKey)
+	require.NoError(t, err)
+	keys, err := jwtkeys.New("stub", key)
+	require.NoError(t, err)
+
+	si := &stubIssuer{keys: keys, clientID: clientID, codes: make(map[string][2]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                si.URL,
+			"authorization_endpoint":                si.URL + "/authorize",
+			"token_endpoint":                        si.URL + "/token",
+			"jwks_uri":                              si.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(si.keys.JWKS())
+	})
+	mux.HandleFunc("/authorize", si.authorize)
+	mux.HandleFunc("/token", si.token)
+	si.Server = httptest.NewServer(mux)
+	t.Cleanup(si.Close)
+	return si
+}
+
+func (si *stubIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != si.clientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	si.Lock()
+	code := fmt.Sprintf("code%d", len(si.codes))
+	si.codes[code] = [2]string{query.Get("nonce"), query.Get("code_challenge")}
+	si.Unlock()
+
+	back, _ := url.Parse(query.Get("redirect_uri"))
+	back.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+func (si *stubIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	si.Lock()
+	defer si.Unlock()
+	// code is exchanged once
+	code, ok := si.codes[r.PostForm.Get("code")]
+	delete(si.codes, r.PostForm.Get("code"))
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != code[1] {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	idToken, _ := si.keys.Sign(jwt.MapClaims{
+		"iss":            si.URL,
+		"sub":            si.subject,
+		"aud":            si.clientID,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          code[0],
+		"email":          si.email,
+		"email_verified": si.verified,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "stub",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+func TestOIDCLogin(t *testing.T) {
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+	ctx := context.Background()
+	var repoif repository.RepoIf = new(repository.FileRepo)
+	linkSVC := repoif.New(ctx, filepath.Join(t.TempDir(), "test_oidc.json"), noopTracer)
+	defer linkSVC.CloseConn()
+	appsvc := endpoint.NewAppsvc(linkSVC, nopProm{}, noopTracer)
+
+	// no provider - no oidc login
+	rr := httptest.NewRecorder()
+	endpoint.RegisterPublicHTTP(appsvc).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/user/oidc/login", nil))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	issuer := newStubIssuer(t, "weblink")
+	var err error
+	appsvc.OIDC, err = endpoint.NewOIDC(ctx, endpoint.OIDCConfig{
+		Issuer:       issuer.URL,
+		ClientID:     "weblink",
+		ClientSecret: "secret",
+		RedirectURL:  "http://weblink.test/user/oidc/callback",
+	})
+	require.NoError(t, err)
+	handler := endpoint.RegisterPublicHTTP(appsvc)
+	noRedirect := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	// login - callback request of browser which came back from provider and its cookie
+	login := func() (*http.Request, *http.Cookie) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/user/oidc/login", nil))
+		require.Equal(t, http.StatusFound, rr.Code)
+		cookies := rr.Result().Cookies()
+		require.Len(t, cookies, 1)
+		require.True(t, cookies[0].HttpOnly)
+
+		resp, err := noRedirect.Get(rr.Header().Get("Location"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		back, err := url.Parse(resp.Header.Get("Location"))
+		require.NoError(t, err)
+		return httptest.NewRequest(http.MethodGet, back.RequestURI(), nil), cookies[0]
+	}
+	// callback - answer of api to callback
+	callback := func(req *http.Request, cookie *http.Cookie) *httptest.ResponseRecorder {
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	// loginUID - uid of token pair of successful login
+	loginUID := func(rr *httptest.ResponseRecorder) string {
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var tokens struct {
+			Access  string `json:"accessToken"`
+			Refresh string `json:"refreshToken"`
+		}
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&tokens))
+		require.NotEmpty(t, tokens.Refresh)
+		token, err := jwt.Parse(tokens.Access, appsvc.Keys.Keyfunc)
+		require.NoError(t, err)
+		return fmt.Sprintf("%v", token.Claims.(jwt.MapClaims)["uid"])
+	}
+
+	issuer.subject, issuer.email, issuer.verified = "ann", "Ann@Example.com", true
+	req, cookie := login()
+	UID := loginUID(callback(req, cookie))
+	user, err := linkSVC.GetUser(UID)
+	require.NoError(t, err)
+	require.Equal(t, "Ann@Example.com", user.Email)
+	require.Equal(t, "USER", user.Role)
+
+	// the same user next time by subject, email of provider does not matter any more
+	issuer.email, issuer.verified = "ann@other.example.com", false
+	req, cookie = login()
+	require.Equal(t, UID, loginUID(callback(req, cookie)))
+
+	// code of provider is used once, state is not accepted without cookie of the same login
+	rr = callback(req, cookie)
+	require.Equal(t, http.StatusUnauthorized, rr.Code)
+	require.Contains(t, rr.Body.String(), `"code":17`)
+	req, _ = login()
+	require.Equal(t, http.StatusBadRequest, callback(req, nil).Code)
+	req, _ = login()
+	_, otherCookie := login()
+	require.Equal(t, http.StatusBadRequest, callback(req, otherCookie).Code)
+
+	// email of new identity is not verified by provider
+	issuer.subject, issuer.email, issuer.verified = "bob", "bob@example.com", false
+	req, cookie = login()
+	require.Equal(t, http.StatusUnauthorized, callback(req, cookie).Code)
+	uid, err := linkSVC.FindUserByEmail("bob@example.com")
+	require.NoError(t, err)
+	require.Empty(t, uid)
+
+	// new identity with email of user created by oidc is linked to it
+	issuer.subject, issuer.email, issuer.verified = "ann-2", "ann@example.com", true
+	req, cookie = login()
+	require.Equal(t, UID, loginUID(callback(req, cookie)))
+	identities, err := linkSVC.ListIdentities(ctx, UID)
+	require.NoError(t, err)
+	require.Len(t, identities, 2)
+	require.Equal(t, issuer.URL, identities[0].Issuer)
+	require.Equal(t, "ann", identities[0].Subject)
+
+	// user registered by password is not taken over by identity with its email
+	localUID, err := linkSVC.PutUser(model.User{Name: "carl", Passwd: "123", Email: "carl@example.com", Role: "CREATOR"})
+	require.NoError(t, err)
+	issuer.subject, issuer.email, issuer.verified = "carl", "carl@example.com", true
+	req, cookie = login()
+	rr = callback(req, cookie)
+	require.Equal(t, http.StatusConflict, rr.Code)
+	require.Contains(t, rr.Body.String(), `"code":20`)
+	identities, err = linkSVC.ListIdentities(ctx, localUID)
+	require.NoError(t, err)
+	require.Empty(t, identities)
+}
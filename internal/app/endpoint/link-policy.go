@@ -0,0 +1,98 @@
+package endpoint
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/policy"
+)
+
+// permissions of api: every route is wrapped by allow with action which user role should be allowed to do,
+// handlers check finer actions (own or any data) by can
+// request of api key is also limited by scopes of key, routes which manage logins of user are not for api keys
+
+// fileRole - file repo has no user profiles, every user of it manages own links
+const fileRole = policy.Creator
+
+// permKey - context key of permissions of request user
+type permKey struct{}
+
+// permissions - policy and role of request user, scopes of api key (nil for jwt token, it is not limited)
+type permissions struct {
+	pol    *policy.Policy
+	role   string
+	scopes map[policy.Action]bool
+}
+
+// allowed - action is allowed to role and is in scopes
+func (perm permissions) allowed(action policy.Action) bool {
+	if perm.scopes != nil && !perm.scopes[action] {
+		return false
+	}
+	return perm.pol.Allowed(perm.role, action)
+}
+
+// requestScopes - scopes of api key of request, nil for jwt token
+func requestScopes(request *http.Request) map[policy.Action]bool {
+	props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
+	list, ok := props["scopes"].([]string)
+	if !ok {
+		return nil
+	}
+	scopes := make(map[policy.Action]bool, len(list))
+	for _, scope := range list {
+		scopes[policy.Action(scope)] = true
+	}
+	return scopes
+}
+
+// userRole - role of user of token
+func userRole(svc linkSvc, UID string) string {
+	if svc.WhoAmI() == 0 {
+		return fileRole
+	}
+	user, err := svc.GetUser(UID)
+	if err != nil {
+		log.Printf("could not get role of user %s, err: %v\n", UID, err)
+		return ""
+	}
+	return user.Role
+}
+
+// allow - handler which is called only when user role is allowed to do action, otherwise 403
+// policy and role are kept in request context for can
+func allow(pol *policy.Policy, svc linkSvc, action policy.Action, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		perm := permissions{
+			pol:    pol,
+			role:   userRole(svc, tokenClaim(request, "uid")),
+			scopes: requestScopes(request),
+		}
+		if !perm.allowed(action) {
+			ResponseAPIError(w, 403, http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(request.Context(), permKey{}, perm)
+		next(w, request.WithContext(ctx))
+	}
+}
+
+// loginOnly - handler of route which manages logins of user (sessions, api keys), api keys get 403 there
+func loginOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		if tokenClaim(request, "iss") == issAPIKey {
+			ResponseAPIError(w, 403, http.StatusForbidden)
+			return
+		}
+		next(w, request)
+	}
+}
+
+// can - user of request (which passed allow) is allowed to do action
+func can(request *http.Request, action policy.Action) bool {
+	perm, ok := request.Context().Value(permKey{}).(permissions)
+	return ok && perm.allowed(action)
+}
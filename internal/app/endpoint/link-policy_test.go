@@ -0,0 +1,235 @@
+package endpoint_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/app/endpoint"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/policy"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
+)
+
+// roleRepo - file repo which acts as db repo with user roles, uid of user is its role
+type roleRepo struct {
+	repository.RepoIf
+}
+
+func (rr roleRepo) WhoAmI() uint64 {
+	return 1
+}
+
+func (rr roleRepo) GetUser(uid string) (model.User, error) {
+	return model.User{Role: strings.TrimPrefix(uid, "uid_")}, nil
+}
+
+// nopProm - metrics which are not collected (prom collectors are registered once per process by TestHandler)
+type nopProm struct{}
+
+func (np nopProm) New() endpoint.PromIf                    { return np }
+func (np nopProm) UpdateHist(method string, dtime float64) {}
+func (np nopProm) UpdateCtr()                              {}
+
+// newRoleHandler - api of roleRepo with policy pol
+func newRoleHandler(t *testing.T, pol *policy.Policy) (*endpoint.Appsvc, http.Handler) {
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+	var repoif repository.RepoIf = new(repository.FileRepo)
+	linkSVC := repoif.New(context.Background(), filepath.Join(t.TempDir(), "test_policy.json"), noopTracer)
+	t.Cleanup(linkSVC.CloseConn)
+
+	appsvc := endpoint.NewAppsvc(roleRepo{linkSVC}, nopProm{}, noopTracer)
+	appsvc.Policy = pol
+	return appsvc, endpoint.RegisterPublicHTTP(appsvc)
+}
+
+// roleStatus - status of api answer to user of role
+func roleStatus(t *testing.T, appsvc *endpoint.Appsvc, handler http.Handler, role, method, path string) int {
+	token, err := endpoint.GenJWTWithClaims(appsvc.Keys, "uid_"+role, 0, "", "")
+	require.NoError(t, err)
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+// every route against every role, "" - user without profile
+func TestRoutePermissions(t *testing.T) {
+	all := []string{policy.SuperUser, policy.Creator, policy.User, ""}
+	roles := []string{policy.SuperUser, policy.Creator, policy.User}
+	tests := []struct {
+		method, route, path string
+		allowed             []string
+	}{
+		{http.MethodPost, "/user/auth", "/user/auth", all},
+		{http.MethodPost, "/token/refresh", "/token/refresh", all},
+		{http.MethodPost, "/user/register", "/user/register", all},
+		{http.MethodPost, "/user/logout", "/user/logout", all},
+		{http.MethodGet, "/user/sessions", "/user/sessions", all},
+		{http.MethodDelete, "/user/sessions/{sid}", "/user/sessions/s1", all},
+		{http.MethodPost, "/user/apikeys", "/user/apikeys", all},
+		{http.MethodGet, "/user/apikeys", "/user/apikeys", all},
+		{http.MethodDelete, "/user/apikeys/{id}", "/user/apikeys/k1", all},
+		{http.MethodGet, "/.well-known/jwks.json", "/.well-known/jwks.json", all},
+		{http.MethodGet, "/user/oidc/login", "/user/oidc/login", all},
+		{http.MethodGet, "/user/oidc/callback", "/user/oidc/callback", all},
+		{http.MethodGet, "/users/all", "/users/all", []string{policy.SuperUser}},
+		{http.MethodGet, "/user/", "/user/", roles},
+		{http.MethodGet, "/user/{uid}", "/user/uid_USER", roles},
+		{http.MethodPut, "/user/{uid}", "/user/uid_USER", []string{policy.SuperUser}},
+		{http.MethodDelete, "/user/{uid}", "/user/uid_USER", []string{policy.SuperUser}},
+		{http.MethodGet, "/shortopen/{shortlink}", "/shortopen/link1", roles},
+		{http.MethodGet, "/u/{user}/{shortlink}", "/u/uid_CREATOR/link1", roles},
+		{http.MethodGet, "/shortstat/{shortlink}", "/shortstat/link1", roles},
+		{http.MethodGet, "/shortstat/{shortlink}/clicks", "/shortstat/link1/clicks", roles},
+		{http.MethodGet, "/shortstat/{shortlink}/top", "/shortstat/link1/top", roles},
+		{http.MethodPost, "/links", "/links", []string{policy.SuperUser, policy.Creator}},
+		{http.MethodGet, "/links/all", "/links/all", roles},
+		{http.MethodPut, "/links/{shortlink}", "/links/link1", roles},
+		{http.MethodDelete, "/links/{shortlink}", "/links/link1", []string{policy.SuperUser, policy.Creator}},
+		{http.MethodGet, "/metrics", "/metrics", all},
+		{http.MethodGet, "/__heartbeat__", "/__heartbeat__", all},
+	}
+
+	appsvc, handler := newRoleHandler(t, policy.Default())
+
+	// table has every route of api
+	tested := make(map[string]bool, len(tests))
+	for _, tt := range tests {
+		tested[tt.method+" "+tt.route] = true
+	}
+	err := handler.(*mux.Router).Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		require.NoError(t, err)
+		methods, err := route.GetMethods()
+		if err != nil {
+			// route of any method
+			methods = []string{http.MethodGet}
+		}
+		for _, method := range methods {
+			require.True(t, tested[method+" "+tmpl], "route %s %s is not tested", method, tmpl)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		allowed := make(map[string]bool, len(tt.allowed))
+		for _, role := range tt.allowed {
+			allowed[role] = true
+		}
+		for _, role := range all {
+			t.Run(tt.method+" "+tt.route+" "+role, func(t *testing.T) {
+				status := roleStatus(t, appsvc, handler, role, tt.method, tt.path)
+				if allowed[role] {
+					require.NotEqual(t, http.StatusForbidden, status)
+				} else {
+					require.Equal(t, http.StatusForbidden, status)
+				}
+			})
+		}
+	}
+}
+
+// policy is replaced by configured one
+func TestRoutePermissionsConfigured(t *testing.T) {
+	pol, err := policy.New(map[string][]policy.Action{
+		policy.User:    {policy.LinkCreate, policy.LinkRead},
+		policy.Creator: {policy.LinkRead},
+	})
+	require.NoError(t, err)
+	appsvc, handler := newRoleHandler(t, pol)
+
+	require.NotEqual(t, http.StatusForbidden, roleStatus(t, appsvc, handler, policy.User, http.MethodPost, "/links"))
+	require.Equal(t, http.StatusForbidden, roleStatus(t, appsvc, handler, policy.Creator, http.MethodPost, "/links"))
+	require.Equal(t, http.StatusForbidden, roleStatus(t, appsvc, handler, policy.SuperUser, http.MethodGet, "/users/all"))
+	require.NotEqual(t, http.StatusForbidden, roleStatus(t, appsvc, handler, policy.Creator, http.MethodGet, "/links/all"))
+}
+
+// api key works only for actions of its scopes which are allowed to user role, and only until it is revoked
+func TestAPIKeys(t *testing.T) {
+	appsvc, handler := newRoleHandler(t, policy.Default())
+	token, err := endpoint.GenJWTWithClaims(appsvc.Keys, "uid_"+policy.Creator, 0, "", "")
+	require.NoError(t, err)
+
+	// call - api answer to request with auth header
+	call := func(method, path, body, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(header, value)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	bearer := "Bearer " + token
+
+	// unknown scope, no scopes, key which is expired already
+	for _, body := range []string{
+		`{"name":"ci","scopes":["link.craete"]}`,
+		`{"name":"ci","scopes":[]}`,
+		`{"name":"ci","scopes":["link.read"],"expires_at":"2020-01-01T00:00:00Z"}`,
+	} {
+		rr := call(http.MethodPost, "/user/apikeys", body, "Authorization", bearer)
+		require.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+
+	// read only key, user.read.any is not allowed to creator anyway
+	rr := call(http.MethodPost, "/user/apikeys", `{"name":"stats","scopes":["link.read","user.read.any"]}`, "Authorization", bearer)
+	require.Equal(t, http.StatusCreated, rr.Code)
+	var created model.APIKey
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&created))
+	require.True(t, strings.HasPrefix(created.Key, "wl_"))
+	require.Empty(t, created.Hash)
+
+	// key is not shown in list
+	rr = call(http.MethodGet, "/user/apikeys", "", "Authorization", bearer)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var keys model.APIKeys
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&keys))
+	require.Len(t, keys.Data, 1)
+	require.Equal(t, created.ID, keys.Data[0].ID)
+	require.Equal(t, "uid_"+policy.Creator, keys.Data[0].UID)
+	require.Empty(t, keys.Data[0].Key)
+	require.Empty(t, keys.Data[0].Hash)
+	require.True(t, keys.Data[0].LastUsed.IsZero())
+
+	tests := []struct {
+		method, path, header, value string
+		status                      int
+	}{
+		{http.MethodGet, "/links/all", "X-API-Key", created.Key, http.StatusOK},
+		{http.MethodGet, "/links/all", "Authorization", "ApiKey " + created.Key, http.StatusOK},
+		{http.MethodPost, "/links", "X-API-Key", created.Key, http.StatusForbidden},
+		{http.MethodDelete, "/links/link1", "X-API-Key", created.Key, http.StatusForbidden},
+		{http.MethodGet, "/users/all", "X-API-Key", created.Key, http.StatusForbidden},
+		{http.MethodGet, "/user/sessions", "X-API-Key", created.Key, http.StatusForbidden},
+		{http.MethodPost, "/user/apikeys", "X-API-Key", created.Key, http.StatusForbidden},
+		{http.MethodPost, "/token/refresh", "X-API-Key", created.Key, http.StatusUnauthorized},
+		{http.MethodGet, "/links/all", "X-API-Key", "wl_unknown", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		rr = call(tt.method, tt.path, "", tt.header, tt.value)
+		require.Equal(t, tt.status, rr.Code, "%s %s %s", tt.method, tt.path, tt.header)
+	}
+
+	rr = call(http.MethodGet, "/user/apikeys", "", "Authorization", bearer)
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&keys))
+	require.False(t, keys.Data[0].LastUsed.IsZero())
+
+	// revoke
+	require.Equal(t, http.StatusNotFound, call(http.MethodDelete, "/user/apikeys/none", "", "Authorization", bearer).Code)
+	require.Equal(t, http.StatusOK, call(http.MethodDelete, "/user/apikeys/"+created.ID, "", "Authorization", bearer).Code)
+	rr = call(http.MethodGet, "/links/all", "", "X-API-Key", created.Key)
+	require.Equal(t, http.StatusUnauthorized, rr.Code)
+	require.Contains(t, rr.Body.String(), `"code":16`)
+}
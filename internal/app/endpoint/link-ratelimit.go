@@ -0,0 +1,156 @@
+package endpoint
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/ratelimit"
+)
+
+// rate limits of routes, so /user/auth is not brute forced and /shortopen is not hammered
+// every route of rule has token buckets of its users (uid of token) or client ips,
+// request without token is answered 429 with Retry-After.
+// client ip behind reverse proxy is taken from IPHeader, but only of request which comes from proxy:
+// from any peer when TrustedProxies is empty (api is reachable only through proxy), else from peer of TrustedProxies.
+// client can send header with any addresses and every proxy appends address of its peer (X-Forwarded-For),
+// so addresses are read from the right: the first one which is not trusted proxy is client.
+// single value header (X-Real-IP) is set by proxy itself, its address is client
+
+// keys of rate rules
+const (
+	// RateByIP - bucket of client ip
+	RateByIP = "ip"
+	// RateByUID - bucket of user of token, client ip if request has no token
+	RateByUID = "uid"
+)
+
+// RateRule - limit of route, Key - RateByIP or RateByUID
+type RateRule struct {
+	Key   string
+	Limit ratelimit.Limit
+}
+
+// RateLimits - rules of routes by path template, routes without rule are not limited
+// Store - buckets, nil - no rate limiting; Fallback - buckets of requests when Store fails (e.g. redis is down),
+// nil - such requests are not limited
+// IPHeader - header of client ip set by reverse proxy (e.g. X-Real-IP), empty - ip of connection
+// TrustedProxies - networks of reverse proxies, empty - IPHeader of any peer is taken
+type RateLimits struct {
+	Store          ratelimit.Store
+	Fallback       ratelimit.Store
+	Rules          map[string]RateRule
+	IPHeader       string
+	TrustedProxies []*net.IPNet
+}
+
+// DefaultRateLimits - in-process limits of login routes by ip and of link opens by user
+func DefaultRateLimits() *RateLimits {
+	memory := ratelimit.NewMemory()
+	return &RateLimits{
+		Store:    memory,
+		Fallback: memory,
+		Rules: map[string]RateRule{
+			"/user/auth":             {RateByIP, ratelimit.Per(10, time.Minute)},
+			"/user/register":         {RateByIP, ratelimit.Per(5, time.Minute)},
+			"/token/refresh":         {RateByIP, ratelimit.Per(30, time.Minute)},
+			"/user/oidc/login":       {RateByIP, ratelimit.Per(30, time.Minute)},
+			"/user/oidc/callback":    {RateByIP, ratelimit.Per(30, time.Minute)},
+			"/shortopen/{shortlink}": {RateByUID, ratelimit.Limit{Rate: 5, Burst: 20}},
+			"/u/{user}/{shortlink}":  {RateByUID, ratelimit.Limit{Rate: 5, Burst: 20}},
+		},
+	}
+}
+
+// clientIP - ip of request client, ip of connection if IPHeader is not set by trusted proxy
+func (limits *RateLimits) clientIP(request *http.Request) string {
+	peer, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		peer = request.RemoteAddr
+	}
+	if limits.IPHeader == "" || (len(limits.TrustedProxies) > 0 && !limits.trusted(peer)) {
+		return peer
+	}
+	addrs := strings.Split(strings.Join(request.Header.Values(limits.IPHeader), ","), ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(addrs[i])
+		if net.ParseIP(ip) == nil {
+			// it is not set by proxy
+			break
+		}
+		if i == 0 || !limits.trusted(ip) {
+			return ip
+		}
+	}
+	return peer
+}
+
+// trusted - ip is address of trusted proxy
+func (limits *RateLimits) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, proxy := range limits.TrustedProxies {
+		if parsed != nil && proxy.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// key - bucket of request to route of rule
+func (limits *RateLimits) key(request *http.Request, route string, rule RateRule) string {
+	if rule.Key == RateByUID {
+		if UID := tokenClaim(request, "uid"); UID != "" {
+			return route + "|uid:" + UID
+		}
+	}
+	return route + "|ip:" + limits.clientIP(request)
+}
+
+// RateLimitMiddleware - token bucket limits of routes, it goes after jwt middleware to know uid of request
+func RateLimitMiddleware(limits *RateLimits) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if limits == nil || limits.Store == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+			route := mux.CurrentRoute(request)
+			if route == nil {
+				next.ServeHTTP(w, request)
+				return
+			}
+			tmpl, err := route.GetPathTemplate()
+			if err != nil {
+				next.ServeHTTP(w, request)
+				return
+			}
+			rule, ok := limits.Rules[tmpl]
+			if !ok {
+				next.ServeHTTP(w, request)
+				return
+			}
+
+			key := limits.key(request, tmpl, rule)
+			allowed, retryAfter, err := limits.Store.Take(request.Context(), key, rule.Limit, time.Now())
+			if err != nil {
+				log.Printf("rate limit store error: %v", err)
+				allowed = true
+				if limits.Fallback != nil {
+					allowed, retryAfter, _ = limits.Fallback.Take(request.Context(), key, rule.Limit, time.Now())
+				}
+			}
+			if !allowed {
+				log.Printf("rate limit of %s is reached", key)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				ResponseAPIError(w, 18, http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, request)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package endpoint_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/app/endpoint"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/policy"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/ratelimit"
+)
+
+// brokenStore - store of redis which is down
+type brokenStore struct{}
+
+func (brokenStore) Take(context.Context, string, ratelimit.Limit, time.Time) (bool, time.Duration, error) {
+	return false, 0, errors.New("connection refused")
+}
+
+// rateCall - answer of api to request from ip, token of role if role is set
+func rateCall(t *testing.T, appsvc *endpoint.Appsvc, handler http.Handler, method, path, ip, role string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = ip + ":40000"
+	if role != "" {
+		token, err := endpoint.GenJWTWithClaims(appsvc.Keys, "uid_"+role, 0, "", "")
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRateLimits(t *testing.T) {
+	appsvc, _ := newRoleHandler(t, policy.Default())
+	appsvc.RateLimits.Rules = map[string]endpoint.RateRule{
+		"/user/auth":             {Key: endpoint.RateByIP, Limit: ratelimit.Per(2, time.Minute)},
+		"/shortopen/{shortlink}": {Key: endpoint.RateByUID, Limit: ratelimit.Per(1, time.Minute)},
+	}
+	handler := endpoint.RegisterPublicHTTP(appsvc)
+
+	// by ip
+	for i := 0; i < 2; i++ {
+		require.NotEqual(t, http.StatusTooManyRequests, rateCall(t, appsvc, handler, http.MethodPost, "/user/auth", "198.51.100.1", "").Code)
+	}
+	rr := rateCall(t, appsvc, handler, http.MethodPost, "/user/auth", "198.51.100.1", "")
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	require.Equal(t, "30", rr.Header().Get("Retry-After"))
+	require.Contains(t, rr.Body.String(), `"code":18`)
+	require.NotEqual(t, http.StatusTooManyRequests, rateCall(t, appsvc, handler, http.MethodPost, "/user/auth", "198.51.100.2", "").Code)
+
+	// by user, request without token is limited by ip
+	require.NotEqual(t, http.StatusTooManyRequests, rateCall(t, appsvc, handler, http.MethodGet, "/shortopen/link1", "198.51.100.1", policy.User).Code)
+	require.Equal(t, http.StatusTooManyRequests, rateCall(t, appsvc, handler, http.MethodGet, "/shortopen/link1", "198.51.100.2", policy.User).Code)
+	require.NotEqual(t, http.StatusTooManyRequests, rateCall(t, appsvc, handler, http.MethodGet, "/shortopen/link1", "198.51.100.1", policy.Creator).Code)
+
+	// routes without rule are not limited
+	for i := 0; i < 5; i++ {
+		require.NotEqual(t, http.StatusTooManyRequests, rateCall(t, appsvc, handler, http.MethodGet, "/user/", "198.51.100.1", policy.User).Code)
+	}
+
+	// ip of proxy header, the rightmost address which is not trusted proxy
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	appsvc.RateLimits.IPHeader = "X-Forwarded-For"
+	appsvc.RateLimits.TrustedProxies = []*net.IPNet{proxies}
+	handler = endpoint.RegisterPublicHTTP(appsvc)
+	proxied := func(peer, header, value string) int {
+		req := httptest.NewRequest(http.MethodPost, "/user/auth", nil)
+		req.RemoteAddr = peer + ":40000"
+		req.Header.Set(header, value)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	require.NotEqual(t, http.StatusTooManyRequests, proxied("10.0.0.1", "X-Forwarded-For", "203.0.113.5, 10.0.0.1"))
+	require.NotEqual(t, http.StatusTooManyRequests, proxied("10.0.0.1", "X-Forwarded-For", "203.0.113.5"))
+	// address given by client itself is not taken
+	require.Equal(t, http.StatusTooManyRequests, proxied("10.0.0.2", "X-Forwarded-For", "198.51.100.77, 203.0.113.5, 10.0.0.2"))
+	require.NotEqual(t, http.StatusTooManyRequests, proxied("10.0.0.1", "X-Forwarded-For", "203.0.113.6"))
+	// header of peer which is not trusted proxy is not taken
+	for i := 0; i < 2; i++ {
+		require.NotEqual(t, http.StatusTooManyRequests, proxied("203.0.113.7", "X-Forwarded-For", "203.0.113.8"))
+	}
+	require.Equal(t, http.StatusTooManyRequests, proxied("203.0.113.7", "X-Forwarded-For", "203.0.113.9"))
+	require.NotEqual(t, http.StatusTooManyRequests, proxied("10.0.0.1", "X-Forwarded-For", "203.0.113.8"))
+
+	// single value header of the only proxy
+	appsvc.RateLimits.IPHeader, appsvc.RateLimits.TrustedProxies = "X-Real-IP", nil
+	handler = endpoint.RegisterPublicHTTP(appsvc)
+	for i := 0; i < 2; i++ {
+		require.NotEqual(t, http.StatusTooManyRequests, proxied("10.0.0.1", "X-Real-IP", "203.0.113.10"))
+	}
+	require.Equal(t, http.StatusTooManyRequests, proxied("10.0.0.2", "X-Real-IP", "203.0.113.10"))
+	// not an address - ip of connection
+	require.NotEqual(t, http.StatusTooManyRequests, proxied("10.0.0.3", "X-Real-IP", "unknown"))
+}
+
+// requests are limited by fallback when store fails, and not limited without fallback
+func TestRateLimitsStoreDown(t *testing.T) {
+	appsvc, _ := newRoleHandler(t, policy.Default())
+	appsvc.RateLimits = &endpoint.RateLimits{
+		Store:    brokenStore{},
+		Fallback: ratelimit.NewMemory(),
+		Rules: map[string]endpoint.RateRule{
+			"/user/auth": {Key: endpoint.RateByIP, Limit: ratelimit.Per(1, time.Minute)},
+		},
+	}
+	handler := endpoint.RegisterPublicHTTP(appsvc)
+	require.NotEqual(t, http.StatusTooManyRequests, rateCall(t, appsvc, handler, http.MethodPost, "/user/auth", "198.51.100.1", "").Code)
+	require.Equal(t, http.StatusTooManyRequests, rateCall(t, appsvc, handler, http.MethodPost, "/user/auth", "198.51.100.1", "").Code)
+
+	appsvc.RateLimits.Fallback = nil
+	handler = endpoint.RegisterPublicHTTP(appsvc)
+	for i := 0; i < 3; i++ {
+		require.NotEqual(t, http.StatusTooManyRequests, rateCall(t, appsvc, handler, http.MethodPost, "/user/auth", "198.51.100.1", "").Code)
+	}
+
+	appsvc.RateLimits = nil
+	handler = endpoint.RegisterPublicHTTP(appsvc)
+	for i := 0; i < 3; i++ {
+		require.NotEqual(t, http.StatusTooManyRequests, rateCall(t, appsvc, handler, http.MethodPost, "/user/auth", "198.51.100.1", "").Code)
+	}
+}
@@ -0,0 +1,219 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/jwtkeys"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
+)
+
+// login sessions - every login is session (family of refresh tokens, sid claim)
+// refresh token has its own jti, refresh rotates it, refresh by rotated token revokes whole session
+// /user/logout kills current session, /user/sessions lists sessions of user and kills them one by one,
+// access token works only while its session is alive (middleware checks it, see accessAlive)
+
+// tokenPair - answer of auth and refresh
+type tokenPair struct {
+	Access  string `json:"accessToken"`
+	Refresh string `json:"refreshToken"`
+}
+
+// newTokenID - random id of session or refresh token
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sessionTokens - token pair of session sid, refresh token gets jti
+func sessionTokens(keys *jwtkeys.KeySet, UID, sid, jti string) (tokenPair, error) {
+	access, err := GenJWTWithClaims(keys, UID, 0, sid, "")
+	if err != nil {
+		return tokenPair{}, err
+	}
+	refresh, err := GenJWTWithClaims(keys, UID, 1, sid, jti)
+	if err != nil {
+		return tokenPair{}, err
+	}
+	return tokenPair{Access: access, Refresh: refresh}, nil
+}
+
+// newSession - start session of user login and give its first token pair
+func newSession(ctx context.Context, svc linkSvc, keys *jwtkeys.KeySet, request *http.Request, UID string) (tokenPair, error) {
+	sid, err := newTokenID()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	jti, err := newTokenID()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	now := time.Now().UTC()
+	session := model.Session{
+		ID:        sid,
+		UID:       UID,
+		JTI:       jti,
+		CreatedAt: now,
+		LastUsed:  now,
+		ExpiresAt: now.Add(refreshTokenTTL),
+		UserAgent: request.UserAgent(),
+		IP:        anonymizeIP(request.RemoteAddr),
+	}
+	if err = svc.PutSession(ctx, session); err != nil {
+		return tokenPair{}, err
+	}
+	return sessionTokens(keys, UID, sid, jti)
+}
+
+// writeTokens - json answer with token pair
+func writeTokens(w http.ResponseWriter, tokens tokenPair) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(tokens)
+	if err != nil {
+		return
+	}
+}
+
+// tokenClaim - claim of token which is checked by middleware
+func tokenClaim(request *http.Request, name string) string {
+	props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
+	claim, ok := props[name]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%v", claim)
+}
+
+// accessAlive - session of access token is alive (logout and kill of session stop its access tokens at once)
+// tokens of older versions and of api keys have no session, they are not checked
+func accessAlive(ctx context.Context, svc linkSvc, claims jwt.MapClaims) (bool, error) {
+	sid, _ := claims["sid"].(string)
+	if sid == "" {
+		return true, nil
+	}
+	sessions, err := svc.ListSessions(ctx, fmt.Sprintf("%v", claims["uid"]))
+	if err != nil {
+		return false, err
+	}
+	for _, session := range sessions {
+		if session.ID == sid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// postTokenRefresh - get new pair of jwt tokens when access token is expired
+// refresh token is rotated, reuse of rotated one revokes session
+func postTokenRefresh(svc linkSvc, keys *jwtkeys.KeySet) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+
+		UID := tokenClaim(request, "uid")
+		sid := tokenClaim(request, "sid")
+		jti := tokenClaim(request, "jti")
+		// refresh tokens of older versions have no session
+		if sid == "" || jti == "" {
+			ResponseAPIError(w, 7, http.StatusUnauthorized)
+			return
+		}
+
+		newJTI, err := newTokenID()
+		if err != nil {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		err = svc.RotateSession(ctx, sid, jti, newJTI, time.Now().UTC().Add(refreshTokenTTL))
+		switch {
+		case errors.Is(err, repository.ErrTokenReused):
+			log.Printf("refresh token of session %s (user %s) is reused, session is revoked", sid, UID)
+			ResponseAPIError(w, 15, http.StatusUnauthorized)
+			return
+		case errors.Is(err, repository.ErrSessionRevoked):
+			ResponseAPIError(w, 15, http.StatusUnauthorized)
+			return
+		case err != nil:
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+
+		tokens, err := sessionTokens(keys, UID, sid, newJTI)
+		if err != nil {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		writeTokens(w, tokens)
+	}
+}
+
+// postLogout - kill current session, its refresh token does not work any more
+func postLogout(svc linkSvc) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, request *http.Request) {
+		sid := tokenClaim(request, "sid")
+		if sid == "" {
+			ResponseAPIError(w, 400, http.StatusBadRequest)
+			return
+		}
+		err := svc.RevokeSession(request.Context(), tokenClaim(request, "uid"), sid)
+		if err != nil && !errors.Is(err, repository.ErrNoSession) {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// getSessions - alive sessions of user, current one is marked
+func getSessions(svc linkSvc) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, request *http.Request) {
+		sessions, err := svc.ListSessions(request.Context(), tokenClaim(request, "uid"))
+		if err != nil {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		sid := tokenClaim(request, "sid")
+		for i := range sessions {
+			// jti of refresh token is not given away
+			sessions[i].JTI = ""
+			sessions[i].Current = sessions[i].ID == sid
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(model.Sessions{Data: sessions})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// delSession - kill session of user by id
+func delSession(svc linkSvc) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, request *http.Request) {
+		sid := mux.Vars(request)["sid"]
+		err := svc.RevokeSession(request.Context(), tokenClaim(request, "uid"), sid)
+		if errors.Is(err, repository.ErrNoSession) {
+			ResponseAPIError(w, 404, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,185 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/policy"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
+)
+
+// click stats api - /shortstat/{shortlink}/clicks and /shortstat/{shortlink}/top
+
+const (
+	// statMaxBuckets - limit of time series length in one answer
+	statMaxBuckets = 1000
+	// statTopDefault, statTopMax - how many referrers / user agents to give
+	statTopDefault = 10
+	statTopMax     = 100
+)
+
+// statBucketSize - length of bucket to limit number of buckets
+var statBucketSize = map[string]time.Duration{
+	repository.BucketHour: time.Hour,
+	repository.BucketDay:  24 * time.Hour,
+	repository.BucketWeek: 7 * 24 * time.Hour,
+}
+
+// statDefaultRange - range of stats when 'from' is not set
+var statDefaultRange = map[string]time.Duration{
+	repository.BucketHour: 24 * time.Hour,
+	repository.BucketDay:  30 * 24 * time.Hour,
+	repository.BucketWeek: 12 * 7 * 24 * time.Hour,
+}
+
+// anonymizeIP - cut client address to network: /24 for ipv4, /48 for ipv6
+func anonymizeIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// newClick - click event of request which opens shortlink
+func newClick(request *http.Request, shortURL string) model.Click {
+	props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
+	var UID string
+	if uid, ok := props["uid"]; ok {
+		UID = fmt.Sprintf("%v", uid)
+	}
+	return model.Click{
+		Shorturl:  shortURL,
+		Datetime:  time.Now().UTC(),
+		UID:       UID,
+		Referrer:  request.Referer(),
+		UserAgent: request.UserAgent(),
+		IP:        anonymizeIP(request.RemoteAddr),
+	}
+}
+
+// statShortLink - owner uid and shortlink of request if user can see its stats (owner or link.read.any)
+func statShortLink(ctx context.Context, request *http.Request, linkSvc linkSvc) (string, string, bool) {
+	if linkSvc.WhoAmI() != 0 {
+		props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
+		UID := fmt.Sprintf("%v", props["uid"])
+		if can(request, policy.LinkReadAny) {
+			shortURL := mux.Vars(request)["shortlink"]
+			getElement, err := linkSvc.Get(ctx, UID, shortURL, true)
+			return getElement.UID, shortURL, err == nil && getElement.Shorturl != ""
+		}
+	}
+	UID, storageKey, res := ValidateRequestShortLink(ctx, request, linkSvc)
+	return UID, storageKey, res
+}
+
+// parseStatQuery - range and bucket from url query: bucket=hour|day|week, from, to (RFC3339), top
+func parseStatQuery(request *http.Request, bucket string, top bool) (model.StatQuery, error) {
+	query := request.URL.Query()
+	if val := query.Get("bucket"); val != "" {
+		bucket = val
+	}
+	if err := repository.CheckStatBucket(bucket); err != nil {
+		return model.StatQuery{}, err
+	}
+
+	q := model.StatQuery{To: time.Now().UTC()}
+	if val := query.Get("to"); val != "" {
+		to, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return model.StatQuery{}, fmt.Errorf("bad 'to': %w", err)
+		}
+		q.To = to.UTC()
+	}
+	q.From = q.To.Add(-statDefaultRange[bucket])
+	if val := query.Get("from"); val != "" {
+		from, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return model.StatQuery{}, fmt.Errorf("bad 'from': %w", err)
+		}
+		q.From = from.UTC()
+	}
+	if !q.From.Before(q.To) {
+		return model.StatQuery{}, fmt.Errorf("'from' should be before 'to'")
+	}
+
+	if !top {
+		if q.To.Sub(q.From)/statBucketSize[bucket] > statMaxBuckets {
+			return model.StatQuery{}, fmt.Errorf("too many buckets, max is %d", statMaxBuckets)
+		}
+		q.Bucket = bucket
+		return q, nil
+	}
+
+	q.Top = statTopDefault
+	if val := query.Get("top"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 || n > statTopMax {
+			return model.StatQuery{}, fmt.Errorf("bad 'top', it should be 1..%d", statTopMax)
+		}
+		q.Top = n
+	}
+	return q, nil
+}
+
+// getShortStatClicks - clicks of link by hour/day/week buckets
+func getShortStatClicks(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
+	return shortStatHandler(linkSvc, tracer, "getShortStatClicks", false)
+}
+
+// getShortStatTop - top referrers and user agents of link
+func getShortStatTop(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
+	return shortStatHandler(linkSvc, tracer, "getShortStatTop", true)
+}
+
+// shortStatHandler - common part of click stats handlers
+func shortStatHandler(linkSvc linkSvc, tracer trace.Tracer, name string, top bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+
+		ctx, span := tracer.Start(request.Context(), name)
+		defer span.End()
+
+		owner, shortURL, ok := statShortLink(ctx, request, linkSvc)
+		if !ok {
+			ResponseAPIError(w, 6, http.StatusNotFound)
+			return
+		}
+
+		q, err := parseStatQuery(request, repository.BucketDay, top)
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			ResponseAPIError(w, 400, http.StatusBadRequest)
+			return
+		}
+
+		stats, err := linkSvc.GetClickStats(ctx, owner, shortURL, q)
+		if err != nil {
+			ResponseAPIError(w, 10, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(stats)
+		if err != nil {
+			return
+		}
+	}
+}
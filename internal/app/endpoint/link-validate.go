@@ -2,11 +2,16 @@ package endpoint
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/app/service"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
 )
 
 // GetUserStorageKeys - get all keys for this user in repo
@@ -19,6 +24,16 @@ func GetUserStorageKeys(ctx context.Context, request *http.Request, linkSvc link
 	return storageKeys, UID, err
 }
 
+// ResponseStorageKeysError - reply when keys of user cannot be listed: 503 if worker pool of service is overloaded
+func ResponseStorageKeysError(w http.ResponseWriter, err error) {
+	if errors.Is(err, service.ErrOverloaded) {
+		w.Header().Set("Retry-After", "1")
+		ResponseAPIError(w, 19, http.StatusServiceUnavailable)
+		return
+	}
+	ResponseAPIError(w, 10, http.StatusBadRequest)
+}
+
 // ValidateRequestShortLink - валидация shortlink параметра в request
 // Возвращает саму ссылку, юзерайди (из токена), результат - тру - валидно
 // инвалидно - результ - фалз, и все пустое.
@@ -40,3 +55,14 @@ func ValidateRequestShortLink(ctx context.Context, request *http.Request, linkSv
 
 	return "", "", false
 }
+
+// ValidateLinkLifetime - optional expires_at should be in future, max_redirs should not be negative
+func ValidateLinkLifetime(element model.DataEl) bool {
+	if element.MaxRedirs < 0 {
+		return false
+	}
+	if element.ExpiresAt != nil && !element.ExpiresAt.After(time.Now()) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,164 @@
+package endpoint_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/app/endpoint"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/app/service"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/policy"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
+)
+
+// overloadedRepo - file service whose worker pool rejects lists of links
+type overloadedRepo struct {
+	roleRepo
+}
+
+func (overloadedRepo) WhoAmI() uint64 {
+	return 0
+}
+
+func (overloadedRepo) List(ctx context.Context, uid string) ([]string, error) {
+	return nil, service.ErrOverloaded
+}
+
+// takenRepo - file repo where code is taken by link of other user between check and put of link, taken times
+type takenRepo struct {
+	roleRepo
+	taken *int
+}
+
+func (takenRepo) WhoAmI() uint64 {
+	return 0
+}
+
+func (tr takenRepo) Put(ctx context.Context, uid, key string, value model.DataEl, su bool) error {
+	if *tr.taken > 0 {
+		*tr.taken--
+		return repository.ErrShortlinkTaken
+	}
+	return tr.roleRepo.Put(ctx, uid, key, value, su)
+}
+
+// generated short code which is taken at put is generated again, given one is not
+func TestPostLinkCodeTaken(t *testing.T) {
+	appsvc, _ := newRoleHandler(t, policy.Default())
+	var repoif repository.RepoIf = new(repository.FileRepo)
+	linkSVC := repoif.New(context.Background(), filepath.Join(t.TempDir(), "test_taken.json"), trace.NewNoopTracerProvider().Tracer("test"))
+	t.Cleanup(linkSVC.CloseConn)
+	taken := 0
+	racy := endpoint.NewAppsvc(takenRepo{roleRepo{linkSVC}, &taken}, nopProm{}, trace.NewNoopTracerProvider().Tracer("test"))
+	racy.Keys = appsvc.Keys
+	handler := endpoint.RegisterPublicHTTP(racy)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		token, err := endpoint.GenJWTWithClaims(racy.Keys, "uid_"+policy.Creator, 0, "", "")
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/links", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	taken = 2
+	rr := post(`{"url":"mail.ru"}`)
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+	var element model.DataEl
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&element))
+	require.Zero(t, taken)
+	datael, err := linkSVC.GetShort(context.Background(), element.Shorturl)
+	require.NoError(t, err)
+	require.Equal(t, "mail.ru", datael.URL)
+
+	// no free code after all attempts
+	taken = 100
+	rr = post(`{"url":"mail.ru"}`)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Contains(t, rr.Body.String(), `"code":10`)
+
+	taken = 1
+	rr = post(`{"url":"mail.ru","shorturl":"given"}`)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Contains(t, rr.Body.String(), `"code":5`)
+	require.Zero(t, taken)
+}
+
+// payRepo - db repo where cached profile of user has balance, but payment in repo fails with payErr
+type payRepo struct {
+	roleRepo
+	payErr error
+}
+
+func (pr payRepo) GetUser(uid string) (model.User, error) {
+	user, err := pr.roleRepo.GetUser(uid)
+	user.Balance = money.MustParse("100.00")
+	return user, err
+}
+
+func (payRepo) FindSuperUser() (string, error) {
+	return "uid_" + policy.SuperUser, nil
+}
+
+func (pr payRepo) PayUser(ctx context.Context, uidA, uidB string, amount money.Amount) error {
+	return pr.payErr
+}
+
+// url of paid open is given only after payment in repo is done
+func TestShortOpenPayment(t *testing.T) {
+	appsvc, _ := newRoleHandler(t, policy.Default())
+	var repoif repository.RepoIf = new(repository.FileRepo)
+	linkSVC := repoif.New(context.Background(), filepath.Join(t.TempDir(), "test_pay.json"), trace.NewNoopTracerProvider().Tracer("test"))
+	t.Cleanup(linkSVC.CloseConn)
+	link := model.DataEl{UID: "uid_" + policy.Creator, URL: "mail.ru", Shorturl: "paid.link", Datetime: time.Now(), Active: 1}
+	require.NoError(t, linkSVC.Put(context.Background(), link.UID, link.Shorturl, link, false))
+
+	open := func(payErr error) *httptest.ResponseRecorder {
+		paying := endpoint.NewAppsvc(payRepo{roleRepo{linkSVC}, payErr}, nopProm{}, trace.NewNoopTracerProvider().Tracer("test"))
+		paying.Keys = appsvc.Keys
+		return rateCall(t, paying, endpoint.RegisterPublicHTTP(paying), http.MethodGet, "/shortopen/paid.link", "198.51.100.1", policy.User)
+	}
+
+	rr := open(repository.ErrInsufficientFunds)
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Contains(t, rr.Body.String(), `"code":402`)
+	require.NotContains(t, rr.Body.String(), "mail.ru")
+
+	rr = open(errors.New("connection refused"))
+	require.Contains(t, rr.Body.String(), `"code":10`)
+	require.NotContains(t, rr.Body.String(), "mail.ru")
+
+	rr = open(nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"url":"mail.ru"}`, rr.Body.String())
+}
+
+// list of links answers 503 when worker pool of service is overloaded
+func TestOverloaded(t *testing.T) {
+	appsvc, _ := newRoleHandler(t, policy.Default())
+	var repoif repository.RepoIf = new(repository.FileRepo)
+	linkSVC := repoif.New(context.Background(), filepath.Join(t.TempDir(), "test_overload.json"), trace.NewNoopTracerProvider().Tracer("test"))
+	t.Cleanup(linkSVC.CloseConn)
+	overloaded := endpoint.NewAppsvc(overloadedRepo{roleRepo{linkSVC}}, nopProm{}, trace.NewNoopTracerProvider().Tracer("test"))
+	overloaded.Keys = appsvc.Keys
+	handler := endpoint.RegisterPublicHTTP(overloaded)
+
+	rr := rateCall(t, overloaded, handler, http.MethodGet, "/links/all", "198.51.100.1", policy.User)
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Equal(t, "1", rr.Header().Get("Retry-After"))
+	require.Contains(t, rr.Body.String(), `"code":19`)
+}
@@ -3,20 +3,24 @@ package endpoint
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"sort"
-	"strconv"
 	"time"
 
 	"go.opentelemetry.io/otel/trace"
 
 	"go.opentelemetry.io/otel/attribute"
 
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/jwtkeys"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/policy"
 	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
 
 	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/shortcode"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
@@ -28,6 +32,7 @@ import (
 // также имеет put get del crud - для работы с файлохранилищем
 // list - list all links for uid user
 // GetUn - open link for redir and add 1 to redir count
+// GetUnPersonal - the same for personal link of user (/u/{user}/{shortlink})
 type linkSvc interface {
 	Get(ctx context.Context, uid, key string, su bool) (model.DataEl, error)
 	Put(ctx context.Context, uid, key string, value model.DataEl, su bool) error
@@ -38,17 +43,51 @@ type linkSvc interface {
 	DelUser(uid string) error
 	GetUser(uid string) (model.User, error)
 	WhoAmI() uint64
-	PayUser(ctx context.Context, uidA, uidB, amount string) error
+	PayUser(ctx context.Context, uidA, uidB string, amount money.Amount) error
 	FindSuperUser() (string, error)
+	FindUserByEmail(email string) (string, error)
 	GetAll(ctx context.Context, uid string) (model.Data, error)
 	AuthUser(user model.User) (string, error)
 	GetAllUsers() (model.Users, error)
+	AddClick(ctx context.Context, click model.Click) error
+	GetClickStats(ctx context.Context, uid, shortlink string, q model.StatQuery) (model.ClickStats, error)
+	GetShort(ctx context.Context, shortlink string) (model.DataEl, error)
+	GetUnPersonal(ctx context.Context, uid, shortlink string) (string, error)
+	PutSession(ctx context.Context, session model.Session) error
+	RotateSession(ctx context.Context, sid, oldJTI, newJTI string, expiresAt time.Time) error
+	ListSessions(ctx context.Context, uid string) ([]model.Session, error)
+	RevokeSession(ctx context.Context, uid, sid string) error
+	PutAPIKey(ctx context.Context, key model.APIKey) error
+	AuthAPIKey(ctx context.Context, key string) (model.APIKey, error)
+	ListAPIKeys(ctx context.Context, uid string) ([]model.APIKey, error)
+	RevokeAPIKey(ctx context.Context, uid, id string) error
+	PutIdentity(ctx context.Context, identity model.Identity) error
+	FindIdentity(ctx context.Context, issuer, subject string) (string, error)
+	ListIdentities(ctx context.Context, uid string) ([]model.Identity, error)
 }
 
+// payments of db version: opening balance of new user, su pays creator of new link, user pays su for opening link
+const (
+	openingBalance = 100 * money.Unit
+	linkReward     = 50 * money.Unit
+	openPrice      = 10 * money.Unit
+)
+
+// Appsvc - services of api
+// CodeGen - generator of short codes for links posted without shorturl, default one can be replaced before RegisterPublicHTTP
+// Keys - jwt signing / verification keys, default one (HS256 secret of older versions) can be replaced the same way
+// Policy - actions allowed to user roles, default one is permissions of older versions
+// OIDC - identity provider of OpenID Connect login, nil - only username/password login
+// RateLimits - rate limits of routes, default ones are kept in process
 type Appsvc struct {
-	linkSVC repository.RepoIf
-	Prometh PromIf
-	jTracer trace.Tracer
+	linkSVC    repository.RepoIf
+	Prometh    PromIf
+	jTracer    trace.Tracer
+	CodeGen    *shortcode.Generator
+	Keys       *jwtkeys.KeySet
+	Policy     *policy.Policy
+	OIDC       *OIDC
+	RateLimits *RateLimits
 }
 
 func NewAppsvc(linkSVC repository.RepoIf, Prometh PromIf, jTracer trace.Tracer) *Appsvc {
@@ -56,32 +95,58 @@ func NewAppsvc(linkSVC repository.RepoIf, Prometh PromIf, jTracer trace.Tracer)
 		linkSVC,
 		Prometh,
 		jTracer,
+		shortcode.Default(),
+		jwtkeys.Default(),
+		policy.Default(),
+		nil,
+		DefaultRateLimits(),
 	}
 }
 
+// allow - handler of route which user role should be allowed to do action to call
+func (appsvc *Appsvc) allow(action policy.Action, next http.HandlerFunc) http.HandlerFunc {
+	return allow(appsvc.Policy, appsvc.linkSVC, action, next)
+}
+
 // RegisterPublicHTTP - регистрация роутинга путей типа urls.py для обработки сервером
 func RegisterPublicHTTP(appsvc *Appsvc) *mux.Router {
 	r := mux.NewRouter()
 	// JWT authorization
-	r.HandleFunc("/user/auth", postAuth(appsvc.linkSVC, appsvc.Prometh, appsvc.jTracer)).Methods(http.MethodPost)
-	r.HandleFunc("/token/refresh", postTokenRefresh(appsvc.linkSVC)).Methods(http.MethodPost)
+	r.HandleFunc("/user/auth", postAuth(appsvc.linkSVC, appsvc.Prometh, appsvc.jTracer, appsvc.Keys)).Methods(http.MethodPost)
+	r.HandleFunc("/token/refresh", postTokenRefresh(appsvc.linkSVC, appsvc.Keys)).Methods(http.MethodPost)
 	r.HandleFunc("/user/register", postRegister(appsvc.linkSVC)).Methods(http.MethodPost)
+	// OpenID Connect login
+	r.HandleFunc("/user/oidc/login", getOIDCLogin(appsvc.OIDC)).Methods(http.MethodGet)
+	r.HandleFunc("/user/oidc/callback", getOIDCCallback(appsvc.linkSVC, appsvc.Keys, appsvc.OIDC)).Methods(http.MethodGet)
+	// login sessions of user
+	r.HandleFunc("/user/logout", loginOnly(postLogout(appsvc.linkSVC))).Methods(http.MethodPost)
+	r.HandleFunc("/user/sessions", loginOnly(getSessions(appsvc.linkSVC))).Methods(http.MethodGet)
+	r.HandleFunc("/user/sessions/{sid}", loginOnly(delSession(appsvc.linkSVC))).Methods(http.MethodDelete)
+	// api keys of user
+	r.HandleFunc("/user/apikeys", loginOnly(postAPIKey(appsvc.linkSVC))).Methods(http.MethodPost)
+	r.HandleFunc("/user/apikeys", loginOnly(getAPIKeys(appsvc.linkSVC))).Methods(http.MethodGet)
+	r.HandleFunc("/user/apikeys/{id}", loginOnly(delAPIKey(appsvc.linkSVC))).Methods(http.MethodDelete)
+	// public keys of jwt tokens
+	r.HandleFunc("/.well-known/jwks.json", getJWKS(appsvc.Keys)).Methods(http.MethodGet)
 	// user api (works only with pg interface)
-	r.HandleFunc("/users/all", getAllUserData(appsvc.linkSVC)).Methods(http.MethodGet)
-	r.HandleFunc("/user/", getUserData(appsvc.linkSVC)).Methods(http.MethodGet)
-	r.HandleFunc("/user/{uid}", getUserData(appsvc.linkSVC)).Methods(http.MethodGet)
+	r.HandleFunc("/users/all", appsvc.allow(policy.UserReadAny, getAllUserData(appsvc.linkSVC))).Methods(http.MethodGet)
+	r.HandleFunc("/user/", appsvc.allow(policy.UserRead, getUserData(appsvc.linkSVC))).Methods(http.MethodGet)
+	r.HandleFunc("/user/{uid}", appsvc.allow(policy.UserRead, getUserData(appsvc.linkSVC))).Methods(http.MethodGet)
 
-	r.HandleFunc("/user/{uid}", putUserData(appsvc.linkSVC)).Methods(http.MethodPut)
-	r.HandleFunc("/user/{uid}", delUserData(appsvc.linkSVC)).Methods(http.MethodDelete)
+	r.HandleFunc("/user/{uid}", appsvc.allow(policy.UserUpdateAny, putUserData(appsvc.linkSVC))).Methods(http.MethodPut)
+	r.HandleFunc("/user/{uid}", appsvc.allow(policy.UserDeleteAny, delUserData(appsvc.linkSVC))).Methods(http.MethodDelete)
 
 	// Main function shortlinks api
-	r.HandleFunc("/shortopen/{shortlink}", getShortOpen(appsvc.linkSVC, appsvc.jTracer)).Methods(http.MethodGet)
-	r.HandleFunc("/shortstat/{shortlink}", getShortStat(appsvc.linkSVC, appsvc.jTracer)).Methods(http.MethodGet)
+	r.HandleFunc("/shortopen/{shortlink}", appsvc.allow(policy.LinkOpen, getShortOpen(appsvc.linkSVC, appsvc.jTracer))).Methods(http.MethodGet)
+	r.HandleFunc("/u/{user}/{shortlink}", appsvc.allow(policy.LinkOpen, getUserShortOpen(appsvc.linkSVC, appsvc.jTracer))).Methods(http.MethodGet)
+	r.HandleFunc("/shortstat/{shortlink}", appsvc.allow(policy.LinkRead, getShortStat(appsvc.linkSVC, appsvc.jTracer))).Methods(http.MethodGet)
+	r.HandleFunc("/shortstat/{shortlink}/clicks", appsvc.allow(policy.LinkRead, getShortStatClicks(appsvc.linkSVC, appsvc.jTracer))).Methods(http.MethodGet)
+	r.HandleFunc("/shortstat/{shortlink}/top", appsvc.allow(policy.LinkRead, getShortStatTop(appsvc.linkSVC, appsvc.jTracer))).Methods(http.MethodGet)
 	// Links crud
-	r.HandleFunc("/links", postToLink(appsvc.linkSVC, appsvc.jTracer)).Methods(http.MethodPost)
-	r.HandleFunc("/links/all", getFromLink(appsvc.linkSVC, appsvc.jTracer)).Methods(http.MethodGet)
-	r.HandleFunc("/links/{shortlink}", putToLink(appsvc.linkSVC, appsvc.jTracer)).Methods(http.MethodPut)
-	r.HandleFunc("/links/{shortlink}", delFromLink(appsvc.linkSVC, appsvc.jTracer)).Methods(http.MethodDelete)
+	r.HandleFunc("/links", appsvc.allow(policy.LinkCreate, postToLink(appsvc.linkSVC, appsvc.CodeGen, appsvc.jTracer))).Methods(http.MethodPost)
+	r.HandleFunc("/links/all", appsvc.allow(policy.LinkRead, getFromLink(appsvc.linkSVC, appsvc.jTracer))).Methods(http.MethodGet)
+	r.HandleFunc("/links/{shortlink}", appsvc.allow(policy.LinkUpdate, putToLink(appsvc.linkSVC, appsvc.jTracer))).Methods(http.MethodPut)
+	r.HandleFunc("/links/{shortlink}", appsvc.allow(policy.LinkDelete, delFromLink(appsvc.linkSVC, appsvc.jTracer))).Methods(http.MethodDelete)
 
 	// Prometheus metrics url path
 	r.Handle("/metrics", promhttp.Handler())
@@ -89,7 +154,9 @@ func RegisterPublicHTTP(appsvc *Appsvc) *mux.Router {
 	r.HandleFunc("/__heartbeat__", getHeartBeat(appsvc)).Methods(http.MethodGet)
 
 	// MiddleWare first goes JWT second goes Logging
-	r.Use(JWTCheckMiddleware)
+	r.Use(JWTCheckMiddleware(appsvc.Keys, appsvc.linkSVC))
+	// Rate limit MiddleWare (after jwt one, so user of request is known)
+	r.Use(RateLimitMiddleware(appsvc.RateLimits))
 	// Logging MiddleWare
 	r.Use(LoggingMiddleware)
 	// Prometheus Middleware
@@ -109,18 +176,22 @@ func getHeartBeat(appsvc *Appsvc) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-// delUserData - del user from admin (by suid)
-func delUserData(svc linkSvc) func(http.ResponseWriter, *http.Request) {
+// getJWKS - public keys which verify jwt tokens, other services check tokens offline with them
+func getJWKS(keys *jwtkeys.KeySet) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, request *http.Request) {
-		// check if uid == suid
-		// if yes delete user, which uid is in json
-		props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
-		UID := fmt.Sprintf("%v", props["uid"])
-		suid, _ := svc.FindSuperUser()
-		if UID != suid {
-			ResponseAPIError(w, 401, http.StatusBadRequest)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		err := json.NewEncoder(w).Encode(keys.JWKS())
+		if err != nil {
 			return
 		}
+	}
+}
+
+// delUserData - del user from admin (user.delete.any)
+func delUserData(svc linkSvc) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, request *http.Request) {
+		suid, _ := svc.FindSuperUser()
 		params := mux.Vars(request)
 		effectiveUID := params["uid"]
 		// check user to delete is not SU
@@ -137,18 +208,9 @@ func delUserData(svc linkSvc) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-// putUserData - update user from admin (by suid)
+// putUserData - update user from admin (user.update.any)
 func putUserData(svc linkSvc) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, request *http.Request) {
-		// check if uid == suid
-		// if yes delete user, which uid is in json
-		props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
-		UID := fmt.Sprintf("%v", props["uid"])
-		suid, _ := svc.FindSuperUser()
-		if UID != suid {
-			ResponseAPIError(w, 401, http.StatusBadRequest)
-			return
-		}
 		params := mux.Vars(request)
 		effectiveUID := params["uid"]
 
@@ -179,6 +241,8 @@ func putUserData(svc linkSvc) func(http.ResponseWriter, *http.Request) {
 			ResponseAPIError(w, 9, http.StatusBadRequest)
 			return
 		}
+		// passwd is never given back
+		user.Passwd = ""
 		// form answer json
 		err = json.NewEncoder(w).Encode(user)
 		if err != nil {
@@ -190,19 +254,9 @@ func putUserData(svc linkSvc) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-// getAllUserData - suid method to get all users data for admin purposes
+// getAllUserData - get all users data for admin purposes (user.read.any)
 func getAllUserData(svc linkSvc) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, request *http.Request) {
-		// we just take uid from token and reply with model user json
-		// if we have uid == suid in token we take get param uid and get this uid information with this model json
-		props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
-		UID := fmt.Sprintf("%v", props["uid"])
-		suid, _ := svc.FindSuperUser()
-		if UID != suid {
-			ResponseAPIError(w, 401, http.StatusBadRequest)
-			return
-		}
-
 		sqlData, err3 := svc.GetAllUsers()
 		if err3 != nil {
 			ResponseAPIError(w, 10, http.StatusBadRequest)
@@ -222,12 +276,11 @@ func getAllUserData(svc linkSvc) func(http.ResponseWriter, *http.Request) {
 func getUserData(svc linkSvc) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, request *http.Request) {
 		// we just take uid from token and reply with model user json
-		// if we have uid == suid in token we take get param uid and get this uid information with this model json
+		// if user can read any user (user.read.any) we take get param uid and get this uid information with this model json
 		props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
 		UID := fmt.Sprintf("%v", props["uid"])
-		suid, _ := svc.FindSuperUser()
 		var effectiveUID = UID
-		if UID == suid {
+		if can(request, policy.UserReadAny) {
 			params := mux.Vars(request)
 			effectiveUID = params["uid"]
 			if effectiveUID == "" {
@@ -271,8 +324,8 @@ func postRegister(svc linkSvc) func(http.ResponseWriter, *http.Request) {
 		}
 
 		var err1 error
-		jsonUser.Role = "USER"
-		jsonUser.Balance = "100.00"
+		jsonUser.Role = policy.User
+		jsonUser.Balance = openingBalance
 
 		UID, err1 := svc.PutUser(jsonUser)
 
@@ -285,47 +338,8 @@ func postRegister(svc linkSvc) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-// postTokenRefresh - get new pair of jwt tokens when access token is expired
-func postTokenRefresh(svc linkSvc) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, request *http.Request) {
-		type TokenAnswer struct {
-			Access  string `json:"accessToken"`
-			Refresh string `json:"refreshToken"`
-		}
-
-		props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
-
-		UID := fmt.Sprintf("%v", props["uid"])
-
-		/*
-			Issuer := fmt.Sprintf("%v", props["iss"])
-
-			if Issuer != "weblink_refresh" {
-				ResponseAPIError(w, 7, http.StatusBadRequest)
-				return
-			}
-		*/
-		tokenAccess, _ := GenJWTWithClaims(UID, 0)
-		tokenRefresh, _ := GenJWTWithClaims(UID, 1)
-
-		var jsonTokens = TokenAnswer{
-			Access:  tokenAccess,
-			Refresh: tokenRefresh,
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		err := json.NewEncoder(w).Encode(jsonTokens)
-
-		if err != nil {
-			return
-		}
-
-	}
-}
-
 // postAuth - authenticate and give authorization token
-func postAuth(svc linkSvc, prom PromIf, tracer trace.Tracer) func(http.ResponseWriter, *http.Request) {
+func postAuth(svc linkSvc, prom PromIf, tracer trace.Tracer, keys *jwtkeys.KeySet) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, request *http.Request) {
 
 		defer func() {
@@ -335,7 +349,7 @@ func postAuth(svc linkSvc, prom PromIf, tracer trace.Tracer) func(http.ResponseW
 
 		//span, _ := opentracing.StartSpanFromContextWithTracer(request.Context(), tracer, "postAuth")
 		//defer span.Finish()
-		_, span := tracer.Start(request.Context(), "postAuth")
+		ctx, span := tracer.Start(request.Context(), "postAuth")
 		defer span.End()
 
 		//json header check
@@ -345,14 +359,9 @@ func postAuth(svc linkSvc, prom PromIf, tracer trace.Tracer) func(http.ResponseW
 			return
 		}
 
-		type TokenAnswer struct {
-			Access  string `json:"accessToken"`
-			Refresh string `json:"refreshToken"`
-		}
-
 		checkif := svc.WhoAmI()
 
-		if checkif == 1 {
+		if checkif != 0 {
 
 			var jsonPostUser = model.User{}
 
@@ -374,22 +383,13 @@ func postAuth(svc linkSvc, prom PromIf, tracer trace.Tracer) func(http.ResponseW
 			span.AddEvent("Event", trace.WithAttributes(
 				attribute.String("USER Got Auth Token", jsonPostUser.Name),
 			))
-			tokenAccess, _ := GenJWTWithClaims(UID, 0)
-			tokenRefresh, _ := GenJWTWithClaims(UID, 1)
-
-			var jsonTokens = TokenAnswer{
-				Access:  tokenAccess,
-				Refresh: tokenRefresh,
-			}
-
-			w.Header().Set("Content-Type", "application/json")
-
-			err = json.NewEncoder(w).Encode(jsonTokens)
+			jsonTokens, err := newSession(ctx, svc, keys, request, UID)
 			if err != nil {
+				log.Printf("session of %s is not started, err: %v\n", jsonPostUser.Name, err)
 				ResponseAPIError(w, 10, http.StatusBadRequest)
 				return
 			}
-
+			writeTokens(w, jsonTokens)
 			return
 
 		}
@@ -415,7 +415,7 @@ func postAuth(svc linkSvc, prom PromIf, tracer trace.Tracer) func(http.ResponseW
 
 		checkif = svc.WhoAmI()
 
-		if checkif == 1 {
+		if checkif != 0 {
 
 			//check if user with UID exists
 			user, err4 := svc.GetUser(UID)
@@ -430,8 +430,8 @@ func postAuth(svc linkSvc, prom PromIf, tracer trace.Tracer) func(http.ResponseW
 					Name:    jsonPostRq.UID,
 					Passwd:  "123",
 					Email:   "L@u.ca",
-					Balance: "100.00",
-					Role:    "USER",
+					Balance: openingBalance,
+					Role:    policy.User,
 				}
 
 			}
@@ -447,22 +447,13 @@ func postAuth(svc linkSvc, prom PromIf, tracer trace.Tracer) func(http.ResponseW
 			fmt.Printf("pg added user. %s \n", user.Name)
 		}
 
-		tokenAccess, _ := GenJWTWithClaims(UID, 0)
-		tokenRefresh, _ := GenJWTWithClaims(UID, 1)
-
-		var jsonTokens = TokenAnswer{
-			Access:  tokenAccess,
-			Refresh: tokenRefresh,
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		err = json.NewEncoder(w).Encode(jsonTokens)
+		jsonTokens, err := newSession(ctx, svc, keys, request, UID)
 		if err != nil {
+			log.Printf("session of %s is not started, err: %v\n", UID, err)
 			ResponseAPIError(w, 10, http.StatusBadRequest)
 			return
 		}
-
+		writeTokens(w, jsonTokens)
 		return
 
 	}
@@ -485,23 +476,12 @@ func delFromLink(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 		usefulUID, storageKey, res = ValidateRequestShortLink(ctx, request, linkSvc)
 		var flag bool = false
 
-		if checkif == 1 {
+		if checkif != 0 {
 			props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
 			//fmt.Println(props["uid"])
 			UID := fmt.Sprintf("%v", props["uid"])
 
-			user, err2 := linkSvc.GetUser(UID)
-			if err2 != nil {
-				log.Printf("Coild not get user profile, err: %v\n", err2)
-			}
-			// per rule: users cant delete anything in storage
-			if user.Role == "USER" {
-				ResponseAPIError(w, 401, http.StatusUnauthorized)
-				return
-			}
-
-			suid, _ := linkSvc.FindSuperUser()
-			if suid == UID {
+			if can(request, policy.LinkDeleteAny) {
 				// superuser deletes other user record here
 				params := mux.Vars(request)
 				storageKey = params["shortlink"]
@@ -551,15 +531,14 @@ func putToLink(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 		usefulUID, _, res = ValidateRequestShortLink(ctx, request, linkSvc)
 		var flag bool = false
 
-		if checkif == 1 {
+		if checkif != 0 {
 			props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
 			//fmt.Println(props["uid"])
 			UID := fmt.Sprintf("%v", props["uid"])
 			params := mux.Vars(request)
 			shortURL := params["shortlink"]
 
-			suid, _ := linkSvc.FindSuperUser()
-			if suid == UID {
+			if can(request, policy.LinkUpdateAny) {
 				// superuser updates other user record here
 				// get uid of that user
 				dbElem, _ := linkSvc.Get(ctx, UID, shortURL, true)
@@ -580,11 +559,19 @@ func putToLink(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 			ResponseAPIError(w, 9, http.StatusBadRequest)
 			return
 		}
+		if !ValidateLinkLifetime(element) {
+			ResponseAPIError(w, 400, http.StatusBadRequest)
+			return
+		}
 		element.Datetime = time.Now()
 		element.UID = usefulUID
 		element.Active = 1
 		//looks ok, update storage
 		err = linkSvc.Put(ctx, usefulUID, element.Shorturl, element, false)
+		if errors.Is(err, repository.ErrShortlinkTaken) {
+			ResponseAPIError(w, 5, http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			ResponseAPIError(w, 9, http.StatusBadRequest)
 		}
@@ -598,7 +585,8 @@ func putToLink(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 }
 
 // postToLink - creates new item in api storage
-func postToLink(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
+// when shorturl is omitted it is generated by codeGen
+func postToLink(linkSvc linkSvc, codeGen *shortcode.Generator, tracer trace.Tracer) http.HandlerFunc {
 	return func(w http.ResponseWriter, request *http.Request) {
 
 		//span, ctx := opentracing.StartSpanFromContextWithTracer(request.Context(), tracer, "postToLink")
@@ -616,37 +604,25 @@ func postToLink(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 
 		storageKeys, UID, err := GetUserStorageKeys(ctx, request, linkSvc)
 		if err != nil {
-			ResponseAPIError(w, 10, http.StatusBadRequest)
+			ResponseStorageKeysError(w, err)
 			return
 		}
 
 		checkif := linkSvc.WhoAmI()
 		//db version supports payments for adding links
-		if checkif == 1 {
+		if checkif != 0 {
 			//make payment of 50.00 for the user account who uploaded link from SU account
-
-			user, err2 := linkSvc.GetUser(UID)
-			if err2 != nil {
-				log.Printf("Coild not get user profile, err: %v\n", err2)
+			//(only users who can create links get here)
+			//find payer - su
+			suid, err1 := linkSvc.FindSuperUser()
+			if err1 != nil {
+				log.Printf("Could not find suid.. sorry, payment cannot be done.. err: %v\n", err1)
 			}
 
-			if user.Role == "CREATOR" || user.Role == "SUPERUSER" {
-				//find payer - su
-				suid, err1 := linkSvc.FindSuperUser()
-				if err1 != nil {
-					log.Printf("Could not find suid.. sorry, payment cannot be done.. err: %v\n", err1)
-				}
-
-				err1 = linkSvc.PayUser(ctx, suid, UID, "50.00")
-				if err1 != nil {
-					log.Printf("Payment error, payment to cannot be done.. err: %v\n", err1)
-				}
-			} else {
-				log.Printf("user is not CREATOR, cannot add link and no payment available\n")
-				ResponseAPIError(w, 401, http.StatusBadRequest)
-				return
+			err1 = linkSvc.PayUser(ctx, suid, UID, linkReward)
+			if err1 != nil {
+				log.Printf("Payment error, payment to cannot be done.. err: %v\n", err1)
 			}
-
 		}
 
 		var element = model.DataEl{}
@@ -658,26 +634,40 @@ func postToLink(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 			ResponseAPIError(w, 9, http.StatusBadRequest)
 			return
 		}
-		// check if we have key
-		if element.Shorturl == "" {
-			ResponseAPIError(w, 11, http.StatusBadRequest)
+		if !ValidateLinkLifetime(element) {
+			ResponseAPIError(w, 400, http.StatusBadRequest)
 			return
 		}
 
 		element.Datetime = time.Now()
-		// check if this key already exists
-		for _, storageKey := range storageKeys {
-			if storageKey == element.Shorturl {
+		element.UID = UID
+		element.Active = 1
+		// no key - generate it
+		if element.Shorturl == "" {
+			element, err = putGenerated(ctx, linkSvc, codeGen, element)
+			if err != nil {
+				log.Printf("link with generated short code is not put, err: %v\n", err)
+				ResponseAPIError(w, 10, http.StatusBadRequest)
+				return
+			}
+		} else {
+			// check if this key already exists
+			for _, storageKey := range storageKeys {
+				if storageKey == element.Shorturl {
+					ResponseAPIError(w, 5, http.StatusBadRequest)
+					return
+				}
+			}
+			err = linkSvc.Put(ctx, UID, element.Shorturl, element, false)
+			// global shortlink is used by other user
+			if errors.Is(err, repository.ErrShortlinkTaken) {
 				ResponseAPIError(w, 5, http.StatusBadRequest)
 				return
 			}
-		}
-		element.UID = UID
-		element.Active = 1
-		err = linkSvc.Put(ctx, UID, element.Shorturl, element, false)
-		if err != nil {
-			ResponseAPIError(w, 10, http.StatusBadRequest)
-			return
+			if err != nil {
+				ResponseAPIError(w, 10, http.StatusBadRequest)
+				return
+			}
 		}
 
 		w.WriteHeader(http.StatusCreated) // this has to be the first write!!!
@@ -690,6 +680,46 @@ func postToLink(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 	}
 }
 
+// shortCodeAttempts - how many codes are tried when generated code is taken already
+const shortCodeAttempts = 10
+
+// generateShortCode - new code which is not used by any link in repo (of any user)
+func generateShortCode(ctx context.Context, linkSvc linkSvc, codeGen *shortcode.Generator) (string, error) {
+	for i := 0; i < shortCodeAttempts; i++ {
+		code, err := codeGen.Generate()
+		if err != nil {
+			return "", err
+		}
+		datael, err := linkSvc.GetShort(ctx, code)
+		if err != nil {
+			return "", err
+		}
+		if datael.Shorturl == "" {
+			return code, nil
+		}
+		log.Printf("short code %s is taken already, trying another one", code)
+	}
+	return "", fmt.Errorf("no free short code after %d attempts", shortCodeAttempts)
+}
+
+// putGenerated - put link of user with generated code
+// code can be taken by link of other user after it is checked, then link is put with new code
+func putGenerated(ctx context.Context, linkSvc linkSvc, codeGen *shortcode.Generator, element model.DataEl) (model.DataEl, error) {
+	var err error
+	for i := 0; i < shortCodeAttempts; i++ {
+		element.Shorturl, err = generateShortCode(ctx, linkSvc, codeGen)
+		if err != nil {
+			return element, err
+		}
+		err = linkSvc.Put(ctx, element.UID, element.Shorturl, element, false)
+		if !errors.Is(err, repository.ErrShortlinkTaken) {
+			return element, err
+		}
+		log.Printf("generated short code %s is taken by other link, trying another one", element.Shorturl)
+	}
+	return element, err
+}
+
 // getFromLink - get links list in json
 func getFromLink(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 	return func(w http.ResponseWriter, request *http.Request) {
@@ -704,26 +734,20 @@ func getFromLink(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 
 		checkif := linkSvc.WhoAmI()
 
-		if checkif == 1 {
-			//logic for pg if user role = user list all links in database
+		if checkif != 0 {
+			//logic for pg if user can list all links (link.list.all) list all links in database
 			props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
 			UID := fmt.Sprintf("%v", props["uid"])
 
-			user, err1 := linkSvc.GetUser(UID)
-			if err1 != nil {
-				log.Printf("could not get user profie")
-				// todo insert reply with error
-				return
-			}
-			if user.Role == "USER" || user.Role == "SUPERUSER" {
+			if can(request, policy.LinkListAll) {
 				//
 				sqlData, err3 := linkSvc.GetAll(ctx, UID)
 				if err3 != nil {
 					//to do insert reply with error
 					return
 				}
-				//check if ROLE == USER dont show fields: URL
-				if user.Role == "USER" {
+				//check if user can not read links of others (link.read.any) dont show fields: URL
+				if !can(request, policy.LinkReadAny) {
 					// The _, item := range  xxx - copies the values from the slice xxx to a local variable item;
 					// updating item will not affect the slice.
 					// this will update slice
@@ -744,11 +768,11 @@ func getFromLink(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 		}
 
 		var datajson = model.Data{}
-		// old ver get links of the user , as well as if the user role = creator (in case db ver)
+		// old ver get links of the user , as well as if the user can not list all links (in case db ver)
 		// it also gets its links
 		storageKeys, UID, err := GetUserStorageKeys(ctx, request, linkSvc)
 		if err != nil {
-			ResponseAPIError(w, 10, http.StatusBadRequest)
+			ResponseStorageKeysError(w, err)
 			return
 		}
 
@@ -792,12 +816,11 @@ func getShortStat(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 
 		checkif := linkSvc.WhoAmI()
 
-		if checkif == 1 {
+		if checkif != 0 {
 			props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
 			//fmt.Println(props["uid"])
 			UID := fmt.Sprintf("%v", props["uid"])
-			suid, _ := linkSvc.FindSuperUser()
-			if suid == UID {
+			if can(request, policy.LinkReadAny) {
 				//get link info of other user
 				params := mux.Vars(request)
 				shortURL := params["shortlink"]
@@ -843,16 +866,62 @@ func getShortStat(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 	}
 }
 
+// responseOpenError - reply when link can not be opened: expired, exhausted or repo problem
+func responseOpenError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, repository.ErrLinkExpired):
+		ResponseAPIError(w, 13, http.StatusGone)
+	case errors.Is(err, repository.ErrLinkExhausted):
+		ResponseAPIError(w, 14, http.StatusGone)
+	default:
+		ResponseAPIError(w, 10, http.StatusBadRequest)
+	}
+}
+
+// responsePayError - answer of failed payment for open of link: 402 when balance does not allow it
+func responsePayError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, repository.ErrInsufficientFunds), errors.Is(err, repository.ErrBalanceBlocked):
+		ResponseAPIError(w, 402, http.StatusBadRequest)
+	default:
+		ResponseAPIError(w, 10, http.StatusBadRequest)
+	}
+}
+
 // getShortOpen - get link opened (unonimously)
 func getShortOpen(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
+	return shortOpenHandler(linkSvc, tracer, "getShortOpen", false)
+}
+
+// getUserShortOpen - get personal link of user opened: /u/{user}/{shortlink}, user is uid of owner
+func getUserShortOpen(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
+	return shortOpenHandler(linkSvc, tracer, "getUserShortOpen", true)
+}
+
+// shortOpenHandler - common part of link opening handlers, personal - link is looked up in namespace of user
+func shortOpenHandler(linkSvc linkSvc, tracer trace.Tracer, name string, personal bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, request *http.Request) {
 
 		//span, ctx := opentracing.StartSpanFromContextWithTracer(request.Context(), tracer, "getShortOpen")
 		//defer span.Finish()
 
-		ctx, span := tracer.Start(request.Context(), "getShortOpen")
+		ctx, span := tracer.Start(request.Context(), name)
 		defer span.End()
 
+		params := mux.Vars(request)
+		shortURL := params["shortlink"]
+		click := newClick(request, shortURL)
+		// GetUn retreives link and updates redir count++
+		openLink := func() (string, error) {
+			if personal {
+				return linkSvc.GetUnPersonal(ctx, params["user"], shortURL)
+			}
+			return linkSvc.GetUn(ctx, shortURL)
+		}
+		if personal {
+			click.Owner = params["user"]
+		}
+
 		// get data
 		// update data
 		// redir to real link
@@ -861,23 +930,26 @@ func getShortOpen(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 		var err error
 		// in case of file repo do it and in case of db repo will do it if payment successfull
 		if checkif == 0 {
-			params := mux.Vars(request)
-			shortURL := params["shortlink"]
-			// GetUn retreives link and updates redir count++
-			URL, err = linkSvc.GetUn(ctx, shortURL)
+			URL, err = openLink()
 
 			if err != nil {
-				ResponseAPIError(w, 10, http.StatusBadRequest)
+				responseOpenError(w, err)
 				return
 			}
 			if URL == "" {
 				ResponseAPIError(w, 404, http.StatusBadRequest)
 				return
 			}
+			if err = linkSvc.AddClick(ctx, click); err != nil {
+				log.Printf("click of %s is not saved, err: %v\n", shortURL, err)
+			}
 		}
 
 		//db version supports payments for opening links
-		if checkif == 1 {
+		// profile of user and suid are from cache of service, click is saved in background,
+		// but payment is synchronous: url is given only after open is paid (balance is checked in repo transaction),
+		// open which is not paid is counted still
+		if checkif != 0 {
 			//make payment of 10.00 for the superuser account from USER who opened link
 			//get UID from token
 
@@ -885,7 +957,7 @@ func getShortOpen(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 				URL string `json:"url"`
 			}
 
-			amount := "10.0"
+			amount := openPrice
 			props, _ := request.Context().Value(ctxKey{}).(jwt.MapClaims)
 			//fmt.Println(props["uid"])
 			UID := fmt.Sprintf("%v", props["uid"])
@@ -895,41 +967,48 @@ func getShortOpen(linkSvc linkSvc, tracer trace.Tracer) http.HandlerFunc {
 				log.Printf("Could not get user profile, err: %v\n", err2)
 			}
 
-			if user.Role == "USER" {
-				//todo check if balance is not less then amount
-				balance, _ := strconv.ParseFloat(user.Balance, 64)
-				flamount, _ := strconv.ParseFloat(amount, 64)
-				if balance < 0 || balance < flamount {
+			// users who can not open links free (link.open.free) pay for it
+			paid := !can(request, policy.LinkOpenFree)
+			if paid {
+				// payment checks balance again, when it is paid
+				if user.Balance < amount {
 					ResponseAPIError(w, 402, http.StatusBadRequest)
 					return
 				}
+			} else {
+				log.Printf("user opens links free, no payment available\n")
+			}
+
+			URL, err = openLink()
+
+			if err != nil {
+				responseOpenError(w, err)
+				return
+			}
+			if URL == "" {
+				ResponseAPIError(w, 404, http.StatusBadRequest)
+				return
+			}
+
+			// payment is done only when link is really opened (not expired)
+			if paid {
 				//find payer - su
 				suid, err1 := linkSvc.FindSuperUser()
 				if err1 != nil {
 					log.Printf("Could not find suid.. sorry, payment cannot be done.. err: %v\n", err1)
+					ResponseAPIError(w, 10, http.StatusBadRequest)
+					return
 				}
 
 				err1 = linkSvc.PayUser(ctx, UID, suid, amount)
 				if err1 != nil {
 					log.Printf("Payment error, payment to cannot be done.. err: %v\n", err1)
+					responsePayError(w, err1)
+					return
 				}
-
-			} else {
-				log.Printf("user type is not USER, no payment available\n")
 			}
-
-			params := mux.Vars(request)
-			shortURL := params["shortlink"]
-			// GetUn retreives link and updates redir count++
-			URL, err = linkSvc.GetUn(ctx, shortURL)
-
-			if err != nil {
-				ResponseAPIError(w, 10, http.StatusBadRequest)
-				return
-			}
-			if URL == "" {
-				ResponseAPIError(w, 404, http.StatusBadRequest)
-				return
+			if err = linkSvc.AddClick(ctx, click); err != nil {
+				log.Printf("click of %s is not saved, err: %v\n", shortURL, err)
 			}
 
 			var jsonAns = Answer{
@@ -15,7 +15,9 @@ import (
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/app/endpoint"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
 	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/shortcode"
 )
 
 // crud api test
@@ -29,6 +31,7 @@ func TestHandler(t *testing.T) {
 	//setup server
 	// remove file
 	os.Remove("test.json")
+	os.Remove("test.json.journal")
 	var repoif repository.RepoIf
 	// подстановка в интерфейс соотвествующего хранилища
 	repoif = new(repository.FileRepo)
@@ -162,6 +165,8 @@ func TestHandler(t *testing.T) {
 	}
 	req.RequestURI = "/shortopen/"
 	req.Header.Set("Authorization", "Bearer "+jsonTokens.Access)
+	req.Header.Set("Referer", "https://news.example.com/")
+	req.RemoteAddr = "203.0.113.77:51000"
 
 	rr = httptest.NewRecorder()
 	// execute server with test request
@@ -182,6 +187,190 @@ func TestHandler(t *testing.T) {
 			t.Errorf("header response doesn't match:\n%s", p)
 		}
 	}
+	// click stats test /////////////////////////////////////////////////////////////////////////////////////
+	for _, statURL := range []string{"/shortstat/abrashabra.cadabra/clicks?bucket=hour", "/shortstat/abrashabra.cadabra/top"} {
+		req, err = http.NewRequest("GET", statURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RequestURI = "/shortstat/"
+		req.Header.Set("Authorization", "Bearer "+jsonTokens.Access)
+
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("%s returned wrong status code: got %v want %v", statURL, status, http.StatusOK)
+		}
+		p, errR = ioutil.ReadAll(rr.Body)
+		if errR != nil {
+			t.Fail()
+		} else if !strings.Contains(string(p), `"total":1`) {
+			t.Errorf("%s response doesn't match:\n%s", statURL, p)
+		} else if strings.HasSuffix(statURL, "/top") && !strings.Contains(string(p), `news.example.com`) {
+			t.Errorf("%s response doesn't match:\n%s", statURL, p)
+		}
+	}
+
+	// wrong bucket of click stats test
+	req, err = http.NewRequest("GET", "/shortstat/abrashabra.cadabra/clicks?bucket=year", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/shortstat/"
+	req.Header.Set("Authorization", "Bearer "+jsonTokens.Access)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// link lifetime test /////////////////////////////////////////////////////////////////////////////////////
+	// link which is expired already can not be created
+	jsonStr = []byte(`{ "url": "www.mail.ru","shorturl": "once.only","expires_at": "2001-01-01T00:00:00Z"}`)
+	req, err = http.NewRequest("POST", "/links", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/links"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+jsonTokens.Access)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// link which can be opened once
+	jsonStr = []byte(`{ "url": "www.mail.ru","shorturl": "once.only","max_redirs": 1}`)
+	req, err = http.NewRequest("POST", "/links", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/links"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+jsonTokens.Access)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	for i, want := range []int{http.StatusFound, http.StatusGone} {
+		req, err = http.NewRequest("GET", "/shortopen/once.only", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RequestURI = "/shortopen/"
+		req.Header.Set("Authorization", "Bearer "+jsonTokens.Access)
+
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != want {
+			t.Errorf("open %d returned wrong status code: got %v want %v", i+1, status, want)
+		}
+		if want == http.StatusGone && !strings.Contains(rr.Body.String(), `"code":14`) {
+			t.Errorf("header response doesn't match:\n%s", rr.Body.String())
+		}
+	}
+
+	// generated short code test /////////////////////////////////////////////////////////////////////////////////////
+	jsonStr = []byte(`{ "url": "www.mail.ru"}`)
+	req, err = http.NewRequest("POST", "/links", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/links"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+jsonTokens.Access)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+	var generated struct {
+		Shorturl string `json:"shorturl"`
+	}
+	if err = json.Unmarshal(rr.Body.Bytes(), &generated); err != nil {
+		t.Fatal(err)
+	}
+	if len(generated.Shorturl) != shortcode.DefaultLength {
+		t.Errorf("generated short code %q has wrong length", generated.Shorturl)
+	}
+
+	// shortlink of other user test /////////////////////////////////////////////////////////////////////////////////////
+	jsonStr = []byte(`{"name":"other_user"}`)
+	req, err = http.NewRequest("POST", "/user/auth", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/user/auth"
+	req.Header.Set("Content-Type", "application/json")
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	var otherTokens = TokenAnswer{}
+	if err = json.Unmarshal(rr.Body.Bytes(), &otherTokens); err != nil {
+		t.Fatal(err)
+	}
+
+	// global shortlink is taken by first user
+	jsonStr = []byte(`{ "url": "www.ya.ru","shorturl": "abrashabra.cadabra"}`)
+	req, err = http.NewRequest("POST", "/links", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/links"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+otherTokens.Access)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusBadRequest)
+	}
+	if !strings.Contains(rr.Body.String(), `"code":5`) {
+		t.Errorf("header response doesn't match:\n%s", rr.Body.String())
+	}
+
+	// the same shortlink as personal one is opened by /u/{user}/{shortlink}
+	jsonStr = []byte(`{ "url": "www.ya.ru","shorturl": "abrashabra.cadabra","personal": true}`)
+	req, err = http.NewRequest("POST", "/links", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/links"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+otherTokens.Access)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+
+	req, err = http.NewRequest("GET", "/u/other_user/abrashabra.cadabra", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/u/other_user/abrashabra.cadabra"
+	req.Header.Set("Authorization", "Bearer "+jsonTokens.Access)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusFound)
+	}
+	if location := rr.Header().Get("Location"); !strings.Contains(location, "www.ya.ru") {
+		t.Errorf("personal link is redirected to %q", location)
+	}
+
 	// update item test /////////////////////////////////////////////////////////////////////////////////////
 	jsonStr = []byte(`{ "url": "www.mail.ruUU","shorturl": "abrashabra.cadabra","redirs": 12345}`)
 	req, err = http.NewRequest("PUT", "/links/abrashabra.cadabra", bytes.NewBuffer(jsonStr))
@@ -271,6 +460,93 @@ func TestHandler(t *testing.T) {
 		}
 	}
 
+	// reuse of rotated refresh token revokes session ////////////////////////////////////////////////////////
+	req, err = http.NewRequest("POST", "/token/refresh", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/token/refresh"
+	req.Header.Set("Authorization", "Bearer "+jsonTokens.Refresh)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusUnauthorized)
+	}
+	if !strings.Contains(rr.Body.String(), `"code":15`) {
+		t.Errorf("header response doesn't match:\n%s", rr.Body.String())
+	}
+
+	// sessions and logout test ///////////////////////////////////////////////////////////////////////////////
+	req, err = http.NewRequest("GET", "/user/sessions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/user/sessions"
+	req.Header.Set("Authorization", "Bearer "+otherTokens.Access)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	var sessions model.Sessions
+	if err = json.Unmarshal(rr.Body.Bytes(), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions.Data) != 1 || !sessions.Data[0].Current || sessions.Data[0].JTI != "" {
+		t.Errorf("wrong sessions: %s", rr.Body.String())
+	}
+
+	req, err = http.NewRequest("POST", "/user/logout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/user/logout"
+	req.Header.Set("Authorization", "Bearer "+otherTokens.Access)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	// refresh token of logged out session does not work
+	req, err = http.NewRequest("POST", "/token/refresh", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/token/refresh"
+	req.Header.Set("Authorization", "Bearer "+otherTokens.Refresh)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusUnauthorized)
+	}
+
+	// access token of logged out session does not work either, even before it expires
+	req, err = http.NewRequest("GET", "/user/sessions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/user/sessions"
+	req.Header.Set("Authorization", "Bearer "+otherTokens.Access)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusUnauthorized)
+	}
+	if !strings.Contains(rr.Body.String(), `"code":15`) {
+		t.Errorf("header response doesn't match:\n%s", rr.Body.String())
+	}
+
 	//error token refresh test //////////////////////////////////////////////////////////////////////////////
 	req, err = http.NewRequest("POST", "/token/refresh", nil)
 	if err != nil {
@@ -298,6 +574,25 @@ func TestHandler(t *testing.T) {
 		}
 	}
 
+	// jwks test, no token is needed ////////////////////////////////////////////////////////////////////////
+	req, err = http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RequestURI = "/.well-known/jwks.json"
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	// built-in HS256 secret is never published
+	if body := strings.TrimSpace(rr.Body.String()); body != `{"keys":[]}` {
+		t.Errorf("header response doesn't match:\n%s", body)
+	}
+
 	// remove file
 	os.Remove("test.json")
+	os.Remove("test.json.journal")
 }
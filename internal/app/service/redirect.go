@@ -0,0 +1,238 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/redirs"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
+)
+
+// кеш открытия ссылок (/shortopen)
+// resolved shortlink is kept in cache, so open of popular link does not touch repo: it is counted
+// in store of counters, which are added to repo in batches by flush task of pool (see redirs).
+// miss reads link from repo (no transaction) and puts it to cache.
+// unknown or inactive shortlink is kept as negative entry for NegativeTTL.
+// link with MaxRedirs is never cached and is opened by repo (redirs++ in transaction), as its limit is checked there.
+// entries are flushed by Put, Del, writers of journal and sweeper
+
+const (
+	// DefaultRedirectTTL - time to keep resolved shortlink
+	DefaultRedirectTTL = 10 * time.Minute
+	// DefaultNegativeTTL - time to keep unknown shortlink
+	DefaultNegativeTTL = 30 * time.Second
+	// flushTimeout - timeout of one attempt of flush of opens
+	flushTimeout = 30 * time.Second
+)
+
+// RedirOptions - Store - counters of opens which are not yet added to repo,
+// FlushInterval - how often they are added to repo (they are added by CloseConn as well)
+type RedirOptions struct {
+	Store         redirs.Store
+	FlushInterval time.Duration
+}
+
+// DefaultRedirOptions - counters of process, flushed every 5 seconds
+func DefaultRedirOptions() RedirOptions {
+	return RedirOptions{Store: redirs.NewMemory(), FlushInterval: 5 * time.Second}
+}
+
+// redirect - cached open of shortlink, Missing - there is no such active link (negative entry)
+type redirect struct {
+	URL       string
+	ExpiresAt *time.Time
+	Missing   bool
+}
+
+// openRef - link to open, personal link is in namespace of user UID
+type openRef struct {
+	UID       string
+	Shortlink string
+	Personal  bool
+}
+
+// key - key of cached open
+func (ref openRef) key() string {
+	if ref.Personal {
+		return fmt.Sprintf("uid_OPENU:%s:%s", ref.UID, ref.Shortlink)
+	}
+	return fmt.Sprintf("uid_OPEN:%s", ref.Shortlink)
+}
+
+// counter - counter of opens of link
+func (ref openRef) counter(n int64) model.LinkRedirs {
+	return model.LinkRedirs{UID: ref.UID, Shorturl: ref.Shortlink, Personal: ref.Personal, N: n}
+}
+
+// newRedirectMetrics - opens by result of cache: hit, negative (unknown shortlink) or miss
+func newRedirectMetrics() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redirect_cache_total",
+		Help:      "The number of opens of shortlinks by result of cache",
+	}, []string{"result"})
+}
+
+// open - url of link ref from cache, when miss link is read from repo and put to cache
+// empty url - there is no such active link
+func (s *ServiceWb) open(ctx context.Context, ref openRef) (string, error) {
+	if s.RedirectTTL > 0 {
+		var cached redirect
+		if err := s.cacheWb.Get(ctx, ref.key(), &cached); err == nil {
+			switch {
+			case cached.Missing:
+				s.redirects.WithLabelValues("negative").Inc()
+				return "", nil
+			case cached.ExpiresAt == nil || time.Now().Before(*cached.ExpiresAt):
+				s.redirects.WithLabelValues("hit").Inc()
+				s.countRedirect(ctx, ref)
+				return cached.URL, nil
+			}
+			// link is expired since it was cached, it is read again
+		}
+	}
+	s.redirects.WithLabelValues("miss").Inc()
+
+	var datael model.DataEl
+	var err error
+	if ref.Personal {
+		datael, err = s.repo.Get(ctx, ref.UID, ref.Shortlink, false)
+		// file repo tells unknown link by error, pg and bolt by empty link
+		if errors.Is(err, repository.ErrNoSuchLink) {
+			datael, err = model.DataEl{}, nil
+		}
+	} else {
+		datael, err = s.repo.GetShort(ctx, ref.Shortlink)
+	}
+	if err != nil {
+		return "", err
+	}
+	if datael.Shorturl == "" || datael.Personal != ref.Personal {
+		s.cacheRedirect(ctx, ref, redirect{Missing: true}, s.NegativeTTL)
+		return "", nil
+	}
+	if datael.MaxRedirs > 0 {
+		return s.openRepo(ctx, ref)
+	}
+	// expired link is not opened (and not counted) even before sweeper marks it
+	if datael.ExpiresAt != nil && !time.Now().Before(*datael.ExpiresAt) {
+		return "", repository.ErrLinkExpired
+	}
+	if datael.Active == 0 {
+		s.cacheRedirect(ctx, ref, redirect{Missing: true}, s.NegativeTTL)
+		return "", nil
+	}
+
+	s.countRedirect(ctx, ref)
+	ttl := s.RedirectTTL
+	if datael.ExpiresAt != nil {
+		if left := time.Until(*datael.ExpiresAt); left < ttl {
+			ttl = left
+		}
+	}
+	s.cacheRedirect(ctx, ref, redirect{URL: datael.URL, ExpiresAt: datael.ExpiresAt}, ttl)
+	return datael.URL, nil
+}
+
+// openRepo - open link ref with limit of opens in repo (redirs++ in transaction)
+func (s *ServiceWb) openRepo(ctx context.Context, ref openRef) (string, error) {
+	var URL string
+	var err error
+	if ref.Personal {
+		URL, err = s.repo.GetUnPersonal(ctx, ref.UID, ref.Shortlink)
+	} else {
+		URL, err = s.repo.GetUn(ctx, ref.Shortlink)
+	}
+	if err != nil {
+		return "", err
+	}
+	if URL != "" {
+		//redirs are changed, will remove only cache for uid_GETALL:
+		s.flushCache(ctx, "uid_GETALL:")
+	}
+	return URL, nil
+}
+
+// countRedirect - open of link is counted in store, it is added to repo by next flush
+// if store does not take it (redis is down), it is added to repo at once as batch of one open
+func (s *ServiceWb) countRedirect(ctx context.Context, ref openRef) {
+	err := s.counts.Add(ctx, ref.counter(1))
+	if err == nil {
+		return
+	}
+	log.Printf("service/countRedirect: open of %s is added to repo by request: %v", ref.Shortlink, err)
+	batch, err := redirs.NewBatchID()
+	if err == nil {
+		err = s.repo.AddRedirs(ctx, batch, []model.LinkRedirs{ref.counter(1)})
+	}
+	if err != nil {
+		log.Printf("service/countRedirect: open of %s is not counted: %v", ref.Shortlink, err)
+	}
+}
+
+// cacheRedirect - keep open of ref in cache for ttl (0 - it is not cached)
+func (s *ServiceWb) cacheRedirect(ctx context.Context, ref openRef, entry redirect, ttl time.Duration) {
+	if s.RedirectTTL <= 0 || ttl <= 0 {
+		return
+	}
+	if err := s.cacheWb.Set(ctx, ref.key(), entry, ttl); err != nil {
+		log.Printf("service/cacheRedirect: link %s cannot be put to cache: err: %v", ref.Shortlink, err)
+	}
+}
+
+// flushRedirs - job of flush task: pending opens are added to repo as one batch, then batch is acknowledged
+// failed flush is repeated with the same batch, repo adds it once
+func (s *ServiceWb) flushRedirs(ctx context.Context, _ struct{}) (int, error) {
+	batch, err := s.counts.Take(ctx)
+	if err != nil || batch.ID == "" {
+		return 0, err
+	}
+	if err = s.repo.AddRedirs(ctx, batch.ID, batch.Redirs); err != nil {
+		return 0, err
+	}
+	if err = s.counts.Ack(ctx, batch.ID); err != nil {
+		return 0, err
+	}
+	log.Printf("opens of %d links are added to repo (batch %s)", len(batch.Redirs), batch.ID)
+	s.flushCache(ctx, "uid_GETALL:")
+	return len(batch.Redirs), nil
+}
+
+// flushLoop - flush task is put to pool every interval until service is closed
+func (s *ServiceWb) flushLoop(interval time.Duration) {
+	defer s.flusher.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := Submit(s.ctx, s.qbroker, s.flushTask, struct{}{}); err != nil && s.ctx.Err() == nil {
+				log.Printf("service/flushLoop: opens are not added to repo: %v", err)
+			}
+		case <-s.stopFlush:
+			return
+		}
+	}
+}
+
+// pendingRedirs - opens of link which are not yet added to repo
+func (s *ServiceWb) pendingRedirs(ctx context.Context, datael model.DataEl) int {
+	n, err := s.counts.Pending(ctx, model.LinkRedirs{UID: datael.UID, Shorturl: datael.Shorturl, Personal: datael.Personal})
+	if err != nil {
+		log.Printf("service/pendingRedirs: opens of %s are not known: %v", datael.Shorturl, err)
+		return 0
+	}
+	return int(n)
+}
+
+// flushRedirect - open of shortlink of user uid (global or personal) is not cached any more
+func (s *ServiceWb) flushRedirect(ctx context.Context, uid, shortlink string) {
+	s.flushCache(ctx, openRef{Shortlink: shortlink}.key())
+	s.flushCache(ctx, openRef{UID: uid, Shortlink: shortlink, Personal: true}.key())
+}
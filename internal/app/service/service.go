@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -9,10 +10,10 @@ import (
 	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
 	"go.opentelemetry.io/otel/trace"
 
-	"github.com/go-redis/cache/v8"
-	"github.com/go-redis/redis/v8"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/cache"
 
 	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
 )
 
 // repo имеет тип интерфейс
@@ -27,31 +28,38 @@ type cachedrepo interface {
 	DelUser(uid string) error
 	GetUser(uid string) (model.User, error)
 	WhoAmI() uint64
-	PayUser(ctx context.Context, uidA, uidB, amount string) error
+	PayUser(ctx context.Context, uidA, uidB string, amount money.Amount) error
 	FindSuperUser() (string, error)
+	FindUserByEmail(email string) (string, error)
 	GetAll(ctx context.Context, uid string) (model.Data, error)
 	AuthUser(user model.User) (string, error)
 	GetAllUsers() (model.Users, error)
+	AddClick(ctx context.Context, click model.Click) error
+	GetClickStats(ctx context.Context, uid, shortlink string, q model.StatQuery) (model.ClickStats, error)
+	SweepExpired(ctx context.Context, now time.Time) ([]model.DataEl, error)
+	GetShort(ctx context.Context, shortlink string) (model.DataEl, error)
+	GetUnPersonal(ctx context.Context, uid, shortlink string) (string, error)
+	PutSession(ctx context.Context, session model.Session) error
+	RotateSession(ctx context.Context, sid, oldJTI, newJTI string, expiresAt time.Time) error
+	ListSessions(ctx context.Context, uid string) ([]model.Session, error)
+	RevokeSession(ctx context.Context, uid, sid string) error
+	PutAPIKey(ctx context.Context, key model.APIKey) error
+	AuthAPIKey(ctx context.Context, key string) (model.APIKey, error)
+	ListAPIKeys(ctx context.Context, uid string) ([]model.APIKey, error)
+	RevokeAPIKey(ctx context.Context, uid, id string) error
+	PutIdentity(ctx context.Context, identity model.Identity) error
+	FindIdentity(ctx context.Context, issuer, subject string) (string, error)
+	ListIdentities(ctx context.Context, uid string) ([]model.Identity, error)
 }
 
 // Service - содержит член repo
 type Service struct {
 	repo     cachedrepo
-	repcache *cache.Cache
-}
-
-// New - конструктор Service
-func New(repo cachedrepo) *Service {
-	// connect to redis server
-	rdb := redis.NewClient(&redis.Options{
-		Addr: "192.168.1.204:6379", Password: "", // no password set
-		DB: 0, // use default DB
-	})
-	repcache := cache.New(&cache.Options{
-		Redis:      rdb,
-		LocalCache: cache.NewTinyLFU(1000, time.Minute),
-	})
-	log.Printf("redis is connected")
+	repcache cache.Cache
+}
+
+// New - конструктор Service, repcache - cache of lists (redis or in-process)
+func New(repo cachedrepo, repcache cache.Cache) *Service {
 	return &Service{
 		repo:     repo,
 		repcache: repcache,
@@ -84,13 +92,12 @@ func (s *Service) Put(ctx context.Context, uid, key string, value model.DataEl,
 }
 
 // flushcacheList - when db updated flush cache row related to it
+// key is deleted even if it is not in cache of this instance, as other instances may keep it
 func (s *Service) flushcacheList(ctx context.Context, uid string) {
 	key := fmt.Sprintf("uid_LIST:%s", uid)
-	if s.repcache.Exists(ctx, key) {
-		err := s.repcache.Delete(ctx, key)
-		if err != nil {
-			log.Printf("service/flushcache: del cache err: %v", err)
-		}
+	if err := s.repcache.Delete(ctx, key); err != nil {
+		log.Printf("service/flushcache: del cache err: %v", err)
+	} else {
 		log.Printf("cache of List for %s is deleted", uid)
 	}
 	s.flushcacheGetAll(ctx, uid)
@@ -99,11 +106,9 @@ func (s *Service) flushcacheList(ctx context.Context, uid string) {
 // flushcacheGetAll - when db updated flush cache row related to it
 func (s *Service) flushcacheGetAll(ctx context.Context, uid string) {
 	key := fmt.Sprintf("uid_GETALL:")
-	if s.repcache.Exists(ctx, key) {
-		err := s.repcache.Delete(ctx, key)
-		if err != nil {
-			log.Printf("service/flushcache: del cache err: %v", err)
-		}
+	if err := s.repcache.Delete(ctx, key); err != nil {
+		log.Printf("service/flushcache: del cache err: %v", err)
+	} else {
 		log.Printf("cache of GetAll for %s is deleted", uid)
 	}
 }
@@ -138,17 +143,12 @@ func (s *Service) List(ctx context.Context, uid string) ([]string, error) {
 		return nil, err1
 	}
 
-	err := s.repcache.Set(&cache.Item{
-		Ctx:   ctx,
-		Key:   key,
-		Value: dbitems,
-		TTL:   time.Hour,
-	})
+	err := s.repcache.Set(ctx, key, dbitems, time.Hour)
 	if err != nil {
 		log.Printf("items for %s cannot be put to cache: err: %v", uid, err)
 	}
 
-	if err2 == cache.ErrCacheMiss {
+	if errors.Is(err2, cache.ErrCacheMiss) {
 		log.Printf("items for %s are absent in cache and taken from repo", uid)
 		return dbitems, nil
 	}
@@ -178,17 +178,12 @@ func (s *Service) GetAll(ctx context.Context, uid string) (model.Data, error) {
 		return model.Data{}, err1
 	}
 
-	err := s.repcache.Set(&cache.Item{
-		Ctx:   ctx,
-		Key:   key,
-		Value: dbitems,
-		TTL:   time.Hour,
-	})
+	err := s.repcache.Set(ctx, key, dbitems, time.Hour)
 	if err != nil {
 		log.Printf("items (getall) for %s cannot be put to cache: err: %v", uid, err)
 	}
 
-	if err2 == cache.ErrCacheMiss {
+	if errors.Is(err2, cache.ErrCacheMiss) {
 		log.Printf("items (getall) for %s are absent in cache and taken from repo", uid)
 		return dbitems, nil
 	}
@@ -210,6 +205,17 @@ func (s *Service) GetUn(ctx context.Context, shortlink string) (string, error) {
 	return value, nil
 }
 
+// GetUnPersonal - open personal link of user uid, the same as GetUn
+func (s *Service) GetUnPersonal(ctx context.Context, uid, shortlink string) (string, error) {
+	value, err := s.repo.GetUnPersonal(ctx, uid, shortlink)
+	if err != nil {
+		log.Printf("service/GetUnPersonal: from repo err: %v", err)
+		return "", err
+	}
+	s.flushcacheGetAll(ctx, "dummy")
+	return value, nil
+}
+
 // CloseConn - stub method
 func (s *Service) CloseConn() {
 }
@@ -249,7 +255,7 @@ func (s *Service) WhoAmI() uint64 {
 }
 
 // PayUser - payment one user to another (tx)
-func (s *Service) PayUser(ctx context.Context, uidA, uidB, amount string) error {
+func (s *Service) PayUser(ctx context.Context, uidA, uidB string, amount money.Amount) error {
 	if err := s.repo.PayUser(ctx, uidA, uidB, amount); err != nil {
 		log.Printf("service/PayUser: payuser repo err: %v", err)
 		return err
@@ -286,3 +292,158 @@ func (s *Service) GetAllUsers() (model.Users, error) {
 	}
 	return value, nil
 }
+
+// AddClick - save event of link opening
+func (s *Service) AddClick(ctx context.Context, click model.Click) error {
+	if err := s.repo.AddClick(ctx, click); err != nil {
+		log.Printf("service/AddClick: repo err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetClickStats - stats of link opening
+func (s *Service) GetClickStats(ctx context.Context, uid, shortlink string, q model.StatQuery) (model.ClickStats, error) {
+	value, err := s.repo.GetClickStats(ctx, uid, shortlink, q)
+	if err != nil {
+		log.Printf("service/GetClickStats: repo err: %v", err)
+		return model.ClickStats{}, err
+	}
+	return value, nil
+}
+
+// SweepExpired - mark expired links inactive and flush cached lists of their owners
+func (s *Service) SweepExpired(ctx context.Context, now time.Time) ([]model.DataEl, error) {
+	swept, err := s.repo.SweepExpired(ctx, now)
+	if err != nil {
+		log.Printf("service/SweepExpired: repo err: %v", err)
+	}
+	for _, datael := range swept {
+		s.flushcacheList(ctx, datael.UID)
+	}
+	return swept, err
+}
+
+// GetShort - find link by shortlink whoever owns it
+func (s *Service) GetShort(ctx context.Context, shortlink string) (model.DataEl, error) {
+	value, err := s.repo.GetShort(ctx, shortlink)
+	if err != nil {
+		log.Printf("service/GetShort: repo err: %v", err)
+		return model.DataEl{}, err
+	}
+	return value, nil
+}
+
+// PutSession - save new login session
+func (s *Service) PutSession(ctx context.Context, session model.Session) error {
+	if err := s.repo.PutSession(ctx, session); err != nil {
+		log.Printf("service/PutSession: repo err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// RotateSession - change refresh token of session
+func (s *Service) RotateSession(ctx context.Context, sid, oldJTI, newJTI string, expiresAt time.Time) error {
+	if err := s.repo.RotateSession(ctx, sid, oldJTI, newJTI, expiresAt); err != nil {
+		log.Printf("service/RotateSession: repo err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// ListSessions - alive sessions of user
+func (s *Service) ListSessions(ctx context.Context, uid string) ([]model.Session, error) {
+	value, err := s.repo.ListSessions(ctx, uid)
+	if err != nil {
+		log.Printf("service/ListSessions: repo err: %v", err)
+		return nil, err
+	}
+	return value, nil
+}
+
+// RevokeSession - kill session of user
+func (s *Service) RevokeSession(ctx context.Context, uid, sid string) error {
+	if err := s.repo.RevokeSession(ctx, uid, sid); err != nil {
+		log.Printf("service/RevokeSession: repo err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// PutAPIKey - save new api key of user
+func (s *Service) PutAPIKey(ctx context.Context, key model.APIKey) error {
+	if err := s.repo.PutAPIKey(ctx, key); err != nil {
+		log.Printf("service/PutAPIKey: repo err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// AuthAPIKey - alive api key by key itself
+func (s *Service) AuthAPIKey(ctx context.Context, key string) (model.APIKey, error) {
+	value, err := s.repo.AuthAPIKey(ctx, key)
+	if err != nil {
+		log.Printf("service/AuthAPIKey: repo err: %v", err)
+		return model.APIKey{}, err
+	}
+	return value, nil
+}
+
+// ListAPIKeys - alive api keys of user
+func (s *Service) ListAPIKeys(ctx context.Context, uid string) ([]model.APIKey, error) {
+	value, err := s.repo.ListAPIKeys(ctx, uid)
+	if err != nil {
+		log.Printf("service/ListAPIKeys: repo err: %v", err)
+		return nil, err
+	}
+	return value, nil
+}
+
+// RevokeAPIKey - kill api key of user
+func (s *Service) RevokeAPIKey(ctx context.Context, uid, id string) error {
+	if err := s.repo.RevokeAPIKey(ctx, uid, id); err != nil {
+		log.Printf("service/RevokeAPIKey: repo err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// PutIdentity - link OpenID Connect identity to its user
+func (s *Service) PutIdentity(ctx context.Context, identity model.Identity) error {
+	if err := s.repo.PutIdentity(ctx, identity); err != nil {
+		log.Printf("service/PutIdentity: repo err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// FindIdentity - uid of user of OpenID Connect identity, "" if it is not linked
+func (s *Service) FindIdentity(ctx context.Context, issuer, subject string) (string, error) {
+	value, err := s.repo.FindIdentity(ctx, issuer, subject)
+	if err != nil {
+		log.Printf("service/FindIdentity: repo err: %v", err)
+		return "", err
+	}
+	return value, nil
+}
+
+// ListIdentities - OpenID Connect identities of user
+func (s *Service) ListIdentities(ctx context.Context, uid string) ([]model.Identity, error) {
+	value, err := s.repo.ListIdentities(ctx, uid)
+	if err != nil {
+		log.Printf("service/ListIdentities: repo err: %v", err)
+		return nil, err
+	}
+	return value, nil
+}
+
+// FindUserByEmail - uid of user with email, "" if there is no such user
+func (s *Service) FindUserByEmail(email string) (string, error) {
+	value, err := s.repo.FindUserByEmail(email)
+	if err != nil {
+		log.Printf("service/FindUserByEmail: repo err: %v", err)
+		return "", err
+	}
+	return value, nil
+}
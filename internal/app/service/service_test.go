@@ -0,0 +1,859 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/app/service"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/cache"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/redirs"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/writeback"
+)
+
+// newRepo - file repo of test
+func newRepo(t *testing.T) repository.RepoIf {
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+	var repoif repository.RepoIf = new(repository.FileRepo)
+	repo := repoif.New(context.Background(), filepath.Join(t.TempDir(), "test_service.json"), noopTracer)
+	t.Cleanup(repo.CloseConn)
+	return repo
+}
+
+// newMemoryCache - in-process cache of test
+func newMemoryCache(t *testing.T) cache.Cache {
+	repcache, err := cache.NewMemory(100, time.Hour)
+	require.NoError(t, err)
+	return repcache
+}
+
+// newJournal - write back journal of file name
+func newJournal(t *testing.T, name string) *writeback.Journal {
+	journal, err := writeback.Open(name, writeback.Options{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 20 * time.Millisecond})
+	require.NoError(t, err)
+	return journal
+}
+
+// newSpill - spill journal of pool of file name
+func newSpill(t *testing.T, name string) *writeback.Spill {
+	spill, err := writeback.OpenSpill(name)
+	require.NoError(t, err)
+	return spill
+}
+
+// downRepo - repo which fails puts while it is down
+type downRepo struct {
+	repository.RepoIf
+	mu   sync.Mutex
+	down bool
+}
+
+func (r *downRepo) Put(ctx context.Context, uid, key string, value model.DataEl, su bool) error {
+	r.mu.Lock()
+	down := r.down
+	r.mu.Unlock()
+	if down {
+		return errors.New("repo is down")
+	}
+	return r.RepoIf.Put(ctx, uid, key, value, su)
+}
+
+func (r *downRepo) setDown(down bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.down = down
+}
+
+func link(uid, shorturl string) model.DataEl {
+	return model.DataEl{UID: uid, URL: "https://example.com/" + shorturl, Shorturl: shorturl, Datetime: time.Now(), Active: 1}
+}
+
+// sorted - list of shortlinks in order
+func sorted(items []string) []string {
+	sort.Strings(items)
+	return items
+}
+
+// links of write back service: put goes to repo through cache and worker, lists are cached until change
+func TestServiceWb(t *testing.T) {
+	ctx := context.Background()
+	repo := newRepo(t)
+	svc := service.NewWb(repo, trace.NewNoopTracerProvider().Tracer("test"), newMemoryCache(t),
+		service.PoolOptions{Workers: 1, QueueSize: 1, Policy: service.PolicyBlock},
+		newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), service.DefaultRedirOptions())
+	defer svc.CloseConn()
+
+	require.NoError(t, svc.Put(ctx, "u1", "l1", link("u1", "l1"), false))
+	require.Eventually(t, func() bool {
+		items, err := repo.List(ctx, "u1")
+		return err == nil && len(items) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	items, err := svc.List(ctx, "u1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"l1"}, items)
+
+	// change of repo behind service is not seen while list is cached
+	require.NoError(t, repo.Put(ctx, "u1", "l2", link("u1", "l2"), false))
+	items, err = svc.List(ctx, "u1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"l1"}, items)
+	all, err := svc.GetAll(ctx, "u1")
+	require.NoError(t, err)
+	require.Len(t, all.Data, 2)
+
+	// change through service flushes cache
+	_, err = svc.Del(ctx, "u1", "l1", false)
+	require.NoError(t, err)
+	items, err = svc.List(ctx, "u1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"l2"}, items)
+	all, err = svc.GetAll(ctx, "u1")
+	require.NoError(t, err)
+	require.Len(t, all.Data, 1)
+
+	// global shortlink of other user is checked before write back
+	require.ErrorIs(t, svc.Put(ctx, "u2", "l2", link("u2", "l2"), false), repository.ErrShortlinkTaken)
+}
+
+// failed writes are retried, then they are dead letters, pending writes are kept until next run
+func TestServiceWbRetries(t *testing.T) {
+	ctx := context.Background()
+	tracer := trace.NewNoopTracerProvider().Tracer("test")
+	name := filepath.Join(t.TempDir(), "wb.journal")
+	repo := &downRepo{RepoIf: newRepo(t), down: true}
+	svc := service.NewWb(repo, tracer, newMemoryCache(t), service.DefaultPoolOptions(), newJournal(t, name), service.DefaultRedirOptions())
+
+	// quick puts of one link are coalesced, only last value goes to repo
+	value := link("u1", "l1")
+	require.NoError(t, svc.Put(ctx, "u1", "l1", value, false))
+	value.URL = "https://example.com/last"
+	require.NoError(t, svc.Put(ctx, "u1", "l1", value, false))
+	require.Eventually(t, func() bool { return len(svc.DeadLetters()) == 1 }, time.Second, 5*time.Millisecond)
+	dead := svc.DeadLetters()[0]
+	require.Equal(t, "u1:l1", dead.ID)
+	require.Equal(t, "repo is down", dead.LastError)
+
+	// dead letter is tried again when repo is up
+	repo.setDown(false)
+	require.NoError(t, svc.Requeue("u1:l1"))
+	require.Eventually(t, func() bool {
+		got, err := repo.Get(ctx, "u1", "l1", false)
+		return err == nil && got.URL == "https://example.com/last"
+	}, time.Second, 5*time.Millisecond)
+
+	// pending write of deleted link is not written
+	repo.setDown(true)
+	value.URL = "https://example.com/deleted"
+	require.NoError(t, svc.Put(ctx, "u1", "l1", value, false))
+	_, err := svc.Del(ctx, "u1", "l1", false)
+	require.NoError(t, err)
+
+	// write of l3 is pending when service is stopped, it is written by next run
+	require.NoError(t, svc.Put(ctx, "u1", "l3", link("u1", "l3"), false))
+	svc.CloseConn()
+	repo.setDown(false)
+	svc = service.NewWb(repo, tracer, newMemoryCache(t), service.DefaultPoolOptions(), newJournal(t, name), service.DefaultRedirOptions())
+	defer svc.CloseConn()
+	require.Eventually(t, func() bool {
+		items, err := repo.List(ctx, "u1")
+		return err == nil && len(sorted(items)) == 1 && items[0] == "l3"
+	}, time.Second, 5*time.Millisecond)
+}
+
+// heldRepo - repo whose put waits until it is released
+type heldRepo struct {
+	repository.RepoIf
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *heldRepo) Put(ctx context.Context, uid, key string, value model.DataEl, su bool) error {
+	r.started <- struct{}{}
+	<-r.release
+	return r.RepoIf.Put(ctx, uid, key, value, su)
+}
+
+// delete of link which is being put by writer waits for it, so link is not put back after delete
+func TestServiceWbDelInFlight(t *testing.T) {
+	ctx := context.Background()
+	repo := &heldRepo{RepoIf: newRepo(t), started: make(chan struct{}, 1), release: make(chan struct{})}
+	svc := service.NewWb(repo, trace.NewNoopTracerProvider().Tracer("test"), newMemoryCache(t),
+		service.DefaultPoolOptions(), newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), noFlush())
+	defer svc.CloseConn()
+
+	require.NoError(t, svc.Put(ctx, "u1", "l1", link("u1", "l1"), false))
+	select {
+	case <-repo.started:
+	case <-time.After(time.Second):
+		t.Fatal("write is not taken by writer")
+	}
+	// shortlink of link which is not yet in repo is not given to other user
+	require.ErrorIs(t, svc.Put(ctx, "u2", "l1", link("u2", "l1"), false), repository.ErrShortlinkTaken)
+	deleted := make(chan error, 1)
+	go func() {
+		_, err := svc.Del(ctx, "u1", "l1", false)
+		deleted <- err
+	}()
+	select {
+	case err := <-deleted:
+		t.Fatalf("link is deleted before it is put: %v", err)
+	case <-time.After(30 * time.Millisecond):
+	}
+	close(repo.release)
+	require.NoError(t, <-deleted)
+	_, err := repo.Get(ctx, "u1", "l1", false)
+	require.ErrorIs(t, err, repository.ErrNoSuchLink)
+}
+
+// takenRepo - repo where shortlinks of all puts are taken
+type takenRepo struct {
+	repository.RepoIf
+}
+
+func (r *takenRepo) Put(ctx context.Context, uid, key string, value model.DataEl, su bool) error {
+	return repository.ErrShortlinkTaken
+}
+
+// put which would fail every time is dead letter after first attempt
+func TestServiceWbPermanentFailure(t *testing.T) {
+	ctx := context.Background()
+	svc := service.NewWb(&takenRepo{RepoIf: newRepo(t)}, trace.NewNoopTracerProvider().Tracer("test"), newMemoryCache(t),
+		service.DefaultPoolOptions(), newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), noFlush())
+	defer svc.CloseConn()
+
+	require.NoError(t, svc.Put(ctx, "u1", "l1", link("u1", "l1"), false))
+	require.Eventually(t, func() bool { return len(svc.DeadLetters()) == 1 }, time.Second, 5*time.Millisecond)
+	dead := svc.DeadLetters()[0]
+	require.Equal(t, 1, dead.Attempts)
+	require.Equal(t, repository.ErrShortlinkTaken.Error(), dead.LastError)
+}
+
+// instances of service on one repo: change of one of them is seen by other one at once
+func TestServiceWbInvalidation(t *testing.T) {
+	ctx := context.Background()
+	repo := newRepo(t)
+	bus := cache.NewLocalBus()
+	instances := make([]*service.ServiceWb, 2)
+	for i := range instances {
+		local, err := cache.NewMemory(100, time.Hour)
+		require.NoError(t, err)
+		repcache, err := cache.NewInvalidating(local, bus)
+		require.NoError(t, err)
+		defer repcache.Close()
+		instances[i] = service.NewWb(repo, trace.NewNoopTracerProvider().Tracer("test"), repcache,
+			service.DefaultPoolOptions(), newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), service.DefaultRedirOptions())
+		defer instances[i].CloseConn()
+	}
+
+	require.NoError(t, repo.Put(ctx, "u1", "l1", link("u1", "l1"), false))
+	require.NoError(t, repo.Put(ctx, "u1", "l2", link("u1", "l2"), false))
+	for _, svc := range instances {
+		items, err := svc.List(ctx, "u1")
+		require.NoError(t, err)
+		require.Equal(t, []string{"l1", "l2"}, sorted(items))
+	}
+
+	_, err := instances[0].Del(ctx, "u1", "l1", false)
+	require.NoError(t, err)
+	items, err := instances[1].List(ctx, "u1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"l2"}, items)
+}
+
+// openRepo - repo which counts reads of links and opens of them (redirs++ in repo)
+type openRepo struct {
+	repository.RepoIf
+	reads atomic.Int64
+	opens atomic.Int64
+}
+
+func (r *openRepo) GetShort(ctx context.Context, shortlink string) (model.DataEl, error) {
+	r.reads.Add(1)
+	return r.RepoIf.GetShort(ctx, shortlink)
+}
+
+func (r *openRepo) Get(ctx context.Context, uid, key string, su bool) (model.DataEl, error) {
+	r.reads.Add(1)
+	return r.RepoIf.Get(ctx, uid, key, su)
+}
+
+func (r *openRepo) GetUn(ctx context.Context, shortlink string) (string, error) {
+	r.opens.Add(1)
+	return r.RepoIf.GetUn(ctx, shortlink)
+}
+
+func (r *openRepo) GetUnPersonal(ctx context.Context, uid, shortlink string) (string, error) {
+	r.opens.Add(1)
+	return r.RepoIf.GetUnPersonal(ctx, uid, shortlink)
+}
+
+// repoRedirs - opens of link in repo
+func repoRedirs(t *testing.T, repo repository.RepoIf, uid, shortlink string) int {
+	datael, err := repo.Get(context.Background(), uid, shortlink, false)
+	require.NoError(t, err)
+	return datael.Redirs
+}
+
+// noFlush - counters of opens which are flushed by CloseConn only
+func noFlush() service.RedirOptions {
+	return service.RedirOptions{Store: redirs.NewMemory(), FlushInterval: time.Hour}
+}
+
+// opens of links are served by cache, they are counted in store of counters
+func TestServiceWbRedirects(t *testing.T) {
+	ctx := context.Background()
+	repo := &openRepo{RepoIf: newRepo(t)}
+	svc := service.NewWb(repo, trace.NewNoopTracerProvider().Tracer("test"), newMemoryCache(t),
+		service.DefaultPoolOptions(), newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), noFlush())
+	defer svc.CloseConn()
+
+	value := link("u1", "l1")
+	require.NoError(t, repo.Put(ctx, "u1", "l1", value, false))
+	for i := 0; i < 5; i++ {
+		URL, err := svc.GetUn(ctx, "l1")
+		require.NoError(t, err)
+		require.Equal(t, value.URL, URL)
+	}
+	require.Equal(t, int64(1), repo.reads.Load())
+	require.Equal(t, int64(0), repo.opens.Load())
+	require.Equal(t, float64(5), metric(t, svc, "weblinkmetrics_redirect_cache_total"))
+	// opens are not in repo yet, stats have them
+	require.Equal(t, 0, repoRedirs(t, repo.RepoIf, "u1", "l1"))
+	datael, err := svc.Get(ctx, "u1", "l1", false)
+	require.NoError(t, err)
+	require.Equal(t, 5, datael.Redirs)
+
+	// changed link is not opened from cache
+	value.URL = "https://example.com/changed"
+	require.NoError(t, svc.Put(ctx, "u1", "l1", value, false))
+	require.Eventually(t, func() bool {
+		URL, err := svc.GetUn(ctx, "l1")
+		return err == nil && URL == value.URL
+	}, time.Second, 5*time.Millisecond)
+
+	// unknown shortlink is cached as well, until link of it is put
+	reads := repo.reads.Load()
+	for i := 0; i < 3; i++ {
+		URL, err := svc.GetUn(ctx, "l2")
+		require.NoError(t, err)
+		require.Empty(t, URL)
+	}
+	require.Equal(t, reads+1, repo.reads.Load())
+	require.NoError(t, svc.Put(ctx, "u1", "l2", link("u1", "l2"), false))
+	require.Eventually(t, func() bool {
+		URL, err := svc.GetUn(ctx, "l2")
+		return err == nil && URL == link("u1", "l2").URL
+	}, time.Second, 5*time.Millisecond)
+
+	// deleted link
+	_, err = svc.Del(ctx, "u1", "l1", false)
+	require.NoError(t, err)
+	URL, _ := svc.GetUn(ctx, "l1")
+	require.Empty(t, URL)
+
+	// opens of limited link are checked and counted by repo every time
+	limited := link("u1", "l3")
+	limited.MaxRedirs = 2
+	require.NoError(t, repo.Put(ctx, "u1", "l3", limited, false))
+	for i := 0; i < 2; i++ {
+		_, err = svc.GetUn(ctx, "l3")
+		require.NoError(t, err)
+	}
+	_, err = svc.GetUn(ctx, "l3")
+	require.ErrorIs(t, err, repository.ErrLinkExhausted)
+	require.Equal(t, int64(3), repo.opens.Load())
+
+	// expired link
+	expired := link("u1", "l4")
+	expiresAt := time.Now().Add(-time.Minute)
+	expired.ExpiresAt = &expiresAt
+	require.NoError(t, repo.Put(ctx, "u1", "l4", expired, false))
+	_, err = svc.GetUn(ctx, "l4")
+	require.ErrorIs(t, err, repository.ErrLinkExpired)
+
+	// personal link
+	personal := link("u2", "l1")
+	personal.Personal = true
+	require.NoError(t, repo.Put(ctx, "u2", "l1", personal, false))
+	for i := 0; i < 3; i++ {
+		URL, err = svc.GetUnPersonal(ctx, "u2", "l1")
+		require.NoError(t, err)
+		require.Equal(t, personal.URL, URL)
+	}
+	datael, err = svc.Get(ctx, "u2", "l1", false)
+	require.NoError(t, err)
+	require.Equal(t, 3, datael.Redirs)
+	// personal link is not opened by global shortlink
+	URL, _ = svc.GetUn(ctx, "l1")
+	require.Empty(t, URL)
+
+	// unknown personal link is not found (404), it is read from repo once
+	reads = repo.reads.Load()
+	for i := 0; i < 3; i++ {
+		URL, err = svc.GetUnPersonal(ctx, "u2", "l9")
+		require.NoError(t, err)
+		require.Empty(t, URL)
+	}
+	require.Equal(t, reads+1, repo.reads.Load())
+}
+
+// ackStore - store which fails to acknowledge first batch
+type ackStore struct {
+	redirs.Store
+	failed atomic.Bool
+}
+
+func (s *ackStore) Ack(ctx context.Context, id string) error {
+	if s.failed.CompareAndSwap(false, true) {
+		return errors.New("store is down")
+	}
+	return s.Store.Ack(ctx, id)
+}
+
+// opens are added to repo by flush task exactly once, last ones by CloseConn
+func TestServiceWbRedirsFlush(t *testing.T) {
+	ctx := context.Background()
+	tracer := trace.NewNoopTracerProvider().Tracer("test")
+	repo := newRepo(t)
+	require.NoError(t, repo.Put(ctx, "u1", "l1", link("u1", "l1"), false))
+	store := &ackStore{Store: redirs.NewMemory()}
+	svc := service.NewWb(repo, tracer, newMemoryCache(t), service.DefaultPoolOptions(),
+		newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), service.RedirOptions{Store: store, FlushInterval: 10 * time.Millisecond})
+
+	// batch which is added to repo but is not acknowledged is flushed again, repo adds it once
+	for i := 0; i < 4; i++ {
+		_, err := svc.GetUn(ctx, "l1")
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return repoRedirs(t, repo, "u1", "l1") == 4 }, time.Second, 5*time.Millisecond)
+	require.Eventually(t, func() bool {
+		n, err := store.Pending(ctx, model.LinkRedirs{Shorturl: "l1"})
+		return err == nil && n == 0
+	}, time.Second, 5*time.Millisecond)
+	require.True(t, store.failed.Load())
+	require.Equal(t, 4, repoRedirs(t, repo, "u1", "l1"))
+
+	// last opens are flushed on stop, next run sees them in repo
+	svc.CloseConn()
+	svc = service.NewWb(repo, tracer, newMemoryCache(t), service.DefaultPoolOptions(),
+		newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), noFlush())
+	_, err := svc.GetUn(ctx, "l1")
+	require.NoError(t, err)
+	svc.CloseConn()
+	require.Equal(t, 5, repoRedirs(t, repo, "u1", "l1"))
+}
+
+// userRepo - repo which counts reads of users
+type userRepo struct {
+	repository.RepoIf
+	reads atomic.Int64
+}
+
+func (r *userRepo) GetUser(uid string) (model.User, error) {
+	r.reads.Add(1)
+	return r.RepoIf.GetUser(uid)
+}
+
+func (r *userRepo) FindSuperUser() (string, error) {
+	r.reads.Add(1)
+	return r.RepoIf.FindSuperUser()
+}
+
+// profiles of users and suid are read from cache, payment flushes profiles, clicks are saved in background
+func TestServiceWbUsers(t *testing.T) {
+	ctx := context.Background()
+	repo := &userRepo{RepoIf: newRepo(t)}
+	svc := service.NewWb(repo, trace.NewNoopTracerProvider().Tracer("test"), newMemoryCache(t),
+		service.DefaultPoolOptions(), newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), noFlush())
+	defer svc.CloseConn()
+
+	uid, err := svc.PutUser(model.User{Name: "ann", Passwd: "123", Email: "ann@example.com", Role: "USER", Balance: money.MustParse("100.00")})
+	require.NoError(t, err)
+	suid, err := svc.PutUser(model.User{Name: "su", Passwd: "123", Email: "su@example.com", Role: "SUPERUSER"})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		user, err := svc.GetUser(uid)
+		require.NoError(t, err)
+		require.Equal(t, "USER", user.Role)
+		require.Empty(t, user.Passwd)
+		found, err := svc.FindSuperUser()
+		require.NoError(t, err)
+		require.Equal(t, suid, found)
+	}
+	require.Equal(t, int64(2), repo.reads.Load())
+
+	require.NoError(t, svc.PayUser(ctx, uid, suid, money.MustParse("10.00")))
+	user, err := svc.GetUser(uid)
+	require.NoError(t, err)
+	require.Equal(t, money.MustParse("90.00"), user.Balance)
+	require.Equal(t, int64(3), repo.reads.Load())
+
+	// role is changed by PutUser
+	_, err = svc.PutUser(model.User{Name: "ann", Email: "ann@example.com", Role: "CREATOR"})
+	require.NoError(t, err)
+	user, err = svc.GetUser(uid)
+	require.NoError(t, err)
+	require.Equal(t, "CREATOR", user.Role)
+
+	require.NoError(t, repo.Put(ctx, uid, "l1", link(uid, "l1"), false))
+	require.NoError(t, svc.AddClick(ctx, model.Click{Shorturl: "l1", Datetime: time.Now()}))
+	q := model.StatQuery{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}
+	require.Eventually(t, func() bool {
+		stats, err := svc.GetClickStats(ctx, uid, "l1", q)
+		return err == nil && stats.Total == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+// links of cache aside service
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	repo := newRepo(t)
+	svc := service.New(repo, newMemoryCache(t))
+
+	require.NoError(t, svc.Put(ctx, "u1", "l1", link("u1", "l1"), false))
+	items, err := svc.List(ctx, "u1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"l1"}, items)
+
+	require.NoError(t, repo.Put(ctx, "u1", "l2", link("u1", "l2"), false))
+	items, err = svc.List(ctx, "u1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"l1"}, items)
+
+	require.NoError(t, svc.Put(ctx, "u1", "l3", link("u1", "l3"), false))
+	items, err = svc.List(ctx, "u1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"l1", "l2", "l3"}, sorted(items))
+}
+
+// slowRepo - list of users 'slow*' waits for gate, of users 'broken*' fails
+type slowRepo struct {
+	repository.RepoIf
+	gate    chan struct{}
+	started chan string
+}
+
+func (r *slowRepo) List(ctx context.Context, uid string) ([]string, error) {
+	switch {
+	case strings.HasPrefix(uid, "slow"):
+		r.started <- uid
+		<-r.gate
+	case strings.HasPrefix(uid, "broken"):
+		return nil, errors.New("repo is broken")
+	}
+	return r.RepoIf.List(ctx, uid)
+}
+
+// newPoolService - service of pool of 1 worker and queue of 1 task, worker is busy with list of user 'slow0'
+func newPoolService(t *testing.T, policy string) (*service.ServiceWb, *slowRepo, chan error) {
+	repo := &slowRepo{RepoIf: newRepo(t), gate: make(chan struct{}), started: make(chan string, 10)}
+	opts := service.PoolOptions{Workers: 1, QueueSize: 1, Policy: policy}
+	if policy == service.PolicySpill {
+		opts.Spill = newSpill(t, filepath.Join(t.TempDir(), "pool.spill"))
+	}
+	svc := service.NewWb(repo, trace.NewNoopTracerProvider().Tracer("test"), newMemoryCache(t), opts,
+		newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), service.DefaultRedirOptions())
+
+	results := make(chan error, 10)
+	go func() {
+		_, err := svc.List(context.Background(), "slow0")
+		results <- err
+	}()
+	require.Equal(t, "slow0", <-repo.started)
+	// queue is full
+	go func() {
+		_, err := svc.List(context.Background(), "slow1")
+		results <- err
+	}()
+	require.Eventually(t, func() bool { return metric(t, svc, "weblinkmetrics_pool_queue_depth") == 1 }, time.Second, time.Millisecond)
+	return svc, repo, results
+}
+
+// metric - value of metric of service (count of histogram)
+func metric(t *testing.T, svc *service.ServiceWb, name string) float64 {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(svc.Collectors()...)
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	var value float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			switch {
+			case m.GetGauge() != nil:
+				value += m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				value += m.GetCounter().GetValue()
+			case m.GetHistogram() != nil:
+				value += float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return value
+}
+
+func TestPoolOptions(t *testing.T) {
+	require.NoError(t, service.DefaultPoolOptions().Validate())
+	require.Error(t, service.PoolOptions{Workers: 0, QueueSize: 1, Policy: service.PolicyBlock}.Validate())
+	require.Error(t, service.PoolOptions{Workers: 1, QueueSize: -1, Policy: service.PolicyBlock}.Validate())
+	require.Error(t, service.PoolOptions{Workers: 1, QueueSize: 1, Policy: "drop"}.Validate())
+	require.Error(t, service.PoolOptions{Workers: 1, QueueSize: 1, Policy: service.PolicySpill}.Validate())
+	require.NoError(t, service.PoolOptions{Workers: 1, QueueSize: 1, Policy: service.PolicySpill,
+		Spill: newSpill(t, filepath.Join(t.TempDir(), "pool.spill"))}.Validate())
+}
+
+// full queue: block waits for place until ctx is done, reject fails at once, spill keeps task in journal
+func TestPoolPolicies(t *testing.T) {
+	t.Run("block", func(t *testing.T) {
+		svc, repo, results := newPoolService(t, service.PolicyBlock)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+		defer cancel()
+		_, err := svc.List(ctx, "u1")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		go func() {
+			_, err := svc.List(context.Background(), "u1")
+			results <- err
+		}()
+		close(repo.gate)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, <-results)
+		}
+		svc.CloseConn()
+	})
+	t.Run("reject", func(t *testing.T) {
+		svc, repo, results := newPoolService(t, service.PolicyReject)
+		_, err := svc.List(context.Background(), "u1")
+		require.ErrorIs(t, err, service.ErrOverloaded)
+		require.Equal(t, float64(1), metric(t, svc, "weblinkmetrics_pool_tasks_rejected_total"))
+		close(repo.gate)
+		require.NoError(t, <-results)
+		require.NoError(t, <-results)
+		svc.CloseConn()
+	})
+	t.Run("spill", func(t *testing.T) {
+		svc, repo, results := newPoolService(t, service.PolicySpill)
+		go func() {
+			_, err := svc.List(context.Background(), "u1")
+			results <- err
+		}()
+		require.Eventually(t, func() bool { return metric(t, svc, "weblinkmetrics_pool_tasks_spilled_total") == 1 }, time.Second, time.Millisecond)
+		// background task does not wait for place
+		require.NoError(t, svc.AddClick(context.Background(), model.Click{Shorturl: "l1", Datetime: time.Now()}))
+		require.Equal(t, float64(2), metric(t, svc, "weblinkmetrics_pool_spill_depth"))
+
+		close(repo.gate)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, <-results)
+		}
+		svc.CloseConn()
+		require.Equal(t, float64(4), metric(t, svc, "weblinkmetrics_pool_task_seconds"))
+		require.Equal(t, float64(0), metric(t, svc, "weblinkmetrics_pool_spill_depth"))
+	})
+}
+
+// background tasks spilled by previous run are done after restart, the ones of gone producers are dropped
+func TestPoolSpillRestart(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "pool.spill")
+	spill := newSpill(t, name)
+	click, err := json.Marshal(model.Click{Shorturl: "l1", Datetime: time.Now()})
+	require.NoError(t, err)
+	_, err = spill.Push("click", click, true)
+	require.NoError(t, err)
+	_, err = spill.Push("list", json.RawMessage(`"u1"`), false)
+	require.NoError(t, err)
+	_, err = spill.Push("unknown", json.RawMessage(`1`), true)
+	require.NoError(t, err)
+	require.NoError(t, spill.Close())
+
+	ctx := context.Background()
+	repo := newRepo(t)
+	require.NoError(t, repo.Put(ctx, "u1", "l1", link("u1", "l1"), false))
+	svc := service.NewWb(repo, trace.NewNoopTracerProvider().Tracer("test"), newMemoryCache(t),
+		service.PoolOptions{Workers: 1, QueueSize: 1, Policy: service.PolicySpill, Spill: newSpill(t, name)},
+		newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), noFlush())
+	q := model.StatQuery{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}
+	require.Eventually(t, func() bool {
+		stats, err := svc.GetClickStats(ctx, "u1", "l1", q)
+		return err == nil && stats.Total == 1
+	}, time.Second, 5*time.Millisecond)
+	svc.CloseConn()
+	require.Equal(t, float64(1), metric(t, svc, "weblinkmetrics_pool_task_seconds"))
+
+	spill = newSpill(t, name)
+	defer spill.Close()
+	require.Zero(t, spill.Pending())
+}
+
+// tasks in queue are done before CloseConn returns, new ones fail
+func TestPoolDrain(t *testing.T) {
+	svc, repo, results := newPoolService(t, service.PolicyBlock)
+	closed := make(chan struct{})
+	go func() {
+		svc.CloseConn()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("pool is closed with busy worker")
+	case <-time.After(30 * time.Millisecond):
+	}
+	close(repo.gate)
+	<-closed
+	require.NoError(t, <-results)
+	require.NoError(t, <-results)
+	_, err := svc.List(context.Background(), "u1")
+	require.ErrorIs(t, err, service.ErrPoolClosed)
+
+	require.Equal(t, float64(2), metric(t, svc, "weblinkmetrics_pool_task_seconds"))
+	require.Equal(t, float64(0), metric(t, svc, "weblinkmetrics_pool_queue_depth"))
+}
+
+func TestPoolFailures(t *testing.T) {
+	repo := &slowRepo{RepoIf: newRepo(t)}
+	svc := service.NewWb(repo, trace.NewNoopTracerProvider().Tracer("test"), newMemoryCache(t),
+		service.DefaultPoolOptions(), newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), service.DefaultRedirOptions())
+	defer svc.CloseConn()
+	_, err := svc.List(context.Background(), "broken1")
+	require.Error(t, err)
+	_, err = svc.List(context.Background(), "u1")
+	require.NoError(t, err)
+	require.Equal(t, float64(1), metric(t, svc, "weblinkmetrics_pool_tasks_failed_total"))
+	require.Equal(t, float64(1), metric(t, svc, "weblinkmetrics_pool_task_retries_total"))
+	require.Equal(t, float64(2), metric(t, svc, "weblinkmetrics_pool_task_seconds"))
+	require.Equal(t, float64(0), metric(t, svc, "weblinkmetrics_writeback_pending"))
+}
+
+func TestRegister(t *testing.T) {
+	tasks := service.NewRegistry(trace.NewNoopTracerProvider().Tracer("test"))
+	run := func(ctx context.Context, n int) (int, error) { return n, nil }
+	_, err := service.Register(tasks, service.TaskDef[int, int]{Name: "warmup", Timeout: time.Second, Run: run})
+	require.NoError(t, err)
+	_, err = service.Register(tasks, service.TaskDef[string, bool]{Name: "flush", Retry: service.RetryPolicy{Attempts: 3},
+		Run: func(ctx context.Context, s string) (bool, error) { return true, nil }})
+	require.NoError(t, err)
+
+	_, err = service.Register(tasks, service.TaskDef[int, int]{Name: "warmup", Run: run})
+	require.Error(t, err)
+	_, err = service.Register(tasks, service.TaskDef[int, int]{Name: "nojob"})
+	require.Error(t, err)
+	_, err = service.Register(tasks, service.TaskDef[int, int]{Name: "timeout", Timeout: -1, Run: run})
+	require.Error(t, err)
+	require.Equal(t, []service.TaskInfo{
+		{Name: "flush", Attempts: 3},
+		{Name: "warmup", Timeout: time.Second, Attempts: 1},
+	}, tasks.Types())
+}
+
+// task of registered type gets own timeout of attempt and retries
+func TestTaskRetries(t *testing.T) {
+	svc := service.NewWb(newRepo(t), trace.NewNoopTracerProvider().Tracer("test"), newMemoryCache(t),
+		service.DefaultPoolOptions(), newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), service.DefaultRedirOptions())
+	defer svc.CloseConn()
+	ctx := context.Background()
+	errFatal := errors.New("fatal")
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	flaky, err := service.Register(svc.Tasks(), service.TaskDef[string, string]{
+		Name:    "flaky",
+		Timeout: 20 * time.Millisecond,
+		Retry: service.RetryPolicy{Attempts: 3, Delay: time.Millisecond,
+			Retryable: func(err error) bool { return !errors.Is(err, errFatal) }},
+		Run: func(ctx context.Context, arg string) (string, error) {
+			mu.Lock()
+			attempts[arg]++
+			n := attempts[arg]
+			mu.Unlock()
+			switch {
+			case arg == "fatal":
+				return "", errFatal
+			case arg == "slow":
+				<-ctx.Done()
+				return "", ctx.Err()
+			case n < 3:
+				return "", errors.New("try again")
+			}
+			return "ok " + arg, nil
+		},
+	})
+	require.NoError(t, err)
+
+	res, err := service.Submit(ctx, svc.Pool(), flaky, "a")
+	require.NoError(t, err)
+	require.Equal(t, "ok a", res)
+	_, err = service.Submit(ctx, svc.Pool(), flaky, "fatal")
+	require.ErrorIs(t, err, errFatal)
+	_, err = service.Submit(ctx, svc.Pool(), flaky, "slow")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	mu.Lock()
+	require.Equal(t, map[string]int{"a": 3, "fatal": 1, "slow": 3}, attempts)
+	mu.Unlock()
+	require.Equal(t, float64(4), metric(t, svc, "weblinkmetrics_pool_task_retries_total"))
+	require.Equal(t, float64(2), metric(t, svc, "weblinkmetrics_pool_tasks_failed_total"))
+}
+
+// background task is done after request is over
+func TestEnqueue(t *testing.T) {
+	svc := service.NewWb(newRepo(t), trace.NewNoopTracerProvider().Tracer("test"), newMemoryCache(t),
+		service.DefaultPoolOptions(), newJournal(t, filepath.Join(t.TempDir(), "wb.journal")), service.DefaultRedirOptions())
+	done := make(chan string, 1)
+	hook, err := service.Register(svc.Tasks(), service.TaskDef[string, struct{}]{
+		Name: "webhook",
+		Run: func(ctx context.Context, url string) (struct{}, error) {
+			time.Sleep(10 * time.Millisecond)
+			if err := ctx.Err(); err != nil {
+				return struct{}{}, err
+			}
+			done <- url
+			return struct{}{}, nil
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, service.Enqueue(ctx, svc.Pool(), hook, "https://example.com/hook"))
+	cancel()
+	// task in queue is done before pool is closed
+	svc.CloseConn()
+	require.Equal(t, "https://example.com/hook", <-done)
+	require.ErrorIs(t, service.Enqueue(context.Background(), svc.Pool(), hook, "late"), service.ErrPoolClosed)
+}
+
+// full queue: producer of background task waits for place only until its ctx is done
+func TestEnqueueBlock(t *testing.T) {
+	svc, repo, results := newPoolService(t, service.PolicyBlock)
+	noop, err := service.Register(svc.Tasks(), service.TaskDef[string, struct{}]{
+		Name: "noop",
+		Run:  func(ctx context.Context, arg string) (struct{}, error) { return struct{}{}, nil },
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, service.Enqueue(ctx, svc.Pool(), noop, "click"), context.Canceled)
+	require.ErrorIs(t, svc.AddClick(ctx, model.Click{Shorturl: "short1", Datetime: time.Now()}), context.Canceled)
+
+	close(repo.gate)
+	require.NoError(t, <-results)
+	require.NoError(t, <-results)
+	svc.CloseConn()
+}
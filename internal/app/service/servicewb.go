@@ -2,21 +2,29 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
 
-	"github.com/go-redis/cache/v8"
-	"github.com/go-redis/redis/v8"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/cache"
 
 	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/redirs"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/writeback"
 )
 
+// writeBackTimeout - timeout of one write of link to repo
+const writeBackTimeout = 10 * time.Second
+
 // repo имеет тип интерфейс
 // cервисный интерфейс позволяет кешировать хранилище
 type cachedwbrepo interface {
@@ -29,97 +37,266 @@ type cachedwbrepo interface {
 	DelUser(uid string) error
 	GetUser(uid string) (model.User, error)
 	WhoAmI() uint64
-	PayUser(ctx context.Context, uidA, uidB, amount string) error
+	PayUser(ctx context.Context, uidA, uidB string, amount money.Amount) error
 	FindSuperUser() (string, error)
+	FindUserByEmail(email string) (string, error)
 	GetAll(ctx context.Context, uid string) (model.Data, error)
 	AuthUser(user model.User) (string, error)
 	GetAllUsers() (model.Users, error)
+	AddClick(ctx context.Context, click model.Click) error
+	GetClickStats(ctx context.Context, uid, shortlink string, q model.StatQuery) (model.ClickStats, error)
+	SweepExpired(ctx context.Context, now time.Time) ([]model.DataEl, error)
+	GetShort(ctx context.Context, shortlink string) (model.DataEl, error)
+	GetUnPersonal(ctx context.Context, uid, shortlink string) (string, error)
+	PutSession(ctx context.Context, session model.Session) error
+	RotateSession(ctx context.Context, sid, oldJTI, newJTI string, expiresAt time.Time) error
+	ListSessions(ctx context.Context, uid string) ([]model.Session, error)
+	RevokeSession(ctx context.Context, uid, sid string) error
+	PurgeSessions(ctx context.Context, now time.Time) (int, error)
+	PutAPIKey(ctx context.Context, key model.APIKey) error
+	AuthAPIKey(ctx context.Context, key string) (model.APIKey, error)
+	ListAPIKeys(ctx context.Context, uid string) ([]model.APIKey, error)
+	RevokeAPIKey(ctx context.Context, uid, id string) error
+	PutIdentity(ctx context.Context, identity model.Identity) error
+	FindIdentity(ctx context.Context, issuer, subject string) (string, error)
+	ListIdentities(ctx context.Context, uid string) ([]model.Identity, error)
+	AddRedirs(ctx context.Context, batch string, redirs []model.LinkRedirs) error
 }
 
 // ServiceWb - интерфейс кеша с Writeback
+// RedirectTTL, NegativeTTL - time to keep resolved and unknown shortlinks in cache (see redirect),
+// UserTTL, SessionTTL - time to keep profiles and alive sessions of users (see users), they are set before service is used
 type ServiceWb struct {
-	repo       cachedwbrepo //repo
-	cacheWb    *cache.Cache //основной как бы репозиторий
-	workers    []*Worker    // cache workers - ждут Task из канал Qin и делают его что там надо сделать
-	Qin        chan *Task
-	qbroker    *QBroker // one cache broker - диспетчер очереди Qin - формирует Task и кладет его в Qin
-	ctx        context.Context
-	cancelFunc context.CancelFunc
-	tracer     trace.Tracer
-}
-
-// NewWb - конструктор ServiceWb
-func NewWb(repo cachedwbrepo, tracer trace.Tracer) *ServiceWb {
-	// connect to redis server
-	rdb := redis.NewClient(&redis.Options{
-		Addr: "192.168.1.204:6379", Password: "", // no password set
-		DB: 0, // use default DB
-	})
-	repcache := cache.New(&cache.Options{
-		Redis:      rdb,
-		LocalCache: cache.NewTinyLFU(1000, time.Minute),
-	})
-	log.Printf("redis is connected")
+	repo        cachedwbrepo //repo
+	cacheWb     cache.Cache  //основной как бы репозиторий
+	workers     []*Worker    // cache workers - ждут Task из канал Qin и делают его что там надо сделать
+	Qin         chan Task
+	qbroker     *QBroker  // one cache broker - диспетчер очереди Qin - кладет Task в Qin
+	tasks       *Registry // types of tasks of workers
+	listTask    *TaskType[string, []string]
+	flushTask   *TaskType[struct{}, int]
+	clickTask   *TaskType[model.Click, struct{}]
+	redirects   *prometheus.CounterVec
+	counts      redirs.Store // opens of links which are not yet added to repo
+	flusher     sync.WaitGroup
+	stopFlush   chan struct{}
+	journal     *writeback.Journal // pending writes of links - пишутся в repo писателями
+	writers     sync.WaitGroup
+	ctx         context.Context
+	cancelFunc  context.CancelFunc
+	tracer      trace.Tracer
+	RedirectTTL time.Duration
+	NegativeTTL time.Duration
+	UserTTL     time.Duration
+	SessionTTL  time.Duration
+}
+
+// NewWb - конструктор ServiceWb, repcache - cache (redis or in-process), pool - cache workers and queue of them,
+// pool.Workers is also number of writers of journal to repo, journal is closed by CloseConn,
+// counts - counters of opens of links and how often they are flushed to repo
+func NewWb(repo cachedwbrepo, tracer trace.Tracer, repcache cache.Cache, pool PoolOptions, journal *writeback.Journal, counts RedirOptions) *ServiceWb {
+	if err := pool.Validate(); err != nil {
+		log.Printf("service/NewWb: %v, default pool is used", err)
+		pool = DefaultPoolOptions()
+	}
+	if counts.Store == nil || counts.FlushInterval <= 0 {
+		log.Printf("service/NewWb: counters of opens %T are flushed every %v, default ones are used", counts.Store, counts.FlushInterval)
+		counts = DefaultRedirOptions()
+	}
 
 	//init cache workers
-	nWorkers := 2
-	Qin := make(chan *Task)
-	qbroker := &QBroker{Qin}
+	qbroker := newQBroker(pool)
+	tasks := NewRegistry(tracer)
 
 	var workers []*Worker
-	for i := 0; i < nWorkers; i++ {
-		worker := NewWorker(i, Qin)
+	for i := 0; i < pool.Workers; i++ {
+		worker := NewWorker(i, qbroker.Qin, &qbroker.workers)
 		workers = append(workers, worker)
 	}
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 
 	servicewb := &ServiceWb{
-		repo:       repo,
-		cacheWb:    repcache,
-		workers:    workers,
-		Qin:        Qin,
-		qbroker:    qbroker,
-		ctx:        ctx,
-		cancelFunc: cancelFunc,
-		tracer:     tracer,
+		repo:        repo,
+		cacheWb:     repcache,
+		workers:     workers,
+		Qin:         qbroker.Qin,
+		qbroker:     qbroker,
+		tasks:       tasks,
+		redirects:   newRedirectMetrics(),
+		counts:      counts.Store,
+		stopFlush:   make(chan struct{}),
+		journal:     journal,
+		ctx:         ctx,
+		cancelFunc:  cancelFunc,
+		tracer:      tracer,
+		RedirectTTL: DefaultRedirectTTL,
+		NegativeTTL: DefaultNegativeTTL,
+		UserTTL:     DefaultUserTTL,
+		SessionTTL:  DefaultSessionTTL,
 	}
 
-	// start workers (to work along with the cache)
+	// list of user links from repo to cache, read is retried once
+	servicewb.listTask, _ = Register(tasks, TaskDef[string, []string]{
+		Name:    "list",
+		Timeout: 10 * time.Second,
+		Retry:   RetryPolicy{Attempts: 2, Delay: 100 * time.Millisecond},
+		Run:     servicewb.listToCache,
+	})
+	// opens of links to repo, batch is added once, so flush is retried
+	servicewb.flushTask, _ = Register(tasks, TaskDef[struct{}, int]{
+		Name:    "flush_redirs",
+		Timeout: flushTimeout,
+		Retry:   RetryPolicy{Attempts: 3, Delay: 200 * time.Millisecond, MaxDelay: time.Second},
+		Run:     servicewb.flushRedirs,
+	})
+	// click of open to repo, request is not waiting for it
+	servicewb.clickTask, _ = Register(tasks, TaskDef[model.Click, struct{}]{
+		Name:    "click",
+		Timeout: 10 * time.Second,
+		Retry:   RetryPolicy{Attempts: 2, Delay: 100 * time.Millisecond},
+		Run:     servicewb.saveClick,
+	})
+
+	// start workers (to work along with the cache), spilled tasks of previous run are done by types registered above
 	for _, worker := range workers {
-		go worker.ProcessQ(ctx, servicewb)
+		go worker.ProcessQ(qbroker)
+	}
+	qbroker.startDrain(tasks)
+	// start writers of pending links, they work on ctx of service, not on ctx of request
+	for i := 0; i < pool.Workers; i++ {
+		servicewb.writers.Add(1)
+		go servicewb.writeBack(i)
 	}
+	servicewb.flusher.Add(1)
+	go servicewb.flushLoop(counts.FlushInterval)
 
 	return servicewb
 }
 
+// Tasks - types of tasks of worker pool, new ones are added by Register
+func (s *ServiceWb) Tasks() *Registry {
+	return s.tasks
+}
+
+// Pool - worker pool, tasks are put to it by Submit and Enqueue
+func (s *ServiceWb) Pool() *QBroker {
+	return s.qbroker
+}
+
+// Collectors - prometheus metrics of worker pool, of write back journal and of cache of opens
+func (s *ServiceWb) Collectors() []prometheus.Collector {
+	return append(s.qbroker.collectors(), s.redirects,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "writeback_pending",
+			Help:      "The number of links which are not yet written to repo",
+		}, func() float64 { return float64(s.journal.Pending()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "writeback_dead_letters",
+			Help:      "The number of links which were not written to repo after all attempts",
+		}, func() float64 { return float64(len(s.journal.DeadLetters())) }),
+	)
+}
+
+// writeBack - writer takes pending writes from journal and puts them to repo until service is closed
+// failed write is retried by journal later, after max attempts it is dead letter (at once, if error is permanent)
+func (s *ServiceWb) writeBack(id int) {
+	defer s.writers.Done()
+	for {
+		write, err := s.journal.Next(s.ctx)
+		if err != nil {
+			log.Printf("writer id = %d finished: %v", id, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, writeBackTimeout)
+		err = s.repo.Put(ctx, write.UID, write.Key, write.Value, write.SU)
+		cancel()
+
+		switch {
+		case err == nil:
+			if err = s.journal.Done(write); err != nil {
+				log.Printf("service/writeBack: journal err: %v", err)
+			}
+			log.Printf("writer %d put link %s to repo (version %d)", id, write.ID, write.Version)
+			s.flushCache(s.ctx, fmt.Sprintf("uid_LIST:%s", write.UID))
+			s.flushCache(s.ctx, "uid_GETALL:")
+			// open may be cached from repo before link is written
+			s.flushRedirect(s.ctx, write.UID, write.Key)
+		case s.ctx.Err() != nil:
+			// service is stopping, write is pending in journal for next run
+			s.journal.Release(write)
+		case permanentErr(err):
+			dead, errJ := s.journal.Reject(write, err)
+			if errJ != nil {
+				log.Printf("service/writeBack: journal err: %v", errJ)
+			}
+			if dead {
+				log.Printf("service/writeBack: link %s is dead letter, it can not be put to repo: %v", write.ID, err)
+			}
+		default:
+			dead, errJ := s.journal.Fail(write, err)
+			if errJ != nil {
+				log.Printf("service/writeBack: journal err: %v", errJ)
+			}
+			if dead {
+				log.Printf("service/writeBack: link %s is dead letter after %d attempts: %v", write.ID, write.Attempts+1, err)
+			} else {
+				log.Printf("service/writeBack: put link %s to repo err: %v, will retry", write.ID, err)
+			}
+		}
+	}
+}
+
+// permanentErr - put to repo failed with err would fail every time, so it is not retried
+func permanentErr(err error) bool {
+	return errors.Is(err, repository.ErrShortlinkTaken)
+}
+
+// DeadLetters - writes of links which were not put to repo after all attempts
+func (s *ServiceWb) DeadLetters() []writeback.Write {
+	return s.journal.DeadLetters()
+}
+
+// Requeue - dead write of id (uid:shortlink) is tried again
+func (s *ServiceWb) Requeue(id string) error {
+	return s.journal.Requeue(id)
+}
+
 // New stub method
 func (s *ServiceWb) New(ctx context.Context, filename string, tracer trace.Tracer) repository.RepoIf {
 	panic("implement me")
 }
 
 // Get - when get from storage
+// opens of link which are not yet flushed are added to its redirs
 func (s *ServiceWb) Get(ctx context.Context, uid, key string, su bool) (model.DataEl, error) {
 	value, err := s.repo.Get(ctx, uid, key, su)
 	if err != nil {
 		log.Printf("service/Get: get from repo err: %v", err)
 		return model.DataEl{}, err
 	}
+	value.Redirs += s.pendingRedirs(ctx, value)
 	return value, nil
 }
 
 // Put - when put to storage
-// writes to cache, then worker puts it from cache to repo
+// writes to journal, then writer puts it from journal to repo
 func (s *ServiceWb) Put(ctx context.Context, uid, key string, value model.DataEl, su bool) error {
 
-	//put item to cache
-	cachekey := fmt.Sprintf("uid_PUT:%s", uid)
-	err := s.cacheWb.Set(&cache.Item{
-		Ctx:   ctx,
-		Key:   cachekey,
-		Value: value,
-		TTL:   time.Hour,
-	})
+	// repo is written later by worker, so global shortlink of other user is checked here,
+	// pending writes of it are checked by journal
+	if !value.Personal {
+		owner, err := s.repo.GetShort(ctx, value.Shorturl)
+		if err != nil {
+			log.Printf("service/Put: get from repo err: %v", err)
+			return err
+		}
+		if owner.Shorturl != "" && owner.UID != value.UID {
+			return repository.ErrShortlinkTaken
+		}
+	}
 
 	//span, ctx := opentracing.StartSpanFromContextWithTracer(ctx, s.tracer, "wb.uid_PUT:")
 	//defer span.Finish()
@@ -127,13 +304,16 @@ func (s *ServiceWb) Put(ctx context.Context, uid, key string, value model.DataEl
 	ctx, span := s.tracer.Start(ctx, "wb.uid_PUT:")
 	defer span.End()
 
-	if err != nil {
-		log.Printf("items (getall) for %s cannot be put to cache: err: %v", uid, err)
+	//put item to journal, pending write of the same link is replaced
+	if err := s.journal.Queue(uid, key, value, su); err != nil {
+		if errors.Is(err, writeback.ErrShortlinkPending) {
+			return repository.ErrShortlinkTaken
+		}
+		log.Printf("link %s of %s cannot be put to journal: err: %v", key, uid, err)
 		return err
 	}
-	//make worker put value from cache to database acync
-	s.qbroker.ProduceWr(ctx, uid, key, su)
-	log.Printf("soon will put data to repo...by some worker (executed ProduceWr) uid=%s ", uid)
+	log.Printf("soon will put data to repo...by some writer uid=%s key=%s", uid, key)
+	s.flushRedirect(ctx, uid, key)
 
 	span.AddEvent("wb.uid_PUT:", trace.WithAttributes(
 		attribute.String("cache write behind to repo task started", uid),
@@ -146,23 +326,29 @@ func (s *ServiceWb) Put(ctx context.Context, uid, key string, value model.DataEl
 }
 
 // flushCache - when db updated flush cache with key uid_LIST or uid_GETALL as key
+// key is deleted even if it is not in cache of this instance, as other instances may keep it
 func (s *ServiceWb) flushCache(ctx context.Context, key string) {
-	if s.cacheWb.Exists(ctx, key) {
-		err := s.cacheWb.Delete(ctx, key)
-		if err != nil {
-			log.Printf("service/flushcache: del cache err: %v", err)
-		}
-		log.Printf("cache for key %s is deleted", key)
+	if err := s.cacheWb.Delete(ctx, key); err != nil {
+		log.Printf("service/flushcache: del cache err: %v", err)
+		return
 	}
+	log.Printf("cache for key %s is deleted", key)
 }
 
 // Del when delete from storage
 func (s *ServiceWb) Del(ctx context.Context, uid, key string, su bool) (string, error) {
-	uid, err := s.repo.Del(ctx, uid, key, su)
+	// pending write of link is not put to repo after delete, write which is being put is waited for
+	if err := s.journal.Cancel(ctx, uid, key); err != nil {
+		log.Printf("service/Del: journal err: %v", err)
+		return "", err
+	}
+	owner, err := s.repo.Del(ctx, uid, key, su)
 	if err != nil {
 		log.Printf("service/Del: del repo err: %v", err)
 		return "", err
 	}
+	s.flushRedirect(ctx, uid, key)
+	uid = owner
 	//flush List key
 	key = fmt.Sprintf("uid_LIST:%s", uid)
 	s.flushCache(ctx, key)
@@ -193,9 +379,9 @@ func (s *ServiceWb) List(ctx context.Context, uid string) ([]string, error) {
 		return items, nil
 	}
 
-	items, err := s.qbroker.Produce(ctx, uid, key)
+	items, err := Submit(ctx, s.qbroker, s.listTask, uid)
 	if err == nil {
-		log.Printf("getting data from repo... by some worker (executed Produce) uid=%s \n", uid)
+		log.Printf("getting data from repo... by some worker (list task) uid=%s \n", uid)
 		span.AddEvent("wb.uid_LIST:", trace.WithAttributes(
 			attribute.String("items (uid_LIST) are absent in cache and taken from repo", uid),
 		))
@@ -208,6 +394,22 @@ func (s *ServiceWb) List(ctx context.Context, uid string) ([]string, error) {
 	return nil, err
 }
 
+// listToCache - job of list task: list of user links from repo, it is put to cache
+func (s *ServiceWb) listToCache(ctx context.Context, uid string) ([]string, error) {
+	dbitems, err := s.repo.List(ctx, uid)
+	if err != nil {
+		log.Printf("service/List: get from repo err: %v", err)
+		return nil, err
+	}
+	if err = s.cacheWb.Set(ctx, fmt.Sprintf("uid_LIST:%s", uid), dbitems, time.Hour); err != nil {
+		// items are from repo anyway, next List reads repo again
+		log.Printf("items for %s cannot be put to cache: err: %v", uid, err)
+	} else {
+		log.Printf("took data for uid = %s from repo to cache successfully \n", uid)
+	}
+	return dbitems, nil
+}
+
 // GetAll - get all links in db (only in pg mode)
 func (s *ServiceWb) GetAll(ctx context.Context, uid string) (model.Data, error) {
 
@@ -240,17 +442,12 @@ func (s *ServiceWb) GetAll(ctx context.Context, uid string) (model.Data, error)
 		return model.Data{}, err1
 	}
 
-	err := s.cacheWb.Set(&cache.Item{
-		Ctx:   ctx,
-		Key:   key,
-		Value: dbitems,
-		TTL:   time.Hour,
-	})
+	err := s.cacheWb.Set(ctx, key, dbitems, time.Hour)
 	if err != nil {
 		log.Printf("items (uid_GETALL:) for %s cannot be put to cache: err: %v", uid, err)
 	}
 
-	if err2 == cache.ErrCacheMiss {
+	if errors.Is(err2, cache.ErrCacheMiss) {
 		log.Printf("items (uid_GETALL:) for %s are absent in cache and taken from repo", uid)
 		span.AddEvent("wb.uid_GETALL:", trace.WithAttributes(
 			attribute.String("items are absent in cache and taken from repo", uid),
@@ -264,22 +461,41 @@ func (s *ServiceWb) GetAll(ctx context.Context, uid string) (model.Data, error)
 }
 
 // GetUn - get unique link unanimously from storage
-// when open link it increases counter as well and makes payment for opening
+// when open link it increases counter as well (counters are added to repo in batches)
+// link is taken from cache of opens when it is there (see redirect)
 func (s *ServiceWb) GetUn(ctx context.Context, shortlink string) (string, error) {
-	value, err := s.repo.GetUn(ctx, shortlink)
+	value, err := s.open(ctx, openRef{Shortlink: shortlink})
 	if err != nil {
 		log.Printf("service/GetUn: from repo err: %v", err)
 		return "", err
 	}
-	//will remove only cache for uid_GETALL:
-	s.flushCache(ctx, "uid_GETALL:")
 	return value, nil
 }
 
-// CloseConn - stub method
+// GetUnPersonal - open personal link of user uid, the same as GetUn
+func (s *ServiceWb) GetUnPersonal(ctx context.Context, uid, shortlink string) (string, error) {
+	value, err := s.open(ctx, openRef{UID: uid, Shortlink: shortlink, Personal: true})
+	if err != nil {
+		log.Printf("service/GetUnPersonal: from repo err: %v", err)
+		return "", err
+	}
+	return value, nil
+}
+
+// CloseConn - stop workers (tasks in queue are done first) and writers, pending writes stay in journal for next run
 func (s *ServiceWb) CloseConn() {
+	close(s.stopFlush)
+	s.flusher.Wait()
+	s.qbroker.Close()
+	// last opens are flushed here, as pool does not take tasks any more
+	if res := s.flushTask.run(context.Background(), struct{}{}, s.qbroker); res.ResultError != nil {
+		log.Printf("service/CloseConn: opens are not added to repo: %v", res.ResultError)
+	}
 	s.cancelFunc()
-	close(s.Qin)
+	s.writers.Wait()
+	if err := s.journal.Close(); err != nil {
+		log.Printf("service/CloseConn: journal close err: %v", err)
+	}
 }
 
 // PutUser - register new or update user
@@ -289,6 +505,7 @@ func (s *ServiceWb) PutUser(value model.User) (string, error) {
 		log.Printf("service/PutUser: putuser repo err: %v", err)
 		return "", err
 	}
+	s.flushUsers(context.Background(), val)
 	return val, nil
 }
 
@@ -298,16 +515,25 @@ func (s *ServiceWb) DelUser(uid string) error {
 		log.Printf("service/UserDel: userdel repo err: %v", err)
 		return err
 	}
+	s.flushUsers(context.Background(), uid)
+	s.flushCache(context.Background(), sessionsKey(uid))
 	return nil
 }
 
 // GetUser - when get user profile
+// profile is from cache when it is there, hash of passwd is not given (it is checked by AuthUser only)
 func (s *ServiceWb) GetUser(uid string) (model.User, error) {
+	ctx := context.Background()
+	if value, ok := s.cachedUser(ctx, uid); ok {
+		return value, nil
+	}
 	value, err := s.repo.GetUser(uid)
 	if err != nil {
 		log.Printf("service/GetUser: getuser from repo err: %v", err)
 		return model.User{}, err
 	}
+	value.Passwd = ""
+	s.cacheUser(ctx, userKey(uid), value)
 	return value, nil
 }
 
@@ -317,21 +543,32 @@ func (s *ServiceWb) WhoAmI() uint64 {
 }
 
 // PayUser - payment one user to another (tx)
-func (s *ServiceWb) PayUser(ctx context.Context, uidA, uidB, amount string) error {
+func (s *ServiceWb) PayUser(ctx context.Context, uidA, uidB string, amount money.Amount) error {
 	if err := s.repo.PayUser(ctx, uidA, uidB, amount); err != nil {
 		log.Printf("service/PayUser: payuser repo err: %v", err)
 		return err
 	}
+	// balances are changed
+	s.flushCache(ctx, userKey(uidA))
+	s.flushCache(ctx, userKey(uidB))
 	return nil
 }
 
-// FindSuperUser - find who is su (get suid)
+// FindSuperUser - find who is su (get suid), it is from cache when it is there
 func (s *ServiceWb) FindSuperUser() (string, error) {
+	ctx := context.Background()
+	var value string
+	if s.UserTTL > 0 && s.cacheWb.Get(ctx, suidKey, &value) == nil {
+		return value, nil
+	}
 	value, err := s.repo.FindSuperUser()
 	if err != nil {
 		log.Printf("service/FindSU: find su repo err: %v", err)
 		return "", err
 	}
+	if value != "" {
+		s.cacheUser(ctx, suidKey, value)
+	}
 	return value, nil
 }
 
@@ -354,3 +591,198 @@ func (s *ServiceWb) GetAllUsers() (model.Users, error) {
 	}
 	return value, nil
 }
+
+// AddClick - save event of link opening, it is saved by click task of pool later
+func (s *ServiceWb) AddClick(ctx context.Context, click model.Click) error {
+	if err := Enqueue(ctx, s.qbroker, s.clickTask, click); err != nil {
+		log.Printf("service/AddClick: click of %s is not queued: %v", click.Shorturl, err)
+		return err
+	}
+	return nil
+}
+
+// GetClickStats - stats of link opening
+func (s *ServiceWb) GetClickStats(ctx context.Context, uid, shortlink string, q model.StatQuery) (model.ClickStats, error) {
+	value, err := s.repo.GetClickStats(ctx, uid, shortlink, q)
+	if err != nil {
+		log.Printf("service/GetClickStats: repo err: %v", err)
+		return model.ClickStats{}, err
+	}
+	return value, nil
+}
+
+// SweepExpired - mark expired links inactive and flush cached lists of their owners
+func (s *ServiceWb) SweepExpired(ctx context.Context, now time.Time) ([]model.DataEl, error) {
+	swept, err := s.repo.SweepExpired(ctx, now)
+	if err != nil {
+		log.Printf("service/SweepExpired: repo err: %v", err)
+	}
+	for _, datael := range swept {
+		s.flushCache(ctx, fmt.Sprintf("uid_LIST:%s", datael.UID))
+		s.flushRedirect(ctx, datael.UID, datael.Shorturl)
+	}
+	if len(swept) > 0 {
+		s.flushCache(ctx, "uid_GETALL:")
+	}
+	return swept, err
+}
+
+// GetShort - find link by shortlink whoever owns it
+func (s *ServiceWb) GetShort(ctx context.Context, shortlink string) (model.DataEl, error) {
+	value, err := s.repo.GetShort(ctx, shortlink)
+	if err != nil {
+		log.Printf("service/GetShort: repo err: %v", err)
+		return model.DataEl{}, err
+	}
+	return value, nil
+}
+
+// AddRedirs - add batch of opens to links in repo, batch which is added already is ignored
+func (s *ServiceWb) AddRedirs(ctx context.Context, batch string, redirs []model.LinkRedirs) error {
+	if err := s.repo.AddRedirs(ctx, batch, redirs); err != nil {
+		log.Printf("service/AddRedirs: repo err: %v", err)
+		return err
+	}
+	s.flushCache(ctx, "uid_GETALL:")
+	return nil
+}
+
+// PutSession - save new login session
+func (s *ServiceWb) PutSession(ctx context.Context, session model.Session) error {
+	if err := s.repo.PutSession(ctx, session); err != nil {
+		log.Printf("service/PutSession: repo err: %v", err)
+		return err
+	}
+	s.flushCache(ctx, sessionsKey(session.UID))
+	return nil
+}
+
+// RotateSession - change refresh token of session
+func (s *ServiceWb) RotateSession(ctx context.Context, sid, oldJTI, newJTI string, expiresAt time.Time) error {
+	if err := s.repo.RotateSession(ctx, sid, oldJTI, newJTI, expiresAt); err != nil {
+		log.Printf("service/RotateSession: repo err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// ListSessions - alive sessions of user, they are from cache when they are there
+// (middleware checks session of every access token by them), jti of refresh token is not given
+func (s *ServiceWb) ListSessions(ctx context.Context, uid string) ([]model.Session, error) {
+	key := sessionsKey(uid)
+	var value []model.Session
+	if s.SessionTTL > 0 && s.cacheWb.Get(ctx, key, &value) == nil {
+		return value, nil
+	}
+	value, err := s.repo.ListSessions(ctx, uid)
+	if err != nil {
+		log.Printf("service/ListSessions: repo err: %v", err)
+		return nil, err
+	}
+	for i := range value {
+		value[i].JTI = ""
+	}
+	if s.SessionTTL > 0 {
+		if err = s.cacheWb.Set(ctx, key, value, s.SessionTTL); err != nil {
+			log.Printf("service/ListSessions: sessions of %s cannot be put to cache: err: %v", uid, err)
+		}
+	}
+	return value, nil
+}
+
+// RevokeSession - kill session of user
+func (s *ServiceWb) RevokeSession(ctx context.Context, uid, sid string) error {
+	if err := s.repo.RevokeSession(ctx, uid, sid); err != nil {
+		log.Printf("service/RevokeSession: repo err: %v", err)
+		return err
+	}
+	s.flushCache(ctx, sessionsKey(uid))
+	return nil
+}
+
+// PurgeSessions - forget revoked and expired sessions, they are not in cached lists anyway
+func (s *ServiceWb) PurgeSessions(ctx context.Context, now time.Time) (int, error) {
+	value, err := s.repo.PurgeSessions(ctx, now)
+	if err != nil {
+		log.Printf("service/PurgeSessions: repo err: %v", err)
+		return 0, err
+	}
+	return value, nil
+}
+
+// PutAPIKey - save new api key of user
+func (s *ServiceWb) PutAPIKey(ctx context.Context, key model.APIKey) error {
+	if err := s.repo.PutAPIKey(ctx, key); err != nil {
+		log.Printf("service/PutAPIKey: repo err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// AuthAPIKey - alive api key by key itself
+func (s *ServiceWb) AuthAPIKey(ctx context.Context, key string) (model.APIKey, error) {
+	value, err := s.repo.AuthAPIKey(ctx, key)
+	if err != nil {
+		log.Printf("service/AuthAPIKey: repo err: %v", err)
+		return model.APIKey{}, err
+	}
+	return value, nil
+}
+
+// ListAPIKeys - alive api keys of user
+func (s *ServiceWb) ListAPIKeys(ctx context.Context, uid string) ([]model.APIKey, error) {
+	value, err := s.repo.ListAPIKeys(ctx, uid)
+	if err != nil {
+		log.Printf("service/ListAPIKeys: repo err: %v", err)
+		return nil, err
+	}
+	return value, nil
+}
+
+// RevokeAPIKey - kill api key of user
+func (s *ServiceWb) RevokeAPIKey(ctx context.Context, uid, id string) error {
+	if err := s.repo.RevokeAPIKey(ctx, uid, id); err != nil {
+		log.Printf("service/RevokeAPIKey: repo err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// PutIdentity - link OpenID Connect identity to its user
+func (s *ServiceWb) PutIdentity(ctx context.Context, identity model.Identity) error {
+	if err := s.repo.PutIdentity(ctx, identity); err != nil {
+		log.Printf("service/PutIdentity: repo err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// FindIdentity - uid of user of OpenID Connect identity, "" if it is not linked
+func (s *ServiceWb) FindIdentity(ctx context.Context, issuer, subject string) (string, error) {
+	value, err := s.repo.FindIdentity(ctx, issuer, subject)
+	if err != nil {
+		log.Printf("service/FindIdentity: repo err: %v", err)
+		return "", err
+	}
+	return value, nil
+}
+
+// ListIdentities - OpenID Connect identities of user
+func (s *ServiceWb) ListIdentities(ctx context.Context, uid string) ([]model.Identity, error) {
+	value, err := s.repo.ListIdentities(ctx, uid)
+	if err != nil {
+		log.Printf("service/ListIdentities: repo err: %v", err)
+		return nil, err
+	}
+	return value, nil
+}
+
+// FindUserByEmail - uid of user with email, "" if there is no such user
+func (s *ServiceWb) FindUserByEmail(email string) (string, error) {
+	value, err := s.repo.FindUserByEmail(email)
+	if err != nil {
+		log.Printf("service/FindUserByEmail: repo err: %v", err)
+		return "", err
+	}
+	return value, nil
+}
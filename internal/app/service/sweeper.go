@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// sweptrepo - repo (or service) which can mark expired links inactive and forget dead sessions
+type sweptrepo interface {
+	SweepExpired(ctx context.Context, now time.Time) ([]model.DataEl, error)
+	PurgeSessions(ctx context.Context, now time.Time) (int, error)
+}
+
+// StartSweeper - run sweeper of expired / exhausted links and of revoked / expired sessions every interval in background
+// returned func stops sweeper and waits until it is finished, it has to be called before repo is closed
+func StartSweeper(repo sweptrepo, interval time.Duration) func() {
+	if interval <= 0 {
+		log.Printf("sweeper of expired links is off")
+		return func() {}
+	}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		log.Printf("sweeper of expired links started, interval %v", interval)
+		for {
+			select {
+			case <-ticker.C:
+				swept, err := repo.SweepExpired(ctx, time.Now())
+				if err != nil {
+					log.Printf("sweeper: err: %v", err)
+				}
+				if len(swept) > 0 {
+					log.Printf("sweeper: %d expired links are marked inactive", len(swept))
+				}
+				purged, err := repo.PurgeSessions(ctx, time.Now())
+				if err != nil {
+					log.Printf("sweeper: sessions err: %v", err)
+				}
+				if purged > 0 {
+					log.Printf("sweeper: %d revoked and expired sessions are deleted", purged)
+				}
+			case <-ctx.Done():
+				log.Printf("sweeper of expired links finished.")
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancelFunc()
+		wg.Wait()
+	}
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/writeback"
+)
+
+// типы заданий пула воркеров
+// type of task is registered once (Register) with its job, timeout and retries, then tasks of it are
+// put to pool by Submit (producer waits for result) or Enqueue (in background, e.g. cache warm-up, webhooks),
+// so worker loop does not know about jobs at all
+
+// RetryPolicy - failed job is tried up to Attempts times (0 - once), delay before next attempt is Delay
+// doubled every attempt up to MaxDelay, Retryable - errors worth retrying (nil - all of them)
+type RetryPolicy struct {
+	Attempts  int
+	Delay     time.Duration
+	MaxDelay  time.Duration
+	Retryable func(error) bool
+}
+
+// delay - wait after failed attempt (1, 2, ...)
+func (r RetryPolicy) delay(attempt int) time.Duration {
+	delay := r.Delay
+	for i := 1; i < attempt && (r.MaxDelay == 0 || delay < r.MaxDelay); i++ {
+		delay *= 2
+	}
+	if r.MaxDelay > 0 && delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+	return delay
+}
+
+// TaskDef - type of task: Run does job of argument A with result T,
+// Timeout - time of one attempt (0 - no own timeout), Retry - attempts of job
+type TaskDef[A, T any] struct {
+	Name    string
+	Timeout time.Duration
+	Retry   RetryPolicy
+	Run     func(ctx context.Context, arg A) (T, error)
+}
+
+// TaskInfo - registered type of task
+type TaskInfo struct {
+	Name     string
+	Timeout  time.Duration
+	Attempts int
+}
+
+// Registry - registered types of tasks by name, tracer - spans of tasks,
+// restorers - background tasks of types by spilled ones (see PolicySpill)
+type Registry struct {
+	mu        sync.Mutex
+	tracer    trace.Tracer
+	types     map[string]TaskInfo
+	restorers map[string]func(spilled writeback.Spilled) (Task, error)
+}
+
+// NewRegistry - empty registry
+func NewRegistry(tracer trace.Tracer) *Registry {
+	return &Registry{tracer: tracer, types: make(map[string]TaskInfo),
+		restorers: make(map[string]func(spilled writeback.Spilled) (Task, error))}
+}
+
+// restore - background task of spilled one, type of it should be registered
+func (r *Registry) restore(spilled writeback.Spilled) (Task, error) {
+	r.mu.Lock()
+	restorer, ok := r.restorers[spilled.Task]
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("service: task type %q is not registered", spilled.Task)
+	}
+	return restorer(spilled)
+}
+
+// Types - registered types in order of name
+func (r *Registry) Types() []TaskInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	infos := make([]TaskInfo, 0, len(r.types))
+	for _, info := range r.types {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(a, b int) bool { return infos[a].Name < infos[b].Name })
+	return infos
+}
+
+// TaskType - registered type of task of argument A and result T
+type TaskType[A, T any] struct {
+	def    TaskDef[A, T]
+	tracer trace.Tracer
+}
+
+// Name - name of type
+func (tt *TaskType[A, T]) Name() string {
+	return tt.def.Name
+}
+
+// Register - add type of task def to registry r, name of type should be unique
+func Register[A, T any](r *Registry, def TaskDef[A, T]) (*TaskType[A, T], error) {
+	if def.Name == "" || def.Run == nil {
+		return nil, errors.New("service: task type should have name and job")
+	}
+	if def.Timeout < 0 || def.Retry.Attempts < 0 || def.Retry.Delay < 0 || def.Retry.MaxDelay < 0 {
+		return nil, fmt.Errorf("service: task type %q: timeout, attempts and delays should not be negative", def.Name)
+	}
+	if def.Retry.Attempts == 0 {
+		def.Retry.Attempts = 1
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.types[def.Name]; ok {
+		return nil, fmt.Errorf("service: task type %q is registered already", def.Name)
+	}
+	r.types[def.Name] = TaskInfo{Name: def.Name, Timeout: def.Timeout, Attempts: def.Retry.Attempts}
+	tt := &TaskType[A, T]{def: def, tracer: r.tracer}
+	r.restorers[def.Name] = func(spilled writeback.Spilled) (Task, error) {
+		var arg A
+		if err := json.Unmarshal(spilled.Arg, &arg); err != nil {
+			return nil, fmt.Errorf("service: argument of task %q: %w", def.Name, err)
+		}
+		return &job[A, T]{tt: tt, ctx: context.Background(), arg: arg, queuedAt: spilled.QueuedAt}, nil
+	}
+	return tt, nil
+}
+
+// ResultDbItems - структура для канала данных и ошибок которые возвращает worker
+type ResultDbItems[T any] struct {
+	ResultError error
+	ResultDb    T
+}
+
+// Task - задание в очереди пула, worker только исполняет его
+// tasks are made of registered types by Submit and Enqueue,
+// marshalArg and background - task in spill journal (background - nobody waits for its result)
+type Task interface {
+	Name() string
+	do(p *QBroker)
+	marshalArg() (json.RawMessage, error)
+	background() bool
+}
+
+// job - task of type tt with argument arg, done - result for producer (nil - nobody waits for it)
+type job[A, T any] struct {
+	tt       *TaskType[A, T]
+	ctx      context.Context
+	arg      A
+	queuedAt time.Time
+	done     chan ResultDbItems[T]
+}
+
+func (j *job[A, T]) Name() string {
+	return j.tt.def.Name
+}
+
+func (j *job[A, T]) marshalArg() (json.RawMessage, error) {
+	return json.Marshal(j.arg)
+}
+
+func (j *job[A, T]) background() bool {
+	return j.done == nil
+}
+
+func (j *job[A, T]) do(p *QBroker) {
+	res := j.tt.run(j.ctx, j.arg, p)
+	p.observe(j.Name(), j.queuedAt, res.ResultError)
+	if j.done != nil {
+		j.done <- res
+		return
+	}
+	if res.ResultError != nil {
+		log.Printf("service: background task %s failed: %v", j.Name(), res.ResultError)
+	}
+}
+
+// run - job with timeout of attempt and retries, in span of task
+func (tt *TaskType[A, T]) run(ctx context.Context, arg A, p *QBroker) ResultDbItems[T] {
+	def := tt.def
+	ctx, span := tt.tracer.Start(ctx, "task."+def.Name)
+	defer span.End()
+
+	var res ResultDbItems[T]
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if def.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, def.Timeout)
+		}
+		res.ResultDb, res.ResultError = def.Run(attemptCtx, arg)
+		cancel()
+		span.SetAttributes(attribute.Int("task.attempts", attempt))
+		if res.ResultError == nil {
+			return res
+		}
+		span.RecordError(res.ResultError)
+
+		retryable := def.Retry.Retryable == nil || def.Retry.Retryable(res.ResultError)
+		if attempt >= def.Retry.Attempts || !retryable || ctx.Err() != nil {
+			span.SetStatus(codes.Error, res.ResultError.Error())
+			return res
+		}
+		p.metrics.retries.WithLabelValues(def.Name).Inc()
+		timer := time.NewTimer(def.Retry.delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			span.SetStatus(codes.Error, res.ResultError.Error())
+			return res
+		case <-timer.C:
+		}
+	}
+}
+
+// Submit - task of type tt with arg is done by pool p, producer waits for its result until ctx is done
+func Submit[A, T any](ctx context.Context, p *QBroker, tt *TaskType[A, T], arg A) (T, error) {
+	var zero T
+	// buffered, so worker does not wait for producer which is gone with its ctx
+	task := &job[A, T]{tt: tt, ctx: ctx, arg: arg, queuedAt: time.Now(), done: make(chan ResultDbItems[T], 1)}
+	//put task to channel Queue for worker
+	if err := p.submit(ctx, task); err != nil {
+		return zero, err
+	}
+
+	//wait for worker to do the job
+	select {
+	case res := <-task.done:
+		return res.ResultDb, res.ResultError
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// Enqueue - task of type tt with arg is done by pool p in background,
+// job keeps values of ctx (e.g. span) but not its cancel, as request is over before it is done;
+// producer waits for place in queue until ctx is done (PolicyBlock)
+func Enqueue[A, T any](ctx context.Context, p *QBroker, tt *TaskType[A, T], arg A) error {
+	task := &job[A, T]{tt: tt, ctx: context.WithoutCancel(ctx), arg: arg, queuedAt: time.Now()}
+	return p.submit(ctx, task)
+}
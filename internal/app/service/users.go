@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// кеш пользователей, сессий и кликов
+// role and balance of user are read by every request of api (policy, payment of open), so profile of user
+// is kept in cache for UserTTL, uid of superuser (payee of opens) as well.
+// profile is flushed by PutUser, DelUser and PayUser of this or other instance (cache is shared or invalidated),
+// payment itself checks balance in repo again, so stale cached balance does not overdraw it.
+// payment of open stays synchronous (endpoint gives link only after it is paid), as it is done in repo.
+// alive sessions of user are kept for SessionTTL, as session of every access token is checked by middleware:
+// they are flushed by PutSession and RevokeSession (logout), session revoked by reuse of its refresh token
+// is dead for access tokens after SessionTTL.
+// clicks of opens are saved by click task of pool, request does not wait for repo
+
+const (
+	// DefaultUserTTL - time to keep profile of user and uid of superuser
+	DefaultUserTTL = 30 * time.Second
+	// DefaultSessionTTL - time to keep alive sessions of user
+	DefaultSessionTTL = 5 * time.Second
+	// suidKey - key of cached uid of superuser
+	suidKey = "uid_SU:"
+)
+
+// userKey - key of cached profile of user uid
+func userKey(uid string) string {
+	return "uid_USER:" + uid
+}
+
+// sessionsKey - key of cached alive sessions of user uid
+func sessionsKey(uid string) string {
+	return "uid_SESSIONS:" + uid
+}
+
+// cachedUser - profile of user uid from cache, ok is false when it is not there
+func (s *ServiceWb) cachedUser(ctx context.Context, uid string) (model.User, bool) {
+	var user model.User
+	if s.UserTTL <= 0 {
+		return user, false
+	}
+	if err := s.cacheWb.Get(ctx, userKey(uid), &user); err != nil {
+		return model.User{}, false
+	}
+	return user, true
+}
+
+// cacheUser - keep value of key in cache for UserTTL (0 - it is not cached)
+func (s *ServiceWb) cacheUser(ctx context.Context, key string, value interface{}) {
+	if s.UserTTL <= 0 {
+		return
+	}
+	if err := s.cacheWb.Set(ctx, key, value, s.UserTTL); err != nil {
+		log.Printf("service/cacheUser: %s cannot be put to cache: err: %v", key, err)
+	}
+}
+
+// flushUsers - profiles of users uids and uid of superuser are read from repo again
+func (s *ServiceWb) flushUsers(ctx context.Context, uids ...string) {
+	for _, uid := range uids {
+		s.flushCache(ctx, userKey(uid))
+	}
+	s.flushCache(ctx, suidKey)
+}
+
+// saveClick - job of click task: click is saved to repo
+func (s *ServiceWb) saveClick(ctx context.Context, click model.Click) (struct{}, error) {
+	return struct{}{}, s.repo.AddClick(ctx, click)
+}
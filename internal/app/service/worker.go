@@ -2,36 +2,80 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
 	"time"
 
-	"github.com/go-redis/cache/v8"
-	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/writeback"
+)
+
+// backpressure policies of worker pool - what Produce does when queue Qin is full
+// PolicyBlock - wait for place in queue (until ctx of request is done)
+// PolicyReject - ErrOverloaded at once, api answers 503
+// PolicySpill - task is kept in durable spill journal (type and json of argument) and is put to queue
+// when it has room, producer of Submit waits for result as usual. background tasks spilled by previous run
+// are done after restart, tasks whose producer is gone with it are dropped.
+// writes of links do not use the pool, they are kept in durable journal (see writeback)
+const (
+	PolicyBlock  = "block"
+	PolicyReject = "reject"
+	PolicySpill  = "spill"
 )
 
-// Task - структура элемента очереди для задания worker что делать
-// реализованы 2 метода Task1 (cache write behind .List) Task2 (cache write behind .Put)
-type Task struct {
-	Name   string
-	ctx    context.Context
-	uid    string
-	key    string
-	su     bool
-	doneCh chan ResultDbItems
+// metricsNamespace - префикс метрик (как у endpoint)
+const metricsNamespace = "weblinkmetrics"
+
+// ErrOverloaded - queue of worker pool is full (PolicyReject)
+var ErrOverloaded = errors.New("service: worker pool is overloaded")
+
+// ErrPoolClosed - task is produced after CloseConn
+var ErrPoolClosed = errors.New("service: worker pool is closed")
+
+// PoolOptions - Workers - number of cache workers (and of writers of journal),
+// QueueSize - capacity of queue Qin, Policy - what to do when it is full,
+// Spill - journal of PolicySpill, pool closes it
+type PoolOptions struct {
+	Workers   int
+	QueueSize int
+	Policy    string
+	Spill     *writeback.Spill
+}
+
+// DefaultPoolOptions - 2 workers, queue of 64 tasks, producer waits for place
+func DefaultPoolOptions() PoolOptions {
+	return PoolOptions{Workers: 2, QueueSize: 64, Policy: PolicyBlock}
+}
+
+// Validate - check of options
+func (o PoolOptions) Validate() error {
+	if o.Workers < 1 || o.QueueSize < 0 {
+		return fmt.Errorf("worker pool: workers %d should be positive, queue size %d should not be negative", o.Workers, o.QueueSize)
+	}
+	switch o.Policy {
+	case PolicyBlock, PolicyReject:
+		return nil
+	case PolicySpill:
+		if o.Spill == nil {
+			return errors.New("worker pool: policy spill needs spill journal")
+		}
+		return nil
+	}
+	return fmt.Errorf("worker pool: policy %q should be %q, %q or %q", o.Policy, PolicyBlock, PolicyReject, PolicySpill)
 }
 
 // Worker - cтруктура воркера
 type Worker struct {
-	Qin chan *Task
+	Qin chan Task
 	id  int
 	wg  *sync.WaitGroup
 }
 
-// NewWorker - Конструктор воркера
-func NewWorker(id int, Qin chan *Task) *Worker {
-	wg := &sync.WaitGroup{}
+// NewWorker - Конструктор воркера, wg - workers of pool
+func NewWorker(id int, Qin chan Task, wg *sync.WaitGroup) *Worker {
 	wg.Add(1)
 	return &Worker{
 		Qin: Qin,
@@ -41,122 +85,239 @@ func NewWorker(id int, Qin chan *Task) *Worker {
 }
 
 // ProcessQ - когда по каналу приходит Task он будет обработан горутиной workera
-func (w Worker) ProcessQ(ctx context.Context, s *ServiceWb) {
+// worker finishes when Qin is closed and drained, so tasks in queue are done on shutdown
+func (w Worker) ProcessQ(p *QBroker) {
+	defer w.wg.Done()
 	log.Printf("worker id = %d started.", w.id)
-	var resultRead ResultDbItems
-	for {
-		select {
-		case job := <-w.Qin:
-			doneCh := job.doneCh
-			log.Printf("worker id = %d got task = %s uid=%s", w.id, job.Name, job.uid)
-
-			//TASK 1 LIST method - async read from repo
-			if job.Name == "Task1" {
-				var dbitems []string
-				var err1 error
-				dbitems, err1 = s.repo.List(job.ctx, job.uid)
-				if err1 != nil {
-					log.Printf("service/List: get from repo err: %v", err1)
-					resultRead.ResultDb = nil
-					resultRead.ResultError = err1
-					doneCh <- resultRead
-					break
-				}
-
-				err := s.cacheWb.Set(&cache.Item{
-					Ctx:   job.ctx,
-					Key:   job.key,
-					Value: dbitems,
-					TTL:   time.Hour,
-				})
-
-				if err != nil {
-					log.Printf("items for %s cannot be put to cache: err: %v", job.uid, err)
-					resultRead.ResultDb = nil
-					resultRead.ResultError = err1
-					doneCh <- resultRead
-					break
-				}
-				log.Printf("worker %d took data for uid = %s from repo to cache successfully \n", w.id, job.uid)
-				resultRead.ResultDb = dbitems
-				resultRead.ResultError = nil
-				doneCh <- resultRead
-			}
+	for task := range w.Qin {
+		log.Printf("worker id = %d got task = %s", w.id, task.Name())
+		task.do(p)
+		log.Printf("task = %v finished by %d worker\n", task.Name(), w.id)
+	}
+	log.Printf("worker id = %d finished.", w.id)
+}
 
-			//TASK 2 PUT async method push cache to repo
-			if job.Name == "Task2" {
-				// get data from cache
-				cachekey := fmt.Sprintf("uid_PUT:%s", job.uid)
-				var value model.DataEl
-				err2 := s.cacheWb.Get(job.ctx, cachekey, &value)
-				if err2 != nil {
-					log.Printf("cannot get value from for %s from cache", job.uid)
-					break
-					//return items, nil
-				}
-
-				if err := s.repo.Put(job.ctx, job.uid, job.key, value, job.su); err != nil {
-					log.Printf("service/Put: put repo err: %v", err)
-					break
-					//same info only !!! )))
-				}
-
-				log.Printf("worker %d put data for uid = %s from cache to repo successfully\n", w.id, job.uid)
-
-				//remove item from cache once done with repo
-				s.flushCache(ctx, cachekey)
+// QBroker -  стуктура диспетчера канала управления воркерами
+// mu - producers hold it for read while they put task to Qin, Close holds it for write to stop them
+// spilled - tasks of this run in spill journal by id, spillMu - producer holds it until task is there,
+// so drainer finds it; stopDrain - drainer puts the rest of spilled tasks to queue and finishes
+type QBroker struct {
+	Qin       chan Task
+	policy    string
+	mu        sync.RWMutex
+	closed    bool
+	workers   sync.WaitGroup
+	metrics   *poolMetrics
+	spill     *writeback.Spill
+	spillMu   sync.Mutex
+	spilled   map[uint64]Task
+	stopDrain context.CancelFunc
+	drainer   sync.WaitGroup
+}
 
+// poolMetrics - метрики пула: глубина очереди, время заданий, отказы
+type poolMetrics struct {
+	queueDepth prometheus.GaugeFunc
+	spillDepth prometheus.GaugeFunc
+	latency    *prometheus.HistogramVec
+	failed     *prometheus.CounterVec
+	retries    *prometheus.CounterVec
+	rejected   prometheus.Counter
+	spilledCtr prometheus.Counter
+}
+
+// newQBroker - broker of queue of size and policy of options
+func newQBroker(opts PoolOptions) *QBroker {
+	p := &QBroker{Qin: make(chan Task, opts.QueueSize), policy: opts.Policy, spill: opts.Spill, spilled: make(map[uint64]Task)}
+	p.metrics = &poolMetrics{
+		queueDepth: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "pool_queue_depth",
+			Help:      "The number of tasks waiting in queue of worker pool",
+		}, func() float64 { return float64(len(p.Qin)) }),
+		spillDepth: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "pool_spill_depth",
+			Help:      "The number of tasks waiting in spill journal of worker pool",
+		}, func() float64 {
+			if p.spill == nil {
+				return 0
 			}
+			return float64(p.spill.Pending())
+		}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "pool_task_seconds",
+			Help:      "The time of task from queueing till result",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"task"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "pool_tasks_failed_total",
+			Help:      "The number of tasks finished with error",
+		}, []string{"task"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "pool_task_retries_total",
+			Help:      "The number of retried attempts of tasks",
+		}, []string{"task"}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "pool_tasks_rejected_total",
+			Help:      "The number of tasks rejected as queue is full",
+		}),
+		spilledCtr: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "pool_tasks_spilled_total",
+			Help:      "The number of tasks put to spill journal as queue is full",
+		}),
+	}
+	return p
+}
 
-			log.Printf("task = %v finished by %d worker\n", job.Name, w.id)
+// observe - metrics of finished task
+func (p *QBroker) observe(name string, queuedAt time.Time, err error) {
+	p.metrics.latency.WithLabelValues(name).Observe(time.Since(queuedAt).Seconds())
+	if err != nil {
+		p.metrics.failed.WithLabelValues(name).Inc()
+	}
+}
 
-		case <-ctx.Done():
-			w.wg.Done()
-			log.Printf("worker id = %d finished.", w.id)
+// submit - put task to queue by policy
+func (p *QBroker) submit(ctx context.Context, task Task) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrPoolClosed
+	}
+	select {
+	case p.Qin <- task:
+		return nil
+	default:
+	}
+	// queue is full
+	switch p.policy {
+	case PolicyReject:
+		p.metrics.rejected.Inc()
+		return ErrOverloaded
+	case PolicySpill:
+		return p.spillTask(task)
+	}
+	select {
+	case p.Qin <- task:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// spillTask - task is put to spill journal, it is kept in memory as well for producer waiting for its result
+func (p *QBroker) spillTask(task Task) error {
+	arg, err := task.marshalArg()
+	if err != nil {
+		return fmt.Errorf("service: task %s can not be spilled: %w", task.Name(), err)
+	}
+	p.spillMu.Lock()
+	defer p.spillMu.Unlock()
+	spilled, err := p.spill.Push(task.Name(), arg, task.background())
+	if err != nil {
+		return err
+	}
+	p.spilled[spilled.ID] = task
+	p.metrics.spilledCtr.Inc()
+	return nil
+}
+
+// startDrain - spilled tasks are put to queue by drainer, tasks of previous run are made by types of registry
+func (p *QBroker) startDrain(tasks *Registry) {
+	if p.spill == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.stopDrain = cancel
+	p.drainer.Add(1)
+	go p.drain(ctx, tasks)
+}
+
+// drain - spilled tasks to queue in order of spill, as soon as it has room; when ctx is done,
+// the rest of them is put to queue, so they are done before pool is closed
+func (p *QBroker) drain(ctx context.Context, tasks *Registry) {
+	defer p.drainer.Done()
+	for {
+		spilled, err := p.spill.Next(ctx)
+		if err != nil {
 			return
 		}
+		task := p.unspill(spilled, tasks)
+		if task == nil {
+			if err = p.spill.Done(spilled.ID); err != nil {
+				log.Printf("service: spilled task %s %d is not removed: %v", spilled.Task, spilled.ID, err)
+			}
+			continue
+		}
+		p.Qin <- &spilledTask{Task: task, id: spilled.ID}
 	}
 }
 
-// QBroker -  стуктура диспетчера канала управления воркерами
-type QBroker struct {
-	Qin chan *Task
+// unspill - task of spilled one, nil - it is not to be done
+func (p *QBroker) unspill(spilled writeback.Spilled, tasks *Registry) Task {
+	p.spillMu.Lock()
+	task, ok := p.spilled[spilled.ID]
+	delete(p.spilled, spilled.ID)
+	p.spillMu.Unlock()
+	if ok {
+		return task
+	}
+	// task of previous run
+	if !spilled.Background {
+		log.Printf("service: spilled task %s %d is dropped, its producer is gone", spilled.Task, spilled.ID)
+		return nil
+	}
+	task, err := tasks.restore(spilled)
+	if err != nil {
+		log.Printf("service: spilled task %s %d is dropped: %v", spilled.Task, spilled.ID, err)
+		return nil
+	}
+	return task
 }
 
-// ResultDbItems - структура для канала данных и ошибок которые возвращает worker
-type ResultDbItems struct {
-	ResultError error
-	ResultDb    []string
+// spilledTask - task taken from spill journal, it is removed from there when it is done
+type spilledTask struct {
+	Task
+	id uint64
 }
 
-// Produce - функция генерит задание task1 для исполнения воркером (метод LIST)
-func (p QBroker) Produce(ctx context.Context, uid string, key string) ([]string, error) {
-	doneCh := make(chan ResultDbItems)
-	task := &Task{"Task1",
-		ctx,
-		uid,
-		key,
-		false,
-		doneCh,
+func (t *spilledTask) do(p *QBroker) {
+	t.Task.do(p)
+	if err := p.spill.Done(t.id); err != nil {
+		log.Printf("service: spilled task %s %d is not removed: %v", t.Name(), t.id, err)
 	}
-	//put task to channel Queue for worker
-	p.Qin <- task
-
-	//wait for worker to retreive data from repo
-	res := <-doneCh
-	return res.ResultDb, res.ResultError
 }
 
-// ProduceWr - функция генерит задание task2 для исполнения воркером (метод PUT)
-func (p QBroker) ProduceWr(ctx context.Context, uid string, key string, su bool) {
-	doneCh := make(chan ResultDbItems)
-	task := &Task{"Task2",
-		ctx,
-		uid,
-		key,
-		su,
-		doneCh,
+// Close - no more tasks, tasks in queue (and spilled ones) are done by workers before it returns
+func (p *QBroker) Close() {
+	p.mu.Lock()
+	closing := !p.closed
+	p.closed = true
+	p.mu.Unlock()
+	// producers are gone: they put task to queue while they hold mu
+	if closing {
+		if p.stopDrain != nil {
+			p.stopDrain()
+			p.drainer.Wait()
+		}
+		close(p.Qin)
+	}
+	p.workers.Wait()
+	if closing && p.spill != nil {
+		if err := p.spill.Close(); err != nil {
+			log.Printf("service: spill journal close err: %v", err)
+		}
 	}
-	p.Qin <- task
-	//просто кидает задание Task2 а воркер его подхватывает и исполняет
+}
+
+// collectors - metrics of pool
+func (p *QBroker) collectors() []prometheus.Collector {
+	m := p.metrics
+	return []prometheus.Collector{m.queueDepth, m.spillDepth, m.latency, m.failed, m.retries, m.rejected, m.spilledCtr}
 }
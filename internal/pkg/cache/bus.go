@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// invalidation of local tiers of instances
+// cache of instance keeps hot keys in process (local tier) in front of shared redis, so key deleted by
+// one instance is still served by local tier of others until it expires. Invalidating cache broadcasts
+// deleted keys by bus, other instances evict them from local tier at once.
+// RedisBus - pub/sub of redis, LocalBus - instances of one process (unit tests)
+// messages published while redis is not reachable are lost, then local tier is stale until its ttl
+
+// Invalidation - keys deleted by instance Origin
+type Invalidation struct {
+	Origin string   `json:"origin"`
+	Keys   []string `json:"keys"`
+}
+
+// Bus - broadcast of invalidations to all instances (sender too)
+// Subscribe calls handler for every invalidation until unsubscribe is called
+type Bus interface {
+	Publish(ctx context.Context, inv Invalidation) error
+	Subscribe(handler func(Invalidation)) (unsubscribe func(), err error)
+}
+
+// Tiered - cache with local tier of process, DeleteLocal evicts key from local tier only
+type Tiered interface {
+	Cache
+	DeleteLocal(key string)
+}
+
+// LocalBus - bus of instances of one process, handlers are called by Publish
+type LocalBus struct {
+	mu       sync.Mutex
+	next     int
+	handlers map[int]func(Invalidation)
+}
+
+// NewLocalBus - bus without subscribers
+func NewLocalBus() *LocalBus {
+	return &LocalBus{handlers: make(map[int]func(Invalidation))}
+}
+
+// Publish - call handlers of subscribers
+func (b *LocalBus) Publish(_ context.Context, inv Invalidation) error {
+	b.mu.Lock()
+	handlers := make([]func(Invalidation), 0, len(b.handlers))
+	for _, handler := range b.handlers {
+		handlers = append(handlers, handler)
+	}
+	b.mu.Unlock()
+	for _, handler := range handlers {
+		handler(inv)
+	}
+	return nil
+}
+
+// Subscribe - handler is called for every invalidation
+func (b *LocalBus) Subscribe(handler func(Invalidation)) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.handlers[id] = handler
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+	}, nil
+}
+
+// Invalidating - cache of instance whose deletes are broadcast by bus,
+// deletes of other instances evict keys from its local tier
+type Invalidating struct {
+	Tiered
+	bus         Bus
+	origin      string
+	unsubscribe func()
+}
+
+// NewInvalidating - cache c of instance on bus, Close stops listening to bus
+func NewInvalidating(c Tiered, bus Bus) (*Invalidating, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	inv := &Invalidating{Tiered: c, bus: bus, origin: hex.EncodeToString(id)}
+	unsubscribe, err := bus.Subscribe(inv.evict)
+	if err != nil {
+		return nil, fmt.Errorf("cache: subscribe to invalidations: %w", err)
+	}
+	inv.unsubscribe = unsubscribe
+	return inv, nil
+}
+
+// Delete - remove key and tell other instances to evict it
+func (c *Invalidating) Delete(ctx context.Context, key string) error {
+	if err := c.Tiered.Delete(ctx, key); err != nil {
+		return err
+	}
+	if err := c.bus.Publish(ctx, Invalidation{Origin: c.origin, Keys: []string{key}}); err != nil {
+		return fmt.Errorf("cache: invalidation of %s is not broadcast: %w", key, err)
+	}
+	return nil
+}
+
+// evict - keys deleted by other instance are removed from local tier
+// it is not logged, as every put, delete and flush of every instance comes here
+func (c *Invalidating) evict(inv Invalidation) {
+	if inv.Origin == c.origin {
+		return
+	}
+	for _, key := range inv.Keys {
+		c.DeleteLocal(key)
+	}
+}
+
+// Close - stop listening to bus
+func (c *Invalidating) Close() {
+	c.unsubscribe()
+}
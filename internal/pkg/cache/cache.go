@@ -0,0 +1,23 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// cache of service between api and repo
+// values are kept encoded (msgpack), so Get gives copy of value and any type can be cached
+// Redis - shared by instances of api, Memory - of one process (laptop, ci, unit tests)
+
+// ErrCacheMiss - key is not in cache (or it is expired)
+var ErrCacheMiss = errors.New("cache: key is missing")
+
+// Cache - values of keys with time to live
+// Get decodes value of key to value (pointer), ttl of Set is time to keep value
+type Cache interface {
+	Get(ctx context.Context, key string, value interface{}) error
+	Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+	Exists(ctx context.Context, key string) bool
+	Delete(ctx context.Context, key string) error
+}
@@ -0,0 +1,179 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/cache"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// testCache - behaviour of any cache, keys are prefixed by prefix
+func testCache(t *testing.T, c cache.Cache, prefix string) {
+	ctx := context.Background()
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	link := model.DataEl{UID: "u1", URL: "https://example.com", Shorturl: "abc", Active: 1, ExpiresAt: &expires, Personal: true}
+
+	var got model.DataEl
+	require.ErrorIs(t, c.Get(ctx, prefix+"link", &got), cache.ErrCacheMiss)
+	require.False(t, c.Exists(ctx, prefix+"link"))
+
+	require.NoError(t, c.Set(ctx, prefix+"link", link, time.Hour))
+	require.True(t, c.Exists(ctx, prefix+"link"))
+	require.NoError(t, c.Get(ctx, prefix+"link", &got))
+	require.Equal(t, link.Shorturl, got.Shorturl)
+	require.Equal(t, link.URL, got.URL)
+	require.True(t, got.Personal)
+	require.True(t, expires.Equal(*got.ExpiresAt))
+
+	// value is copied, so changes of got do not change cache
+	got.URL = "https://changed.example.com"
+	var again model.DataEl
+	require.NoError(t, c.Get(ctx, prefix+"link", &again))
+	require.Equal(t, link.URL, again.URL)
+
+	// lists are cached as well, value of key is replaced
+	require.NoError(t, c.Set(ctx, prefix+"list", []string{"a", "b"}, time.Hour))
+	require.NoError(t, c.Set(ctx, prefix+"list", []string{"c"}, time.Hour))
+	var items []string
+	require.NoError(t, c.Get(ctx, prefix+"list", &items))
+	require.Equal(t, []string{"c"}, items)
+
+	require.NoError(t, c.Delete(ctx, prefix+"link"))
+	require.False(t, c.Exists(ctx, prefix+"link"))
+	require.ErrorIs(t, c.Get(ctx, prefix+"link", &got), cache.ErrCacheMiss)
+	// missing key is deleted without error
+	require.NoError(t, c.Delete(ctx, prefix+"link"))
+}
+
+func TestMemory(t *testing.T) {
+	c, err := cache.NewMemory(100, time.Hour)
+	require.NoError(t, err)
+	testCache(t, c, "")
+}
+
+func TestNewMemory(t *testing.T) {
+	_, err := cache.NewMemory(0, time.Hour)
+	require.Error(t, err)
+	_, err = cache.NewMemory(10, 0)
+	require.Error(t, err)
+}
+
+// least recently used keys are evicted
+func TestMemorySize(t *testing.T) {
+	ctx := context.Background()
+	c, err := cache.NewMemory(3, time.Hour)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, c.Set(ctx, key, key, time.Hour))
+	}
+	var value string
+	require.NoError(t, c.Get(ctx, "a", &value))
+
+	require.NoError(t, c.Set(ctx, "d", "d", time.Hour))
+	require.Equal(t, 3, c.Len())
+	require.False(t, c.Exists(ctx, "b"))
+	for _, key := range []string{"a", "c", "d"} {
+		require.True(t, c.Exists(ctx, key), key)
+	}
+}
+
+// ttl of key is no longer than max ttl
+func TestMemoryTTL(t *testing.T) {
+	ctx := context.Background()
+	c, err := cache.NewMemory(10, 50*time.Millisecond)
+	require.NoError(t, err)
+	require.NoError(t, c.Set(ctx, "short", 1, 20*time.Millisecond))
+	require.NoError(t, c.Set(ctx, "long", 1, time.Hour))
+	require.NoError(t, c.Set(ctx, "default", 1, 0))
+
+	time.Sleep(30 * time.Millisecond)
+	require.False(t, c.Exists(ctx, "short"))
+	require.True(t, c.Exists(ctx, "long"))
+
+	time.Sleep(30 * time.Millisecond)
+	var value int
+	require.ErrorIs(t, c.Get(ctx, "long", &value), cache.ErrCacheMiss)
+	require.False(t, c.Exists(ctx, "default"))
+	require.Equal(t, 0, c.Len())
+}
+
+func TestMemoryConcurrent(t *testing.T) {
+	ctx := context.Background()
+	c, err := cache.NewMemory(50, time.Hour)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := fmt.Sprintf("k%d", (i*j)%80)
+				_ = c.Set(ctx, key, []string{key}, time.Hour)
+				var items []string
+				if err := c.Get(ctx, key, &items); err == nil && items[0] != key {
+					t.Errorf("key %s has value %v", key, items)
+				}
+				if j%7 == 0 {
+					_ = c.Delete(ctx, key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.LessOrEqual(t, c.Len(), 50)
+}
+
+// failingBus - bus which is not reachable
+type failingBus struct{ *cache.LocalBus }
+
+func (failingBus) Publish(context.Context, cache.Invalidation) error {
+	return errors.New("connection refused")
+}
+
+// delete of one instance evicts key from other instances on bus
+func TestInvalidating(t *testing.T) {
+	ctx := context.Background()
+	bus := cache.NewLocalBus()
+	instances := make([]*cache.Invalidating, 3)
+	for i := range instances {
+		local, err := cache.NewMemory(10, time.Hour)
+		require.NoError(t, err)
+		instances[i], err = cache.NewInvalidating(local, bus)
+		require.NoError(t, err)
+		require.NoError(t, instances[i].Set(ctx, "uid_LIST:u1", []string{"l1"}, time.Hour))
+		require.NoError(t, instances[i].Set(ctx, "uid_LIST:u2", []string{"l2"}, time.Hour))
+	}
+	testCache(t, instances[0], "test:")
+
+	require.NoError(t, instances[1].Delete(ctx, "uid_LIST:u1"))
+	for i, c := range instances {
+		require.False(t, c.Exists(ctx, "uid_LIST:u1"), "instance %d", i)
+		require.True(t, c.Exists(ctx, "uid_LIST:u2"), "instance %d", i)
+	}
+
+	// closed instance does not listen to bus
+	instances[2].Close()
+	require.NoError(t, instances[0].Delete(ctx, "uid_LIST:u2"))
+	require.False(t, instances[1].Exists(ctx, "uid_LIST:u2"))
+	require.True(t, instances[2].Exists(ctx, "uid_LIST:u2"))
+}
+
+// key is deleted even if invalidation cannot be sent
+func TestInvalidatingBusDown(t *testing.T) {
+	ctx := context.Background()
+	local, err := cache.NewMemory(10, time.Hour)
+	require.NoError(t, err)
+	c, err := cache.NewInvalidating(local, failingBus{cache.NewLocalBus()})
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Set(ctx, "k", 1, time.Hour))
+	require.ErrorContains(t, c.Delete(ctx, "k"), "connection refused")
+	require.False(t, c.Exists(ctx, "k"))
+}
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Memory - cache of this process, it keeps up to size keys (least recently used ones are evicted)
+// for ttl of Set, but no longer than maxTTL
+type Memory struct {
+	mu     sync.Mutex
+	size   int
+	maxTTL time.Duration
+	// lru - most recently used first
+	lru  *list.List
+	keys map[string]*list.Element
+}
+
+type memoryItem struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+// NewMemory - empty cache of size keys and maxTTL
+func NewMemory(size int, maxTTL time.Duration) (*Memory, error) {
+	if size < 1 || maxTTL <= 0 {
+		return nil, fmt.Errorf("cache: size %d and max ttl %v should be positive", size, maxTTL)
+	}
+	return &Memory{
+		size:   size,
+		maxTTL: maxTTL,
+		lru:    list.New(),
+		keys:   make(map[string]*list.Element),
+	}, nil
+}
+
+// item - alive item of key, expired one is removed
+func (m *Memory) item(key string, now time.Time) (*memoryItem, bool) {
+	elem, ok := m.keys[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*memoryItem)
+	if !now.Before(item.expires) {
+		m.lru.Remove(elem)
+		delete(m.keys, key)
+		return nil, false
+	}
+	return item, true
+}
+
+// Get - value of key
+func (m *Memory) Get(_ context.Context, key string, value interface{}) error {
+	m.mu.Lock()
+	item, ok := m.item(key, time.Now())
+	if !ok {
+		m.mu.Unlock()
+		return ErrCacheMiss
+	}
+	m.lru.MoveToFront(m.keys[key])
+	data := item.data
+	m.mu.Unlock()
+
+	// data is not changed after Set, so it is decoded without lock
+	return msgpack.Unmarshal(data, value)
+}
+
+// Set - keep value of key for ttl (maxTTL if ttl is zero or longer)
+func (m *Memory) Set(_ context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, err := msgpack.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 || ttl > m.maxTTL {
+		ttl = m.maxTTL
+	}
+	item := &memoryItem{key: key, data: data, expires: time.Now().Add(ttl)}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.keys[key]; ok {
+		elem.Value = item
+		m.lru.MoveToFront(elem)
+		return nil
+	}
+	m.keys[key] = m.lru.PushFront(item)
+	for m.lru.Len() > m.size {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.keys, oldest.Value.(*memoryItem).key)
+	}
+	return nil
+}
+
+// Exists - key is in cache
+func (m *Memory) Exists(_ context.Context, key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.item(key, time.Now())
+	return ok
+}
+
+// Delete - remove key
+func (m *Memory) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.keys[key]; ok {
+		m.lru.Remove(elem)
+		delete(m.keys, key)
+	}
+	return nil
+}
+
+// DeleteLocal - remove key, all of cache is local to process
+func (m *Memory) DeleteLocal(key string) {
+	_ = m.Delete(context.Background(), key)
+}
+
+// Len - number of keys kept (expired ones too, until they are touched or evicted)
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	rediscache "github.com/go-redis/cache/v8"
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis - cache in redis with small local cache of hot keys in front of it
+type Redis struct {
+	cache *rediscache.Cache
+}
+
+// NewRedis - cache of redis client
+func NewRedis(client *redis.Client) *Redis {
+	return &Redis{
+		cache: rediscache.New(&rediscache.Options{
+			Redis:      client,
+			LocalCache: rediscache.NewTinyLFU(1000, time.Minute),
+		}),
+	}
+}
+
+// Get - value of key
+func (r *Redis) Get(ctx context.Context, key string, value interface{}) error {
+	err := r.cache.Get(ctx, key, value)
+	if errors.Is(err, rediscache.ErrCacheMiss) {
+		return ErrCacheMiss
+	}
+	return err
+}
+
+// Set - keep value of key for ttl
+func (r *Redis) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return r.cache.Set(&rediscache.Item{
+		Ctx:   ctx,
+		Key:   key,
+		Value: value,
+		TTL:   ttl,
+	})
+}
+
+// Exists - key is in cache
+func (r *Redis) Exists(ctx context.Context, key string) bool {
+	return r.cache.Exists(ctx, key)
+}
+
+// Delete - remove key, missing key is not error
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	err := r.cache.Delete(ctx, key)
+	if errors.Is(err, rediscache.ErrCacheMiss) {
+		return nil
+	}
+	return err
+}
+
+// DeleteLocal - remove key from local cache of this instance only (redis is changed by other one)
+func (r *Redis) DeleteLocal(key string) {
+	r.cache.DeleteFromLocalCache(key)
+}
+
+// RedisBus - invalidations by pub/sub channel of redis
+type RedisBus struct {
+	client  *redis.Client
+	channel string
+}
+
+// NewRedisBus - bus of redis client on channel
+func NewRedisBus(client *redis.Client, channel string) *RedisBus {
+	return &RedisBus{client: client, channel: channel}
+}
+
+// Publish - send invalidation to all subscribers of channel
+func (b *RedisBus) Publish(ctx context.Context, inv Invalidation) error {
+	msg, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, b.channel, msg).Err()
+}
+
+// Subscribe - handler is called for every invalidation of channel,
+// if redis is not reachable subscription is retried in background
+func (b *RedisBus) Subscribe(handler func(Invalidation)) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sub := b.client.Subscribe(ctx, b.channel)
+	// wait for subscription, so invalidations published after Subscribe are not missed
+	if _, err := sub.Receive(ctx); err != nil {
+		log.Printf("cache: subscribe to redis channel %s: %v, retrying in background", b.channel, err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for msg := range sub.Channel() {
+			var inv Invalidation
+			if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+				log.Printf("cache: broken invalidation of channel %s: %v", b.channel, err)
+				continue
+			}
+			handler(inv)
+		}
+	}()
+	return func() {
+		_ = sub.Close()
+		<-done
+	}, nil
+}
@@ -0,0 +1,56 @@
+// +build integration
+
+package cache_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/cache"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/redistest"
+)
+
+// redis of REDIS_ADDR
+func TestIntegrationRedis(t *testing.T) {
+	rdb := redistest.Client(t)
+	testCache(t, cache.NewRedis(rdb), fmt.Sprintf("test%d:", time.Now().UnixNano()))
+}
+
+// local tiers of instances on redis bus
+func TestIntegrationRedisInvalidating(t *testing.T) {
+	rdb := redistest.Client(t)
+	ctx := context.Background()
+	prefix := fmt.Sprintf("test%d:", time.Now().UnixNano())
+	bus := cache.NewRedisBus(rdb, prefix+"invalidate")
+	a, err := cache.NewInvalidating(cache.NewRedis(rdb), bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := cache.NewInvalidating(cache.NewRedis(rdb), bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if err = a.Set(ctx, prefix+"list", []string{"l1"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// b keeps key in local tier
+	var items []string
+	if err = b.Get(ctx, prefix+"list", &items); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Delete(ctx, prefix+"list"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for b.Get(ctx, prefix+"list", &items) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("key is not evicted from local tier of other instance")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,88 @@
+package fileutil
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// durable writes of files of repo and write back journals
+// snapshot is replaced as a whole (temp file + rename), journal is appended by whole records:
+// record which is not written or synced completely is cut off, so next record does not go after half of it
+
+// File - appended journal, it is *os.File
+type File interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+}
+
+// AppendRecord - write record at the end of journal and fsync it
+// on error journal is truncated back to its size before record (record is not applied by caller either)
+func AppendRecord(file File, rec []byte) error {
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("journal seek error: %w", err)
+	}
+	if _, err = file.Write(rec); err != nil {
+		return cutOff(file, offset, fmt.Errorf("journal write error: %w", err))
+	}
+	if err = file.Sync(); err != nil {
+		// record may be on disk or not, it is cut off so replay does not apply it
+		return cutOff(file, offset, fmt.Errorf("journal sync error: %w", err))
+	}
+	return nil
+}
+
+// cutOff - truncate journal to offset after error of record
+func cutOff(file File, offset int64, err error) error {
+	if errTrunc := file.Truncate(offset); errTrunc != nil {
+		return fmt.Errorf("%w, journal truncate error: %v", err, errTrunc)
+	}
+	if _, errSeek := file.Seek(offset, io.SeekStart); errSeek != nil {
+		return fmt.Errorf("%w, journal seek error: %v", err, errSeek)
+	}
+	return err
+}
+
+// WriteFileAtomic - write file via temp file in the same dir, fsync and rename
+// so file is either old or new one when crash happens
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+	tmp, err := os.CreateTemp(dir, filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer func() {
+		// nothing to remove if rename was successful
+		_ = os.Remove(tmpName)
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, filename); err != nil {
+		return err
+	}
+
+	// fsync dir to make rename durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
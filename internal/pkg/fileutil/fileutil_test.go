@@ -0,0 +1,89 @@
+package fileutil_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/fileutil"
+)
+
+// brokenFile - journal on full disk: write puts only part of record, or sync fails
+type brokenFile struct {
+	*os.File
+	short    bool
+	syncFail bool
+}
+
+func (f *brokenFile) Write(p []byte) (int, error) {
+	if f.short {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, errors.New("no space left on device")
+	}
+	return f.File.Write(p)
+}
+
+func (f *brokenFile) Sync() error {
+	if f.syncFail {
+		return errors.New("input/output error")
+	}
+	return f.File.Sync()
+}
+
+func TestAppendRecord(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.journal")
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	defer file.Close()
+	journal := &brokenFile{File: file}
+
+	require.NoError(t, fileutil.AppendRecord(journal, []byte("rec1\n")))
+
+	// half of record is cut off
+	journal.short = true
+	require.Error(t, fileutil.AppendRecord(journal, []byte("rec2 which is long\n")))
+	journal.short = false
+	require.NoError(t, fileutil.AppendRecord(journal, []byte("rec3\n")))
+
+	// record which is not synced is cut off
+	journal.syncFail = true
+	require.Error(t, fileutil.AppendRecord(journal, []byte("rec4\n")))
+	journal.syncFail = false
+
+	data, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, "rec1\nrec3\n", string(data))
+
+	// journal opened for append
+	appended, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	defer appended.Close()
+	journal = &brokenFile{File: appended, short: true}
+	require.Error(t, fileutil.AppendRecord(journal, []byte("rec5 which is long\n")))
+	journal.short = false
+	require.NoError(t, fileutil.AppendRecord(journal, []byte("rec6\n")))
+	data, err = os.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, "rec1\nrec3\nrec6\n", string(data))
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "snapshot.json")
+	require.NoError(t, fileutil.WriteFileAtomic(name, []byte("old"), 0600))
+	require.NoError(t, fileutil.WriteFileAtomic(name, []byte("new"), 0644))
+
+	data, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(data))
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	// no temp files are left
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
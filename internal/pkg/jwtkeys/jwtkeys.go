@@ -0,0 +1,264 @@
+package jwtkeys
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// signing and verification keys of jwt tokens
+// key files are kept in one dir, file name without extension is kid of key:
+// <kid>.pem - RSA (RS256) or EC (ES256/ES384/ES512) private key, or public key of older key which only verifies
+// <kid>.secret - HS256 shared secret
+// all keys verify tokens (so tokens of previous key are valid during rotation), one of private keys signs
+
+// DefaultKID - kid of key which is used when no keys are configured
+const DefaultKID = "default"
+
+// defaultSecret - HS256 secret of older versions, only for development setups without keys
+const defaultSecret = "AllYourBase"
+
+// Key - one key of set
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	// signKey - private key or secret, nil for public keys
+	signKey interface{}
+	// verifyKey - public key or secret
+	verifyKey interface{}
+}
+
+// KeySet - keys by kid and key which signs new tokens
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+// New - set of keys, signKID is kid of key which signs (it should have private key or secret)
+func New(signKID string, keys ...*Key) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*Key, len(keys))}
+	for _, key := range keys {
+		if _, ok := ks.keys[key.ID]; ok {
+			return nil, fmt.Errorf("jwt key %q is duplicated", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+	signing, ok := ks.keys[signKID]
+	if !ok {
+		return nil, fmt.Errorf("jwt signing key %q is not found", signKID)
+	}
+	if signing.signKey == nil {
+		return nil, fmt.Errorf("jwt signing key %q has no private key", signKID)
+	}
+	ks.signing = signing
+	return ks, nil
+}
+
+// Default - HS256 key set with secret of older versions, tokens are compatible with them
+func Default() *KeySet {
+	ks, _ := New(DefaultKID, NewSecretKey(DefaultKID, []byte(defaultSecret)))
+	return ks
+}
+
+// NewSecretKey - HS256 key
+func NewSecretKey(kid string, secret []byte) *Key {
+	return &Key{ID: kid, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+}
+
+// NewPrivateKey - RS256 key of *rsa.PrivateKey or ES256/384/512 key of *ecdsa.PrivateKey
+func NewPrivateKey(kid string, private interface{}) (*Key, error) {
+	switch priv := private.(type) {
+	case *rsa.PrivateKey:
+		return &Key{ID: kid, Method: jwt.SigningMethodRS256, signKey: priv, verifyKey: &priv.PublicKey}, nil
+	case *ecdsa.PrivateKey:
+		method, err := ecMethod(priv.Curve)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{ID: kid, Method: method, signKey: priv, verifyKey: &priv.PublicKey}, nil
+	}
+	return nil, fmt.Errorf("jwt key %q: unsupported private key type %T", kid, private)
+}
+
+// NewPublicKey - verify only key of *rsa.PublicKey or *ecdsa.PublicKey
+func NewPublicKey(kid string, public interface{}) (*Key, error) {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		return &Key{ID: kid, Method: jwt.SigningMethodRS256, verifyKey: pub}, nil
+	case *ecdsa.PublicKey:
+		method, err := ecMethod(pub.Curve)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{ID: kid, Method: method, verifyKey: pub}, nil
+	}
+	return nil, fmt.Errorf("jwt key %q: unsupported public key type %T", kid, public)
+}
+
+// ecMethod - ES method of curve
+func ecMethod(curve elliptic.Curve) (jwt.SigningMethod, error) {
+	switch curve {
+	case elliptic.P256():
+		return jwt.SigningMethodES256, nil
+	case elliptic.P384():
+		return jwt.SigningMethodES384, nil
+	case elliptic.P521():
+		return jwt.SigningMethodES512, nil
+	}
+	return nil, fmt.Errorf("unsupported ec curve %s", curve.Params().Name)
+}
+
+// LoadDir - key set of *.pem and *.secret files in dir
+func LoadDir(dir, signKID string) (*KeySet, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read jwt keys dir: %w", err)
+	}
+	var keys []*Key
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(entry.Name())
+		kid := strings.TrimSuffix(entry.Name(), ext)
+		if ext != ".pem" && ext != ".secret" {
+			continue
+		}
+		body, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read jwt key %q: %w", kid, err)
+		}
+		var key *Key
+		if ext == ".secret" {
+			secret := strings.TrimSpace(string(body))
+			if secret == "" {
+				return nil, fmt.Errorf("jwt key %q: secret is empty", kid)
+			}
+			key = NewSecretKey(kid, []byte(secret))
+		} else if key, err = ParsePEM(kid, body); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return New(signKID, keys...)
+}
+
+// ParsePEM - key of PEM block: private key (PKCS1, PKCS8, SEC1) or public key (PKIX, PKCS1)
+func ParsePEM(kid string, body []byte) (*Key, error) {
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, fmt.Errorf("jwt key %q: no PEM block", kid)
+	}
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("jwt key %q: unsupported PEM block %q", kid, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jwt key %q: %w", kid, err)
+	}
+	if strings.HasSuffix(block.Type, "PUBLIC KEY") {
+		return NewPublicKey(kid, parsed)
+	}
+	return NewPrivateKey(kid, parsed)
+}
+
+// Sign - signed token of claims, kid of signing key is in header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.Method, claims)
+	token.Header["kid"] = ks.signing.ID
+	return token.SignedString(ks.signing.signKey)
+}
+
+// Keyfunc - jwt.Parse key lookup by kid, tokens without kid (older versions) are checked by signing key
+// alg of token should be alg of key, so public key can not be used as HMAC secret
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	key := ks.signing
+	if kid, ok := token.Header["kid"]; ok {
+		kidText, _ := kid.(string)
+		if key, ok = ks.keys[kidText]; !ok {
+			return nil, fmt.Errorf("unknown kid %v", kid)
+		}
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v of key %s", token.Header["alg"], key.ID)
+	}
+	return key.verifyKey, nil
+}
+
+// JWK - public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS - set of public keys, answer of /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS - public keys of set sorted by kid, HS256 secrets are never published
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		b64 := base64.RawURLEncoding.EncodeToString
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, JWK{
+				Kty: "RSA",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				N:   b64(pub.N.Bytes()),
+				E:   b64(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			// coordinates are padded to curve size
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			jwks.Keys = append(jwks.Keys, JWK{
+				Kty: "EC",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: pub.Curve.Params().Name,
+				X:   b64(pub.X.FillBytes(make([]byte, size))),
+				Y:   b64(pub.Y.FillBytes(make([]byte, size))),
+			})
+		}
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		return jwks.Keys[i].Kid < jwks.Keys[j].Kid
+	})
+	return jwks
+}
@@ -0,0 +1,115 @@
+package jwtkeys_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/jwtkeys"
+)
+
+// writePEM - write key of PEM block type to dir/name
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) {
+	body := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), body, 0600))
+}
+
+func TestKeySetRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	writePEM(t, dir, "rsa-2024.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err)
+	writePEM(t, dir, "ec-2025.pem", "PRIVATE KEY", ecDER)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hs-old.secret"), []byte("oldsecret\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0600))
+
+	// tokens signed by rsa key before rotation
+	before, err := jwtkeys.LoadDir(dir, "rsa-2024")
+	require.NoError(t, err)
+	oldToken, err := before.Sign(jwt.MapClaims{"uid": "u1"})
+	require.NoError(t, err)
+
+	// rotation: ec key signs, rsa key still verifies (only its public part is left)
+	rsaPubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(dir, "rsa-2024.pem")))
+	writePEM(t, dir, "rsa-2024.pem", "PUBLIC KEY", rsaPubDER)
+	after, err := jwtkeys.LoadDir(dir, "ec-2025")
+	require.NoError(t, err)
+	newToken, err := after.Sign(jwt.MapClaims{"uid": "u2"})
+	require.NoError(t, err)
+
+	for _, ss := range []string{oldToken, newToken} {
+		token, err := jwt.Parse(ss, after.Keyfunc)
+		require.NoError(t, err)
+		require.True(t, token.Valid)
+	}
+	token, _ := jwt.Parse(newToken, after.Keyfunc)
+	require.Equal(t, "ec-2025", token.Header["kid"])
+	require.Equal(t, "ES256", token.Header["alg"])
+
+	// public key can not sign
+	_, err = jwtkeys.LoadDir(dir, "rsa-2024")
+	require.Error(t, err)
+
+	// only public keys are published
+	jwks := after.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	require.Equal(t, "ec-2025", jwks.Keys[0].Kid)
+	require.Equal(t, "EC", jwks.Keys[0].Kty)
+	require.Equal(t, "P-256", jwks.Keys[0].Crv)
+	require.Len(t, jwks.Keys[0].X, 43)
+	require.Equal(t, "rsa-2024", jwks.Keys[1].Kid)
+	require.Equal(t, "RS256", jwks.Keys[1].Alg)
+	require.Equal(t, "AQAB", jwks.Keys[1].E)
+}
+
+func TestKeySetRejects(t *testing.T) {
+	ks := jwtkeys.Default()
+	other, err := jwtkeys.New("k2", jwtkeys.NewSecretKey("k2", []byte("other")))
+	require.NoError(t, err)
+
+	// token of older version has no kid, it is checked by signing key
+	legacy := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"uid": "u1"})
+	ss, err := legacy.SignedString([]byte("AllYourBase"))
+	require.NoError(t, err)
+	token, err := jwt.Parse(ss, ks.Keyfunc)
+	require.NoError(t, err)
+	require.True(t, token.Valid)
+
+	// unknown kid
+	ss, err = other.Sign(jwt.MapClaims{"uid": "u1"})
+	require.NoError(t, err)
+	_, err = jwt.Parse(ss, ks.Keyfunc)
+	require.Error(t, err)
+
+	// alg of token should match key
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key, err := jwtkeys.NewPrivateKey(jwtkeys.DefaultKID, rsaKey)
+	require.NoError(t, err)
+	rsaSet, err := jwtkeys.New(jwtkeys.DefaultKID, key)
+	require.NoError(t, err)
+	ss, err = rsaSet.Sign(jwt.MapClaims{"uid": "u1"})
+	require.NoError(t, err)
+	_, err = jwt.Parse(ss, ks.Keyfunc)
+	require.Error(t, err)
+
+	// no jwks for secrets
+	require.Empty(t, ks.JWKS().Keys)
+}
@@ -1,6 +1,10 @@
 package model
 
-import "time"
+import (
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
+)
 
 // Data  - json array for Data
 type Data struct {
@@ -8,13 +12,26 @@ type Data struct {
 }
 
 // DataEl - элемент Data строки файла json
+// ExpiresAt - link can not be opened after this time, MaxRedirs - after this number of opens (optional, 0 - no limit)
+// Personal - link is in namespace of its user (/u/{uid}/{shortlink}), otherwise shortlink is unique for all users
 type DataEl struct {
-	UID      string    `json:"uid"`
-	URL      string    `json:"url"`
-	Shorturl string    `json:"shorturl"`
-	Datetime time.Time `json:"datetime"`
-	Active   int       `json:"active"`
-	Redirs   int       `json:"redirs"`
+	UID       string     `json:"uid"`
+	URL       string     `json:"url"`
+	Shorturl  string     `json:"shorturl"`
+	Datetime  time.Time  `json:"datetime"`
+	Active    int        `json:"active"`
+	Redirs    int        `json:"redirs"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	MaxRedirs int        `json:"max_redirs,omitempty"`
+	Personal  bool       `json:"personal,omitempty"`
+}
+
+// LinkRedirs - N opens of link which are not yet added to its Redirs, UID is owner of personal link
+type LinkRedirs struct {
+	UID      string `json:"uid,omitempty"`
+	Shorturl string `json:"shorturl"`
+	Personal bool   `json:"personal,omitempty"`
+	N        int64  `json:"n"`
 }
 
 // Users - array of user for json
@@ -23,11 +40,112 @@ type Users struct {
 }
 
 // User - элемент json
+// Balance - balance of user by ledger of payments, on registration it is opening balance of user
 type User struct {
-	UID     string `json:"uid"`
-	Name    string `json:"name"`
-	Passwd  string `json:"passwd"`
-	Email   string `json:"email"`
-	Role    string `json:"role"`
-	Balance string `json:"balance"`
+	UID     string       `json:"uid"`
+	Name    string       `json:"name"`
+	Passwd  string       `json:"passwd,omitempty"`
+	Email   string       `json:"email"`
+	Role    string       `json:"role"`
+	Balance money.Amount `json:"balance"`
+}
+
+// Click - one open of shortlink (event of /shortopen)
+// Owner - uid of link owner, it is set for personal link and filled by repo for global one
+// UID - who opened link (if known), IP - anonymised address of client
+type Click struct {
+	Shorturl  string    `json:"shorturl"`
+	Owner     string    `json:"owner,omitempty"`
+	Datetime  time.Time `json:"datetime"`
+	UID       string    `json:"uid,omitempty"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"useragent,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+}
+
+// StatQuery - what to count for shortlink stats in range [From, To)
+// Bucket - hour, day or week, empty if clicks series is not needed
+// Top - how many top referrers and user agents to give, 0 if they are not needed
+type StatQuery struct {
+	Bucket string
+	From   time.Time
+	To     time.Time
+	Top    int
+}
+
+// ClickBucket - clicks in one bucket of time series, Start - start of bucket (UTC)
+type ClickBucket struct {
+	Start  time.Time `json:"start"`
+	Clicks int       `json:"clicks"`
+}
+
+// TopEl - referrer or user agent with its clicks
+type TopEl struct {
+	Value  string `json:"value"`
+	Clicks int    `json:"clicks"`
+}
+
+// ClickStats - json of shortlink stats
+type ClickStats struct {
+	Shorturl   string        `json:"shorturl"`
+	Bucket     string        `json:"bucket,omitempty"`
+	From       time.Time     `json:"from"`
+	To         time.Time     `json:"to"`
+	Total      int           `json:"total"`
+	Clicks     []ClickBucket `json:"clicks,omitempty"`
+	Referrers  []TopEl       `json:"referrers,omitempty"`
+	UserAgents []TopEl       `json:"useragents,omitempty"`
+}
+
+// Session - login of user: family of refresh tokens, ID is family id (sid claim of tokens)
+// JTI - id of current refresh token of family, older ones are rotated out
+// Revoked - session is killed (logout or reuse of rotated token), its tokens are not refreshed any more
+type Session struct {
+	ID        string    `json:"id"`
+	UID       string    `json:"uid"`
+	JTI       string    `json:"jti,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UserAgent string    `json:"useragent,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Revoked   bool      `json:"revoked,omitempty"`
+	Current   bool      `json:"current,omitempty"`
+}
+
+// Sessions - json array of sessions
+type Sessions struct {
+	Data []Session `json:"data"`
+}
+
+// APIKey - long-lived key of user for programmatic access instead of jwt login
+// Key - the key itself, it is given only once when key is created, repo keeps only its Hash
+// Scopes - actions of policy which key is limited to
+// ExpiresAt - zero time means key does not expire, Revoked - key is killed by user
+type APIKey struct {
+	ID        string    `json:"id"`
+	UID       string    `json:"uid"`
+	Name      string    `json:"name"`
+	Key       string    `json:"key,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// APIKeys - json array of api keys
+type APIKeys struct {
+	Data []APIKey `json:"data"`
+}
+
+// Identity - account of user at OpenID Connect provider, it is keyed by Issuer and Subject (iss and sub of id token)
+// Email - email of account when it was linked, provider may change it, so user is not looked up by it
+type Identity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	UID       string    `json:"uid"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
 }
@@ -0,0 +1,153 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// суммы денег на балансах пользователей
+// Amount is fixed point number of cents, so sums are exact like NUMERIC(12,2) of pg (no float64).
+// in json and sql it is decimal string "100.00", json number 100.5 is taken as well.
+// sql parameter is String() of amount ($1::numeric), as pgx would take Amount as number of cents
+
+// Cent, Unit - 0.01 and 1.00
+const (
+	Cent Amount = 1
+	Unit Amount = 100
+)
+
+// Max - the biggest amount of NUMERIC(12,2): 9999999999.99
+const Max Amount = 999999999999
+
+// ErrRange - amount is bigger than Max
+var ErrRange = errors.New("money: amount is out of range")
+
+// Amount - money in cents
+type Amount int64
+
+// Parse - amount of decimal string: "10", "-3.5", "100.00", at most 2 digits after point
+func Parse(s string) (Amount, error) {
+	str := s
+	neg := false
+	switch {
+	case strings.HasPrefix(str, "-"):
+		neg, str = true, str[1:]
+	case strings.HasPrefix(str, "+"):
+		str = str[1:]
+	}
+	units, cents := str, ""
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		units, cents = str[:i], str[i+1:]
+		if cents == "" || len(cents) > 2 {
+			return 0, fmt.Errorf("money: wrong amount %q: 1 or 2 digits after point are expected", s)
+		}
+	}
+	if units == "" || !digits(units) || !digits(cents) {
+		return 0, fmt.Errorf("money: wrong amount %q", s)
+	}
+	// units are checked before they overflow int64
+	if len(strings.TrimLeft(units, "0")) > 10 {
+		return 0, fmt.Errorf("%w: %q", ErrRange, s)
+	}
+	u, err := strconv.ParseInt(units, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("money: wrong amount %q: %w", s, err)
+	}
+	c := int64(0)
+	if cents != "" {
+		c, _ = strconv.ParseInt((cents + "0")[:2], 10, 64)
+	}
+	a := Amount(u*100 + c)
+	if a > Max {
+		return 0, fmt.Errorf("%w: %q", ErrRange, s)
+	}
+	if neg {
+		a = -a
+	}
+	return a, nil
+}
+
+// digits - s has only decimal digits
+func digits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// MustParse - Parse of constant amount, panics if it is wrong
+func MustParse(s string) Amount {
+	a, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// Valid - amount is in range of NUMERIC(12,2)
+func (a Amount) Valid() bool {
+	return a >= -Max && a <= Max
+}
+
+// String - decimal string with 2 digits after point: "-3.50"
+func (a Amount) String() string {
+	sign := ""
+	abs := int64(a)
+	if abs < 0 {
+		sign, abs = "-", -abs
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, abs/100, abs%100)
+}
+
+// MarshalJSON - amount as decimal string
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON - amount of decimal string or number, "" and null are 0.00
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	str := string(data)
+	if str == "null" {
+		*a = 0
+		return nil
+	}
+	if strings.HasPrefix(str, `"`) {
+		if err := json.Unmarshal(data, &str); err != nil {
+			return err
+		}
+		if str == "" {
+			*a = 0
+			return nil
+		}
+	}
+	parsed, err := Parse(str)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Scan - amount of sql column (numeric::varchar)
+func (a *Amount) Scan(src interface{}) error {
+	var str string
+	switch v := src.(type) {
+	case string:
+		str = v
+	case []byte:
+		str = string(v)
+	default:
+		return fmt.Errorf("money: can not scan %T", src)
+	}
+	parsed, err := Parse(str)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
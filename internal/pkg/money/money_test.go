@@ -0,0 +1,92 @@
+package money_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    money.Amount
+		str     string
+		wantErr bool
+	}{
+		{in: "100.00", want: 100 * money.Unit, str: "100.00"},
+		{in: "10.0", want: 10 * money.Unit, str: "10.00"},
+		{in: "10", want: 10 * money.Unit, str: "10.00"},
+		{in: "0.1", want: 10 * money.Cent, str: "0.10"},
+		{in: "-3.05", want: -305, str: "-3.05"},
+		{in: "+7.5", want: 750, str: "7.50"},
+		{in: "9999999999.99", want: money.Max, str: "9999999999.99"},
+		{in: "0000000000001.00", want: money.Unit, str: "1.00"},
+		{in: "10000000000.00", wantErr: true},
+		{in: "99999999999999999999", wantErr: true},
+		{in: "1.005", wantErr: true},
+		{in: "1.", wantErr: true},
+		{in: ".5", wantErr: true},
+		{in: "1e3", wantErr: true},
+		{in: "1,5", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "-", wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := money.Parse(tt.in)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.str, got.String())
+		})
+	}
+}
+
+func TestAmountExact(t *testing.T) {
+	// 0.1 + 0.2 is 0.30 exactly, float64 gives 0.30000000000000004
+	sum := money.MustParse("0.1") + money.MustParse("0.2")
+	require.Equal(t, money.MustParse("0.30"), sum)
+
+	var balance money.Amount
+	for i := 0; i < 1000; i++ {
+		balance += money.MustParse("0.01")
+	}
+	require.Equal(t, "10.00", balance.String())
+}
+
+func TestAmountJSON(t *testing.T) {
+	var user struct {
+		Balance money.Amount `json:"balance"`
+	}
+	for in, want := range map[string]money.Amount{
+		`{"balance":"100.00"}`: 100 * money.Unit,
+		`{"balance":42.5}`:     4250,
+		`{"balance":""}`:       0,
+		`{"balance":null}`:     0,
+	} {
+		require.NoError(t, json.Unmarshal([]byte(in), &user), in)
+		require.Equal(t, want, user.Balance, in)
+	}
+	require.Error(t, json.Unmarshal([]byte(`{"balance":"1.234"}`), &user))
+
+	user.Balance = -250
+	data, err := json.Marshal(user)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"balance":"-2.50"}`, string(data))
+}
+
+func TestAmountSQL(t *testing.T) {
+	var a money.Amount
+	require.NoError(t, a.Scan([]byte("99.99")))
+	require.Equal(t, money.Amount(9999), a)
+	require.NoError(t, a.Scan("0.00"))
+	require.Equal(t, money.Amount(0), a)
+	require.Error(t, a.Scan(12.5))
+}
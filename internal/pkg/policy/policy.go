@@ -0,0 +1,149 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// permissions of user roles
+// every api action has name like link.create, action without .any works with own data of user,
+// action with .any works with data of other users as well
+// matrix role -> actions is default one or is loaded from json file:
+// {"SUPERUSER": ["link.create", ...], "CREATOR": [...], "USER": [...]}
+
+// Action - what user does
+type Action string
+
+// api actions
+const (
+	// LinkCreate - add new link
+	LinkCreate Action = "link.create"
+	// LinkRead - list own links and see their stats
+	LinkRead Action = "link.read"
+	// LinkReadAny - see links and stats of other users, urls are not masked
+	LinkReadAny Action = "link.read.any"
+	// LinkListAll - list links of all users (urls are masked without LinkReadAny)
+	LinkListAll Action = "link.list.all"
+	// LinkUpdate - update own link
+	LinkUpdate Action = "link.update"
+	// LinkUpdateAny - update link of other user
+	LinkUpdateAny Action = "link.update.any"
+	// LinkDelete - delete own link
+	LinkDelete Action = "link.delete"
+	// LinkDeleteAny - delete link of other user
+	LinkDeleteAny Action = "link.delete.any"
+	// LinkOpen - open shortlink
+	LinkOpen Action = "link.open"
+	// LinkOpenFree - open shortlink without payment
+	LinkOpenFree Action = "link.open.free"
+	// UserRead - see own profile
+	UserRead Action = "user.read"
+	// UserReadAny - see profiles of other users and list all users
+	UserReadAny Action = "user.read.any"
+	// UserUpdateAny - update profile of any user
+	UserUpdateAny Action = "user.update.any"
+	// UserDeleteAny - delete any user (but superuser)
+	UserDeleteAny Action = "user.delete.any"
+)
+
+// Actions - all known actions
+var Actions = []Action{
+	LinkCreate, LinkRead, LinkReadAny, LinkListAll,
+	LinkUpdate, LinkUpdateAny, LinkDelete, LinkDeleteAny,
+	LinkOpen, LinkOpenFree,
+	UserRead, UserReadAny, UserUpdateAny, UserDeleteAny,
+}
+
+// user roles, the same as user_role of pg users table
+const (
+	SuperUser = "SUPERUSER"
+	Creator   = "CREATOR"
+	User      = "USER"
+)
+
+// Roles - all user roles
+var Roles = []string{SuperUser, Creator, User}
+
+// Policy - actions allowed to roles
+type Policy struct {
+	allowed map[string]map[Action]bool
+}
+
+// Known - action is one of Actions
+func Known(action Action) bool {
+	for _, known := range Actions {
+		if action == known {
+			return true
+		}
+	}
+	return false
+}
+
+// New - policy of matrix role -> actions, unknown actions are errors (so typo in config is not ignored)
+func New(matrix map[string][]Action) (*Policy, error) {
+	p := &Policy{allowed: make(map[string]map[Action]bool, len(matrix))}
+	for role, actions := range matrix {
+		if role == "" {
+			return nil, fmt.Errorf("policy: empty role")
+		}
+		p.allowed[role] = make(map[Action]bool, len(actions))
+		for _, action := range actions {
+			if !Known(action) {
+				return nil, fmt.Errorf("policy: unknown action %q of role %s", action, role)
+			}
+			p.allowed[role][action] = true
+		}
+	}
+	return p, nil
+}
+
+// Default - policy of previous versions: superuser does anything, creator manages own links,
+// user opens links for payment and sees links of all users with urls masked
+func Default() *Policy {
+	p, _ := New(map[string][]Action{
+		SuperUser: Actions,
+		Creator: {
+			LinkCreate, LinkRead, LinkUpdate, LinkDelete, LinkOpen, LinkOpenFree,
+			UserRead,
+		},
+		User: {
+			LinkRead, LinkListAll, LinkUpdate, LinkOpen,
+			UserRead,
+		},
+	})
+	return p
+}
+
+// Load - policy of json file
+func Load(path string) (*Policy, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policy file: %w", err)
+	}
+	var matrix map[string][]Action
+	if err = json.Unmarshal(body, &matrix); err != nil {
+		return nil, fmt.Errorf("parse policy file %s: %w", path, err)
+	}
+	return New(matrix)
+}
+
+// Allowed - role is allowed to do action, unknown role is allowed nothing
+func (p *Policy) Allowed(role string, action Action) bool {
+	return p.allowed[role][action]
+}
+
+// Matrix - actions of roles sorted by name, e.g. to log policy on start
+func (p *Policy) Matrix() map[string][]Action {
+	matrix := make(map[string][]Action, len(p.allowed))
+	for role, actions := range p.allowed {
+		list := make([]Action, 0, len(actions))
+		for action := range actions {
+			list = append(list, action)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+		matrix[role] = list
+	}
+	return matrix
+}
@@ -0,0 +1,58 @@
+package policy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/policy"
+)
+
+func TestDefault(t *testing.T) {
+	p := policy.Default()
+
+	for _, action := range policy.Actions {
+		require.True(t, p.Allowed(policy.SuperUser, action), action)
+		require.False(t, p.Allowed("", action), action)
+		require.False(t, p.Allowed("GUEST", action), action)
+	}
+	require.True(t, p.Allowed(policy.Creator, policy.LinkCreate))
+	require.False(t, p.Allowed(policy.Creator, policy.LinkDeleteAny))
+	require.False(t, p.Allowed(policy.User, policy.LinkCreate))
+	require.False(t, p.Allowed(policy.User, policy.LinkDelete))
+	require.False(t, p.Allowed(policy.User, policy.LinkOpenFree))
+	require.True(t, p.Allowed(policy.User, policy.LinkListAll))
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"SUPERUSER": ["user.read.any", "link.delete.any"],
+		"USER": ["link.create", "link.open"],
+		"GUEST": []
+	}`), 0600))
+	p, err := policy.Load(path)
+	require.NoError(t, err)
+	require.True(t, p.Allowed(policy.User, policy.LinkCreate))
+	require.False(t, p.Allowed(policy.SuperUser, policy.LinkCreate))
+	// roles which are not in file are allowed nothing
+	require.False(t, p.Allowed(policy.Creator, policy.LinkOpen))
+	require.Equal(t, []policy.Action{policy.LinkDeleteAny, policy.UserReadAny}, p.Matrix()[policy.SuperUser])
+	require.Empty(t, p.Matrix()["GUEST"])
+
+	// typo in action
+	require.NoError(t, os.WriteFile(path, []byte(`{"USER": ["link.craete"]}`), 0600))
+	_, err = policy.Load(path)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`["link.create"]`), 0600))
+	_, err = policy.Load(path)
+	require.Error(t, err)
+
+	_, err = policy.Load(filepath.Join(dir, "none.json"))
+	require.Error(t, err)
+}
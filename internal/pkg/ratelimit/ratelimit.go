@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// token bucket rate limits
+// bucket of key holds up to Burst tokens and gets Rate tokens per second, every request takes one token,
+// request without token is rejected and is told when next token comes
+// buckets are kept in process (Memory) or in redis (Redis), so they are shared by all instances of api
+
+// Limit - Rate tokens per second, Burst - size of bucket
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Per - limit of n requests per period, burst of n
+func Per(n int, period time.Duration) Limit {
+	return Limit{Rate: float64(n) / period.Seconds(), Burst: n}
+}
+
+// Validate - limit can give tokens
+func (l Limit) Validate() error {
+	if l.Rate <= 0 || l.Burst < 1 {
+		return fmt.Errorf("ratelimit: rate %v and burst %d should be positive", l.Rate, l.Burst)
+	}
+	return nil
+}
+
+// Store - buckets of keys
+// Take takes token of key bucket, retryAfter - time to next token when request is not allowed
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// take - token bucket step: tokens of bucket updated at last are refilled to now and one is taken
+// returns tokens left and time to next token (zero if token is taken)
+func take(limit Limit, tokens float64, last, now time.Time) (float64, time.Duration) {
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(limit.Burst), tokens+elapsed*limit.Rate)
+	}
+	if tokens >= 1 {
+		return tokens - 1, 0
+	}
+	return tokens, time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+}
+
+// full - time to refill empty bucket, bucket which is idle for so long is the same as new one
+func full(limit Limit) time.Duration {
+	return time.Duration(float64(limit.Burst) / limit.Rate * float64(time.Second))
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// idle - time after last when bucket is full again
+	idle time.Duration
+}
+
+// Memory - buckets of this process
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	// swept - last time of removing full buckets
+	swept time.Time
+}
+
+// memorySweep - interval of removing full buckets, so map does not grow with every ip ever seen
+const memorySweep = time.Minute
+
+// NewMemory - empty in-process store
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]*bucket)}
+}
+
+// Take - take token of key bucket
+func (m *Memory) Take(_ context.Context, key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.swept) > memorySweep {
+		for k, b := range m.buckets {
+			if now.Sub(b.last) > b.idle {
+				delete(m.buckets, k)
+			}
+		}
+		m.swept = now
+	}
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		m.buckets[key] = b
+	}
+	var retryAfter time.Duration
+	b.tokens, retryAfter = take(limit, b.tokens, b.last, now)
+	if now.After(b.last) {
+		b.last = now
+	}
+	b.idle = full(limit)
+	return retryAfter == 0, retryAfter, nil
+}
+
+// Len - number of buckets kept
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.buckets)
+}
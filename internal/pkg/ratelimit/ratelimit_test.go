@@ -0,0 +1,86 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/ratelimit"
+)
+
+// testStore - token bucket behaviour of store, keys are prefixed by prefix
+func testStore(t *testing.T, store ratelimit.Store, prefix string) {
+	ctx := context.Background()
+	limit := ratelimit.Per(3, 3*time.Second)
+	now := time.Now()
+
+	// burst is taken at once, then one token per second
+	for i := 0; i < 3; i++ {
+		allowed, _, err := store.Take(ctx, prefix+"a", limit, now)
+		require.NoError(t, err)
+		require.True(t, allowed, "request %d", i)
+	}
+	allowed, retryAfter, err := store.Take(ctx, prefix+"a", limit, now)
+	require.NoError(t, err)
+	require.False(t, allowed)
+	require.InDelta(t, time.Second, retryAfter, float64(10*time.Millisecond))
+
+	// other key has own bucket
+	allowed, _, err = store.Take(ctx, prefix+"b", limit, now)
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	allowed, retryAfter, err = store.Take(ctx, prefix+"a", limit, now.Add(500*time.Millisecond))
+	require.NoError(t, err)
+	require.False(t, allowed)
+	require.InDelta(t, 500*time.Millisecond, retryAfter, float64(10*time.Millisecond))
+	allowed, _, err = store.Take(ctx, prefix+"a", limit, now.Add(time.Second))
+	require.NoError(t, err)
+	require.True(t, allowed)
+	allowed, _, err = store.Take(ctx, prefix+"a", limit, now.Add(time.Second))
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	// idle bucket is refilled up to burst only
+	for i := 0; i < 3; i++ {
+		allowed, _, err = store.Take(ctx, prefix+"a", limit, now.Add(time.Hour))
+		require.NoError(t, err)
+		require.True(t, allowed, "request %d", i)
+	}
+	allowed, _, err = store.Take(ctx, prefix+"a", limit, now.Add(time.Hour))
+	require.NoError(t, err)
+	require.False(t, allowed)
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, ratelimit.NewMemory(), "")
+}
+
+func TestMemorySweep(t *testing.T) {
+	store := ratelimit.NewMemory()
+	ctx := context.Background()
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		_, _, err := store.Take(ctx, key, ratelimit.Per(1, time.Second), now)
+		require.NoError(t, err)
+	}
+	_, _, err := store.Take(ctx, "long", ratelimit.Per(1, time.Hour), now)
+	require.NoError(t, err)
+	require.Equal(t, 4, store.Len())
+
+	// full buckets are dropped, bucket of long period is kept
+	_, _, err = store.Take(ctx, "d", ratelimit.Per(1, time.Second), now.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 2, store.Len())
+}
+
+func TestLimit(t *testing.T) {
+	limit := ratelimit.Per(10, time.Minute)
+	require.Equal(t, 10, limit.Burst)
+	require.InDelta(t, 1.0/6, limit.Rate, 1e-9)
+	require.NoError(t, limit.Validate())
+	require.Error(t, ratelimit.Limit{Rate: 0, Burst: 1}.Validate())
+	require.Error(t, ratelimit.Limit{Rate: 1, Burst: 0}.Validate())
+}
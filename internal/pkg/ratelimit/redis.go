@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisPrefix - prefix of bucket keys in redis
+const redisPrefix = "ratelimit:"
+
+// redisTake - token bucket step of take in one script, so instances do not race for bucket
+// KEYS[1] - bucket hash {tokens, last (ms)}, ARGV - rate (per ms), burst, now (ms), ttl (ms)
+// returns {1, 0} - token is taken, {0, ms} - time to next token
+var redisTake = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(bucket[1])
+local last = tonumber(bucket[2])
+if tokens == nil then
+  tokens = burst
+  last = now
+end
+if now > last then
+  tokens = math.min(burst, tokens + (now - last) * rate)
+  last = now
+end
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', last)
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return {allowed, wait}
+`)
+
+// Redis - buckets in redis, shared by instances of api
+type Redis struct {
+	client redis.Scripter
+}
+
+// NewRedis - store of redis client
+func NewRedis(client redis.Scripter) *Redis {
+	return &Redis{client: client}
+}
+
+// Take - take token of key bucket, now of instance is used, so clocks of instances should be in sync
+func (r *Redis) Take(ctx context.Context, key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	ttl := full(limit) + time.Second
+	res, err := redisTake.Run(ctx, r.client, []string{redisPrefix + key},
+		limit.Rate/1000, limit.Burst, now.UnixMilli(), ttl.Milliseconds()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return res[0] == 1, time.Duration(res[1]) * time.Millisecond, nil
+}
@@ -0,0 +1,18 @@
+// +build integration
+
+package ratelimit_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/ratelimit"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/redistest"
+)
+
+// redis of REDIS_ADDR
+func TestIntegrationRedis(t *testing.T) {
+	rdb := redistest.Client(t)
+	testStore(t, ratelimit.NewRedis(rdb), fmt.Sprintf("test%d:", time.Now().UnixNano()))
+}
@@ -0,0 +1,144 @@
+package redirs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// счетчики открытий ссылок
+// open of link is counted in store (Add), not in repo. flusher takes all pending opens as one batch (Take),
+// adds it to repo and acknowledges it (Ack). batch is sealed: Take returns the same batch with the same id
+// until it is acknowledged, so batch which is added to repo but not acknowledged (crash, restart, error)
+// is added again by next flush, and repo ignores it by id - opens are added exactly once.
+// Memory - counters of process, they are lost if process crashes before flush,
+// Redis - counters shared by instances, they are kept across restarts
+
+// ErrNoBatch - acknowledged batch is not the batch of store
+var ErrNoBatch = errors.New("redirs: there is no such batch")
+
+// Batch - opens of links sealed for flush, empty ID - there is nothing to flush
+type Batch struct {
+	ID     string
+	Redirs []model.LinkRedirs
+}
+
+// Store - counters of opens which are not yet added to repo
+// Pending - opens of link which are not acknowledged (pending and sealed ones)
+type Store interface {
+	Add(ctx context.Context, link model.LinkRedirs) error
+	Pending(ctx context.Context, link model.LinkRedirs) (int64, error)
+	Take(ctx context.Context) (Batch, error)
+	Ack(ctx context.Context, id string) error
+}
+
+// NewBatchID - random id of batch
+func NewBatchID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// field - counter name of link: g:<shortlink> or p:<uid>:<shortlink>
+func field(link model.LinkRedirs) string {
+	if link.Personal {
+		return "p:" + link.UID + ":" + link.Shorturl
+	}
+	return "g:" + link.Shorturl
+}
+
+// parseField - link of counter name with n opens
+func parseField(name string, n int64) (model.LinkRedirs, error) {
+	switch {
+	case strings.HasPrefix(name, "g:"):
+		return model.LinkRedirs{Shorturl: name[2:], N: n}, nil
+	case strings.HasPrefix(name, "p:"):
+		parts := strings.SplitN(name[2:], ":", 2)
+		if len(parts) == 2 {
+			return model.LinkRedirs{UID: parts[0], Shorturl: parts[1], Personal: true, N: n}, nil
+		}
+	}
+	return model.LinkRedirs{}, fmt.Errorf("redirs: broken counter %q", name)
+}
+
+// newBatch - batch id of counters, links are in order of counter names
+func newBatch(id string, counters map[string]int64) (Batch, error) {
+	batch := Batch{ID: id, Redirs: make([]model.LinkRedirs, 0, len(counters))}
+	for name, n := range counters {
+		link, err := parseField(name, n)
+		if err != nil {
+			return Batch{}, err
+		}
+		batch.Redirs = append(batch.Redirs, link)
+	}
+	sort.Slice(batch.Redirs, func(a, b int) bool { return field(batch.Redirs[a]) < field(batch.Redirs[b]) })
+	return batch, nil
+}
+
+// Memory - counters of this process
+type Memory struct {
+	mu      sync.Mutex
+	pending map[string]int64
+	// sealed - counters of batch sealedID which is not acknowledged yet
+	sealed   map[string]int64
+	sealedID string
+}
+
+// NewMemory - store without opens
+func NewMemory() *Memory {
+	return &Memory{pending: make(map[string]int64)}
+}
+
+// Add - link.N opens of link
+func (m *Memory) Add(_ context.Context, link model.LinkRedirs) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending[field(link)] += link.N
+	return nil
+}
+
+// Pending - opens of link which are not acknowledged
+func (m *Memory) Pending(_ context.Context, link model.LinkRedirs) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name := field(link)
+	return m.pending[name] + m.sealed[name], nil
+}
+
+// Take - batch which is not acknowledged, or pending opens sealed as new batch
+func (m *Memory) Take(_ context.Context) (Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sealedID == "" {
+		if len(m.pending) == 0 {
+			return Batch{}, nil
+		}
+		id, err := NewBatchID()
+		if err != nil {
+			return Batch{}, err
+		}
+		m.sealed, m.sealedID = m.pending, id
+		m.pending = make(map[string]int64)
+	}
+	return newBatch(m.sealedID, m.sealed)
+}
+
+// Ack - batch id is added to repo
+func (m *Memory) Ack(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id == "" || id != m.sealedID {
+		return ErrNoBatch
+	}
+	m.sealed, m.sealedID = nil, ""
+	return nil
+}
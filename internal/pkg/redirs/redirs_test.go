@@ -0,0 +1,65 @@
+package redirs_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/redirs"
+)
+
+// testStore - behaviour of any store without opens
+func testStore(t *testing.T, store redirs.Store) {
+	ctx := context.Background()
+	global := model.LinkRedirs{Shorturl: "l1", N: 1}
+	personal := model.LinkRedirs{UID: "u1", Shorturl: "l1:x", Personal: true, N: 2}
+
+	batch, err := store.Take(ctx)
+	require.NoError(t, err)
+	require.Empty(t, batch.ID)
+
+	require.NoError(t, store.Add(ctx, global))
+	require.NoError(t, store.Add(ctx, global))
+	require.NoError(t, store.Add(ctx, personal))
+	n, err := store.Pending(ctx, global)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+
+	// batch is sealed: it is taken again until it is acknowledged, new opens wait for next batch
+	batch, err = store.Take(ctx)
+	require.NoError(t, err)
+	require.NotEmpty(t, batch.ID)
+	require.Equal(t, []model.LinkRedirs{
+		{Shorturl: "l1", N: 2},
+		{UID: "u1", Shorturl: "l1:x", Personal: true, N: 2},
+	}, batch.Redirs)
+	require.NoError(t, store.Add(ctx, global))
+	again, err := store.Take(ctx)
+	require.NoError(t, err)
+	require.Equal(t, batch, again)
+	n, err = store.Pending(ctx, global)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+
+	require.ErrorIs(t, store.Ack(ctx, "other"), redirs.ErrNoBatch)
+	require.NoError(t, store.Ack(ctx, batch.ID))
+	require.ErrorIs(t, store.Ack(ctx, batch.ID), redirs.ErrNoBatch)
+	n, err = store.Pending(ctx, personal)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), n)
+
+	next, err := store.Take(ctx)
+	require.NoError(t, err)
+	require.NotEqual(t, batch.ID, next.ID)
+	require.Equal(t, []model.LinkRedirs{{Shorturl: "l1", N: 1}}, next.Redirs)
+	require.NoError(t, store.Ack(ctx, next.ID))
+	batch, err = store.Take(ctx)
+	require.NoError(t, err)
+	require.Empty(t, batch.ID)
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, redirs.NewMemory())
+}
@@ -0,0 +1,110 @@
+package redirs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// keys of store in redis: pending counters (hash), sealed counters (hash) and id of sealed batch
+const (
+	redisPending = "pending"
+	redisSealed  = "sealed"
+	redisBatchID = "batch"
+)
+
+// redisTake - seal pending counters as batch ARGV[1] unless there is sealed batch already, in one script
+// KEYS - pending, sealed, batch id; returns {} - nothing to flush, or {id, name1, n1, name2, n2, ...}
+var redisTake = redis.NewScript(`
+local id = redis.call('GET', KEYS[3])
+if not id then
+  if redis.call('EXISTS', KEYS[1]) == 0 then
+    return {}
+  end
+  redis.call('RENAME', KEYS[1], KEYS[2])
+  redis.call('SET', KEYS[3], ARGV[1])
+  id = ARGV[1]
+end
+local res = redis.call('HGETALL', KEYS[2])
+table.insert(res, 1, id)
+return res
+`)
+
+// redisAck - drop sealed batch ARGV[1], returns 0 if it is not sealed batch
+var redisAck = redis.NewScript(`
+if redis.call('GET', KEYS[3]) ~= ARGV[1] then
+  return 0
+end
+redis.call('DEL', KEYS[2], KEYS[3])
+return 1
+`)
+
+// Redis - counters in redis, shared by instances of api
+type Redis struct {
+	client redis.Cmdable
+	keys   []string
+}
+
+// NewRedis - store of client with keys of prefix
+func NewRedis(client redis.Cmdable, prefix string) *Redis {
+	return &Redis{client: client, keys: []string{prefix + redisPending, prefix + redisSealed, prefix + redisBatchID}}
+}
+
+// Add - link.N opens of link (HINCRBY)
+func (r *Redis) Add(ctx context.Context, link model.LinkRedirs) error {
+	return r.client.HIncrBy(ctx, r.keys[0], field(link), link.N).Err()
+}
+
+// Pending - opens of link which are not acknowledged
+func (r *Redis) Pending(ctx context.Context, link model.LinkRedirs) (int64, error) {
+	name := field(link)
+	var total int64
+	for _, key := range r.keys[:2] {
+		n, err := r.client.HGet(ctx, key, name).Int64()
+		if err != nil && err != redis.Nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Take - batch which is not acknowledged, or pending opens sealed as new batch
+func (r *Redis) Take(ctx context.Context) (Batch, error) {
+	id, err := NewBatchID()
+	if err != nil {
+		return Batch{}, err
+	}
+	res, err := redisTake.Run(ctx, r.client, r.keys, id).StringSlice()
+	if err != nil {
+		return Batch{}, err
+	}
+	if len(res) == 0 {
+		return Batch{}, nil
+	}
+	counters := make(map[string]int64, len(res)/2)
+	for i := 1; i+1 < len(res); i += 2 {
+		n, err := strconv.ParseInt(res[i+1], 10, 64)
+		if err != nil {
+			return Batch{}, fmt.Errorf("redirs: broken counter %q: %w", res[i], err)
+		}
+		counters[res[i]] = n
+	}
+	return newBatch(res[0], counters)
+}
+
+// Ack - batch id is added to repo
+func (r *Redis) Ack(ctx context.Context, id string) error {
+	acked, err := redisAck.Run(ctx, r.client, r.keys, id).Int()
+	if err != nil {
+		return err
+	}
+	if acked == 0 {
+		return ErrNoBatch
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+// +build integration
+
+package redirs_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/redirs"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/redistest"
+)
+
+// redis of REDIS_ADDR
+func TestIntegrationRedis(t *testing.T) {
+	rdb := redistest.Client(t)
+	testStore(t, redirs.NewRedis(rdb, fmt.Sprintf("test%d:redirs:", time.Now().UnixNano())))
+}
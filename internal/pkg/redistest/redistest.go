@@ -0,0 +1,27 @@
+package redistest
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redis для интеграционных тестов
+// redis is taken from REDIS_ADDR, test is skipped when it is not set or redis does not answer ping
+
+// Client - client of redis of REDIS_ADDR, it is closed when test ends
+func Client(t testing.TB) *redis.Client {
+	t.Helper()
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { _ = rdb.Close() })
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("redis %s is not available: %v", addr, err)
+	}
+	return rdb
+}
@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// api keys helpers - same rules for all repos
+// key is random and long, so it is kept as sha256 (no need for slow hash like passwords), repo is looked up by hash
+
+// ErrNoAPIKey - no such api key (or it is revoked or expired)
+var ErrNoAPIKey = errors.New("no such api key")
+
+// apiKeyTouch - last_used of key is updated not more often than this, so every request does not write to repo
+const apiKeyTouch = time.Minute
+
+// HashAPIKey - hash of key which is kept in repo
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyAlive - key is not revoked and not expired
+func apiKeyAlive(key model.APIKey, now time.Time) bool {
+	return !key.Revoked && (key.ExpiresAt.IsZero() || now.Before(key.ExpiresAt))
+}
+
+// liveAPIKeys - alive keys of uid sorted by creation, hashes are not given away
+func liveAPIKeys(keys []model.APIKey, uid string, now time.Time) []model.APIKey {
+	live := []model.APIKey{}
+	for _, key := range keys {
+		if key.UID == uid && apiKeyAlive(key, now) {
+			key.Hash = ""
+			live = append(live, key)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].CreatedAt.Before(live[j].CreatedAt)
+	})
+	return live
+}
+
+// newAPIKey - key to be put: it should have id, uid, key and scopes, key itself is replaced by its hash
+func newAPIKey(key model.APIKey) (model.APIKey, error) {
+	if key.ID == "" || key.UID == "" || key.Key == "" || len(key.Scopes) == 0 {
+		return model.APIKey{}, fmt.Errorf("api key should have id, uid, key and scopes")
+	}
+	key.Hash = HashAPIKey(key.Key)
+	key.Key = ""
+	return key, nil
+}
+
+// touchAPIKey - alive key of auth, changed - last_used is updated and key has to be saved
+func touchAPIKey(key *model.APIKey, now time.Time) (changed bool, err error) {
+	if !apiKeyAlive(*key, now) {
+		return false, ErrNoAPIKey
+	}
+	if now.Sub(key.LastUsed) < apiKeyTouch {
+		return false, nil
+	}
+	key.LastUsed = now
+	return true, nil
+}
@@ -0,0 +1,1208 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
+	bolt "go.etcd.io/bbolt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// bolt buckets - same 'tables' as pg has
+// users_data is keyed as uid:short_url, short_links is index short_url -> uid:short_url
+// link_clicks is keyed as short_url 0x00 seq, so clicks of one link are next to each other
+// user_sessions is keyed as session id, user_apikeys is keyed as hash of key, user_identities - as identityKey
+// redirect_batches is keyed as id of added batch of opens, value is time of adding
+// ledger_lines is keyed as seq, lines of transaction are next to each other (see ledger)
+var (
+	bucketUsers        = []byte("users")
+	bucketUsersData    = []byte("users_data")
+	bucketShortLinks   = []byte("short_links")
+	bucketTransactions = []byte("users_transactions")
+	bucketClicks       = []byte("link_clicks")
+	bucketSessions     = []byte("user_sessions")
+	bucketAPIKeys      = []byte("user_apikeys")
+	bucketIdentities   = []byte("user_identities")
+	bucketRedirBatches = []byte("redirect_batches")
+	bucketLedger       = []byte("ledger_lines")
+)
+
+// BoltRepo - embedded single file storage (bbolt) with the same features as pg repo
+// users, links and transactions are kept as json values in bolt buckets
+type BoltRepo struct {
+	fileName string
+	DB       *bolt.DB
+	Tracer   trace.Tracer
+}
+
+// WhoAmI - driver id 2-bolt
+func (br *BoltRepo) WhoAmI() uint64 {
+	return 2
+}
+
+// New - init of bolt driver, creates file and buckets if needed
+func (br *BoltRepo) New(ctx context.Context, filename string, tracer trace.Tracer) RepoIf {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		log.Fatalf("Problem with bolt storage: %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketUsers, bucketUsersData, bucketShortLinks, bucketTransactions, bucketClicks, bucketSessions, bucketAPIKeys, bucketIdentities, bucketRedirBatches, bucketLedger} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return fmt.Errorf("create bucket %s: %w", bucket, err)
+			}
+		}
+		return boltPostUnposted(tx)
+	})
+	if err != nil {
+		log.Fatalf("Problem with bolt storage: %v", err)
+	}
+
+	return &BoltRepo{
+		fileName: filename,
+		DB:       db,
+		Tracer:   tracer,
+	}
+}
+
+// CloseConn - close bolt file when server quit
+func (br *BoltRepo) CloseConn() {
+	if err := br.DB.Close(); err != nil {
+		log.Printf("can't close bolt storage: %v", err)
+	}
+}
+
+// boltKey - key of users_data bucket
+func boltKey(uid, shorturl string) []byte {
+	return []byte(uid + ":" + shorturl)
+}
+
+// itob - bolt sequence to sortable key
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// boltGetUser - read user record from users bucket, ok = false if there is no such user
+func boltGetUser(tx *bolt.Tx, uid string) (User, bool, error) {
+	var user User
+	val := tx.Bucket(bucketUsers).Get([]byte(uid))
+	if val == nil {
+		return User{}, false, nil
+	}
+	if err := json.Unmarshal(val, &user); err != nil {
+		return User{}, false, fmt.Errorf("failed to read user: %w", err)
+	}
+	return user, true, nil
+}
+
+// boltPutUser - write user record to users bucket
+func boltPutUser(tx *bolt.Tx, user *User) error {
+	val, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketUsers).Put([]byte(user.UID), val)
+}
+
+// boltGetData - read link record by users_data key
+func boltGetData(tx *bolt.Tx, key []byte) (UserData, bool, error) {
+	var userdata UserData
+	val := tx.Bucket(bucketUsersData).Get(key)
+	if val == nil {
+		return UserData{}, false, nil
+	}
+	if err := json.Unmarshal(val, &userdata); err != nil {
+		return UserData{}, false, fmt.Errorf("failed to read userdata: %w", err)
+	}
+	return userdata, true, nil
+}
+
+// boltPutData - write link record and update short_links index
+// only global (not personal) links are in index, index is checked for conflicts by caller
+func boltPutData(tx *bolt.Tx, userdata *UserData) error {
+	val, err := json.Marshal(userdata)
+	if err != nil {
+		return err
+	}
+	key := boltKey(userdata.UID, userdata.ShortURL)
+	if err = tx.Bucket(bucketUsersData).Put(key, val); err != nil {
+		return err
+	}
+	index := tx.Bucket(bucketShortLinks)
+	if userdata.Personal {
+		if bytes.Equal(index.Get([]byte(userdata.ShortURL)), key) {
+			return index.Delete([]byte(userdata.ShortURL))
+		}
+		return nil
+	}
+	return index.Put([]byte(userdata.ShortURL), key)
+}
+
+// boltDelData - delete link record with its clicks and short_links index entry
+func boltDelData(tx *bolt.Tx, uid, shorturl string) error {
+	key := boltKey(uid, shorturl)
+	if err := tx.Bucket(bucketUsersData).Delete(key); err != nil {
+		return err
+	}
+	if err := boltDelClicks(tx, uid, shorturl); err != nil {
+		return err
+	}
+
+	index := tx.Bucket(bucketShortLinks)
+	if !bytes.Equal(index.Get([]byte(shorturl)), key) {
+		return nil
+	}
+	return index.Delete([]byte(shorturl))
+}
+
+// boltShortTaken - ErrShortlinkTaken if global shortlink belongs to other user than uid
+func boltShortTaken(tx *bolt.Tx, uid, shorturl string) error {
+	dbkey := tx.Bucket(bucketShortLinks).Get([]byte(shorturl))
+	if dbkey != nil && !bytes.Equal(dbkey, boltKey(uid, shorturl)) {
+		return ErrShortlinkTaken
+	}
+	return nil
+}
+
+// clicksPrefix - prefix of link_clicks keys of link uid:shorturl
+func clicksPrefix(uid, shorturl string) []byte {
+	return append(boltKey(uid, shorturl), 0)
+}
+
+// boltDelClicks - delete all clicks of link uid:shorturl
+func boltDelClicks(tx *bolt.Tx, uid, shorturl string) error {
+	prefix := clicksPrefix(uid, shorturl)
+	c := tx.Bucket(bucketClicks).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get - get data string from bolt repo
+// uid - user uid, key - shortlink
+// if uid == suid (SUPERUSER uid) - retreives information despite original uid
+func (br *BoltRepo) Get(ctx context.Context, uid, key string, su bool) (model.DataEl, error) {
+	suid, _ := br.FindSuperUser()
+
+	var userdata UserData
+	err := br.DB.View(func(tx *bolt.Tx) error {
+		dbkey := boltKey(uid, key)
+		if suid == uid {
+			dbkey = tx.Bucket(bucketShortLinks).Get([]byte(key))
+			if dbkey == nil {
+				return nil
+			}
+		}
+		var err error
+		userdata, _, err = boltGetData(tx, dbkey)
+		return err
+	})
+	if err != nil {
+		return model.DataEl{}, err
+	}
+
+	return userDataToModel(userdata), nil
+}
+
+// Put - store data string to bolt repo
+// uid - user uid, key - shortlink
+// checking if uid/suid is eligible is done at API handler level
+func (br *BoltRepo) Put(ctx context.Context, uid, key string, value model.DataEl, su bool) error {
+	_, span := br.Tracer.Start(ctx, "Put to bolt repo")
+	defer span.End()
+
+	span.AddEvent("bolt Put", trace.WithAttributes(
+		attribute.String("uid", uid),
+		attribute.String("shorturl", value.Shorturl),
+	))
+
+	return br.DB.Update(func(tx *bolt.Tx) error {
+		user, ok, err := boltGetUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("failed to add/change userdata: no user %s", uid)
+		}
+
+		// global shortlink is unique for all users
+		if !value.Personal {
+			if err = boltShortTaken(tx, uid, value.Shorturl); err != nil {
+				return err
+			}
+		}
+
+		userdata, ok, err := boltGetData(tx, boltKey(uid, value.Shorturl))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// new link is active, like in pg
+			userdata = UserData{
+				UserID:   user.ID,
+				UID:      uid,
+				ShortURL: value.Shorturl,
+				IsActive: true,
+			}
+		}
+		userdata.URL = value.URL
+		userdata.Redirs = value.Redirs
+		userdata.DateTime = value.Datetime
+		userdata.IsActive = value.Active == 1
+		userdata.ExpiresAt = value.ExpiresAt
+		userdata.MaxRedirs = value.MaxRedirs
+		userdata.Personal = value.Personal
+
+		return boltPutData(tx, &userdata)
+	})
+}
+
+// Del - delete data entity from bolt repo
+// uid - user uid, key - shortlink
+// if uid == suid (SUPERUSER uid) - deletes link despite original uid
+func (br *BoltRepo) Del(ctx context.Context, uid, key string, su bool) (string, error) {
+	suid, _ := br.FindSuperUser()
+
+	var useruid = uid
+	err := br.DB.Update(func(tx *bolt.Tx) error {
+		if suid == uid {
+			dbkey := tx.Bucket(bucketShortLinks).Get([]byte(key))
+			if dbkey == nil {
+				return nil
+			}
+			userdata, _, err := boltGetData(tx, dbkey)
+			if err != nil {
+				return err
+			}
+			useruid = userdata.UID
+		}
+		return boltDelData(tx, useruid, key)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to del userdata: %w", err)
+	}
+	return useruid, nil
+}
+
+// List - list all keys for this user uid
+func (br *BoltRepo) List(ctx context.Context, uid string) ([]string, error) {
+	_, span := br.Tracer.Start(ctx, "bolt_repo.LIST")
+	defer span.End()
+
+	var usersShortURL []string
+	err := br.DB.View(func(tx *bolt.Tx) error {
+		links, err := br.listTx(tx, uid)
+		if err != nil {
+			return err
+		}
+		// only live links, like in pg
+		for _, shorturl := range links {
+			userdata, _, err := boltGetData(tx, boltKey(uid, shorturl))
+			if err != nil {
+				return err
+			}
+			if userdata.IsActive {
+				usersShortURL = append(usersShortURL, shorturl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usersShortURL, nil
+}
+
+// GetUn - find unique shortlink in storage for shortopen api method
+// + update redir count (in one bolt transaction)
+func (br *BoltRepo) GetUn(ctx context.Context, shortlink string) (string, error) {
+	return br.openLink(false, func(tx *bolt.Tx) []byte {
+		return tx.Bucket(bucketShortLinks).Get([]byte(shortlink))
+	})
+}
+
+// GetUnPersonal - find personal shortlink of user uid + update redir count
+func (br *BoltRepo) GetUnPersonal(ctx context.Context, uid, shortlink string) (string, error) {
+	return br.openLink(true, func(tx *bolt.Tx) []byte {
+		return boltKey(uid, shortlink)
+	})
+}
+
+// openLink - url of link which key is found by linkKey, redirs++
+// empty url if there is no such (personal or global) link or link is not active, ErrLinkExpired/ErrLinkExhausted if it is over
+func (br *BoltRepo) openLink(personal bool, linkKey func(tx *bolt.Tx) []byte) (string, error) {
+	var URL string
+	err := br.DB.Update(func(tx *bolt.Tx) error {
+		dbkey := linkKey(tx)
+		if dbkey == nil {
+			return nil
+		}
+		userdata, ok, err := boltGetData(tx, dbkey)
+		if err != nil || !ok || userdata.Personal != personal {
+			return err
+		}
+		// expired or exhausted link is not opened, even before sweeper marks it
+		if err = linkLifetimeErr(userdata.ExpiresAt, userdata.MaxRedirs, userdata.Redirs, time.Now()); err != nil {
+			return err
+		}
+		if !userdata.IsActive {
+			return nil
+		}
+		userdata.Redirs++
+		URL = userdata.URL
+		return boltPutData(tx, &userdata)
+	})
+	if err != nil {
+		return "", err
+	}
+	return URL, nil
+}
+
+// AddRedirs - add batch of opens to links in one bolt transaction, batch which is added already is ignored
+func (br *BoltRepo) AddRedirs(ctx context.Context, batch string, redirs []model.LinkRedirs) error {
+	if batch == "" {
+		return errNoBatchID
+	}
+	err := br.DB.Update(func(tx *bolt.Tx) error {
+		batches := tx.Bucket(bucketRedirBatches)
+		if batches.Get([]byte(batch)) != nil {
+			log.Printf("batch of opens %s is added already", batch)
+			return nil
+		}
+		// ids of old batches are not needed, they are not repeated any more
+		now := time.Now()
+		cursor := batches.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var at time.Time
+			if err := at.UnmarshalText(v); err != nil || !batchAlive(at, now) {
+				if err = cursor.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		at, err := now.MarshalText()
+		if err != nil {
+			return err
+		}
+		if err = batches.Put([]byte(batch), at); err != nil {
+			return err
+		}
+
+		for _, link := range redirs {
+			dbkey := boltKey(link.UID, link.Shorturl)
+			if !link.Personal {
+				dbkey = tx.Bucket(bucketShortLinks).Get([]byte(link.Shorturl))
+			}
+			if dbkey == nil {
+				continue
+			}
+			userdata, ok, err := boltGetData(tx, dbkey)
+			if err != nil {
+				return err
+			}
+			if !ok || userdata.Personal != link.Personal {
+				continue
+			}
+			userdata.Redirs += int(link.N)
+			if err = boltPutData(tx, &userdata); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add batch of opens %s: %w", batch, err)
+	}
+	return nil
+}
+
+// GetAll get all active data items (with links) from bolt sorted by date, like in pg
+func (br *BoltRepo) GetAll(ctx context.Context, uid string) (model.Data, error) {
+	_, span := br.Tracer.Start(ctx, "bolt_repo.GETALL")
+	defer span.End()
+
+	var usersdata []UserData
+	err := br.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUsersData).ForEach(func(k, v []byte) error {
+			var userdata UserData
+			if err := json.Unmarshal(v, &userdata); err != nil {
+				return fmt.Errorf("failed to read userdata: %w", err)
+			}
+			if userdata.IsActive {
+				usersdata = append(usersdata, userdata)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return model.Data{}, err
+	}
+
+	sort.Slice(usersdata, func(i, j int) bool {
+		return usersdata[i].DateTime.Before(usersdata[j].DateTime)
+	})
+
+	var alldata model.Data
+	for _, userdata := range usersdata {
+		alldata.Data = append(alldata.Data, userDataToModel(userdata))
+	}
+	return alldata, nil
+}
+
+// PutUser new user add or update current profile
+// new user gets balance as opening transaction, on update only last_login and role are changed like in pg
+func (br *BoltRepo) PutUser(value model.User) (string, error) {
+	newuser := newUser(value)
+	uid := newuser.UID
+
+	err := br.DB.Update(func(tx *bolt.Tx) error {
+		user, ok, err := boltGetUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			id, err := tx.Bucket(bucketUsers).NextSequence()
+			if err != nil {
+				return err
+			}
+			user = newuser
+			if user.Passwd, err = HashPasswd(value.Passwd); err != nil {
+				return err
+			}
+			user.ID = int(id)
+			user.CreatedOn = time.Now()
+			if value.Balance != 0 {
+				user.Balance = value.Balance
+				trans, lines := opening(user, value.Balance, user.CreatedOn)
+				if err = boltPost(tx, trans, lines); err != nil {
+					return err
+				}
+			}
+		}
+		user.LastLogin = time.Now()
+		user.UserRole = tUserRole(value.Role)
+
+		return boltPutUser(tx, &user)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to add user: %w", err)
+	}
+	return uid, nil
+}
+
+// GetUser get user and put it in model.User struct
+func (br *BoltRepo) GetUser(uid string) (model.User, error) {
+	var user User
+	err := br.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		user, _, err = boltGetUser(tx, uid)
+		return err
+	})
+	if err != nil {
+		return model.User{}, err
+	}
+
+	apiuser := userToModel(user)
+	apiuser.UID = ""
+	return apiuser, nil
+}
+
+// DelUser delete user and all his links
+func (br *BoltRepo) DelUser(uid string) error {
+	err := br.DB.Update(func(tx *bolt.Tx) error {
+		links, err := br.listTx(tx, uid)
+		if err != nil {
+			return err
+		}
+		for _, shorturl := range links {
+			if err := boltDelData(tx, uid, shorturl); err != nil {
+				return err
+			}
+		}
+		sessions, err := boltAllSessions(tx)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if session.UID != uid {
+				continue
+			}
+			if err := tx.Bucket(bucketSessions).Delete([]byte(session.ID)); err != nil {
+				return err
+			}
+		}
+		keys, err := boltAllAPIKeys(tx)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if key.UID != uid {
+				continue
+			}
+			if err := tx.Bucket(bucketAPIKeys).Delete([]byte(key.Hash)); err != nil {
+				return err
+			}
+		}
+		identities, err := boltAllIdentities(tx)
+		if err != nil {
+			return err
+		}
+		for _, identity := range userIdentities(identities, uid) {
+			if err := tx.Bucket(bucketIdentities).Delete([]byte(identityKey(identity.Issuer, identity.Subject))); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketUsers).Delete([]byte(uid))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to del user: %w", err)
+	}
+	return nil
+}
+
+// listTx - short_urls of user inside of bolt transaction
+func (br *BoltRepo) listTx(tx *bolt.Tx, uid string) ([]string, error) {
+	var links []string
+	prefix := uid + ":"
+	c := tx.Bucket(bucketUsersData).Cursor()
+	for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+		links = append(links, strings.TrimPrefix(string(k), prefix))
+	}
+	return links, nil
+}
+
+// allUsers - read all users from users bucket
+func (br *BoltRepo) allUsers() ([]User, error) {
+	var users []User
+	err := br.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		users, err = boltAllUsers(tx)
+		return err
+	})
+	return users, err
+}
+
+// boltAllUsers - all records of users bucket
+func boltAllUsers(tx *bolt.Tx) ([]User, error) {
+	var users []User
+	err := tx.Bucket(bucketUsers).ForEach(func(k, v []byte) error {
+		var user User
+		if err := json.Unmarshal(v, &user); err != nil {
+			return fmt.Errorf("failed to read user: %w", err)
+		}
+		users = append(users, user)
+		return nil
+	})
+	return users, err
+}
+
+// FindSuperUser - gets suid of superuser
+func (br *BoltRepo) FindSuperUser() (string, error) {
+	users, err := br.allUsers()
+	if err != nil {
+		return "", err
+	}
+	var suid string
+	for _, user := range users {
+		if user.UserRole == SUPERUSER {
+			suid = user.UID
+		}
+	}
+	return suid, nil
+}
+
+// FindUserByEmail - uid of user with email (case is ignored), the oldest one if there are some
+// "" if there is no such user
+func (br *BoltRepo) FindUserByEmail(email string) (string, error) {
+	users, err := br.allUsers()
+	if err != nil {
+		return "", err
+	}
+	return userByEmail(users, email), nil
+}
+
+// AuthUser - check user&password ie autheticate and return UID if successful
+func (br *BoltRepo) AuthUser(userAuth model.User) (string, error) {
+	users, err := br.allUsers()
+	if err != nil {
+		return "", err
+	}
+	for _, user := range users {
+		if user.Name != userAuth.Name {
+			continue
+		}
+		ok, rehash := checkPasswd(user.Passwd, userAuth.Passwd)
+		if !ok {
+			continue
+		}
+		passwd, err := upgradePasswd(user.Passwd, userAuth.Passwd, rehash)
+		if err != nil {
+			return "", err
+		}
+		// update lastlogin and plaintext passwd of older record
+		err = br.DB.Update(func(tx *bolt.Tx) error {
+			user.LastLogin = time.Now()
+			user.Passwd = passwd
+			return boltPutUser(tx, &user)
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to update userdata: %w", err)
+		}
+		return user.UID, nil
+	}
+	return "", nil
+}
+
+// GetAllUsers - suid method to get all users data
+func (br *BoltRepo) GetAllUsers() (model.Users, error) {
+	users, err := br.allUsers()
+	if err != nil {
+		return model.Users{}, err
+	}
+
+	return usersToModel(users), nil
+}
+
+// PayUser - pay amount for uidA to uidB as transaction
+// users, transaction and its lines are written in one bolt transaction, failed payment is not kept like in pg
+func (br *BoltRepo) PayUser(ctx context.Context, uidA, uidB string, amount money.Amount) error {
+	_, span := br.Tracer.Start(ctx, "bolt_repo.PayUser")
+	defer span.End()
+
+	span.AddEvent("bolt PayUser", trace.WithAttributes(
+		attribute.String("uidA", uidA),
+		attribute.String("uidB", uidB),
+		attribute.String("amount", amount.String()),
+	))
+
+	return br.DB.Update(func(tx *bolt.Tx) error {
+		userA, okA, err := boltGetUser(tx, uidA)
+		if err != nil {
+			return err
+		}
+		userB, okB, err := boltGetUser(tx, uidB)
+		if err != nil {
+			return err
+		}
+		if !okA || !okB {
+			return fmt.Errorf("no such user %s or %s", uidA, uidB)
+		}
+
+		// uidA pays uidB amount
+		trans, lines, err := pay(&userA, &userB, amount, time.Now())
+		if err != nil {
+			return err
+		}
+		if err = boltPutUser(tx, &userA); err != nil {
+			return err
+		}
+		if err = boltPutUser(tx, &userB); err != nil {
+			return err
+		}
+		return boltPost(tx, trans, lines)
+	})
+}
+
+// boltPost - write transaction and its lines with next ids, cached balances are written by caller
+func boltPost(tx *bolt.Tx, trans UsersTransactions, lines []LedgerLine) error {
+	transID, err := tx.Bucket(bucketTransactions).NextSequence()
+	if err != nil {
+		return err
+	}
+	trans.ID = int(transID)
+	val, err := json.Marshal(trans)
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(bucketTransactions).Put(itob(transID), val); err != nil {
+		return err
+	}
+
+	ledger := tx.Bucket(bucketLedger)
+	for _, line := range lines {
+		id, err := ledger.NextSequence()
+		if err != nil {
+			return err
+		}
+		line.ID, line.TransactionID = int(id), trans.ID
+		if val, err = json.Marshal(line); err != nil {
+			return err
+		}
+		if err = ledger.Put(itob(id), val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltPostUnposted - balances of users of older files (without ledger) are posted as opening balances
+func boltPostUnposted(tx *bolt.Tx) error {
+	users, err := boltAllUsers(tx)
+	if err != nil {
+		return err
+	}
+	var lines []LedgerLine
+	err = tx.Bucket(bucketLedger).ForEach(func(k, v []byte) error {
+		var line LedgerLine
+		if err := json.Unmarshal(v, &line); err != nil {
+			return fmt.Errorf("failed to read ledger line: %w", err)
+		}
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	byUID := make(map[string]User, len(users))
+	for _, user := range users {
+		byUID[user.UID] = user
+	}
+	for uid, amount := range unposted(users, lines) {
+		trans, lines := opening(byUID[uid], amount, time.Now())
+		if err = boltPost(tx, trans, lines); err != nil {
+			return err
+		}
+		log.Printf("balance %s of user %s is posted to ledger", amount, uid)
+	}
+	return nil
+}
+
+// AddClick - save event of link opening
+func (br *BoltRepo) AddClick(ctx context.Context, click model.Click) error {
+	err := br.DB.Update(func(tx *bolt.Tx) error {
+		// global link - owner is taken from index
+		if click.Owner == "" {
+			dbkey := tx.Bucket(bucketShortLinks).Get([]byte(click.Shorturl))
+			if dbkey == nil {
+				return fmt.Errorf("No such link")
+			}
+			click.Owner = strings.TrimSuffix(string(dbkey), ":"+click.Shorturl)
+		}
+		if tx.Bucket(bucketUsersData).Get(boltKey(click.Owner, click.Shorturl)) == nil {
+			return fmt.Errorf("No such link")
+		}
+		clicks := tx.Bucket(bucketClicks)
+		seq, err := clicks.NextSequence()
+		if err != nil {
+			return err
+		}
+		val, err := json.Marshal(click)
+		if err != nil {
+			return err
+		}
+		return clicks.Put(append(clicksPrefix(click.Owner, click.Shorturl), itob(seq)...), val)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add click: %w", err)
+	}
+	return nil
+}
+
+// GetClickStats - count clicks of link uid:shortlink by time buckets and top referrers / user agents
+func (br *BoltRepo) GetClickStats(ctx context.Context, uid, shortlink string, q model.StatQuery) (model.ClickStats, error) {
+	_, span := br.Tracer.Start(ctx, "bolt_repo.CLICKSTATS")
+	defer span.End()
+
+	var clicks []model.Click
+	err := br.DB.View(func(tx *bolt.Tx) error {
+		prefix := clicksPrefix(uid, shortlink)
+		c := tx.Bucket(bucketClicks).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var click model.Click
+			if err := json.Unmarshal(v, &click); err != nil {
+				return err
+			}
+			clicks = append(clicks, click)
+		}
+		return nil
+	})
+	if err != nil {
+		return model.ClickStats{}, fmt.Errorf("failed to read clicks: %w", err)
+	}
+	return clickStats(uid, shortlink, clicks, q), nil
+}
+
+// SweepExpired - mark links which are expired or reached max redirs as inactive
+// returns links which have been marked
+func (br *BoltRepo) SweepExpired(ctx context.Context, now time.Time) ([]model.DataEl, error) {
+	var swept []model.DataEl
+	err := br.DB.Update(func(tx *bolt.Tx) error {
+		var expired []UserData
+		err := tx.Bucket(bucketUsersData).ForEach(func(k, v []byte) error {
+			var userdata UserData
+			if err := json.Unmarshal(v, &userdata); err != nil {
+				return err
+			}
+			if userdata.IsActive && linkLifetimeErr(userdata.ExpiresAt, userdata.MaxRedirs, userdata.Redirs, now) != nil {
+				expired = append(expired, userdata)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// bucket is not changed inside of ForEach
+		for _, userdata := range expired {
+			userdata.IsActive = false
+			if err = boltPutData(tx, &userdata); err != nil {
+				return err
+			}
+			swept = append(swept, userDataToModel(userdata))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sweep links: %w", err)
+	}
+	return swept, nil
+}
+
+// GetShort - find link by shortlink whoever owns it, empty if there is no such link
+func (br *BoltRepo) GetShort(ctx context.Context, shortlink string) (model.DataEl, error) {
+	var userdata UserData
+	err := br.DB.View(func(tx *bolt.Tx) error {
+		dbkey := tx.Bucket(bucketShortLinks).Get([]byte(shortlink))
+		if dbkey == nil {
+			return nil
+		}
+		var err error
+		userdata, _, err = boltGetData(tx, dbkey)
+		return err
+	})
+	if err != nil {
+		return model.DataEl{}, err
+	}
+	if userdata.ShortURL == "" {
+		return model.DataEl{}, nil
+	}
+	return userDataToModel(userdata), nil
+}
+
+// boltGetSession - read session by id, ok = false if there is no such session
+func boltGetSession(tx *bolt.Tx, sid string) (model.Session, bool, error) {
+	var session model.Session
+	val := tx.Bucket(bucketSessions).Get([]byte(sid))
+	if val == nil {
+		return model.Session{}, false, nil
+	}
+	if err := json.Unmarshal(val, &session); err != nil {
+		return model.Session{}, false, fmt.Errorf("failed to read session: %w", err)
+	}
+	return session, true, nil
+}
+
+// boltPutSession - write session to user_sessions bucket
+func boltPutSession(tx *bolt.Tx, session *model.Session) error {
+	val, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketSessions).Put([]byte(session.ID), val)
+}
+
+// boltAllSessions - all sessions, there are few of them per user
+func boltAllSessions(tx *bolt.Tx) ([]model.Session, error) {
+	var sessions []model.Session
+	err := tx.Bucket(bucketSessions).ForEach(func(k, v []byte) error {
+		var session model.Session
+		if err := json.Unmarshal(v, &session); err != nil {
+			return fmt.Errorf("failed to read session: %w", err)
+		}
+		sessions = append(sessions, session)
+		return nil
+	})
+	return sessions, err
+}
+
+// PutSession - save new session
+func (br *BoltRepo) PutSession(ctx context.Context, session model.Session) error {
+	if err := checkNewSession(session); err != nil {
+		return err
+	}
+	err := br.DB.Update(func(tx *bolt.Tx) error {
+		return boltPutSession(tx, &session)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add session: %w", err)
+	}
+	return nil
+}
+
+// RotateSession - change refresh token of session from oldJTI to newJTI
+// ErrTokenReused if oldJTI is rotated out already (session gets revoked), ErrSessionRevoked if session is dead
+func (br *BoltRepo) RotateSession(ctx context.Context, sid, oldJTI, newJTI string, expiresAt time.Time) error {
+	// revoke of reused session has to be committed, so rotate error is returned after transaction
+	var rotateErr error
+	err := br.DB.Update(func(tx *bolt.Tx) error {
+		session, ok, err := boltGetSession(tx, sid)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			rotateErr = ErrSessionRevoked
+			return nil
+		}
+		var changed bool
+		changed, rotateErr = rotateSession(&session, oldJTI, newJTI, expiresAt, time.Now())
+		if !changed {
+			return nil
+		}
+		return boltPutSession(tx, &session)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rotate session: %w", err)
+	}
+	return rotateErr
+}
+
+// ListSessions - alive sessions of user
+func (br *BoltRepo) ListSessions(ctx context.Context, uid string) ([]model.Session, error) {
+	var sessions []model.Session
+	err := br.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		sessions, err = boltAllSessions(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return liveSessions(sessions, uid, time.Now()), nil
+}
+
+// PurgeSessions - delete revoked and expired sessions, returns how many of them
+func (br *BoltRepo) PurgeSessions(ctx context.Context, now time.Time) (int, error) {
+	purged := 0
+	err := br.DB.Update(func(tx *bolt.Tx) error {
+		purged = 0
+		sessions, err := boltAllSessions(tx)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if sessionAlive(session, now) {
+				continue
+			}
+			if err := tx.Bucket(bucketSessions).Delete([]byte(session.ID)); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge sessions: %w", err)
+	}
+	return purged, nil
+}
+
+// RevokeSession - kill session sid of user, all his sessions if sid is empty
+func (br *BoltRepo) RevokeSession(ctx context.Context, uid, sid string) error {
+	return br.DB.Update(func(tx *bolt.Tx) error {
+		sessions, err := boltAllSessions(tx)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, session := range sessions {
+			if session.UID != uid || session.Revoked || (sid != "" && session.ID != sid) {
+				continue
+			}
+			found = true
+			session.Revoked = true
+			if err := boltPutSession(tx, &session); err != nil {
+				return err
+			}
+		}
+		if sid != "" && !found {
+			return ErrNoSession
+		}
+		return nil
+	})
+}
+
+// boltPutAPIKey - write api key to user_apikeys bucket
+func boltPutAPIKey(tx *bolt.Tx, key *model.APIKey) error {
+	val, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketAPIKeys).Put([]byte(key.Hash), val)
+}
+
+// boltAllAPIKeys - all api keys, there are few of them per user
+func boltAllAPIKeys(tx *bolt.Tx) ([]model.APIKey, error) {
+	var keys []model.APIKey
+	err := tx.Bucket(bucketAPIKeys).ForEach(func(k, v []byte) error {
+		var key model.APIKey
+		if err := json.Unmarshal(v, &key); err != nil {
+			return fmt.Errorf("failed to read api key: %w", err)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+// PutAPIKey - save new api key, only hash of key is kept
+func (br *BoltRepo) PutAPIKey(ctx context.Context, key model.APIKey) error {
+	key, err := newAPIKey(key)
+	if err != nil {
+		return err
+	}
+	err = br.DB.Update(func(tx *bolt.Tx) error {
+		return boltPutAPIKey(tx, &key)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add api key: %w", err)
+	}
+	return nil
+}
+
+// AuthAPIKey - alive api key by key itself, ErrNoAPIKey if there is no such key
+func (br *BoltRepo) AuthAPIKey(ctx context.Context, key string) (model.APIKey, error) {
+	var apiKey model.APIKey
+	err := br.DB.Update(func(tx *bolt.Tx) error {
+		val := tx.Bucket(bucketAPIKeys).Get([]byte(HashAPIKey(key)))
+		if val == nil {
+			return ErrNoAPIKey
+		}
+		if err := json.Unmarshal(val, &apiKey); err != nil {
+			return fmt.Errorf("failed to read api key: %w", err)
+		}
+		changed, err := touchAPIKey(&apiKey, time.Now())
+		if err != nil || !changed {
+			return err
+		}
+		return boltPutAPIKey(tx, &apiKey)
+	})
+	if err != nil {
+		return model.APIKey{}, err
+	}
+	apiKey.Hash = ""
+	return apiKey, nil
+}
+
+// ListAPIKeys - alive api keys of user
+func (br *BoltRepo) ListAPIKeys(ctx context.Context, uid string) ([]model.APIKey, error) {
+	var keys []model.APIKey
+	err := br.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		keys, err = boltAllAPIKeys(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return liveAPIKeys(keys, uid, time.Now()), nil
+}
+
+// RevokeAPIKey - kill api key id of user
+func (br *BoltRepo) RevokeAPIKey(ctx context.Context, uid, id string) error {
+	return br.DB.Update(func(tx *bolt.Tx) error {
+		keys, err := boltAllAPIKeys(tx)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if key.UID != uid || key.ID != id || key.Revoked {
+				continue
+			}
+			key.Revoked = true
+			return boltPutAPIKey(tx, &key)
+		}
+		return ErrNoAPIKey
+	})
+}
+
+// boltAllIdentities - all identities, there are few of them per user
+func boltAllIdentities(tx *bolt.Tx) ([]model.Identity, error) {
+	var identities []model.Identity
+	err := tx.Bucket(bucketIdentities).ForEach(func(k, v []byte) error {
+		var identity model.Identity
+		if err := json.Unmarshal(v, &identity); err != nil {
+			return fmt.Errorf("failed to read identity: %w", err)
+		}
+		identities = append(identities, identity)
+		return nil
+	})
+	return identities, err
+}
+
+// boltGetIdentity - identity of user_identities bucket, ok is false when there is no such identity
+func boltGetIdentity(tx *bolt.Tx, issuer, subject string) (identity model.Identity, ok bool, err error) {
+	val := tx.Bucket(bucketIdentities).Get([]byte(identityKey(issuer, subject)))
+	if val == nil {
+		return identity, false, nil
+	}
+	if err = json.Unmarshal(val, &identity); err != nil {
+		return identity, false, fmt.Errorf("failed to read identity: %w", err)
+	}
+	return identity, true, nil
+}
+
+// PutIdentity - link identity to its user, ErrIdentityTaken if it is linked to other user
+func (br *BoltRepo) PutIdentity(ctx context.Context, identity model.Identity) error {
+	if err := checkNewIdentity(identity); err != nil {
+		return err
+	}
+	return br.DB.Update(func(tx *bolt.Tx) error {
+		linked, ok, err := boltGetIdentity(tx, identity.Issuer, identity.Subject)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if linked.UID != identity.UID {
+				return ErrIdentityTaken
+			}
+			return nil
+		}
+		val, err := json.Marshal(identity)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketIdentities).Put([]byte(identityKey(identity.Issuer, identity.Subject)), val)
+	})
+}
+
+// FindIdentity - uid of user of identity, "" if it is not linked
+func (br *BoltRepo) FindIdentity(ctx context.Context, issuer, subject string) (string, error) {
+	var identity model.Identity
+	err := br.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		identity, _, err = boltGetIdentity(tx, issuer, subject)
+		return err
+	})
+	return identity.UID, err
+}
+
+// ListIdentities - identities of user
+func (br *BoltRepo) ListIdentities(ctx context.Context, uid string) ([]model.Identity, error) {
+	var identities []model.Identity
+	err := br.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		identities, err = boltAllIdentities(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return userIdentities(identities, uid), nil
+}
@@ -0,0 +1,603 @@
+// +build integration
+
+package repository_test
+
+// go test --tags=integration . --run tests + integration tests. ,
+// '/ +build integration' avoids test to be runned by 'go test .'
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestIntegrationSVCBoltRepo(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.BoltRepo)
+
+	// No-op tracer (does nothing)
+	var noopTracer trace.Tracer
+	noopTracer = trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage.db")
+	linkSVC = repoif.New(ctx, "test_storage.db", noopTracer)
+	defer func() {
+		linkSVC.CloseConn()
+		// physically remove test bolt storage file
+		_ = os.Remove("test_storage.db")
+	}()
+
+	su := model.User{
+		Name:    "test_su",
+		Passwd:  "123",
+		Email:   "su@u.ca",
+		Balance: money.MustParse("1000.00"),
+		Role:    "SUPERUSER",
+	}
+	suid, err := linkSVC.PutUser(su)
+	require.NoError(t, err)
+
+	// init test struct
+	tests := []struct {
+		name     string
+		alldata  model.Data
+		user     model.User
+		err      error
+		UID      []string
+		prepare  func() []string
+		testfunc func(UID []string) (model.Data, model.User, error)
+		check    func(t *testing.T, alldata model.Data, user model.User, err error)
+		remove   func(UID []string)
+	}{ // slice
+		{ // struct
+			name: "test1",
+			prepare: func() []string {
+				fmt.Print("prepare\n")
+
+				user := model.User{
+					Name:    "test_user1",
+					Passwd:  "123",
+					Email:   "L@u.ca",
+					Balance: money.MustParse("100.00"),
+					Role:    "CREATOR",
+				}
+				uid, _ := linkSVC.PutUser(user)
+
+				userdata := model.DataEl{
+					UID:      uid,
+					URL:      "mail.ru",
+					Shorturl: "abracadabra.gu",
+					Datetime: time.Now(),
+					Active:   1,
+				}
+				_ = linkSVC.Put(ctx, uid, userdata.Shorturl, userdata, false)
+
+				return []string{uid}
+			},
+			testfunc: func(UID []string) (model.Data, model.User, error) {
+				fmt.Print("run BoltRepo Get, List, GetUn, GetAll \n")
+				data, err := linkSVC.Get(ctx, UID[0], "abracadabra.gu", false)
+				if err != nil || data.URL != "mail.ru" {
+					return model.Data{}, model.User{}, fmt.Errorf("get: %v %v", data, err)
+				}
+				keys, err := linkSVC.List(ctx, UID[0])
+				if err != nil || len(keys) != 1 {
+					return model.Data{}, model.User{}, fmt.Errorf("list: %v %v", keys, err)
+				}
+				URL, err := linkSVC.GetUn(ctx, "abracadabra.gu")
+				if err != nil || URL != "mail.ru" {
+					return model.Data{}, model.User{}, fmt.Errorf("getun: %v %v", URL, err)
+				}
+				alldata, err := linkSVC.GetAll(ctx, UID[0])
+				return alldata, model.User{}, err
+			},
+			check: func(t *testing.T, alldata model.Data, user model.User, err error) {
+				require.NoError(t, err)
+				require.Len(t, alldata.Data, 1)
+				require.Equal(t, 1, alldata.Data[0].Redirs)
+				require.Equal(t, 1, alldata.Data[0].Active)
+			},
+			remove: func(UID []string) {
+				fmt.Print("remove\n")
+				for _, uid := range UID {
+					_ = linkSVC.DelUser(uid)
+				}
+			},
+		},
+		{ // struct
+			name: "test2",
+			prepare: func() []string {
+				fmt.Print("prepare\n")
+
+				user := model.User{
+					Name:    "test_user2",
+					Passwd:  "123",
+					Email:   "L2@u.ca",
+					Balance: money.MustParse("100.00"),
+					Role:    "USER",
+				}
+				uid, _ := linkSVC.PutUser(user)
+				return []string{uid}
+			},
+			testfunc: func(UID []string) (model.Data, model.User, error) {
+				fmt.Print("run BoltRepo AuthUser, PayUser \n")
+				uid, err := linkSVC.AuthUser(model.User{Name: "test_user2", Passwd: "123"})
+				if err != nil || uid != UID[0] {
+					return model.Data{}, model.User{}, fmt.Errorf("auth: %v %v", uid, err)
+				}
+				uid, _ = linkSVC.AuthUser(model.User{Name: "test_user2", Passwd: "1234"})
+				if uid != "" {
+					return model.Data{}, model.User{}, fmt.Errorf("auth with wrong passwd")
+				}
+				if err = linkSVC.PayUser(ctx, UID[0], UID[0], money.MustParse("10.0")); err == nil {
+					return model.Data{}, model.User{}, fmt.Errorf("user paid himself")
+				}
+				err = linkSVC.PayUser(ctx, UID[0], suid, money.MustParse("10.0"))
+				if err != nil {
+					return model.Data{}, model.User{}, err
+				}
+				user, err := linkSVC.GetUser(UID[0])
+				return model.Data{}, user, err
+			},
+			check: func(t *testing.T, alldata model.Data, user model.User, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "90.00", user.Balance.String())
+				require.Equal(t, "USER", user.Role)
+			},
+			remove: func(UID []string) {
+				fmt.Print("remove\n")
+				for _, uid := range UID {
+					_ = linkSVC.DelUser(uid)
+				}
+			},
+		},
+		{ // struct
+			name: "test3",
+			prepare: func() []string {
+				fmt.Print("prepare\n")
+				return nil
+			},
+			testfunc: func(UID []string) (model.Data, model.User, error) {
+				fmt.Print("run BoltRepo FindSuperUser, GetAllUsers \n")
+				uid, err := linkSVC.FindSuperUser()
+				if err != nil || uid != suid {
+					return model.Data{}, model.User{}, fmt.Errorf("find su: %v %v", uid, err)
+				}
+				users, err := linkSVC.GetAllUsers()
+				if err != nil || len(users.Data) != 1 {
+					return model.Data{}, model.User{}, fmt.Errorf("all users: %v %v", users, err)
+				}
+				return model.Data{}, users.Data[0], nil
+			},
+			check: func(t *testing.T, alldata model.Data, user model.User, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "SUPERUSER", user.Role)
+				require.Empty(t, user.Passwd)
+			},
+			remove: func(UID []string) {
+				fmt.Print("remove\n")
+			},
+		},
+	}
+
+	//run table tests in a cycle
+	for _, tt := range tests {
+		tt := tt // // capture range variable
+		t.Run(tt.name, func(t *testing.T) {
+			tt.UID = tt.prepare()
+			tt.alldata, tt.user, tt.err = tt.testfunc(tt.UID)
+			tt.check(t, tt.alldata, tt.user, tt.err)
+			tt.remove(tt.UID)
+		})
+	}
+}
+
+func TestIntegrationBoltRepoExpiry(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.BoltRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_expiry.db")
+	linkSVC = repoif.New(ctx, "test_storage_expiry.db", noopTracer)
+	defer func() {
+		linkSVC.CloseConn()
+		// physically remove test bolt storage file
+		_ = os.Remove("test_storage_expiry.db")
+	}()
+
+	uid, err := linkSVC.PutUser(model.User{Name: "test_user1", Passwd: "123", Email: "u1@u.ca", Role: "CREATOR"})
+	require.NoError(t, err)
+	expiresAt := time.Now().Add(time.Hour)
+	links := []model.DataEl{
+		{UID: uid, URL: "mail.ru", Shorturl: "expires.gu", Datetime: time.Now(), Active: 1, ExpiresAt: &expiresAt},
+		{UID: uid, URL: "mail.ru", Shorturl: "forever.gu", Datetime: time.Now(), Active: 1},
+	}
+	for _, link := range links {
+		require.NoError(t, linkSVC.Put(ctx, link.UID, link.Shorturl, link, false))
+	}
+
+	// two hours later
+	swept, err := linkSVC.SweepExpired(ctx, time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, swept, 1)
+	require.Equal(t, "expires.gu", swept[0].Shorturl)
+
+	// swept link is not listed, like in pg
+	keys, err := linkSVC.List(ctx, uid)
+	require.NoError(t, err)
+	require.Equal(t, []string{"forever.gu"}, keys)
+	alldata, err := linkSVC.GetAll(ctx, uid)
+	require.NoError(t, err)
+	require.Len(t, alldata.Data, 1)
+	require.Equal(t, "forever.gu", alldata.Data[0].Shorturl)
+}
+
+func TestIntegrationBoltRepoShortlinks(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.BoltRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_short.db")
+	linkSVC = repoif.New(ctx, "test_storage_short.db", noopTracer)
+	defer func() {
+		linkSVC.CloseConn()
+		// physically remove test bolt storage file
+		_ = os.Remove("test_storage_short.db")
+	}()
+
+	uid1, err := linkSVC.PutUser(model.User{Name: "test_user1", Passwd: "123", Email: "u1@u.ca", Role: "CREATOR"})
+	require.NoError(t, err)
+	uid2, err := linkSVC.PutUser(model.User{Name: "test_user2", Passwd: "123", Email: "u2@u.ca", Role: "CREATOR"})
+	require.NoError(t, err)
+
+	link := model.DataEl{UID: uid1, URL: "mail.ru", Shorturl: "taken.gu", Datetime: time.Now(), Active: 1}
+	require.NoError(t, linkSVC.Put(ctx, uid1, link.Shorturl, link, false))
+	other := model.DataEl{UID: uid2, URL: "ya.ru", Shorturl: "taken.gu", Datetime: time.Now(), Active: 1}
+	require.ErrorIs(t, linkSVC.Put(ctx, uid2, other.Shorturl, other, false), repository.ErrShortlinkTaken)
+
+	other.Personal = true
+	require.NoError(t, linkSVC.Put(ctx, uid2, other.Shorturl, other, false))
+	URL, err := linkSVC.GetUn(ctx, "taken.gu")
+	require.NoError(t, err)
+	require.Equal(t, "mail.ru", URL)
+	URL, err = linkSVC.GetUnPersonal(ctx, uid2, "taken.gu")
+	require.NoError(t, err)
+	require.Equal(t, "ya.ru", URL)
+
+	// deleted shortlink is free again
+	_, err = linkSVC.Del(ctx, uid1, "taken.gu", false)
+	require.NoError(t, err)
+	other.Personal = false
+	require.NoError(t, linkSVC.Put(ctx, uid2, other.Shorturl, other, false))
+	datael, err := linkSVC.GetShort(ctx, "taken.gu")
+	require.NoError(t, err)
+	require.Equal(t, uid2, datael.UID)
+}
+
+func TestIntegrationBoltRepoSessions(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.BoltRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_sessions.db")
+	linkSVC = repoif.New(ctx, "test_storage_sessions.db", noopTracer)
+	defer func() {
+		linkSVC.CloseConn()
+		// physically remove test bolt storage file
+		_ = os.Remove("test_storage_sessions.db")
+	}()
+
+	uid, err := linkSVC.PutUser(model.User{Name: "test_user1", Passwd: "123", Email: "u1@u.ca", Role: "USER"})
+	require.NoError(t, err)
+
+	now := time.Now()
+	expiresAt := now.Add(time.Hour)
+	session := model.Session{ID: "s1", UID: uid, JTI: "j1", CreatedAt: now, LastUsed: now, ExpiresAt: expiresAt}
+	require.NoError(t, linkSVC.PutSession(ctx, session))
+
+	require.NoError(t, linkSVC.RotateSession(ctx, "s1", "j1", "j2", expiresAt))
+	sessions, err := linkSVC.ListSessions(ctx, uid)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, "j2", sessions[0].JTI)
+
+	// reuse is committed as revoke
+	require.ErrorIs(t, linkSVC.RotateSession(ctx, "s1", "j1", "j3", expiresAt), repository.ErrTokenReused)
+	sessions, err = linkSVC.ListSessions(ctx, uid)
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	// revoked session is deleted by sweeper
+	purged, err := linkSVC.PurgeSessions(ctx, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+	require.ErrorIs(t, linkSVC.RotateSession(ctx, "s1", "j2", "j3", expiresAt), repository.ErrSessionRevoked)
+
+	// sessions go away with user
+	session.ID = "s2"
+	require.NoError(t, linkSVC.PutSession(ctx, session))
+	require.NoError(t, linkSVC.DelUser(uid))
+	require.ErrorIs(t, linkSVC.RevokeSession(ctx, uid, "s2"), repository.ErrNoSession)
+}
+
+func TestIntegrationBoltRepoAPIKeys(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.BoltRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_apikeys.db")
+	linkSVC = repoif.New(ctx, "test_storage_apikeys.db", noopTracer)
+	defer func() {
+		linkSVC.CloseConn()
+		// physically remove test bolt storage file
+		_ = os.Remove("test_storage_apikeys.db")
+	}()
+
+	uid, err := linkSVC.PutUser(model.User{Name: "test_user1", Passwd: "123", Email: "u1@u.ca", Role: "USER"})
+	require.NoError(t, err)
+
+	require.NoError(t, linkSVC.PutAPIKey(ctx, model.APIKey{ID: "k1", UID: uid, Key: "wl_1", Scopes: []string{"link.read"}, CreatedAt: time.Now()}))
+	key, err := linkSVC.AuthAPIKey(ctx, "wl_1")
+	require.NoError(t, err)
+	require.Equal(t, uid, key.UID)
+	require.Equal(t, []string{"link.read"}, key.Scopes)
+
+	keys, err := linkSVC.ListAPIKeys(ctx, uid)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.False(t, keys[0].LastUsed.IsZero())
+
+	require.NoError(t, linkSVC.RevokeAPIKey(ctx, uid, "k1"))
+	_, err = linkSVC.AuthAPIKey(ctx, "wl_1")
+	require.ErrorIs(t, err, repository.ErrNoAPIKey)
+
+	// keys go away with user
+	require.NoError(t, linkSVC.PutAPIKey(ctx, model.APIKey{ID: "k2", UID: uid, Key: "wl_2", Scopes: []string{"link.read"}, CreatedAt: time.Now()}))
+	require.NoError(t, linkSVC.DelUser(uid))
+	_, err = linkSVC.AuthAPIKey(ctx, "wl_2")
+	require.ErrorIs(t, err, repository.ErrNoAPIKey)
+}
+
+func TestIntegrationBoltRepoIdentities(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.BoltRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_identities.db")
+	linkSVC = repoif.New(ctx, "test_storage_identities.db", noopTracer)
+	defer func() {
+		linkSVC.CloseConn()
+		// physically remove test bolt storage file
+		_ = os.Remove("test_storage_identities.db")
+	}()
+
+	uid, err := linkSVC.PutUser(model.User{Name: "test_user1", Passwd: "123", Email: "u1@u.ca", Role: "USER"})
+	require.NoError(t, err)
+
+	identity := model.Identity{Issuer: "https://idp.test", Subject: "s1", UID: uid, Email: "u1@u.ca", CreatedAt: time.Now()}
+	require.NoError(t, linkSVC.PutIdentity(ctx, identity))
+	require.NoError(t, linkSVC.PutIdentity(ctx, identity))
+	require.ErrorIs(t, linkSVC.PutIdentity(ctx, model.Identity{Issuer: "https://idp.test", Subject: "s1", UID: "test_uid2"}), repository.ErrIdentityTaken)
+
+	found, err := linkSVC.FindIdentity(ctx, "https://idp.test", "s1")
+	require.NoError(t, err)
+	require.Equal(t, uid, found)
+	identities, err := linkSVC.ListIdentities(ctx, uid)
+	require.NoError(t, err)
+	require.Len(t, identities, 1)
+	require.Equal(t, "u1@u.ca", identities[0].Email)
+
+	// identities go away with user
+	require.NoError(t, linkSVC.DelUser(uid))
+	found, err = linkSVC.FindIdentity(ctx, "https://idp.test", "s1")
+	require.NoError(t, err)
+	require.Empty(t, found)
+}
+
+func TestIntegrationBoltRepoPasswd(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.BoltRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	// storage of older version with plaintext passwd
+	_ = os.Remove("test_storage_passwd.db")
+	defer os.Remove("test_storage_passwd.db")
+	db, err := bolt.Open("test_storage_passwd.db", 0600, &bolt.Options{Timeout: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		users, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		return users.Put([]byte("olduid"), []byte(`{"uid":"olduid","name":"old_user","passwd":"123","user_role":"USER","balance":"0.00"}`))
+	}))
+	require.NoError(t, db.Close())
+
+	linkSVC = repoif.New(ctx, "test_storage_passwd.db", noopTracer)
+
+	// new user gets hash, passwd of existing user is not changed by PutUser
+	user := model.User{Name: "new_user", Passwd: "456", Email: "n@u.ca", Role: "USER"}
+	uid, err := linkSVC.PutUser(user)
+	require.NoError(t, err)
+	user.Passwd = "654"
+	_, err = linkSVC.PutUser(user)
+	require.NoError(t, err)
+	authUID, err := linkSVC.AuthUser(model.User{Name: "new_user", Passwd: "654"})
+	require.NoError(t, err)
+	require.Empty(t, authUID)
+
+	authUID, err = linkSVC.AuthUser(model.User{Name: "old_user", Passwd: "321"})
+	require.NoError(t, err)
+	require.Empty(t, authUID)
+	authUID, err = linkSVC.AuthUser(model.User{Name: "old_user", Passwd: "123"})
+	require.NoError(t, err)
+	require.Equal(t, "olduid", authUID)
+	linkSVC.CloseConn()
+
+	db, err = bolt.Open("test_storage_passwd.db", 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	require.NoError(t, err)
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		users := tx.Bucket([]byte("users"))
+		require.NotContains(t, string(users.Get([]byte("olduid"))), `"passwd":"123"`)
+		require.NotContains(t, string(users.Get([]byte(uid))), `"passwd":"456"`)
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	// plaintext is upgraded, old and new users log in with hash
+	linkSVC = repoif.New(ctx, "test_storage_passwd.db", noopTracer)
+	defer linkSVC.CloseConn()
+	authUID, err = linkSVC.AuthUser(model.User{Name: "old_user", Passwd: "123"})
+	require.NoError(t, err)
+	require.Equal(t, "olduid", authUID)
+	authUID, err = linkSVC.AuthUser(model.User{Name: "new_user", Passwd: "456"})
+	require.NoError(t, err)
+	require.Equal(t, uid, authUID)
+}
+
+func TestIntegrationBoltRepoRedirs(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.BoltRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_redirs.db")
+	linkSVC = repoif.New(ctx, "test_storage_redirs.db", noopTracer)
+	defer func() {
+		linkSVC.CloseConn()
+		// physically remove test bolt storage file
+		_ = os.Remove("test_storage_redirs.db")
+	}()
+
+	uid1, err := linkSVC.PutUser(model.User{Name: "test_user1", Passwd: "123", Email: "u1@u.ca", Role: "CREATOR"})
+	require.NoError(t, err)
+	uid2, err := linkSVC.PutUser(model.User{Name: "test_user2", Passwd: "123", Email: "u2@u.ca", Role: "CREATOR"})
+	require.NoError(t, err)
+	link := model.DataEl{UID: uid1, URL: "mail.ru", Shorturl: "batch.gu", Datetime: time.Now(), Active: 1}
+	require.NoError(t, linkSVC.Put(ctx, uid1, link.Shorturl, link, false))
+	personal := model.DataEl{UID: uid2, URL: "ya.ru", Shorturl: "batch.gu", Datetime: time.Now(), Active: 1, Personal: true}
+	require.NoError(t, linkSVC.Put(ctx, uid2, personal.Shorturl, personal, false))
+
+	batch := []model.LinkRedirs{
+		{Shorturl: "batch.gu", N: 3},
+		{UID: uid2, Shorturl: "batch.gu", Personal: true, N: 2},
+		{Shorturl: "none.gu", N: 1},
+	}
+	require.Error(t, linkSVC.AddRedirs(ctx, "", batch))
+	require.NoError(t, linkSVC.AddRedirs(ctx, "b1", batch))
+	// repeated batch is ignored
+	require.NoError(t, linkSVC.AddRedirs(ctx, "b1", batch))
+	require.NoError(t, linkSVC.AddRedirs(ctx, "b2", batch[:1]))
+
+	data, err := linkSVC.Get(ctx, uid1, "batch.gu", false)
+	require.NoError(t, err)
+	require.Equal(t, 6, data.Redirs)
+	data, err = linkSVC.Get(ctx, uid2, "batch.gu", false)
+	require.NoError(t, err)
+	require.Equal(t, 2, data.Redirs)
+}
+
+func TestIntegrationBoltRepoLedger(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.BoltRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_ledger.db")
+	linkSVC = repoif.New(ctx, "test_storage_ledger.db", noopTracer)
+	defer func() {
+		linkSVC.CloseConn()
+		// physically remove test bolt storage file
+		_ = os.Remove("test_storage_ledger.db")
+	}()
+
+	user := model.User{Name: "test_user1", Passwd: "123", Email: "u1@u.ca", Balance: money.MustParse("100.00"), Role: "USER"}
+	uid1, err := linkSVC.PutUser(user)
+	require.NoError(t, err)
+	// balance of existing user is changed by payments only
+	user.Balance = 0
+	_, err = linkSVC.PutUser(user)
+	require.NoError(t, err)
+	uid2, err := linkSVC.PutUser(model.User{Name: "test_user2", Passwd: "123", Email: "u2@u.ca", Role: "CREATOR"})
+	require.NoError(t, err)
+
+	require.ErrorIs(t, linkSVC.PayUser(ctx, uid1, uid2, money.MustParse("-1.00")), repository.ErrBadAmount)
+	require.ErrorIs(t, linkSVC.PayUser(ctx, uid1, uid1, money.MustParse("1.00")), repository.ErrSelfPayment)
+	require.ErrorIs(t, linkSVC.PayUser(ctx, uid2, uid1, money.MustParse("0.01")), repository.ErrInsufficientFunds)
+
+	payConcurrently(ctx, t, linkSVC, uid1, uid2)
+
+	// restart keeps balances, nothing is posted again
+	linkSVC.CloseConn()
+	linkSVC = repoif.New(ctx, "test_storage_ledger.db", noopTracer)
+	got, err := linkSVC.GetUser(uid1)
+	require.NoError(t, err)
+	require.Equal(t, "2.00", got.Balance.String())
+}
+
+// payConcurrently - 30 payments of 7.00 at once from payer with 100.00 to payee without money:
+// 14 of them are done, others find balance of payer less than amount
+func payConcurrently(ctx context.Context, t *testing.T, linkSVC repository.RepoIf, payer, payee string) {
+	errs := make(chan error, 30)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- linkSVC.PayUser(ctx, payer, payee, money.MustParse("7.00"))
+		}()
+	}
+	paid := 0
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			require.ErrorIs(t, err, repository.ErrInsufficientFunds)
+			continue
+		}
+		paid++
+	}
+	require.Equal(t, 14, paid)
+
+	for uid, balance := range map[string]string{payer: "2.00", payee: "98.00"} {
+		got, err := linkSVC.GetUser(uid)
+		require.NoError(t, err)
+		require.Equal(t, balance, got.Balance.String())
+	}
+}
@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// click stats helpers - same bucketing for all repos: buckets start at UTC hour, day or week (monday),
+// like pg date_trunc does. pg counts in sql, file and bolt repos count clicks in memory
+
+// clickKeep - file repo keeps clicks of this time, stats of older range are empty
+const clickKeep = 90 * 24 * time.Hour
+
+// clickAlive - click of at is still kept
+func clickAlive(at, now time.Time) bool {
+	return now.Sub(at) < clickKeep
+}
+
+// stat buckets
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+	BucketWeek = "week"
+)
+
+// truncBucket - start of bucket which t is in
+func truncBucket(t time.Time, bucket string) time.Time {
+	t = t.UTC()
+	switch bucket {
+	case BucketHour:
+		return t.Truncate(time.Hour)
+	case BucketDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case BucketWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		// monday is first day of week
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	}
+	return t
+}
+
+// nextBucket - start of bucket which follows bucket started at t
+func nextBucket(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case BucketHour:
+		return t.Add(time.Hour)
+	case BucketDay:
+		return t.AddDate(0, 0, 1)
+	case BucketWeek:
+		return t.AddDate(0, 0, 7)
+	}
+	return t
+}
+
+// CheckStatBucket - error if bucket is unknown
+func CheckStatBucket(bucket string) error {
+	switch bucket {
+	case BucketHour, BucketDay, BucketWeek:
+		return nil
+	}
+	return fmt.Errorf("unknown stat bucket %q, use hour, day or week", bucket)
+}
+
+// fillBuckets - time series over whole range of query, buckets without clicks are zero
+func fillBuckets(counts map[time.Time]int, q model.StatQuery) []model.ClickBucket {
+	var buckets []model.ClickBucket
+	for start := truncBucket(q.From, q.Bucket); start.Before(q.To); start = nextBucket(start, q.Bucket) {
+		buckets = append(buckets, model.ClickBucket{Start: start, Clicks: counts[start]})
+	}
+	return buckets
+}
+
+// topOf - n values with most clicks, ties are sorted by value
+func topOf(counts map[string]int, n int) []model.TopEl {
+	top := make([]model.TopEl, 0, len(counts))
+	for value, clicks := range counts {
+		top = append(top, model.TopEl{Value: value, Clicks: clicks})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Clicks != top[j].Clicks {
+			return top[i].Clicks > top[j].Clicks
+		}
+		return top[i].Value < top[j].Value
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// clickStats - count stats of link uid:shortlink from its clicks (file and bolt repos)
+func clickStats(uid, shortlink string, clicks []model.Click, q model.StatQuery) model.ClickStats {
+	stats := model.ClickStats{
+		Shorturl: shortlink,
+		Bucket:   q.Bucket,
+		From:     q.From,
+		To:       q.To,
+	}
+	buckets := make(map[time.Time]int)
+	referrers := make(map[string]int)
+	agents := make(map[string]int)
+	for _, click := range clicks {
+		if click.Shorturl != shortlink || click.Owner != uid || click.Datetime.Before(q.From) || !click.Datetime.Before(q.To) {
+			continue
+		}
+		stats.Total++
+		buckets[truncBucket(click.Datetime, q.Bucket)]++
+		referrers[click.Referrer]++
+		agents[click.UserAgent]++
+	}
+	if q.Bucket != "" {
+		stats.Clicks = fillBuckets(buckets, q)
+	}
+	if q.Top > 0 {
+		stats.Referrers = topOf(referrers, q.Top)
+		stats.UserAgents = topOf(agents, q.Top)
+	}
+	return stats
+}
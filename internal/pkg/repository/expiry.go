@@ -0,0 +1,34 @@
+package repository
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// link lifetime - link with expires_at in the past or with redirs >= max_redirs can not be opened any more.
+// GetUn of every repo refuses such link, sweeper (SweepExpired) marks them inactive
+
+var (
+	// ErrLinkExpired - link is opened after expires_at
+	ErrLinkExpired = errors.New("link is expired")
+	// ErrLinkExhausted - link has been opened max_redirs times already
+	ErrLinkExhausted = errors.New("link reached max redirs")
+)
+
+// linkLifetimeErr - ErrLinkExpired or ErrLinkExhausted if link can not be opened at now, nil if it is alive
+func linkLifetimeErr(expiresAt *time.Time, maxRedirs, redirs int, now time.Time) error {
+	if expiresAt != nil && !now.Before(*expiresAt) {
+		return ErrLinkExpired
+	}
+	if maxRedirs > 0 && redirs >= maxRedirs {
+		return ErrLinkExhausted
+	}
+	return nil
+}
+
+// dataLifetimeErr - linkLifetimeErr of model link
+func dataLifetimeErr(datael model.DataEl, now time.Time) error {
+	return linkLifetimeErr(datael.ExpiresAt, datael.MaxRedirs, datael.Redirs, now)
+}
@@ -3,16 +3,20 @@ package repository
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"strings"
+	"sort"
 	"sync"
+	"time"
 
 	//"github.com/opentracing/opentracing-go"
 
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/fileutil"
 	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -29,29 +33,84 @@ type RepoIf interface {
 	DelUser(uid string) error
 	GetUser(uid string) (model.User, error)
 	WhoAmI() uint64
-	PayUser(ctx context.Context, uidA, uidB, amount string) error
+	PayUser(ctx context.Context, uidA, uidB string, amount money.Amount) error
 	FindSuperUser() (string, error)
+	FindUserByEmail(email string) (string, error)
 	GetAll(ctx context.Context, uid string) (model.Data, error)
 	AuthUser(user model.User) (string, error)
 	GetAllUsers() (model.Users, error)
+	AddClick(ctx context.Context, click model.Click) error
+	GetClickStats(ctx context.Context, uid, shortlink string, q model.StatQuery) (model.ClickStats, error)
+	SweepExpired(ctx context.Context, now time.Time) ([]model.DataEl, error)
+	GetShort(ctx context.Context, shortlink string) (model.DataEl, error)
+	GetUnPersonal(ctx context.Context, uid, shortlink string) (string, error)
+	PutSession(ctx context.Context, session model.Session) error
+	RotateSession(ctx context.Context, sid, oldJTI, newJTI string, expiresAt time.Time) error
+	ListSessions(ctx context.Context, uid string) ([]model.Session, error)
+	RevokeSession(ctx context.Context, uid, sid string) error
+	PurgeSessions(ctx context.Context, now time.Time) (int, error)
+	PutAPIKey(ctx context.Context, key model.APIKey) error
+	AuthAPIKey(ctx context.Context, key string) (model.APIKey, error)
+	ListAPIKeys(ctx context.Context, uid string) ([]model.APIKey, error)
+	RevokeAPIKey(ctx context.Context, uid, id string) error
+	PutIdentity(ctx context.Context, identity model.Identity) error
+	FindIdentity(ctx context.Context, issuer, subject string) (string, error)
+	ListIdentities(ctx context.Context, uid string) ([]model.Identity, error)
+	AddRedirs(ctx context.Context, batch string, redirs []model.LinkRedirs) error
 }
 
-// GetAllUsers - stub
-func (fr *FileRepo) GetAllUsers() (model.Users, error) {
-	return model.Users{}, nil
-}
+// ErrShortlinkTaken - global shortlink belongs to other user already
+var ErrShortlinkTaken = errors.New("shortlink is taken already")
+
+// ErrNoSuchLink - there is no (active) link of user, it is told by Get of file repo
+var ErrNoSuchLink = errors.New("No such link")
 
 // FileRepo - структура для файло-стораджа
 // fileData - мап содержимого файла хешированная as map key := datael.UID + ":" + datael.Shorturl
+// shortIndex - индекс shortlink -> key of fileData для GetUn (only global links, shortlink is unique among them)
+// fileUsers - мап пользователей по uid, fileTrans - транзакции платежей (как в pg), fileLedger - их строки (see ledger)
+// fileClicks - события открытия ссылок для статистики (за clickKeep), clickBuf - клики, которые ещё не в журнале
+// fileSessions - сессии (семейства refresh токенов) по id
+// fileAPIKeys - api ключи пользователей по hash ключа
+// fileIdentities - OpenID Connect identities пользователей по identityKey
+// fileBatches - ids of added batches of opens with time of adding
+// journal - append-only журнал изменений, seq - номер последней записи, journaled - записей после снапшота
 type FileRepo struct {
 	sync.RWMutex
-	fileName string
-	fileData map[string]model.DataEl
+	fileName   string
+	fileData   map[string]model.DataEl
+	shortIndex map[string]string
+	fileUsers  map[string]User
+	fileTrans  []UsersTransactions
+	fileLedger []LedgerLine
+	fileClicks []model.Click
+	// clicks are journaled by batches (one fsync per batch), see AddClick
+	clickBuf []model.Click
+	done     chan struct{}
+	// sessions are few per user, map by id
+	fileSessions map[string]model.Session
+	fileAPIKeys  map[string]model.APIKey
+	// identities are never changed, they go away with user
+	fileIdentities map[string]model.Identity
+	fileBatches    map[string]time.Time
+	journal        *os.File
+	seq            uint64
+	journaled      int
 }
 
-// AuthUser - stub
-func (fr *FileRepo) AuthUser(user model.User) (string, error) {
-	return "", nil
+// fileStorage - json image of file: links next to users and their transactions
+// seq - last journal record which is in this snapshot
+type fileStorage struct {
+	Seq          uint64               `json:"seq,omitempty"`
+	Data         []model.DataEl       `json:"data"`
+	Users        []User               `json:"users,omitempty"`
+	Transactions []UsersTransactions  `json:"transactions,omitempty"`
+	Ledger       []LedgerLine         `json:"ledger,omitempty"`
+	Clicks       []model.Click        `json:"clicks,omitempty"`
+	Sessions     []model.Session      `json:"sessions,omitempty"`
+	APIKeys      []model.APIKey       `json:"apikeys,omitempty"`
+	Identities   []model.Identity     `json:"identities,omitempty"`
+	Batches      map[string]time.Time `json:"batches,omitempty"`
 }
 
 // WhoAmI - identification of interface
@@ -63,12 +122,20 @@ func (fr *FileRepo) WhoAmI() uint64 {
 func (fr *FileRepo) New(ctx context.Context, filename string, tracer trace.Tracer) RepoIf {
 	// init file repo
 	fileRepo := &FileRepo{
-		fileName: filename,
-		fileData: make(map[string]model.DataEl),
+		fileName:   filename,
+		fileData:   make(map[string]model.DataEl),
+		shortIndex: make(map[string]string),
+		fileUsers:  make(map[string]User),
+		// sessions of users
+		fileSessions:   make(map[string]model.Session),
+		fileAPIKeys:    make(map[string]model.APIKey),
+		fileIdentities: make(map[string]model.Identity),
+		fileBatches:    make(map[string]time.Time),
+		done:           make(chan struct{}),
 	}
 	//check if file exists
 	// if yes load from disk and populate repo structs
-	// so 'Image' of file is held in map and it gets flushed every time change occurs
+	// so 'Image' of file is held in map, changes go to journal which is replayed on top of it
 	if _, err := os.Stat(filename); err == nil {
 		// path/to/whatever exists
 		err = fileRepo.FileRepoUnpackToStruct()
@@ -77,14 +144,22 @@ func (fr *FileRepo) New(ctx context.Context, filename string, tracer trace.Trace
 		}
 	}
 
+	if err := fileRepo.openJournal(); err != nil {
+		log.Fatalf("Problem with filesystem: %v", err)
+	}
+	if err := fileRepo.postUnposted(); err != nil {
+		log.Fatalf("Problem with filesystem: %v", err)
+	}
+	go fileRepo.clickFlusher()
+
 	return fileRepo
 }
 
-// DumpMapToFile - no lock, as its has been done in upper level
+// DumpMapToFile - write snapshot, no lock, as its has been done in upper level
 func (fr *FileRepo) DumpMapToFile() error {
 	// to do dump map to file.json
-	// make slice of active links and write it to file
-	var fileDataSlice model.Data
+	// make slice of active links and write it to file along with users and transactions
+	var fileDataSlice fileStorage
 
 	for _, value := range fr.fileData {
 		// stripe all not Active when dumping
@@ -92,12 +167,49 @@ func (fr *FileRepo) DumpMapToFile() error {
 			fileDataSlice.Data = append(fileDataSlice.Data, value)
 		}
 	}
+	for _, user := range fr.fileUsers {
+		fileDataSlice.Users = append(fileDataSlice.Users, user)
+	}
+	fileDataSlice.Transactions = fr.fileTrans
+	fileDataSlice.Ledger = fr.fileLedger
+	// clicks of links which are not dumped and old clicks are not needed any more, in memory as well
+	now := time.Now()
+	for _, click := range fr.fileClicks {
+		if datael, ok := fr.fileData[click.Owner+":"+click.Shorturl]; ok && datael.Active == 1 && clickAlive(click.Datetime, now) {
+			fileDataSlice.Clicks = append(fileDataSlice.Clicks, click)
+		}
+	}
+	fr.fileClicks = fileDataSlice.Clicks
+	// revoked and expired sessions are not needed, their tokens can not be refreshed anyway
+	for _, session := range fr.fileSessions {
+		if sessionAlive(session, now) {
+			fileDataSlice.Sessions = append(fileDataSlice.Sessions, session)
+		}
+	}
+	for _, key := range fr.fileAPIKeys {
+		if apiKeyAlive(key, now) {
+			fileDataSlice.APIKeys = append(fileDataSlice.APIKeys, key)
+		}
+	}
+	for _, identity := range fr.fileIdentities {
+		fileDataSlice.Identities = append(fileDataSlice.Identities, identity)
+	}
+	// ids of old batches are not needed, they are not repeated any more
+	for id, at := range fr.fileBatches {
+		if batchAlive(at, now) {
+			if fileDataSlice.Batches == nil {
+				fileDataSlice.Batches = make(map[string]time.Time)
+			}
+			fileDataSlice.Batches[id] = at
+		}
+	}
+	fileDataSlice.Seq = fr.seq
 
 	filedata, _ := json.MarshalIndent(fileDataSlice, "", " ")
 
-	err := ioutil.WriteFile(fr.fileName, filedata, 0644)
+	err := fileutil.WriteFileAtomic(fr.fileName, filedata, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("snapshot write error: %w", err)
 	}
 
 	return nil
@@ -127,7 +239,7 @@ func (fr *FileRepo) FileRepoUnpackToStruct() error {
 	// read our opened jsonFile as a byte array.
 	byteValue, _ := ioutil.ReadAll(jsonFile)
 	// we initialize our data array
-	var fileDataSlice model.Data
+	var fileDataSlice fileStorage
 	// we unmarshal our byteArray which contains our
 	// jsonFile's content into 'fileDataSlice' which we defined above
 	err = json.Unmarshal(byteValue, &fileDataSlice)
@@ -137,10 +249,50 @@ func (fr *FileRepo) FileRepoUnpackToStruct() error {
 	// quickly populate our file map
 
 	// we iterate through array and make map key [UID:shortlink]=filedata struct
+	// shortlink of older files can be used by some users, the oldest link keeps it and others become personal
+	sort.SliceStable(fileDataSlice.Data, func(i, j int) bool {
+		return fileDataSlice.Data[i].Datetime.Before(fileDataSlice.Data[j].Datetime)
+	})
 	for _, datael := range fileDataSlice.Data {
 		key := datael.UID + ":" + datael.Shorturl
+		if _, taken := fr.shortIndex[datael.Shorturl]; taken && !datael.Personal {
+			log.Printf("shortlink %s of %s is used by other user, it becomes personal", datael.Shorturl, datael.UID)
+			datael.Personal = true
+		}
 		fr.fileData[key] = datael
+		if !datael.Personal {
+			fr.shortIndex[datael.Shorturl] = key
+		}
+	}
+	for _, user := range fileDataSlice.Users {
+		fr.fileUsers[user.UID] = user
+	}
+	fr.fileTrans = fileDataSlice.Transactions
+	fr.fileLedger = fileDataSlice.Ledger
+	// clicks of older files have no owner, they are clicks of global links
+	now := time.Now()
+	for _, click := range fileDataSlice.Clicks {
+		if !clickAlive(click.Datetime, now) {
+			continue
+		}
+		if click.Owner == "" {
+			click.Owner = fr.fileData[fr.shortIndex[click.Shorturl]].UID
+		}
+		fr.fileClicks = append(fr.fileClicks, click)
+	}
+	for _, session := range fileDataSlice.Sessions {
+		fr.fileSessions[session.ID] = session
+	}
+	for _, key := range fileDataSlice.APIKeys {
+		fr.fileAPIKeys[key.Hash] = key
+	}
+	for _, identity := range fileDataSlice.Identities {
+		fr.fileIdentities[identityKey(identity.Issuer, identity.Subject)] = identity
 	}
+	for id, at := range fileDataSlice.Batches {
+		fr.fileBatches[id] = at
+	}
+	fr.seq = fileDataSlice.Seq
 
 	return nil
 }
@@ -156,49 +308,74 @@ func (fr *FileRepo) Get(ctx context.Context, uid, key string, su bool) (model.Da
 	if datael, ok := fr.fileData[key]; ok {
 		if datael.Active == 0 {
 			// deleted already
-			err := fmt.Errorf("link deleted already")
+			err := fmt.Errorf("link deleted already: %w", ErrNoSuchLink)
 			return model.DataEl{}, err
 		}
 
 		return datael, nil
 
 	}
-	err := fmt.Errorf("No such link")
-	return model.DataEl{}, err
+	return model.DataEl{}, ErrNoSuchLink
 }
 
 // GetUn - find unique shortlink in storage for shortopen api method
-// + update redir count (protected by lock)
+// + update redir count (only counter update is protected by write lock)
 func (fr *FileRepo) GetUn(ctx context.Context, shortlink string) (string, error) {
+	// find link by shortlink index
+	fr.RWMutex.RLock()
+	key, ok := fr.shortIndex[shortlink]
+	fr.RWMutex.RUnlock()
+
+	if !ok {
+		err := fmt.Errorf("No such link")
+		return "", err
+	}
+	return fr.openLink(key, false)
+}
+
+// GetUnPersonal - find personal shortlink of user uid + update redir count
+func (fr *FileRepo) GetUnPersonal(ctx context.Context, uid, shortlink string) (string, error) {
+	return fr.openLink(uid+":"+shortlink, true)
+}
+
+// openLink - url of link with key, redirs++
+func (fr *FileRepo) openLink(key string, personal bool) (string, error) {
 	fr.RWMutex.Lock()
 	defer fr.RWMutex.Unlock()
-	// get data needed
-	// retrieve dat string
-	for key, datael := range fr.fileData {
-		//strip user: from key
-		//check if we have match
-		keys := strings.Split(key, ":")
-		if keys[1] == shortlink {
-			//found unique link
-			if datael.Active == 0 {
-				// deleted already
-				err := fmt.Errorf("link deleted already")
-				return "", err
-			}
-			// update redirs count save it and return it
-			datael.Redirs++
-			fr.fileData[key] = datael
-			// changes needs to be flushed to file
-			err := fr.DumpMapToFile()
-			if err != nil {
-				return "", err
-			}
-			return datael.URL, nil
-		}
+	datael, ok := fr.fileData[key]
+	if !ok || datael.Personal != personal {
+		err := fmt.Errorf("No such link")
+		return "", err
+	}
+	// expired or exhausted link is not opened, even before sweeper marks it
+	if err := dataLifetimeErr(datael, time.Now()); err != nil {
+		return "", err
+	}
+	if datael.Active == 0 {
+		// deleted already
+		err := fmt.Errorf("link deleted already")
+		return "", err
 	}
+	// update redirs count save it to journal and return it
+	err := fr.commit(journalRec{Op: opRedir, Key: key})
+	if err != nil {
+		return "", err
+	}
+	return datael.URL, nil
+}
 
-	err := fmt.Errorf("No such link")
-	return "", err
+// AddRedirs - add batch of opens to links (one journal record), batch which is added already is ignored
+func (fr *FileRepo) AddRedirs(ctx context.Context, batch string, redirs []model.LinkRedirs) error {
+	if batch == "" {
+		return errNoBatchID
+	}
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+	if _, ok := fr.fileBatches[batch]; ok {
+		log.Printf("batch of opens %s is added already", batch)
+		return nil
+	}
+	return fr.commit(journalRec{Op: opRedirs, Batch: &redirBatch{ID: batch, At: time.Now(), Redirs: redirs}})
 }
 
 // Put - store data string to repo
@@ -212,9 +389,13 @@ func (fr *FileRepo) Put(ctx context.Context, uid, key string, value model.DataEl
 	}*/
 	key = uid + ":" + key
 
-	fr.fileData[key] = value
-	// changes needs to be flushed to file
-	err := fr.DumpMapToFile()
+	// global shortlink is unique for all users
+	if indexKey, ok := fr.shortIndex[value.Shorturl]; ok && !value.Personal && indexKey != key {
+		return ErrShortlinkTaken
+	}
+
+	// changes needs to be written to journal
+	err := fr.commit(journalRec{Op: opPut, Key: key, Data: &value})
 	if err != nil {
 		return err
 	}
@@ -226,11 +407,9 @@ func (fr *FileRepo) Del(ctx context.Context, uid, key string, su bool) (string,
 	fr.RWMutex.Lock()
 	defer fr.RWMutex.Unlock()
 	key = uid + ":" + key
-	if datael, ok := fr.fileData[key]; ok {
-		datael.Active = 0
-		fr.fileData[key] = datael
-		// dump data to file straight away
-		err := fr.DumpMapToFile()
+	if _, ok := fr.fileData[key]; ok {
+		// write change to journal straight away
+		err := fr.commit(journalRec{Op: opDel, Key: key})
 		if err != nil {
 			return "", err
 		}
@@ -255,34 +434,200 @@ func (fr *FileRepo) List(ctx context.Context, uid string) ([]string, error) {
 	return keys, nil
 }
 
-// GetAll заглушки
+// GetAll get all active data items (with links) sorted by date, like in pg
 func (fr *FileRepo) GetAll(ctx context.Context, uid string) (model.Data, error) {
-	return model.Data{}, nil
+	fr.RWMutex.RLock()
+	defer fr.RWMutex.RUnlock()
+
+	var alldata model.Data
+	for _, val := range fr.fileData {
+		if val.Active == 1 {
+			alldata.Data = append(alldata.Data, val)
+		}
+	}
+	sort.Slice(alldata.Data, func(i, j int) bool {
+		return alldata.Data[i].Datetime.Before(alldata.Data[j].Datetime)
+	})
+	return alldata, nil
+}
+
+// PayUser - pay amount for uidA to uidB as transaction
+// users, transaction and its lines go as one journal record, failed payment is not kept like in pg
+func (fr *FileRepo) PayUser(ctx context.Context, uidA, uidB string, amount money.Amount) error {
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	userA, okA := fr.fileUsers[uidA]
+	userB, okB := fr.fileUsers[uidB]
+	if !okA || !okB {
+		return fmt.Errorf("no such user %s or %s", uidA, uidB)
+	}
+
+	trans, lines, err := pay(&userA, &userB, amount, time.Now())
+	if err != nil {
+		return err
+	}
+	return fr.commit(fr.post(journalRec{Op: opPay, Users: []User{userA, userB}}, trans, lines))
 }
 
-// PayUser заглушки
-func (fr *FileRepo) PayUser(ctx context.Context, uidA, uidB, amount string) error {
+// post - transaction and its lines with next ids are added to record rec, no lock, as its has been done in upper level
+func (fr *FileRepo) post(rec journalRec, trans UsersTransactions, lines []LedgerLine) journalRec {
+	trans.ID = len(fr.fileTrans) + 1
+	for i := range lines {
+		lines[i].ID = len(fr.fileLedger) + 1 + i
+		lines[i].TransactionID = trans.ID
+	}
+	rec.Trans, rec.Lines = &trans, lines
+	return rec
+}
+
+// postUnposted - balances of users of older files (without ledger) are posted as opening balances
+func (fr *FileRepo) postUnposted() error {
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	users := make([]User, 0, len(fr.fileUsers))
+	for _, user := range fr.fileUsers {
+		users = append(users, user)
+	}
+	for uid, amount := range unposted(users, fr.fileLedger) {
+		trans, lines := opening(fr.fileUsers[uid], amount, time.Now())
+		if err := fr.commit(fr.post(journalRec{Op: opPay}, trans, lines)); err != nil {
+			return err
+		}
+		log.Printf("balance %s of user %s is posted to ledger", amount, uid)
+	}
 	return nil
 }
 
-// FindSuperUser заглушки
+// FindSuperUser - gets suid of superuser
 func (fr *FileRepo) FindSuperUser() (string, error) {
-	return "", nil
+	fr.RWMutex.RLock()
+	defer fr.RWMutex.RUnlock()
+
+	var suid string
+	for _, user := range fr.fileUsers {
+		if user.UserRole == SUPERUSER {
+			suid = user.UID
+		}
+	}
+	return suid, nil
 }
 
-// PutUser заглушки
+// FindUserByEmail - uid of user with email (case is ignored), the oldest one if there are some
+// "" if there is no such user
+func (fr *FileRepo) FindUserByEmail(email string) (string, error) {
+	fr.RWMutex.RLock()
+	defer fr.RWMutex.RUnlock()
+
+	users := make([]User, 0, len(fr.fileUsers))
+	for _, user := range fr.fileUsers {
+		users = append(users, user)
+	}
+	return userByEmail(users, email), nil
+}
+
+// PutUser new user add or update current profile
+// new user gets balance as opening transaction, on update only last_login and role are changed like in pg
 func (fr *FileRepo) PutUser(value model.User) (string, error) {
-	return "", nil
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	newuser := newUser(value)
+	user, ok := fr.fileUsers[newuser.UID]
+	if !ok {
+		passwd, err := HashPasswd(value.Passwd)
+		if err != nil {
+			return "", err
+		}
+		user = newuser
+		user.Passwd = passwd
+		user.ID = len(fr.fileUsers) + 1
+		for _, other := range fr.fileUsers {
+			if other.ID >= user.ID {
+				user.ID = other.ID + 1
+			}
+		}
+		user.CreatedOn = time.Now()
+	}
+	user.LastLogin = time.Now()
+	user.UserRole = tUserRole(value.Role)
+
+	rec := journalRec{Op: opUser}
+	if !ok && value.Balance != 0 {
+		user.Balance = value.Balance
+		trans, lines := opening(user, value.Balance, user.CreatedOn)
+		rec = fr.post(rec, trans, lines)
+	}
+	rec.Users = []User{user}
+	err := fr.commit(rec)
+	if err != nil {
+		return "", err
+	}
+	return user.UID, nil
 }
 
-// DelUser заглушки
+// DelUser delete user and his links
 func (fr *FileRepo) DelUser(uid string) error {
-	return nil
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	return fr.commit(journalRec{Op: opDelUser, UID: uid})
 }
 
-// GetUser заглушки
+// GetUser get user and put it in model.User struct
 func (fr *FileRepo) GetUser(uid string) (model.User, error) {
-	return model.User{}, nil
+	fr.RWMutex.RLock()
+	defer fr.RWMutex.RUnlock()
+
+	user, ok := fr.fileUsers[uid]
+	if !ok {
+		return model.User{}, nil
+	}
+	apiuser := userToModel(user)
+	apiuser.UID = ""
+	return apiuser, nil
+}
+
+// AuthUser - check user&password ie autheticate and return UID if successful
+func (fr *FileRepo) AuthUser(userAuth model.User) (string, error) {
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	for uid, user := range fr.fileUsers {
+		if user.Name != userAuth.Name {
+			continue
+		}
+		ok, rehash := checkPasswd(user.Passwd, userAuth.Passwd)
+		if !ok {
+			continue
+		}
+		passwd, err := upgradePasswd(user.Passwd, userAuth.Passwd, rehash)
+		if err != nil {
+			return "", err
+		}
+		// update lastlogin and plaintext passwd of older record
+		user.LastLogin = time.Now()
+		user.Passwd = passwd
+		err = fr.commit(journalRec{Op: opUser, Users: []User{user}})
+		if err != nil {
+			return "", fmt.Errorf("failed to update userdata: %w", err)
+		}
+		return uid, nil
+	}
+	return "", nil
+}
+
+// GetAllUsers - suid method to get all users data
+func (fr *FileRepo) GetAllUsers() (model.Users, error) {
+	fr.RWMutex.RLock()
+	defer fr.RWMutex.RUnlock()
+
+	users := make([]User, 0, len(fr.fileUsers))
+	for _, user := range fr.fileUsers {
+		users = append(users, user)
+	}
+	return usersToModel(users), nil
 }
 
 // AddUser заглушки
@@ -290,7 +635,306 @@ func (fr *FileRepo) AddUser(value model.User) (string, error) {
 	return "", nil
 }
 
-// CloseConn заглушки
+// CloseConn - compact journal into snapshot and close it when server quit
 func (fr *FileRepo) CloseConn() {
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	select {
+	case <-fr.done:
+	default:
+		close(fr.done)
+	}
+	if err := fr.flushClicks(); err != nil {
+		log.Printf("can't save clicks: %v", err)
+	}
+	if err := fr.compact(); err != nil {
+		log.Printf("can't compact file storage: %v", err)
+	}
+	if err := fr.journal.Close(); err != nil {
+		log.Printf("can't close file: %v", err)
+	}
+}
+
+// clickBatch, clickFlushEvery - buffered clicks are journaled when there are clickBatch of them,
+// or clickFlushEvery after previous batch: clicks of the last second are lost on crash, they are only for stats
+const (
+	clickBatch      = 100
+	clickFlushEvery = time.Second
+)
+
+// AddClick - save event of link opening, it is journaled with batch of clicks
+func (fr *FileRepo) AddClick(ctx context.Context, click model.Click) error {
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	// global link - owner is taken from index
+	if click.Owner == "" {
+		key, ok := fr.shortIndex[click.Shorturl]
+		if !ok {
+			return fmt.Errorf("No such link")
+		}
+		click.Owner = fr.fileData[key].UID
+	}
+	if _, ok := fr.fileData[click.Owner+":"+click.Shorturl]; !ok {
+		return fmt.Errorf("No such link")
+	}
+	fr.clickBuf = append(fr.clickBuf, click)
+	if len(fr.clickBuf) >= clickBatch {
+		return fr.flushClicks()
+	}
+	return nil
+}
+
+// flushClicks - journal buffered clicks by one record, no lock, as its has been done in upper level
+// clicks of failed batch are dropped, so buffer does not grow while journal can not be written
+func (fr *FileRepo) flushClicks() error {
+	if len(fr.clickBuf) == 0 {
+		return nil
+	}
+	clicks := fr.clickBuf
+	fr.clickBuf = nil
+	return fr.commit(journalRec{Op: opClicks, Clicks: clicks})
+}
+
+// clickFlusher - journal buffered clicks every clickFlushEvery until repo is closed
+func (fr *FileRepo) clickFlusher() {
+	ticker := time.NewTicker(clickFlushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fr.done:
+			return
+		case <-ticker.C:
+			fr.RWMutex.Lock()
+			err := fr.flushClicks()
+			fr.RWMutex.Unlock()
+			if err != nil {
+				log.Printf("file repo: clicks are not saved: %v", err)
+			}
+		}
+	}
+}
+
+// GetClickStats - count clicks of link uid:shortlink by time buckets and top referrers / user agents
+// buffered clicks are journaled first, so stats have them
+func (fr *FileRepo) GetClickStats(ctx context.Context, uid, shortlink string, q model.StatQuery) (model.ClickStats, error) {
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	if err := fr.flushClicks(); err != nil {
+		return model.ClickStats{}, err
+	}
+	return clickStats(uid, shortlink, fr.fileClicks, q), nil
+}
+
+// SweepExpired - mark links which are expired or reached max redirs as inactive ('delete' them)
+// returns links which have been marked
+func (fr *FileRepo) SweepExpired(ctx context.Context, now time.Time) ([]model.DataEl, error) {
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	var swept []model.DataEl
+	for key, datael := range fr.fileData {
+		if datael.Active == 0 || dataLifetimeErr(datael, now) == nil {
+			continue
+		}
+		if err := fr.commit(journalRec{Op: opSweep, Key: key}); err != nil {
+			return swept, err
+		}
+		datael.Active = 0
+		swept = append(swept, datael)
+	}
+	return swept, nil
+}
+
+// GetShort - find link by shortlink whoever owns it, empty if there is no such link
+func (fr *FileRepo) GetShort(ctx context.Context, shortlink string) (model.DataEl, error) {
+	fr.RWMutex.RLock()
+	defer fr.RWMutex.RUnlock()
+
+	key, ok := fr.shortIndex[shortlink]
+	if !ok {
+		return model.DataEl{}, nil
+	}
+	return fr.fileData[key], nil
+}
+
+// PutSession - save new session
+func (fr *FileRepo) PutSession(ctx context.Context, session model.Session) error {
+	if err := checkNewSession(session); err != nil {
+		return err
+	}
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	return fr.commit(journalRec{Op: opSession, Session: &session})
+}
+
+// RotateSession - change refresh token of session from oldJTI to newJTI
+// ErrTokenReused if oldJTI is rotated out already (session gets revoked), ErrSessionRevoked if session is dead
+func (fr *FileRepo) RotateSession(ctx context.Context, sid, oldJTI, newJTI string, expiresAt time.Time) error {
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	session, ok := fr.fileSessions[sid]
+	if !ok {
+		return ErrSessionRevoked
+	}
+	changed, err := rotateSession(&session, oldJTI, newJTI, expiresAt, time.Now())
+	if changed {
+		if cerr := fr.commit(journalRec{Op: opSession, Session: &session}); cerr != nil {
+			return cerr
+		}
+	}
+	return err
+}
+
+// ListSessions - alive sessions of user
+func (fr *FileRepo) ListSessions(ctx context.Context, uid string) ([]model.Session, error) {
+	fr.RWMutex.RLock()
+	defer fr.RWMutex.RUnlock()
+
+	sessions := make([]model.Session, 0, len(fr.fileSessions))
+	for _, session := range fr.fileSessions {
+		sessions = append(sessions, session)
+	}
+	return liveSessions(sessions, uid, time.Now()), nil
+}
+
+// RevokeSession - kill session sid of user, all his sessions if sid is empty
+func (fr *FileRepo) RevokeSession(ctx context.Context, uid, sid string) error {
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	if sid != "" {
+		session, ok := fr.fileSessions[sid]
+		if !ok || session.UID != uid || session.Revoked {
+			return ErrNoSession
+		}
+	}
+	for _, session := range fr.fileSessions {
+		if session.UID != uid || session.Revoked || (sid != "" && session.ID != sid) {
+			continue
+		}
+		session.Revoked = true
+		if err := fr.commit(journalRec{Op: opSession, Session: &session}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// PurgeSessions - forget revoked and expired sessions, returns how many of them
+// they are not journaled: dead sessions of journal are dropped again by next purge and by snapshot
+func (fr *FileRepo) PurgeSessions(ctx context.Context, now time.Time) (int, error) {
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	purged := 0
+	for sid, session := range fr.fileSessions {
+		if !sessionAlive(session, now) {
+			delete(fr.fileSessions, sid)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// PutAPIKey - save new api key, only hash of key is kept
+func (fr *FileRepo) PutAPIKey(ctx context.Context, key model.APIKey) error {
+	key, err := newAPIKey(key)
+	if err != nil {
+		return err
+	}
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	return fr.commit(journalRec{Op: opAPIKey, APIKey: &key})
+}
+
+// AuthAPIKey - alive api key by key itself, ErrNoAPIKey if there is no such key
+func (fr *FileRepo) AuthAPIKey(ctx context.Context, key string) (model.APIKey, error) {
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	apiKey, ok := fr.fileAPIKeys[HashAPIKey(key)]
+	if !ok {
+		return model.APIKey{}, ErrNoAPIKey
+	}
+	changed, err := touchAPIKey(&apiKey, time.Now())
+	if err != nil {
+		return model.APIKey{}, err
+	}
+	if changed {
+		if err = fr.commit(journalRec{Op: opAPIKey, APIKey: &apiKey}); err != nil {
+			return model.APIKey{}, err
+		}
+	}
+	apiKey.Hash = ""
+	return apiKey, nil
+}
+
+// ListAPIKeys - alive api keys of user
+func (fr *FileRepo) ListAPIKeys(ctx context.Context, uid string) ([]model.APIKey, error) {
+	fr.RWMutex.RLock()
+	defer fr.RWMutex.RUnlock()
+
+	keys := make([]model.APIKey, 0, len(fr.fileAPIKeys))
+	for _, key := range fr.fileAPIKeys {
+		keys = append(keys, key)
+	}
+	return liveAPIKeys(keys, uid, time.Now()), nil
+}
+
+// RevokeAPIKey - kill api key id of user
+func (fr *FileRepo) RevokeAPIKey(ctx context.Context, uid, id string) error {
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	for _, key := range fr.fileAPIKeys {
+		if key.UID != uid || key.ID != id || key.Revoked {
+			continue
+		}
+		key.Revoked = true
+		return fr.commit(journalRec{Op: opAPIKey, APIKey: &key})
+	}
+	return ErrNoAPIKey
+}
+
+// PutIdentity - link identity to its user, ErrIdentityTaken if it is linked to other user
+func (fr *FileRepo) PutIdentity(ctx context.Context, identity model.Identity) error {
+	if err := checkNewIdentity(identity); err != nil {
+		return err
+	}
+	fr.RWMutex.Lock()
+	defer fr.RWMutex.Unlock()
+
+	if linked, ok := fr.fileIdentities[identityKey(identity.Issuer, identity.Subject)]; ok {
+		if linked.UID != identity.UID {
+			return ErrIdentityTaken
+		}
+		return nil
+	}
+	return fr.commit(journalRec{Op: opIdentity, Identity: &identity})
+}
+
+// FindIdentity - uid of user of identity, "" if it is not linked
+func (fr *FileRepo) FindIdentity(ctx context.Context, issuer, subject string) (string, error) {
+	fr.RWMutex.RLock()
+	defer fr.RWMutex.RUnlock()
+
+	return fr.fileIdentities[identityKey(issuer, subject)].UID, nil
+}
+
+// ListIdentities - identities of user
+func (fr *FileRepo) ListIdentities(ctx context.Context, uid string) ([]model.Identity, error) {
+	fr.RWMutex.RLock()
+	defer fr.RWMutex.RUnlock()
+
+	identities := make([]model.Identity, 0, len(fr.fileIdentities))
+	for _, identity := range fr.fileIdentities {
+		identities = append(identities, identity)
+	}
+	return userIdentities(identities, uid), nil
 }
@@ -6,12 +6,15 @@ package repository_test
 // '/ +build integration' avoids test to be runned by 'go test .'
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
 	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/repository"
 	"github.com/stretchr/testify/require"
 
@@ -225,4 +228,678 @@ func TestIntegrationSVCFileRepo(t *testing.T) {
 
 	// physically remove test json storage file
 	_ = os.Remove("test_storage.json")
+	_ = os.Remove("test_storage.json.journal")
+}
+
+func TestIntegrationFileRepoUsers(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.FileRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	linkSVC = repoif.New(ctx, "test_storage_users.json", noopTracer)
+	// physically remove test json storage file
+	defer os.Remove("test_storage_users.json")
+	defer os.Remove("test_storage_users.json.journal")
+
+	suid, err := linkSVC.PutUser(model.User{Name: "su", Passwd: "123", Email: "su@u.ca", Balance: money.MustParse("0.00"), Role: "SUPERUSER"})
+	require.NoError(t, err)
+	uid, err := linkSVC.PutUser(model.User{Name: "test_user1", Passwd: "123", Email: "L@u.ca", Balance: money.MustParse("100.00"), Role: "USER"})
+	require.NoError(t, err)
+
+	authUID, err := linkSVC.AuthUser(model.User{Name: "test_user1", Passwd: "123"})
+	require.NoError(t, err)
+	require.Equal(t, uid, authUID)
+
+	authUID, err = linkSVC.AuthUser(model.User{Name: "test_user1", Passwd: "321"})
+	require.NoError(t, err)
+	require.Empty(t, authUID)
+
+	found, err := linkSVC.FindSuperUser()
+	require.NoError(t, err)
+	require.Equal(t, suid, found)
+
+	// paying himself does not create money
+	require.Error(t, linkSVC.PayUser(ctx, uid, uid, money.MustParse("10.0")))
+	require.NoError(t, linkSVC.PayUser(ctx, uid, suid, money.MustParse("10.0")))
+
+	// reload file to check users and balances are persisted
+	linkSVC = repoif.New(ctx, "test_storage_users.json", noopTracer)
+
+	user, err := linkSVC.GetUser(uid)
+	require.NoError(t, err)
+	require.Equal(t, "90.00", user.Balance.String())
+	require.Equal(t, "USER", user.Role)
+
+	users, err := linkSVC.GetAllUsers()
+	require.NoError(t, err)
+	require.Len(t, users.Data, 2)
+	require.Equal(t, "10.00", users.Data[0].Balance.String())
+	require.Empty(t, users.Data[0].Passwd)
+
+	require.NoError(t, linkSVC.DelUser(uid))
+	user, err = linkSVC.GetUser(uid)
+	require.NoError(t, err)
+	require.Empty(t, user.Name)
+}
+
+func TestIntegrationFileRepoJournal(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.FileRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_journal.json")
+	_ = os.Remove("test_storage_journal.json.journal")
+	// physically remove test json storage file
+	defer os.Remove("test_storage_journal.json")
+	defer os.Remove("test_storage_journal.json.journal")
+
+	linkSVC = repoif.New(ctx, "test_storage_journal.json", noopTracer)
+
+	userdata := model.DataEl{
+		UID:      "test_uid1",
+		URL:      "mail.ru",
+		Shorturl: "abracadabra.gu",
+		Datetime: time.Now(),
+		Active:   1,
+	}
+	require.NoError(t, linkSVC.Put(ctx, "test_uid1", userdata.Shorturl, userdata, false))
+	userdata.Shorturl = "deleted.gu"
+	require.NoError(t, linkSVC.Put(ctx, "test_uid1", userdata.Shorturl, userdata, false))
+	_, err := linkSVC.Del(ctx, "test_uid1", "deleted.gu", false)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = linkSVC.GetUn(ctx, "abracadabra.gu")
+		require.NoError(t, err)
+	}
+
+	// no snapshot yet, all changes are in journal
+	_, err = os.Stat("test_storage_journal.json")
+	require.True(t, os.IsNotExist(err))
+
+	// crash in the middle of journal write
+	journal, err := os.OpenFile("test_storage_journal.json.journal", os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = journal.WriteString(`{"seq":100,"op":"redir","key":"test_uid1:abr`)
+	require.NoError(t, err)
+	require.NoError(t, journal.Close())
+
+	// recovery - journal is replayed, broken record is dropped and snapshot is written
+	linkSVC = repoif.New(ctx, "test_storage_journal.json", noopTracer)
+
+	data, err := linkSVC.Get(ctx, "test_uid1", "abracadabra.gu", false)
+	require.NoError(t, err)
+	require.Equal(t, 3, data.Redirs)
+
+	keys, err := linkSVC.List(ctx, "test_uid1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"abracadabra.gu"}, keys)
+
+	// one more redirect after recovery, then clean shutdown
+	_, err = linkSVC.GetUn(ctx, "abracadabra.gu")
+	require.NoError(t, err)
+	linkSVC.CloseConn()
+
+	linkSVC = repoif.New(ctx, "test_storage_journal.json", noopTracer)
+	data, err = linkSVC.Get(ctx, "test_uid1", "abracadabra.gu", false)
+	require.NoError(t, err)
+	require.Equal(t, 4, data.Redirs)
+}
+
+func TestIntegrationFileRepoClicks(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.FileRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_clicks.json")
+	_ = os.Remove("test_storage_clicks.json.journal")
+	// physically remove test json storage file
+	defer os.Remove("test_storage_clicks.json")
+	defer os.Remove("test_storage_clicks.json.journal")
+
+	linkSVC = repoif.New(ctx, "test_storage_clicks.json", noopTracer)
+
+	userdata := model.DataEl{UID: "test_uid1", URL: "mail.ru", Shorturl: "abracadabra.gu", Datetime: time.Now(), Active: 1}
+	require.NoError(t, linkSVC.Put(ctx, "test_uid1", userdata.Shorturl, userdata, false))
+
+	// sunday evening, monday morning and monday noon of last week
+	monday := time.Now().UTC().Truncate(24 * time.Hour)
+	for monday.Weekday() != time.Monday {
+		monday = monday.AddDate(0, 0, -1)
+	}
+	base := monday.AddDate(0, 0, -7).Add(-30 * time.Minute)
+	for i, offset := range []time.Duration{0, 9 * time.Hour, 13 * time.Hour} {
+		click := model.Click{Shorturl: "abracadabra.gu", Datetime: base.Add(offset), Referrer: "ya.ru", UserAgent: "curl"}
+		if i == 0 {
+			click.Referrer = "google.com"
+		}
+		require.NoError(t, linkSVC.AddClick(ctx, click))
+	}
+	require.Error(t, linkSVC.AddClick(ctx, model.Click{Shorturl: "nosuch.gu", Datetime: base}))
+	// click of last year is not kept
+	yearAgo := base.AddDate(-1, 0, 0)
+	require.NoError(t, linkSVC.AddClick(ctx, model.Click{Shorturl: "abracadabra.gu", Datetime: yearAgo}))
+
+	// clicks are journaled by one record before stats are counted
+	q := model.StatQuery{From: base, To: base.Add(24 * time.Hour)}
+	stats, err := linkSVC.GetClickStats(ctx, "test_uid1", "abracadabra.gu", q)
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.Total)
+	body, err := os.ReadFile("test_storage_clicks.json.journal")
+	require.NoError(t, err)
+	require.Equal(t, 1, strings.Count(string(body), `"op":"clicks"`))
+
+	// reload file to check clicks are persisted
+	linkSVC.CloseConn()
+	linkSVC = repoif.New(ctx, "test_storage_clicks.json", noopTracer)
+
+	q = model.StatQuery{Bucket: repository.BucketDay, From: base.Add(-24 * time.Hour), To: base.Add(48 * time.Hour), Top: 1}
+	stats, err = linkSVC.GetClickStats(ctx, "test_uid1", "abracadabra.gu", q)
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.Total)
+	require.Len(t, stats.Clicks, 4)
+	require.Equal(t, []int{0, 1, 2, 0}, []int{stats.Clicks[0].Clicks, stats.Clicks[1].Clicks, stats.Clicks[2].Clicks, stats.Clicks[3].Clicks})
+	require.Equal(t, []model.TopEl{{Value: "ya.ru", Clicks: 2}}, stats.Referrers)
+	require.Equal(t, []model.TopEl{{Value: "curl", Clicks: 3}}, stats.UserAgents)
+
+	// weeks start on monday
+	q = model.StatQuery{Bucket: repository.BucketWeek, From: base, To: base.Add(24 * time.Hour)}
+	stats, err = linkSVC.GetClickStats(ctx, "test_uid1", "abracadabra.gu", q)
+	require.NoError(t, err)
+	require.Len(t, stats.Clicks, 2)
+	require.Equal(t, monday.AddDate(0, 0, -14), stats.Clicks[0].Start)
+	require.Equal(t, 1, stats.Clicks[0].Clicks)
+	require.Equal(t, 2, stats.Clicks[1].Clicks)
+
+	q = model.StatQuery{From: yearAgo, To: yearAgo.Add(time.Hour)}
+	stats, err = linkSVC.GetClickStats(ctx, "test_uid1", "abracadabra.gu", q)
+	require.NoError(t, err)
+	require.Zero(t, stats.Total)
+}
+
+func TestIntegrationFileRepoExpiry(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.FileRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_expiry.json")
+	_ = os.Remove("test_storage_expiry.json.journal")
+	// physically remove test json storage file
+	defer os.Remove("test_storage_expiry.json")
+	defer os.Remove("test_storage_expiry.json.journal")
+
+	linkSVC = repoif.New(ctx, "test_storage_expiry.json", noopTracer)
+
+	expiresAt := time.Now().Add(time.Hour)
+	links := []model.DataEl{
+		{UID: "test_uid1", URL: "mail.ru", Shorturl: "expires.gu", Datetime: time.Now(), Active: 1, ExpiresAt: &expiresAt},
+		{UID: "test_uid1", URL: "mail.ru", Shorturl: "twice.gu", Datetime: time.Now(), Active: 1, MaxRedirs: 2},
+		{UID: "test_uid1", URL: "mail.ru", Shorturl: "forever.gu", Datetime: time.Now(), Active: 1},
+	}
+	for _, link := range links {
+		require.NoError(t, linkSVC.Put(ctx, link.UID, link.Shorturl, link, false))
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := linkSVC.GetUn(ctx, "twice.gu")
+		require.NoError(t, err)
+	}
+	_, err := linkSVC.GetUn(ctx, "twice.gu")
+	require.ErrorIs(t, err, repository.ErrLinkExhausted)
+
+	// nothing is expired by time yet
+	swept, err := linkSVC.SweepExpired(ctx, time.Now())
+	require.NoError(t, err)
+	require.Len(t, swept, 1)
+	require.Equal(t, "twice.gu", swept[0].Shorturl)
+
+	// two hours later
+	later := time.Now().Add(2 * time.Hour)
+	swept, err = linkSVC.SweepExpired(ctx, later)
+	require.NoError(t, err)
+	require.Len(t, swept, 1)
+	require.Equal(t, "expires.gu", swept[0].Shorturl)
+
+	keys, err := linkSVC.List(ctx, "test_uid1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"forever.gu"}, keys)
+	alldata, err := linkSVC.GetAll(ctx, "test_uid1")
+	require.NoError(t, err)
+	require.Len(t, alldata.Data, 1)
+	require.Equal(t, "forever.gu", alldata.Data[0].Shorturl)
+
+	// exhausted link still gives its own error after sweeper
+	_, err = linkSVC.GetUn(ctx, "twice.gu")
+	require.ErrorIs(t, err, repository.ErrLinkExhausted)
+}
+
+func TestIntegrationFileRepoShortlinks(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.FileRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_short.json")
+	_ = os.Remove("test_storage_short.json.journal")
+	// physically remove test json storage file
+	defer os.Remove("test_storage_short.json")
+	defer os.Remove("test_storage_short.json.journal")
+
+	linkSVC = repoif.New(ctx, "test_storage_short.json", noopTracer)
+
+	link := model.DataEl{UID: "test_uid1", URL: "mail.ru", Shorturl: "taken.gu", Datetime: time.Now(), Active: 1}
+	require.NoError(t, linkSVC.Put(ctx, "test_uid1", link.Shorturl, link, false))
+	// owner can update link, other user can not take its shortlink
+	require.NoError(t, linkSVC.Put(ctx, "test_uid1", link.Shorturl, link, false))
+	other := model.DataEl{UID: "test_uid2", URL: "ya.ru", Shorturl: "taken.gu", Datetime: time.Now(), Active: 1}
+	require.ErrorIs(t, linkSVC.Put(ctx, "test_uid2", other.Shorturl, other, false), repository.ErrShortlinkTaken)
+
+	// personal link of other user with the same shortlink is opened only by its namespace
+	other.Personal = true
+	require.NoError(t, linkSVC.Put(ctx, "test_uid2", other.Shorturl, other, false))
+	URL, err := linkSVC.GetUn(ctx, "taken.gu")
+	require.NoError(t, err)
+	require.Equal(t, "mail.ru", URL)
+	URL, err = linkSVC.GetUnPersonal(ctx, "test_uid2", "taken.gu")
+	require.NoError(t, err)
+	require.Equal(t, "ya.ru", URL)
+	_, err = linkSVC.GetUnPersonal(ctx, "test_uid1", "taken.gu")
+	require.Error(t, err)
+
+	// clicks are counted per owner
+	require.NoError(t, linkSVC.AddClick(ctx, model.Click{Shorturl: "taken.gu", Datetime: time.Now()}))
+	require.NoError(t, linkSVC.AddClick(ctx, model.Click{Shorturl: "taken.gu", Owner: "test_uid2", Datetime: time.Now()}))
+	require.NoError(t, linkSVC.AddClick(ctx, model.Click{Shorturl: "taken.gu", Owner: "test_uid2", Datetime: time.Now()}))
+	q := model.StatQuery{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}
+	stats, err := linkSVC.GetClickStats(ctx, "test_uid1", "taken.gu", q)
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Total)
+	stats, err = linkSVC.GetClickStats(ctx, "test_uid2", "taken.gu", q)
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.Total)
+
+	// deleted shortlink is free again, index survives reload
+	_, err = linkSVC.Del(ctx, "test_uid1", "taken.gu", false)
+	require.NoError(t, err)
+	linkSVC.CloseConn()
+	linkSVC = repoif.New(ctx, "test_storage_short.json", noopTracer)
+	third := model.DataEl{UID: "test_uid3", URL: "go.dev", Shorturl: "taken.gu", Datetime: time.Now(), Active: 1}
+	require.NoError(t, linkSVC.Put(ctx, "test_uid3", third.Shorturl, third, false))
+	datael, err := linkSVC.GetShort(ctx, "taken.gu")
+	require.NoError(t, err)
+	require.Equal(t, "test_uid3", datael.UID)
+}
+
+func TestIntegrationFileRepoPasswd(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.FileRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_passwd.json.journal")
+	// physically remove test json storage file
+	defer os.Remove("test_storage_passwd.json")
+	defer os.Remove("test_storage_passwd.json.journal")
+
+	// storage of older version with plaintext passwd
+	plain := `{"data":[],"users":[{"uid":"olduid","name":"old_user","passwd":"123","user_role":"USER","balance":"0.00"}]}`
+	require.NoError(t, os.WriteFile("test_storage_passwd.json", []byte(plain), 0644))
+
+	linkSVC = repoif.New(ctx, "test_storage_passwd.json", noopTracer)
+
+	// new user gets hash
+	_, err := linkSVC.PutUser(model.User{Name: "new_user", Passwd: "456", Email: "n@u.ca", Balance: money.MustParse("0.00"), Role: "USER"})
+	require.NoError(t, err)
+
+	authUID, err := linkSVC.AuthUser(model.User{Name: "old_user", Passwd: "321"})
+	require.NoError(t, err)
+	require.Empty(t, authUID)
+	authUID, err = linkSVC.AuthUser(model.User{Name: "old_user", Passwd: "123"})
+	require.NoError(t, err)
+	require.Equal(t, "olduid", authUID)
+	linkSVC.CloseConn()
+
+	raw, err := os.ReadFile("test_storage_passwd.json")
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), `"passwd":"123"`)
+	require.NotContains(t, string(raw), `"passwd":"456"`)
+
+	// plaintext is upgraded, old and new users log in with hash
+	linkSVC = repoif.New(ctx, "test_storage_passwd.json", noopTracer)
+	authUID, err = linkSVC.AuthUser(model.User{Name: "old_user", Passwd: "123"})
+	require.NoError(t, err)
+	require.Equal(t, "olduid", authUID)
+	authUID, err = linkSVC.AuthUser(model.User{Name: "new_user", Passwd: "456"})
+	require.NoError(t, err)
+	require.NotEmpty(t, authUID)
+
+	users, err := linkSVC.GetAllUsers()
+	require.NoError(t, err)
+	for _, user := range users.Data {
+		require.Empty(t, user.Passwd)
+	}
+}
+
+func TestIntegrationFileRepoSessions(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.FileRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_sessions.json")
+	_ = os.Remove("test_storage_sessions.json.journal")
+	// physically remove test json storage file
+	defer os.Remove("test_storage_sessions.json")
+	defer os.Remove("test_storage_sessions.json.journal")
+
+	linkSVC = repoif.New(ctx, "test_storage_sessions.json", noopTracer)
+
+	now := time.Now()
+	expiresAt := now.Add(time.Hour)
+	for _, session := range []model.Session{
+		{ID: "s1", UID: "test_uid1", JTI: "j1", CreatedAt: now, LastUsed: now, ExpiresAt: expiresAt},
+		{ID: "s2", UID: "test_uid1", JTI: "j2", CreatedAt: now.Add(time.Second), LastUsed: now, ExpiresAt: expiresAt},
+		{ID: "s3", UID: "test_uid2", JTI: "j3", CreatedAt: now, LastUsed: now, ExpiresAt: expiresAt},
+	} {
+		require.NoError(t, linkSVC.PutSession(ctx, session))
+	}
+
+	// rotation, then reuse of rotated token revokes session
+	require.NoError(t, linkSVC.RotateSession(ctx, "s1", "j1", "j1a", expiresAt))
+	require.ErrorIs(t, linkSVC.RotateSession(ctx, "s1", "j1", "j1b", expiresAt), repository.ErrTokenReused)
+	require.ErrorIs(t, linkSVC.RotateSession(ctx, "s1", "j1a", "j1b", expiresAt), repository.ErrSessionRevoked)
+
+	// revoke is persisted
+	linkSVC.CloseConn()
+	linkSVC = repoif.New(ctx, "test_storage_sessions.json", noopTracer)
+	sessions, err := linkSVC.ListSessions(ctx, "test_uid1")
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, "s2", sessions[0].ID)
+
+	// other user can not kill session
+	require.ErrorIs(t, linkSVC.RevokeSession(ctx, "test_uid2", "s2"), repository.ErrNoSession)
+	require.NoError(t, linkSVC.RevokeSession(ctx, "test_uid1", "s2"))
+	require.ErrorIs(t, linkSVC.RotateSession(ctx, "s2", "j2", "j2a", expiresAt), repository.ErrSessionRevoked)
+
+	// all sessions of user
+	require.NoError(t, linkSVC.RevokeSession(ctx, "test_uid2", ""))
+	sessions, err = linkSVC.ListSessions(ctx, "test_uid2")
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	// revoked and expired sessions are deleted by sweeper, alive ones are kept
+	require.NoError(t, linkSVC.PutSession(ctx, model.Session{ID: "s4", UID: "test_uid1", JTI: "j4", CreatedAt: now, LastUsed: now, ExpiresAt: expiresAt}))
+	purged, err := linkSVC.PurgeSessions(ctx, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 2, purged)
+	purged, err = linkSVC.PurgeSessions(ctx, time.Now())
+	require.NoError(t, err)
+	require.Zero(t, purged)
+	purged, err = linkSVC.PurgeSessions(ctx, expiresAt)
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+}
+
+func TestIntegrationFileRepoAPIKeys(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.FileRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_apikeys.json")
+	_ = os.Remove("test_storage_apikeys.json.journal")
+	// physically remove test json storage file
+	defer os.Remove("test_storage_apikeys.json")
+	defer os.Remove("test_storage_apikeys.json.journal")
+
+	linkSVC = repoif.New(ctx, "test_storage_apikeys.json", noopTracer)
+
+	now := time.Now()
+	require.Error(t, linkSVC.PutAPIKey(ctx, model.APIKey{ID: "k0", UID: "test_uid1", Key: "wl_0"}))
+	for _, key := range []model.APIKey{
+		{ID: "k1", UID: "test_uid1", Key: "wl_1", Scopes: []string{"link.read"}, CreatedAt: now},
+		{ID: "k2", UID: "test_uid1", Key: "wl_2", Scopes: []string{"link.read"}, CreatedAt: now.Add(time.Second)},
+		{ID: "k3", UID: "test_uid1", Key: "wl_3", Scopes: []string{"link.read"}, CreatedAt: now, ExpiresAt: now.Add(-time.Second)},
+	} {
+		require.NoError(t, linkSVC.PutAPIKey(ctx, key))
+	}
+
+	key, err := linkSVC.AuthAPIKey(ctx, "wl_1")
+	require.NoError(t, err)
+	require.Equal(t, "k1", key.ID)
+	require.Empty(t, key.Hash)
+	require.False(t, key.LastUsed.IsZero())
+	_, err = linkSVC.AuthAPIKey(ctx, "wl_unknown")
+	require.ErrorIs(t, err, repository.ErrNoAPIKey)
+	_, err = linkSVC.AuthAPIKey(ctx, "wl_3")
+	require.ErrorIs(t, err, repository.ErrNoAPIKey)
+
+	// other user can not revoke key
+	require.ErrorIs(t, linkSVC.RevokeAPIKey(ctx, "test_uid2", "k1"), repository.ErrNoAPIKey)
+	require.NoError(t, linkSVC.RevokeAPIKey(ctx, "test_uid1", "k1"))
+	require.ErrorIs(t, linkSVC.RevokeAPIKey(ctx, "test_uid1", "k1"), repository.ErrNoAPIKey)
+
+	// revoke is persisted, key itself is not
+	linkSVC.CloseConn()
+	body, err := os.ReadFile("test_storage_apikeys.json.journal")
+	require.NoError(t, err)
+	require.NotContains(t, string(body), "wl_2")
+	linkSVC = repoif.New(ctx, "test_storage_apikeys.json", noopTracer)
+	_, err = linkSVC.AuthAPIKey(ctx, "wl_1")
+	require.ErrorIs(t, err, repository.ErrNoAPIKey)
+	keys, err := linkSVC.ListAPIKeys(ctx, "test_uid1")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, "k2", keys[0].ID)
+	require.Empty(t, keys[0].Hash)
+}
+
+func TestIntegrationFileRepoIdentities(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.FileRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_identities.json")
+	_ = os.Remove("test_storage_identities.json.journal")
+	// physically remove test json storage file
+	defer os.Remove("test_storage_identities.json")
+	defer os.Remove("test_storage_identities.json.journal")
+
+	linkSVC = repoif.New(ctx, "test_storage_identities.json", noopTracer)
+
+	now := time.Now()
+	require.Error(t, linkSVC.PutIdentity(ctx, model.Identity{Issuer: "https://idp.test", UID: "test_uid1"}))
+	require.NoError(t, linkSVC.PutIdentity(ctx, model.Identity{Issuer: "https://idp.test", Subject: "s1", UID: "test_uid1", CreatedAt: now}))
+	require.NoError(t, linkSVC.PutIdentity(ctx, model.Identity{Issuer: "https://other.test", Subject: "s1", UID: "test_uid1", CreatedAt: now.Add(time.Second)}))
+	// identity is linked once
+	require.NoError(t, linkSVC.PutIdentity(ctx, model.Identity{Issuer: "https://idp.test", Subject: "s1", UID: "test_uid1", CreatedAt: now}))
+	require.ErrorIs(t, linkSVC.PutIdentity(ctx, model.Identity{Issuer: "https://idp.test", Subject: "s1", UID: "test_uid2", CreatedAt: now}), repository.ErrIdentityTaken)
+
+	uid, err := linkSVC.FindIdentity(ctx, "https://idp.test", "s1")
+	require.NoError(t, err)
+	require.Equal(t, "test_uid1", uid)
+	uid, err = linkSVC.FindIdentity(ctx, "https://idp.test", "s2")
+	require.NoError(t, err)
+	require.Empty(t, uid)
+
+	// identities are persisted
+	linkSVC.CloseConn()
+	linkSVC = repoif.New(ctx, "test_storage_identities.json", noopTracer)
+	identities, err := linkSVC.ListIdentities(ctx, "test_uid1")
+	require.NoError(t, err)
+	require.Len(t, identities, 2)
+	require.Equal(t, "https://idp.test", identities[0].Issuer)
+	require.Equal(t, "https://other.test", identities[1].Issuer)
+
+	// identities go away with user
+	require.NoError(t, linkSVC.DelUser("test_uid1"))
+	uid, err = linkSVC.FindIdentity(ctx, "https://idp.test", "s1")
+	require.NoError(t, err)
+	require.Empty(t, uid)
+}
+
+func TestIntegrationFileRepoRedirs(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.FileRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_redirs.json")
+	_ = os.Remove("test_storage_redirs.json.journal")
+	// physically remove test json storage file
+	defer os.Remove("test_storage_redirs.json")
+	defer os.Remove("test_storage_redirs.json.journal")
+
+	linkSVC = repoif.New(ctx, "test_storage_redirs.json", noopTracer)
+
+	link := model.DataEl{UID: "test_uid1", URL: "mail.ru", Shorturl: "batch.gu", Datetime: time.Now(), Active: 1}
+	require.NoError(t, linkSVC.Put(ctx, "test_uid1", link.Shorturl, link, false))
+	personal := model.DataEl{UID: "test_uid2", URL: "ya.ru", Shorturl: "batch.gu", Datetime: time.Now(), Active: 1, Personal: true}
+	require.NoError(t, linkSVC.Put(ctx, "test_uid2", personal.Shorturl, personal, false))
+
+	batch := []model.LinkRedirs{
+		{Shorturl: "batch.gu", N: 3},
+		{UID: "test_uid2", Shorturl: "batch.gu", Personal: true, N: 2},
+		{Shorturl: "none.gu", N: 1},
+	}
+	require.Error(t, linkSVC.AddRedirs(ctx, "", batch))
+	require.NoError(t, linkSVC.AddRedirs(ctx, "b1", batch))
+	// repeated batch is ignored
+	require.NoError(t, linkSVC.AddRedirs(ctx, "b1", batch))
+
+	check := func(redirs, personalRedirs int) {
+		data, err := linkSVC.Get(ctx, "test_uid1", "batch.gu", false)
+		require.NoError(t, err)
+		require.Equal(t, redirs, data.Redirs)
+		data, err = linkSVC.Get(ctx, "test_uid2", "batch.gu", false)
+		require.NoError(t, err)
+		require.Equal(t, personalRedirs, data.Redirs)
+	}
+	check(3, 2)
+
+	// batch is still known after restart: from journal, then from snapshot
+	for i := 0; i < 2; i++ {
+		linkSVC.CloseConn()
+		linkSVC = repoif.New(ctx, "test_storage_redirs.json", noopTracer)
+		require.NoError(t, linkSVC.AddRedirs(ctx, "b1", batch))
+		check(3, 2)
+	}
+	require.NoError(t, linkSVC.AddRedirs(ctx, "b2", batch[:1]))
+	check(6, 2)
+	linkSVC.CloseConn()
+}
+
+func TestIntegrationFileRepoLedger(t *testing.T) {
+	var repoif, linkSVC repository.RepoIf
+	repoif = new(repository.FileRepo)
+
+	// No-op tracer (does nothing)
+	noopTracer := trace.NewNoopTracerProvider().Tracer("test")
+
+	ctx := context.Background()
+
+	_ = os.Remove("test_storage_ledger.json.journal")
+	// physically remove test json storage file
+	defer os.Remove("test_storage_ledger.json")
+	defer os.Remove("test_storage_ledger.json.journal")
+
+	// snapshot of older version: balance without ledger
+	legacy := `{"data":[],"users":[{"id":1,"uid":"old_uid","name":"old","balance":"70.50","user_role":"USER"}]}`
+	require.NoError(t, os.WriteFile("test_storage_ledger.json", []byte(legacy), 0644))
+
+	linkSVC = repoif.New(ctx, "test_storage_ledger.json", noopTracer)
+
+	suid, err := linkSVC.PutUser(model.User{Name: "su", Passwd: "123", Email: "su@u.ca", Role: "SUPERUSER"})
+	require.NoError(t, err)
+	user := model.User{Name: "test_user1", Passwd: "123", Email: "L@u.ca", Balance: money.MustParse("100.00"), Role: "USER"}
+	uid, err := linkSVC.PutUser(user)
+	require.NoError(t, err)
+	// balance of existing user is changed by payments only
+	user.Balance = money.MustParse("500.00")
+	_, err = linkSVC.PutUser(user)
+	require.NoError(t, err)
+
+	require.ErrorIs(t, linkSVC.PayUser(ctx, uid, suid, 0), repository.ErrBadAmount)
+	require.ErrorIs(t, linkSVC.PayUser(ctx, uid, suid, money.MustParse("-5.00")), repository.ErrBadAmount)
+	require.ErrorIs(t, linkSVC.PayUser(ctx, uid, uid, money.MustParse("1.00")), repository.ErrSelfPayment)
+	require.Error(t, linkSVC.PayUser(ctx, uid, "none", money.MustParse("1.00")))
+	require.NoError(t, linkSVC.PayUser(ctx, uid, suid, money.MustParse("60.00")))
+	// the rest 40.00 is not enough
+	require.ErrorIs(t, linkSVC.PayUser(ctx, uid, suid, money.MustParse("60.00")), repository.ErrInsufficientFunds)
+	require.NoError(t, linkSVC.PayUser(ctx, "old_uid", uid, money.MustParse("0.50")))
+
+	balances := map[string]string{uid: "40.50", suid: "60.00", "old_uid": "70.00"}
+	for id, balance := range balances {
+		got, err := linkSVC.GetUser(id)
+		require.NoError(t, err)
+		require.Equal(t, balance, got.Balance.String())
+	}
+
+	// every transaction of snapshot is balanced, sums of lines of accounts are balances
+	checkSnapshot := func() {
+		linkSVC.CloseConn()
+		raw, err := os.ReadFile("test_storage_ledger.json")
+		require.NoError(t, err)
+		var storage struct {
+			Transactions []repository.UsersTransactions `json:"transactions"`
+			Ledger       []repository.LedgerLine        `json:"ledger"`
+		}
+		require.NoError(t, json.Unmarshal(raw, &storage))
+		// openings of old_uid and uid, 2 payments
+		require.Len(t, storage.Transactions, 4)
+		require.Len(t, storage.Ledger, 8)
+		sums := make(map[int]money.Amount)
+		accounts := make(map[string]money.Amount)
+		for _, line := range storage.Ledger {
+			sums[line.TransactionID] += line.Amount
+			accounts[line.Account] += line.Amount
+		}
+		for _, trans := range storage.Transactions {
+			require.True(t, trans.Successful)
+			require.Zero(t, sums[trans.ID], trans.Description)
+		}
+		for id, balance := range balances {
+			require.Equal(t, balance, accounts[id].String())
+		}
+		require.Equal(t, "-170.50", accounts[repository.IssueAccount].String())
+	}
+	checkSnapshot()
+	// nothing is posted twice after restart
+	linkSVC = repoif.New(ctx, "test_storage_ledger.json", noopTracer)
+	checkSnapshot()
 }
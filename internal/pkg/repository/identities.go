@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// OpenID Connect identities helpers - same rules for all repos
+// identity (issuer, subject) is linked to one user, user can have identities of some providers
+
+// ErrIdentityTaken - identity is linked to other user already
+var ErrIdentityTaken = errors.New("identity is linked to other user already")
+
+// identityKey - key of identity in file and bolt repos, issuer is url, so it has no spaces
+func identityKey(issuer, subject string) string {
+	return issuer + " " + subject
+}
+
+// checkNewIdentity - identity to be put should have issuer, subject and uid
+func checkNewIdentity(identity model.Identity) error {
+	if identity.Issuer == "" || identity.Subject == "" || identity.UID == "" {
+		return fmt.Errorf("identity should have issuer, subject and uid")
+	}
+	return nil
+}
+
+// userIdentities - identities of uid sorted by creation
+func userIdentities(identities []model.Identity, uid string) []model.Identity {
+	found := []model.Identity{}
+	for _, identity := range identities {
+		if identity.UID == uid {
+			found = append(found, identity)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].CreatedAt.Before(found[j].CreatedAt)
+	})
+	return found
+}
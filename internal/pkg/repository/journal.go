@@ -0,0 +1,266 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/fileutil"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// journal of file repo - every change is appended as json line to <filename>.journal and fsynced,
+// so redirect or put costs one small write instead of dumping whole map.
+// after journalCompactEvery records map is dumped as snapshot to <filename> (temp file + rename)
+// and journal is truncated. snapshot keeps seq of last record in it, so records
+// which are already in snapshot are skipped when journal is replayed after crash.
+
+// journalCompactEvery - how many journal records trigger compaction into snapshot
+const journalCompactEvery = 1000
+
+// journal operations
+const (
+	opPut      = "put"
+	opDel      = "del"
+	opRedir    = "redir"
+	opUser     = "user"
+	opDelUser  = "deluser"
+	opPay      = "pay"
+	opClick    = "click"
+	opClicks   = "clicks"
+	opSweep    = "sweep"
+	opSession  = "session"
+	opAPIKey   = "apikey"
+	opIdentity = "identity"
+	opRedirs   = "redirs"
+)
+
+// journalRec - one change of file repo, one line of journal
+type journalRec struct {
+	Seq   uint64             `json:"seq"`
+	Op    string             `json:"op"`
+	Key   string             `json:"key,omitempty"`
+	Data  *model.DataEl      `json:"data,omitempty"`
+	Users []User             `json:"users,omitempty"`
+	Trans *UsersTransactions `json:"trans,omitempty"`
+	// Lines - lines of ledger of Trans
+	Lines []LedgerLine `json:"lines,omitempty"`
+	UID   string       `json:"uid,omitempty"`
+	Click *model.Click `json:"click,omitempty"`
+	// Clicks - batch of clicks (Click - one click of older journals)
+	Clicks []model.Click `json:"clicks,omitempty"`
+	// Session - new state of session
+	Session *model.Session `json:"session,omitempty"`
+	// APIKey - new state of api key
+	APIKey *model.APIKey `json:"apikey,omitempty"`
+	// Identity - new identity of user
+	Identity *model.Identity `json:"identity,omitempty"`
+	// Batch - batch of opens added to links
+	Batch *redirBatch `json:"batch,omitempty"`
+}
+
+// redirBatch - batch of opens with id, At - time of adding
+type redirBatch struct {
+	ID     string             `json:"id"`
+	At     time.Time          `json:"at"`
+	Redirs []model.LinkRedirs `json:"redirs"`
+}
+
+// journalName - name of journal file for snapshot file
+func journalName(filename string) string {
+	return filename + ".journal"
+}
+
+// applyRec - apply change to maps, no lock, as its has been done in upper level
+func (fr *FileRepo) applyRec(rec *journalRec) {
+	switch rec.Op {
+	case opPut:
+		fr.fileData[rec.Key] = *rec.Data
+		if rec.Data.Personal {
+			fr.unindex(rec.Data.Shorturl, rec.Key)
+		} else {
+			fr.shortIndex[rec.Data.Shorturl] = rec.Key
+		}
+	case opDel:
+		if datael, ok := fr.fileData[rec.Key]; ok {
+			datael.Active = 0
+			fr.fileData[rec.Key] = datael
+			// deleted shortlink is free for others
+			fr.unindex(datael.Shorturl, rec.Key)
+		}
+	case opSweep:
+		// expired link keeps its shortlink, owner can renew it
+		if datael, ok := fr.fileData[rec.Key]; ok {
+			datael.Active = 0
+			fr.fileData[rec.Key] = datael
+		}
+	case opRedir:
+		if datael, ok := fr.fileData[rec.Key]; ok {
+			datael.Redirs++
+			fr.fileData[rec.Key] = datael
+		}
+	case opRedirs:
+		if _, ok := fr.fileBatches[rec.Batch.ID]; ok {
+			break
+		}
+		fr.fileBatches[rec.Batch.ID] = rec.Batch.At
+		for _, link := range rec.Batch.Redirs {
+			key := link.UID + ":" + link.Shorturl
+			if !link.Personal {
+				key = fr.shortIndex[link.Shorturl]
+			}
+			if datael, ok := fr.fileData[key]; ok && datael.Personal == link.Personal {
+				datael.Redirs += int(link.N)
+				fr.fileData[key] = datael
+			}
+		}
+	case opUser, opPay:
+		for _, user := range rec.Users {
+			fr.fileUsers[user.UID] = user
+		}
+		if rec.Trans != nil {
+			fr.fileTrans = append(fr.fileTrans, *rec.Trans)
+		}
+		fr.fileLedger = append(fr.fileLedger, rec.Lines...)
+	case opDelUser:
+		delete(fr.fileUsers, rec.UID)
+		for key, val := range fr.fileData {
+			if val.UID == rec.UID {
+				delete(fr.fileData, key)
+				fr.unindex(val.Shorturl, key)
+			}
+		}
+		clicks := fr.fileClicks[:0]
+		for _, click := range fr.fileClicks {
+			if click.Owner != rec.UID {
+				clicks = append(clicks, click)
+			}
+		}
+		fr.fileClicks = clicks
+		for id, session := range fr.fileSessions {
+			if session.UID == rec.UID {
+				delete(fr.fileSessions, id)
+			}
+		}
+		for hash, key := range fr.fileAPIKeys {
+			if key.UID == rec.UID {
+				delete(fr.fileAPIKeys, hash)
+			}
+		}
+		for id, identity := range fr.fileIdentities {
+			if identity.UID == rec.UID {
+				delete(fr.fileIdentities, id)
+			}
+		}
+	case opSession:
+		fr.fileSessions[rec.Session.ID] = *rec.Session
+	case opAPIKey:
+		fr.fileAPIKeys[rec.APIKey.Hash] = *rec.APIKey
+	case opIdentity:
+		fr.fileIdentities[identityKey(rec.Identity.Issuer, rec.Identity.Subject)] = *rec.Identity
+	case opClick:
+		fr.fileClicks = append(fr.fileClicks, *rec.Click)
+	case opClicks:
+		fr.fileClicks = append(fr.fileClicks, rec.Clicks...)
+	}
+	fr.seq = rec.Seq
+}
+
+// unindex - remove key from shortlink index
+func (fr *FileRepo) unindex(shortlink, key string) {
+	if fr.shortIndex[shortlink] == key {
+		delete(fr.shortIndex, shortlink)
+	}
+}
+
+// commit - write change to journal (fsync) then apply it, no lock, as its has been done in upper level
+// change is durable when record is written, so failed compaction is only logged and tried again by next commit
+func (fr *FileRepo) commit(rec journalRec) error {
+	rec.Seq = fr.seq + 1
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	// record which is not written is cut off, so it is not replayed and next one is not appended to half of it
+	if err = fileutil.AppendRecord(fr.journal, line); err != nil {
+		return err
+	}
+
+	fr.applyRec(&rec)
+	fr.journaled++
+
+	if fr.journaled >= journalCompactEvery {
+		if err = fr.compact(); err != nil {
+			log.Printf("journal %s: compaction error, it is tried again by next commit: %v", journalName(fr.fileName), err)
+		}
+	}
+	return nil
+}
+
+// compact - dump snapshot and truncate journal
+func (fr *FileRepo) compact() error {
+	if err := fr.DumpMapToFile(); err != nil {
+		return err
+	}
+	if err := fr.journal.Truncate(0); err != nil {
+		return fmt.Errorf("journal truncate error: %w", err)
+	}
+	if _, err := fr.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fr.journaled = 0
+	return fr.journal.Sync()
+}
+
+// openJournal - open journal, replay records which are newer than snapshot
+// broken tail of journal (crash in the middle of write) is cut off
+func (fr *FileRepo) openJournal() error {
+	journal, err := os.OpenFile(journalName(fr.fileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("journal open error: %w", err)
+	}
+
+	var good int64
+	reader := bufio.NewReader(journal)
+	for {
+		line, errRead := reader.ReadBytes('\n')
+		if errRead != nil {
+			if len(line) != 0 {
+				log.Printf("journal %s: cut off unfinished record at %d", journalName(fr.fileName), good)
+			}
+			break
+		}
+		var rec journalRec
+		if err = json.Unmarshal(line, &rec); err != nil {
+			log.Printf("journal %s: cut off broken record at %d: %v", journalName(fr.fileName), good, err)
+			break
+		}
+		good += int64(len(line))
+		if rec.Seq <= fr.seq {
+			// already in snapshot
+			continue
+		}
+		fr.applyRec(&rec)
+		fr.journaled++
+	}
+
+	if err = journal.Truncate(good); err != nil {
+		return fmt.Errorf("journal truncate error: %w", err)
+	}
+	if _, err = journal.Seek(good, io.SeekStart); err != nil {
+		return err
+	}
+	fr.journal = journal
+
+	if fr.journaled > 0 {
+		// start with fresh snapshot
+		return fr.compact()
+	}
+	return nil
+}
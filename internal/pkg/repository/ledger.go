@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
+)
+
+// двойная запись платежей (ledger)
+// every transaction (UsersTransactions) is posted as lines of accounts whose sum is 0, lines are never changed.
+// account of user is his uid, money given to users (opening balances) comes from IssueAccount.
+// balance of user is sum of lines of his account, it is cached in user record and is changed only together with lines.
+// pg locks rows of both users (SELECT ... FOR UPDATE) before balance is checked, so concurrent payments
+// can not overdraw; file and bolt repos have one writer anyway.
+// balances of older versions (without ledger) are posted as opening balances: by migration in pg, on start in file and bolt
+
+// IssueAccount - account which gives money to users, its balance is negative sum of all balances
+const IssueAccount = "@issue"
+
+var (
+	// ErrBadAmount - amount of payment is not > 0
+	ErrBadAmount = errors.New("amount of payment should be > 0")
+	// ErrSelfPayment - payer is payee
+	ErrSelfPayment = errors.New("user can not pay himself")
+	// ErrBalanceBlocked - balance of payer is blocked
+	ErrBalanceBlocked = errors.New("balance of payer is blocked")
+	// ErrInsufficientFunds - balance of payer is less than amount
+	ErrInsufficientFunds = errors.New("balance of payer is less than amount")
+)
+
+// LedgerLine - line of transaction TransactionID: Amount is added to balance of Account
+type LedgerLine struct {
+	ID            int          `db:"id" json:"id"`
+	TransactionID int          `db:"transaction_id" json:"transaction_id"`
+	Account       string       `db:"account" json:"account"`
+	Amount        money.Amount `db:"amount" json:"amount"`
+	DateTime      time.Time    `db:"date_time" json:"date_time"`
+}
+
+// checkPayment - payer can pay amount to payee
+func checkPayment(payer, payee User, amount money.Amount) error {
+	switch {
+	case amount <= 0:
+		return ErrBadAmount
+	case payer.UID == payee.UID:
+		return ErrSelfPayment
+	case payer.IsBalanceBlocked:
+		return ErrBalanceBlocked
+	case payer.Balance < amount:
+		return ErrInsufficientFunds
+	case !(payee.Balance + amount).Valid():
+		return fmt.Errorf("balance of payee: %w", money.ErrRange)
+	}
+	return nil
+}
+
+// paymentDescription - description of transaction of payment
+func paymentDescription(uidA, uidB string, amount money.Amount) string {
+	return "Payment +" + amount.String() + " from " + uidA + " for " + uidB
+}
+
+// openingDescription - description of transaction of opening balance
+func openingDescription(uid string, amount money.Amount) string {
+	return "Opening balance " + amount.String() + " of " + uid
+}
+
+// posting - transaction of amount from account of user from to account of user to, and its lines
+// user of IssueAccount has no record (ID 0), ids of transaction and lines are set by repo
+func posting(from, to User, amount money.Amount, description string, at time.Time) (UsersTransactions, []LedgerLine) {
+	trans := UsersTransactions{
+		DateTime:    at,
+		UserIDFrom:  from.ID,
+		UserIDTo:    to.ID,
+		Amount:      amount,
+		Description: description,
+		Successful:  true,
+	}
+	lines := []LedgerLine{
+		{Account: from.UID, Amount: -amount, DateTime: at},
+		{Account: to.UID, Amount: amount, DateTime: at},
+	}
+	return trans, lines
+}
+
+// pay - payment of amount from userA to userB, cached balances are changed in place
+func pay(userA, userB *User, amount money.Amount, at time.Time) (UsersTransactions, []LedgerLine, error) {
+	if err := checkPayment(*userA, *userB, amount); err != nil {
+		return UsersTransactions{}, nil, err
+	}
+	trans, lines := posting(*userA, *userB, amount, paymentDescription(userA.UID, userB.UID, amount), at)
+	userA.Balance -= amount
+	userB.Balance += amount
+	return trans, lines, nil
+}
+
+// opening - transaction of opening balance of user, balance is already in user record
+func opening(user User, amount money.Amount, at time.Time) (UsersTransactions, []LedgerLine) {
+	return posting(User{UID: IssueAccount}, user, amount, openingDescription(user.UID, amount), at)
+}
+
+// unposted - users whose cached balance is not equal to sum of lines of their account -> difference
+func unposted(users []User, lines []LedgerLine) map[string]money.Amount {
+	balances := make(map[string]money.Amount)
+	for _, line := range lines {
+		balances[line.Account] += line.Amount
+	}
+	diff := make(map[string]money.Amount)
+	for _, user := range users {
+		if amount := user.Balance - balances[user.UID]; amount != 0 {
+			diff[user.UID] = amount
+		}
+	}
+	return diff
+}
@@ -0,0 +1,244 @@
+package repository
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// pg schema migrations - sql files are embedded into binary
+// file name is <version>_<name>.up.sql and <version>_<name>.down.sql
+// applied versions are kept in schema_migrations table
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID - pg advisory lock key, so only one instance migrates db at a time
+const migrationLockID = 1980_0001
+
+// Migrator - repo which has schema to migrate (pg)
+type Migrator interface {
+	Migrate(ctx context.Context, cmd string) error
+	MigrationStatus(ctx context.Context) ([]MigrationState, error)
+}
+
+// Migration - one version of schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationState - migration and time when it was applied (zero if pending)
+type MigrationState struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// loadMigrations - read embedded sql files sorted by version
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s: name should be <version>_<name>", fileName)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: bad version: %w", fileName, err)
+		}
+		body, err := migrationFiles.ReadFile(path.Join("migrations", fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	var migrations []Migration
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s: both up and down files are needed", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// withMigrationLock - run f on one connection holding pg advisory lock
+func withMigrationLock(ctx context.Context, dbpool *pgxpool.Pool, f func(conn *pgxpool.Conn) error) error {
+	conn, err := dbpool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err = conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to take migration lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+			log.Printf("failed to release migration lock: %v", err)
+		}
+	}()
+
+	const sql = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT        NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT current_timestamp
+	);
+	`
+	if _, err = conn.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	return f(conn)
+}
+
+// appliedMigrations - version -> time it was applied
+func appliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[int]time.Time, error) {
+	const sql = `SELECT version, applied_at FROM schema_migrations;`
+	rows, err := conn.Query(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("failed to read response: %w", rows.Err())
+	}
+	return applied, nil
+}
+
+// runMigration - apply migration sql and record it in one transaction
+func runMigration(ctx context.Context, conn *pgxpool.Conn, m Migration, up bool) error {
+	return conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if up {
+			if _, err := tx.Exec(ctx, m.Up); err != nil {
+				return fmt.Errorf("migration %d_%s up: %w", m.Version, m.Name, err)
+			}
+			const sql = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2);`
+			_, err := tx.Exec(ctx, sql, m.Version, m.Name)
+			return err
+		}
+		if _, err := tx.Exec(ctx, m.Down); err != nil {
+			return fmt.Errorf("migration %d_%s down: %w", m.Version, m.Name, err)
+		}
+		const sql = `DELETE FROM schema_migrations WHERE version = $1;`
+		_, err := tx.Exec(ctx, sql, m.Version)
+		return err
+	})
+}
+
+// Migrate - up applies all pending migrations, down reverts last applied one
+func (pgr *PgRepo) Migrate(ctx context.Context, cmd string) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, pgr.DBPool, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		switch cmd {
+		case "up":
+			for _, m := range migrations {
+				if _, ok := applied[m.Version]; ok {
+					continue
+				}
+				if err = runMigration(ctx, conn, m, true); err != nil {
+					return err
+				}
+				log.Printf("migration %d_%s is applied", m.Version, m.Name)
+			}
+			return nil
+		case "down":
+			for i := len(migrations) - 1; i >= 0; i-- {
+				m := migrations[i]
+				if _, ok := applied[m.Version]; !ok {
+					continue
+				}
+				if err = runMigration(ctx, conn, m, false); err != nil {
+					return err
+				}
+				log.Printf("migration %d_%s is reverted", m.Version, m.Name)
+				return nil
+			}
+			log.Printf("no migrations to revert")
+			return nil
+		}
+		return fmt.Errorf("unknown migrate command %q, use up, down or status", cmd)
+	})
+}
+
+// MigrationStatus - all migrations with time they were applied
+func (pgr *PgRepo) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var states []MigrationState
+	err = withMigrationLock(ctx, pgr.DBPool, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			states = append(states, MigrationState{Migration: m, AppliedAt: applied[m.Version]})
+		}
+		return nil
+	})
+	return states, err
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS users_transactions;
+DROP TABLE IF EXISTS users_data;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,39 @@
+-- base schema of weblink: users, their links and payments b/w users
+CREATE TABLE IF NOT EXISTS users (
+    id                 SERIAL PRIMARY KEY,
+    uid                VARCHAR(64)    NOT NULL UNIQUE, -- constraint users_uid_key
+    name               VARCHAR(255)   NOT NULL,
+    passwd             VARCHAR(255)   NOT NULL DEFAULT '',
+    email              VARCHAR(255)   NOT NULL DEFAULT '',
+    created_on         TIMESTAMPTZ    NOT NULL DEFAULT current_timestamp,
+    last_login         TIMESTAMPTZ    NOT NULL DEFAULT current_timestamp,
+    is_active          BOOLEAN        NOT NULL DEFAULT TRUE,
+    user_role          VARCHAR(16)    NOT NULL DEFAULT 'USER'
+        CHECK (user_role IN ('SUPERUSER', 'CREATOR', 'USER')),
+    is_balance_blocked BOOLEAN        NOT NULL DEFAULT FALSE,
+    balance            NUMERIC(12, 2) NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS users_data (
+    id        SERIAL PRIMARY KEY,
+    user_id   INTEGER      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    uid       VARCHAR(64)  NOT NULL,
+    url       TEXT         NOT NULL,
+    short_url VARCHAR(255) NOT NULL,
+    date_time TIMESTAMPTZ  NOT NULL DEFAULT current_timestamp,
+    is_active BOOLEAN      NOT NULL DEFAULT TRUE,
+    redirs    INTEGER      NOT NULL DEFAULT 0,
+    CONSTRAINT users_data_shorturl_user_id_keys UNIQUE (short_url, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS users_data_uid_idx ON users_data (uid);
+
+CREATE TABLE IF NOT EXISTS users_transactions (
+    id           SERIAL PRIMARY KEY,
+    date_time    TIMESTAMPTZ    NOT NULL DEFAULT current_timestamp,
+    user_id_from INTEGER REFERENCES users (id) ON DELETE SET NULL,
+    user_id_to   INTEGER REFERENCES users (id) ON DELETE SET NULL,
+    amount       NUMERIC(12, 2) NOT NULL,
+    description  TEXT           NOT NULL DEFAULT '',
+    successful   BOOLEAN        NOT NULL DEFAULT FALSE
+);
@@ -0,0 +1,12 @@
+-- every open of shortlink for click stats, removed together with link
+CREATE TABLE IF NOT EXISTS link_clicks (
+    id         BIGSERIAL PRIMARY KEY,
+    link_id    INTEGER      NOT NULL REFERENCES users_data (id) ON DELETE CASCADE,
+    date_time  TIMESTAMPTZ  NOT NULL DEFAULT current_timestamp,
+    uid        VARCHAR(64)  NOT NULL DEFAULT '',
+    referrer   TEXT         NOT NULL DEFAULT '',
+    user_agent TEXT         NOT NULL DEFAULT '',
+    ip         VARCHAR(64)  NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS link_clicks_link_id_date_time_idx ON link_clicks (link_id, date_time);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS users_data_expires_at_idx;
+
+ALTER TABLE users_data
+    DROP COLUMN IF EXISTS max_redirs,
+    DROP COLUMN IF EXISTS expires_at;
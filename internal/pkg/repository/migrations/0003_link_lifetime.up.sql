@@ -0,0 +1,8 @@
+-- optional lifetime of link: time of expiry and max number of opens (0 - no limit)
+ALTER TABLE users_data
+    ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS max_redirs INTEGER NOT NULL DEFAULT 0;
+
+-- sweeper looks only at live links which can expire
+CREATE INDEX IF NOT EXISTS users_data_expires_at_idx ON users_data (expires_at)
+    WHERE is_active AND expires_at IS NOT NULL;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS users_data_short_url_global_key;
+
+ALTER TABLE users_data
+    DROP COLUMN IF EXISTS personal;
@@ -0,0 +1,10 @@
+-- shortlink is unique among global links, personal links are opened by /u/{user}/{shortlink}
+ALTER TABLE users_data
+    ADD COLUMN IF NOT EXISTS personal BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- shortlinks used by some users before: the oldest link keeps it, others become personal
+UPDATE users_data d SET personal = true
+    WHERE EXISTS (SELECT 1 FROM users_data o WHERE o.short_url = d.short_url AND o.id < d.id AND NOT o.personal);
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_data_short_url_global_key ON users_data (short_url)
+    WHERE NOT personal;
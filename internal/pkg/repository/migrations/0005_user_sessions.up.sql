@@ -0,0 +1,14 @@
+-- refresh token families: one row per login, jti is id of its current refresh token
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id         TEXT PRIMARY KEY,
+    uid        VARCHAR(64) NOT NULL REFERENCES users (uid) ON DELETE CASCADE,
+    jti        TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT current_timestamp,
+    last_used  TIMESTAMPTZ NOT NULL DEFAULT current_timestamp,
+    expires_at TIMESTAMPTZ NOT NULL,
+    user_agent TEXT        NOT NULL DEFAULT '',
+    ip         TEXT        NOT NULL DEFAULT '',
+    revoked    BOOLEAN     NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS user_sessions_uid_idx ON user_sessions (uid);
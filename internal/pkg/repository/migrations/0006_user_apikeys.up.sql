@@ -0,0 +1,15 @@
+-- api keys of users: only sha256 of key is kept, scopes are actions of policy
+-- last_used is null for key which is not used yet, expires_at is null for key which does not expire
+CREATE TABLE IF NOT EXISTS user_apikeys (
+    id         TEXT PRIMARY KEY,
+    uid        VARCHAR(64) NOT NULL REFERENCES users (uid) ON DELETE CASCADE,
+    name       TEXT        NOT NULL DEFAULT '',
+    hash       TEXT        NOT NULL UNIQUE,
+    scopes     TEXT[]      NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT current_timestamp,
+    last_used  TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ,
+    revoked    BOOLEAN     NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS user_apikeys_uid_idx ON user_apikeys (uid);
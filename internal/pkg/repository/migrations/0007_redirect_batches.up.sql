@@ -0,0 +1,8 @@
+-- ids of batches of opens which are added to redirs of links, so repeated batch is not added twice
+-- old ids are deleted by AddRedirs
+CREATE TABLE IF NOT EXISTS redirect_batches (
+    id         TEXT PRIMARY KEY,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS redirect_batches_applied_at_idx ON redirect_batches (applied_at);
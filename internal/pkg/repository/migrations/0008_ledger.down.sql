@@ -0,0 +1,4 @@
+-- transactions of opening balances stay in users_transactions
+DROP TABLE IF EXISTS ledger_lines;
+
+DROP FUNCTION IF EXISTS ledger_lines_immutable();
@@ -0,0 +1,48 @@
+-- double-entry ledger: every transaction is posted as immutable lines of accounts whose sum is 0
+-- account is uid of user or '@issue' (opening balances), users.balance is cached sum of lines of user
+CREATE TABLE IF NOT EXISTS ledger_lines (
+    id             BIGSERIAL PRIMARY KEY,
+    transaction_id INTEGER        NOT NULL REFERENCES users_transactions (id),
+    account        VARCHAR(64)    NOT NULL,
+    amount         NUMERIC(12, 2) NOT NULL CHECK (amount <> 0),
+    date_time      TIMESTAMPTZ    NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS ledger_lines_account_idx ON ledger_lines (account);
+CREATE INDEX IF NOT EXISTS ledger_lines_transaction_id_idx ON ledger_lines (transaction_id);
+
+CREATE OR REPLACE FUNCTION ledger_lines_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'ledger lines can not be changed';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS ledger_lines_immutable ON ledger_lines;
+CREATE TRIGGER ledger_lines_immutable BEFORE UPDATE OR DELETE ON ledger_lines
+    FOR EACH ROW EXECUTE PROCEDURE ledger_lines_immutable();
+
+-- successful payments of older versions, account of deleted user is '@deleted'
+INSERT INTO ledger_lines (transaction_id, account, amount, date_time)
+SELECT t.id, COALESCE(u.uid, '@deleted'), -t.amount, t.date_time
+    FROM users_transactions t LEFT JOIN users u ON u.id = t.user_id_from
+    WHERE t.successful AND t.amount <> 0
+UNION ALL
+SELECT t.id, COALESCE(u.uid, '@deleted'), t.amount, t.date_time
+    FROM users_transactions t LEFT JOIN users u ON u.id = t.user_id_to
+    WHERE t.successful AND t.amount <> 0;
+
+-- the rest of balances (set by PutUser of older versions) are posted as opening balances
+WITH unposted AS (
+    SELECT u.id, u.uid,
+           u.balance - COALESCE((SELECT SUM(l.amount) FROM ledger_lines l WHERE l.account = u.uid), 0) AS amount
+        FROM users u
+), opening AS (
+    INSERT INTO users_transactions (date_time, user_id_from, user_id_to, amount, description, successful)
+    SELECT current_timestamp, NULL, id, amount, 'Opening balance ' || amount || ' of ' || uid, TRUE
+        FROM unposted WHERE amount <> 0
+    RETURNING id, user_id_to, amount, date_time
+)
+INSERT INTO ledger_lines (transaction_id, account, amount, date_time)
+SELECT o.id, u.uid, o.amount, o.date_time FROM opening o JOIN users u ON u.id = o.user_id_to
+UNION ALL
+SELECT o.id, '@issue', -o.amount, o.date_time FROM opening o;
@@ -0,0 +1,11 @@
+-- OpenID Connect identities of users: account (issuer, subject) of provider is linked to one user
+CREATE TABLE IF NOT EXISTS user_identities (
+    issuer     TEXT        NOT NULL,
+    subject    TEXT        NOT NULL,
+    uid        VARCHAR(64) NOT NULL REFERENCES users (uid) ON DELETE CASCADE,
+    email      TEXT        NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_uid_idx ON user_identities (uid);
@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// password helpers - same for all repos: passwd is kept as bcrypt hash (salt is part of hash)
+// older records keep plaintext passwd, it is replaced by hash on next successful login
+
+// passwdCost - bcrypt cost of new hashes, hashes of lower cost are upgraded on login too
+const passwdCost = bcrypt.DefaultCost
+
+// HashPasswd - bcrypt hash of password with new random salt
+func HashPasswd(passwd string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(passwd), passwdCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash passwd: %w", err)
+	}
+	return string(hash), nil
+}
+
+// checkPasswd - passwd matches stored one (hash or plaintext of older record)
+// rehash - stored passwd should be replaced by new hash
+func checkPasswd(stored, passwd string) (ok, rehash bool) {
+	cost, err := bcrypt.Cost([]byte(stored))
+	if err != nil {
+		// not a hash - plaintext, compared in constant time as well
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(passwd)) == 1
+		return ok, ok
+	}
+	ok = bcrypt.CompareHashAndPassword([]byte(stored), []byte(passwd)) == nil
+	return ok, ok && cost < passwdCost
+}
+
+// upgradePasswd - new hash of passwd if stored one needs it, stored one otherwise
+func upgradePasswd(stored, passwd string, rehash bool) (string, error) {
+	if !rehash {
+		return stored, nil
+	}
+	return HashPasswd(passwd)
+}
@@ -4,16 +4,18 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"log"
 	"net"
-	"strconv"
 	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/money"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -32,49 +34,62 @@ const (
 
 // User - go struct of pg db
 type User struct {
-	ID               int       `db:"id"`
-	UID              string    `db:"uid"`
-	Name             string    `db:"name"`
-	Passwd           string    `db:"passwd"`
-	Email            string    `db:"email"`
-	CreatedOn        time.Time `db:"created_on"`
-	LastLogin        time.Time `db:"last_login"`
-	IsActive         bool      `db:"is_active"`
-	UserRole         tUserRole `db:"user_role"`
-	IsBalanceBlocked bool      `db:"is_balance_blocked"`
-	Balance          string    `db:"balance"`
+	ID               int          `db:"id" json:"id"`
+	UID              string       `db:"uid" json:"uid"`
+	Name             string       `db:"name" json:"name"`
+	Passwd           string       `db:"passwd" json:"passwd"`
+	Email            string       `db:"email" json:"email"`
+	CreatedOn        time.Time    `db:"created_on" json:"created_on"`
+	LastLogin        time.Time    `db:"last_login" json:"last_login"`
+	IsActive         bool         `db:"is_active" json:"is_active"`
+	UserRole         tUserRole    `db:"user_role" json:"user_role"`
+	IsBalanceBlocked bool         `db:"is_balance_blocked" json:"is_balance_blocked"`
+	Balance          money.Amount `db:"balance" json:"balance"`
 }
 
+// pgUniqueViolation - pg error code of unique index violation
+const pgUniqueViolation = "23505"
+
 // UserData - go struct of pg db - related to user data contains all shortlink url counters
 type UserData struct {
-	ID       int       `db:"id"`
-	UserID   int       `db:"user_id"`
-	UID      string    `db:"uid"`
-	URL      string    `db:"url"`
-	ShortURL string    `db:"short_url"`
-	DateTime time.Time `db:"date_time"`
-	IsActive bool      `db:"is_active"`
-	Redirs   int       `db:"redirs"`
+	ID       int       `db:"id" json:"id"`
+	UserID   int       `db:"user_id" json:"user_id"`
+	UID      string    `db:"uid" json:"uid"`
+	URL      string    `db:"url" json:"url"`
+	ShortURL string    `db:"short_url" json:"short_url"`
+	DateTime time.Time `db:"date_time" json:"date_time"`
+	IsActive bool      `db:"is_active" json:"is_active"`
+	Redirs   int       `db:"redirs" json:"redirs"`
+	// ExpiresAt, MaxRedirs - optional lifetime of link
+	ExpiresAt *time.Time `db:"expires_at" json:"expires_at,omitempty"`
+	MaxRedirs int        `db:"max_redirs" json:"max_redirs,omitempty"`
+	// Personal - link is opened only by /u/{user}/{shortlink}, its shortlink is not unique
+	Personal bool `db:"personal" json:"personal,omitempty"`
 }
 
-// UsersTransactions - go struct of pg db - related to transactions b/w users
+// UsersTransactions - go struct of pg db - related to transactions b/w users, they are posted to ledger (see ledger)
+// failed payments are not kept, Successful is false only in rows of older versions
 type UsersTransactions struct {
-	ID          int       `db:"id"`
-	DateTime    time.Time `db:"date_time"`
-	UserIDFrom  int       `db:"user_id_from"`
-	UserIDTo    int       `db:"user_id_to"`
-	Amount      string    `db:"amount"`
-	Description string    `db:"description"`
-	Successful  bool      `db:"successful"`
+	ID          int          `db:"id" json:"id"`
+	DateTime    time.Time    `db:"date_time" json:"date_time"`
+	UserIDFrom  int          `db:"user_id_from" json:"user_id_from"`
+	UserIDTo    int          `db:"user_id_to" json:"user_id_to"`
+	Amount      money.Amount `db:"amount" json:"amount"`
+	Description string       `db:"description" json:"description"`
+	Successful  bool         `db:"successful" json:"successful"`
 }
 
 // PgRepo init pg go struct holds connex to db
+// MaxConns, MinConns - pool size, they are set at prototype before New (zero - 8 and 4)
 type PgRepo struct {
 	URL    string
 	CTX    context.Context
 	DBPool *pgxpool.Pool
 	Logger *zap.Logger
 	Tracer trace.Tracer
+
+	MaxConns int32
+	MinConns int32
 }
 
 // GetAllUsers - suid method to get all users data
@@ -82,7 +97,7 @@ func (pgr *PgRepo) GetAllUsers() (model.Users, error) {
 
 	grGetAllUsers := func(ctx context.Context, dbpool *pgxpool.Pool) ([]User, error) {
 		const sql = `
-			SELECT id, uid, name, passwd, email, is_active, created_on, balance::varchar,
+			SELECT id, uid, name, email, is_active, created_on, balance::varchar,
 					last_login, is_balance_blocked, user_role FROM users ORDER BY user_role, name;
 			`
 		rows, err := dbpool.Query(ctx, sql)
@@ -100,7 +115,6 @@ func (pgr *PgRepo) GetAllUsers() (model.Users, error) {
 			err = rows.Scan(&user.ID,
 				&user.UID,
 				&user.Name,
-				&user.Passwd,
 				&user.Email,
 				&user.IsActive,
 				&user.CreatedOn,
@@ -158,44 +172,53 @@ func (pgr *PgRepo) GetAllUsers() (model.Users, error) {
 }
 
 // AuthUser - check user&password ie autheticate and return UID if successful
+// plaintext passwd of older record is replaced by hash
 func (pgr *PgRepo) AuthUser(userAuth model.User) (string, error) {
-	// get user UID by name, password from users if exists return get UID
-	// and update lastlogin
+	// get users by name, the one whose password matches is authenticated
+	// and its lastlogin is updated
 	const sql = `
 	SELECT UID, name, passwd FROM users
-		WHERE name = $1 AND passwd = $2;
+		WHERE name = $1;
 	`
 	rows, err := pgr.DBPool.Query(pgr.CTX, sql,
 		userAuth.Name,
-		userAuth.Passwd,
 	)
 
-	var user User
-
 	if err != nil {
 		return "", fmt.Errorf("failed to query data: %w", err) // Вызов Close нужен, чтобы вернуть соединение в пул
 	}
 
 	defer rows.Close()
 
+	var users []User
 	for rows.Next() {
+		var user User
 		err = rows.Scan(&user.UID, &user.Name, &user.Passwd)
 		if err != nil {
 			return "", fmt.Errorf("failed to scan row: %w", err)
 		}
+		users = append(users, user)
 	}
 
 	if rows.Err() != nil {
 		return "", fmt.Errorf("failed to read response: %w", rows.Err())
 	}
 
-	if userAuth.Name == user.Name && userAuth.Passwd == user.Passwd {
-		// update lastlogin
+	for _, user := range users {
+		ok, rehash := checkPasswd(user.Passwd, userAuth.Passwd)
+		if !ok {
+			continue
+		}
+		passwd, err := upgradePasswd(user.Passwd, userAuth.Passwd, rehash)
+		if err != nil {
+			return "", err
+		}
+		// update lastlogin and passwd
 		const sql = `
-		UPDATE users SET last_login = current_timestamp
+		UPDATE users SET last_login = current_timestamp, passwd = $2
 			WHERE UID = $1;
 	`
-		_, err = pgr.DBPool.Exec(pgr.CTX, sql, user.UID)
+		_, err = pgr.DBPool.Exec(pgr.CTX, sql, user.UID, passwd)
 
 		if err != nil {
 			return "", fmt.Errorf("failed to update userdata: %w", err)
@@ -228,6 +251,10 @@ func (pgr *PgRepo) New(ctx context.Context, filename string, tracer trace.Tracer
 	// Pool соединений обязательно ограничивать сверху
 	cfg.MaxConns = 8
 	cfg.MinConns = 4
+	if pgr.MaxConns > 0 {
+		cfg.MaxConns = pgr.MaxConns
+		cfg.MinConns = pgr.MinConns
+	}
 	// HealthCheckPeriod - частота пингования соединения с Postgres
 	cfg.HealthCheckPeriod = 1 * time.Minute
 	// MaxConnLifetime - сколько времени будет жить соединение.
@@ -256,10 +283,12 @@ func (pgr *PgRepo) New(ctx context.Context, filename string, tracer trace.Tracer
 	}
 
 	return &PgRepo{
-		CTX:    ctx,
-		URL:    url,
-		DBPool: dbpool,
-		Tracer: tracer,
+		CTX:      ctx,
+		URL:      url,
+		DBPool:   dbpool,
+		Tracer:   tracer,
+		MaxConns: cfg.MaxConns,
+		MinConns: cfg.MinConns,
 	}
 }
 
@@ -270,11 +299,11 @@ func (pgr *PgRepo) Get(ctx context.Context, uid, key string, su bool) (model.Dat
 
 	grGet := func(ctx context.Context, dbpool *pgxpool.Pool, uid, shorturl string, su bool) (UserData, error) {
 		const sql = `
-	SELECT id, user_id, url, redirs, is_active, short_url, date_time, uid FROM users_data
+	SELECT id, user_id, url, redirs, is_active, short_url, date_time, uid, expires_at, max_redirs, personal FROM users_data
     	WHERE uid = $1 AND short_url = $2;
 	`
 		const sqlsu = `
-	SELECT id, user_id, url, redirs, is_active, short_url, date_time, uid FROM users_data
+	SELECT id, user_id, url, redirs, is_active, short_url, date_time, uid, expires_at, max_redirs, personal FROM users_data
     	WHERE short_url = $1;
 	`
 		var rows pgx.Rows
@@ -302,6 +331,9 @@ func (pgr *PgRepo) Get(ctx context.Context, uid, key string, su bool) (model.Dat
 				&userdata.ShortURL,
 				&userdata.DateTime,
 				&userdata.UID,
+				&userdata.ExpiresAt,
+				&userdata.MaxRedirs,
+				&userdata.Personal,
 			)
 
 			if err != nil {
@@ -329,18 +361,7 @@ func (pgr *PgRepo) Get(ctx context.Context, uid, key string, su bool) (model.Dat
 		return model.DataEl{}, err
 	}
 
-	//adjust field Active db - bool , api - int
-	var activeInt = 0
-	if userdata.IsActive {
-		activeInt = 1
-	}
-
-	return model.DataEl{UID: userdata.UID,
-		URL:      userdata.URL,
-		Shorturl: userdata.ShortURL,
-		Datetime: userdata.DateTime,
-		Active:   activeInt,
-		Redirs:   userdata.Redirs}, nil
+	return userDataToModel(userdata), nil
 }
 
 // Put - store data string to pg repo
@@ -357,13 +378,17 @@ func (pgr *PgRepo) Put(ctx context.Context, uid, key string, value model.DataEl,
 
 	grPut := func(ctx context.Context, dbpool *pgxpool.Pool, uid, key string, userdata *UserData) error {
 		const sql = `
-	INSERT INTO users_data (user_id,url,short_url,redirs,date_time,uid)
-    VALUES ((SELECT id FROM users WHERE uid = $1),$2,$3,$4,$5,$1)
+	INSERT INTO users_data (user_id,url,short_url,redirs,date_time,uid,is_active,expires_at,max_redirs,personal)
+    VALUES ((SELECT id FROM users WHERE uid = $1),$2,$3,$4,$5,$1,$6,$7,$8,$9)
         ON CONFLICT ON CONSTRAINT users_data_shorturl_user_id_keys
             DO UPDATE SET url = excluded.url,
                           redirs = excluded.redirs,
                           date_time = excluded.date_time,
-                          uid = excluded.uid;
+                          uid = excluded.uid,
+                          is_active = excluded.is_active,
+                          expires_at = excluded.expires_at,
+                          max_redirs = excluded.max_redirs,
+                          personal = excluded.personal;
 	`
 		data, _ := json.Marshal(userdata)
 
@@ -379,7 +404,16 @@ func (pgr *PgRepo) Put(ctx context.Context, uid, key string, value model.DataEl,
 			userdata.ShortURL,
 			userdata.Redirs,
 			userdata.DateTime,
+			userdata.IsActive,
+			userdata.ExpiresAt,
+			userdata.MaxRedirs,
+			userdata.Personal,
 		)
+		// global shortlink of other user - unique index users_data_short_url_global_key
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+			return ErrShortlinkTaken
+		}
 		if err != nil {
 			return fmt.Errorf("failed to add/change userdata: %w", err)
 		}
@@ -397,11 +431,14 @@ func (pgr *PgRepo) Put(ctx context.Context, uid, key string, value model.DataEl,
 	//var isActiveBool = (value.Active == 1)
 
 	userdata := UserData{UID: value.UID,
-		URL:      value.URL,
-		ShortURL: value.Shorturl,
-		DateTime: value.Datetime,
-		IsActive: value.Active == 1, // most sugarly way of transforming bw int to bool
-		Redirs:   value.Redirs,
+		URL:       value.URL,
+		ShortURL:  value.Shorturl,
+		DateTime:  value.Datetime,
+		IsActive:  value.Active == 1, // most sugarly way of transforming bw int to bool
+		Redirs:    value.Redirs,
+		ExpiresAt: value.ExpiresAt,
+		MaxRedirs: value.MaxRedirs,
+		Personal:  value.Personal,
 	}
 
 	err := grPut(pgr.CTX, pgr.DBPool, uid, key, &userdata)
@@ -500,7 +537,7 @@ func (pgr *PgRepo) List(ctx context.Context, uid string) ([]string, error) {
 	grList := func(ctx context.Context, dbpool *pgxpool.Pool, uid string, span trace.Span) ([]string, error) {
 		const sql = `
 	SELECT short_url FROM users_data
-		WHERE uid = $1;
+		WHERE uid = $1 AND is_active;
 	`
 		span.AddEvent("SQL Query", trace.WithAttributes(
 			attribute.String("query", sql),
@@ -578,54 +615,108 @@ func inTx(ctx context.Context, dbpool *pgxpool.Pool, f TransactionFunc) (string,
 // GetUn - find unique shortlink in storage for shortopen api method
 // + update redir count (protected by lock)
 func (pgr *PgRepo) GetUn(ctx context.Context, shortlink string) (string, error) {
+	const sql = `SELECT id, url, is_active, redirs, expires_at, max_redirs from users_data
+    				WHERE short_url = $1 AND NOT personal
+    				FOR UPDATE;
+	`
+	return pgOpenLink(pgr.CTX, pgr.DBPool, sql, shortlink)
+}
 
-	grGetUn := func(ctx context.Context, dbpool *pgxpool.Pool, shorturl string) (string, error) {
-
-		URL, err := inTx(ctx, dbpool, func(ctx context.Context, tx pgx.Tx) (string, error) {
-			const sql1 = `SELECT url, user_id from users_data
-    						WHERE short_url = $1;
-			`
-			rows, err := tx.Query(ctx, sql1, shorturl)
-			if err != nil {
-				return "", err
-			}
-			var URL string
-			var userID int
+// GetUnPersonal - find personal shortlink of user uid + update redir count
+func (pgr *PgRepo) GetUnPersonal(ctx context.Context, uid, shortlink string) (string, error) {
+	const sql = `SELECT id, url, is_active, redirs, expires_at, max_redirs from users_data
+    				WHERE short_url = $1 AND uid = $2 AND personal
+    				FOR UPDATE;
+	`
+	return pgOpenLink(pgr.CTX, pgr.DBPool, sql, shortlink, uid)
+}
 
-			for rows.Next() {
-				err = rows.Scan(&URL, &userID)
-				if err != nil {
-					return "", err
-				}
-			}
+// pgOpenLink - url of link selected by sql (for update) + redirs++ in one transaction
+// empty url if there is no such link or link is not active
+func pgOpenLink(ctx context.Context, dbpool *pgxpool.Pool, sql string, args ...interface{}) (string, error) {
+	return inTx(ctx, dbpool, func(ctx context.Context, tx pgx.Tx) (string, error) {
+		var id int
+		var URL string
+		var isActive bool
+		var redirs, maxRedirs int
+		var expiresAt *time.Time
 
-			const sql2 = `
-			UPDATE users_data
-    			SET redirs = redirs + 1
-        			WHERE user_id = $1 AND short_url = $2;
-			`
-			_, err = tx.Exec(ctx, sql2, userID, shorturl)
-			if err != nil {
-				return "", err
-			}
+		err := tx.QueryRow(ctx, sql, args...).Scan(&id, &URL, &isActive, &redirs, &expiresAt, &maxRedirs)
+		if err == pgx.ErrNoRows {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
 
-			return URL, nil
-		})
+		// expired or exhausted link is not opened (and not counted) even before sweeper marks it
+		if err = linkLifetimeErr(expiresAt, maxRedirs, redirs, time.Now()); err != nil {
+			return "", err
+		}
+		if !isActive {
+			return "", nil
+		}
 
+		const sqlRedir = `
+		UPDATE users_data
+    		SET redirs = redirs + 1
+        		WHERE id = $1;
+		`
+		_, err = tx.Exec(ctx, sqlRedir, id)
 		if err != nil {
 			return "", err
 		}
 
 		return URL, nil
-	}
-
-	URL, err := grGetUn(pgr.CTX, pgr.DBPool, shortlink)
+	})
+}
 
+// AddRedirs - add batch of opens to links in one transaction, batch which is added already is ignored
+func (pgr *PgRepo) AddRedirs(ctx context.Context, batch string, redirs []model.LinkRedirs) error {
+	if batch == "" {
+		return errNoBatchID
+	}
+	const sqlPrune = `DELETE FROM redirect_batches WHERE applied_at < $1;`
+	const sqlBatch = `
+	INSERT INTO redirect_batches (id) VALUES ($1)
+		ON CONFLICT (id) DO NOTHING;
+	`
+	const sqlRedirs = `
+	UPDATE users_data SET redirs = redirs + $1
+		WHERE short_url = $2 AND NOT personal;
+	`
+	const sqlRedirsPersonal = `
+	UPDATE users_data SET redirs = redirs + $1
+		WHERE short_url = $2 AND uid = $3 AND personal;
+	`
+	_, err := inTx(ctx, pgr.DBPool, func(ctx context.Context, tx pgx.Tx) (string, error) {
+		if _, err := tx.Exec(ctx, sqlPrune, time.Now().Add(-redirBatchKeep)); err != nil {
+			return "", err
+		}
+		tag, err := tx.Exec(ctx, sqlBatch, batch)
+		if err != nil {
+			return "", err
+		}
+		if tag.RowsAffected() == 0 {
+			log.Printf("batch of opens %s is added already", batch)
+			return "", nil
+		}
+		for _, link := range redirs {
+			if link.Personal {
+				_, err = tx.Exec(ctx, sqlRedirsPersonal, link.N, link.Shorturl, link.UID)
+			} else {
+				_, err = tx.Exec(ctx, sqlRedirs, link.N, link.Shorturl)
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	})
 	if err != nil {
-		return "", err
+		return fmt.Errorf("failed to add batch of opens %s: %w", batch, err)
 	}
-
-	return URL, nil
+	return nil
 }
 
 // additional methods for 'improved' interface
@@ -641,35 +732,59 @@ func MyHash256(seq string) string {
 // PutUser new user add or update current profile
 func (pgr *PgRepo) PutUser(value model.User) (string, error) {
 
-	grAddUser := func(ctx context.Context, dbpool *pgxpool.Pool, user *User) (int, error) {
+	// new user gets balance as opening transaction of ledger, balance and passwd of existing user are not changed
+	// passwd is hashed only for new user: existing one is updated first, bcrypt is not run on every upsert
+	grAddUser := func(ctx context.Context, dbpool *pgxpool.Pool, user *User, passwd string) (int, error) {
+		const sqlUpdate = `
+	UPDATE users SET last_login = current_timestamp, user_role = $2
+		WHERE uid = $1
+		returning id;
+	`
 		const sql = `
 	INSERT INTO users (uid, name, passwd, email, user_role, created_on, last_login, balance)
     	VALUES ($1, $2, $3, $4, $5, current_timestamp, current_timestamp, $6::numeric)
 		ON CONFLICT ON CONSTRAINT users_uid_key
 		DO UPDATE SET last_login = excluded.last_login,
-                      balance = excluded.balance,
                       user_role = excluded.user_role
-		returning id;
+		returning id, (xmax = 0);
 	`
 		//passwd = excluded.passwd,
 		var id int
-		err := dbpool.QueryRow(ctx, sql,
-			user.UID,
-			user.Name,
-			user.Passwd,
-			user.Email,
-			user.UserRole,
-			user.Balance,
-		).Scan(&id)
-		if err != nil {
-			return 0, fmt.Errorf("failed to add user: %w", err)
-		}
-
-		return id, nil
+		_, err := inTx(ctx, dbpool, func(ctx context.Context, tx pgx.Tx) (string, error) {
+			err := tx.QueryRow(ctx, sqlUpdate, user.UID, user.UserRole).Scan(&id)
+			if err == nil {
+				return "", nil
+			}
+			if !errors.Is(err, pgx.ErrNoRows) {
+				return "", fmt.Errorf("failed to update user: %w", err)
+			}
+			// user added concurrently is updated by ON CONFLICT
+			if user.Passwd, err = HashPasswd(passwd); err != nil {
+				return "", err
+			}
+			var inserted bool
+			err = tx.QueryRow(ctx, sql,
+				user.UID,
+				user.Name,
+				user.Passwd,
+				user.Email,
+				user.UserRole,
+				user.Balance.String(),
+			).Scan(&id, &inserted)
+			if err != nil {
+				return "", fmt.Errorf("failed to add user: %w", err)
+			}
+			if !inserted || user.Balance == 0 {
+				return "", nil
+			}
+			user.ID = id
+			trans, lines := opening(*user, user.Balance, time.Now())
+			return "", pgPost(ctx, tx, trans, lines)
+		})
+		return id, err
 	}
 	//  generate hash as uid
 	uid := MyHash256(value.Name + value.Email)
-	passwd := value.Passwd
 	var role tUserRole
 	switch value.Role {
 	case "USER":
@@ -683,7 +798,6 @@ func (pgr *PgRepo) PutUser(value model.User) (string, error) {
 	user := User{
 		UID:              uid,
 		Name:             value.Name,
-		Passwd:           passwd,
 		Email:            value.Email,
 		IsActive:         true,
 		UserRole:         role,
@@ -691,7 +805,7 @@ func (pgr *PgRepo) PutUser(value model.User) (string, error) {
 		Balance:          value.Balance,
 	}
 
-	_, err := grAddUser(pgr.CTX, pgr.DBPool, &user)
+	_, err := grAddUser(pgr.CTX, pgr.DBPool, &user, value.Passwd)
 	if err != nil {
 		return "", err
 	}
@@ -831,7 +945,9 @@ func (pgr *PgRepo) FindSuperUser() (string, error) {
 }
 
 // PayUser - pay amount for uidA to uidB as transaction
-func (pgr *PgRepo) PayUser(ctx context.Context, uidA, uidB, amount string) error {
+// rows of both users are locked (FOR UPDATE) in order of id, so concurrent payments of the same users
+// wait for each other, see balance changed by each other and do not deadlock
+func (pgr *PgRepo) PayUser(ctx context.Context, uidA, uidB string, amount money.Amount) error {
 
 	//span, ctx := opentracing.StartSpanFromContextWithTracer(ctx, pgr.Tracer, "pg_repo.PayUser")
 	//defer span.Finish()
@@ -840,171 +956,66 @@ func (pgr *PgRepo) PayUser(ctx context.Context, uidA, uidB, amount string) error
 	defer span.End()
 
 	// pay money transaction b/w users
-	grPayUser := func(ctx context.Context, dbpool *pgxpool.Pool, uidA, uidB string, amount string, span trace.Span) error {
+	grPayUser := func(ctx context.Context, dbpool *pgxpool.Pool, uidA, uidB string, amount money.Amount, span trace.Span) error {
 
 		const sql = `
-		INSERT INTO users_transactions (date_time,  user_id_from,  user_id_to, amount, description, successful )
-        	VALUES (current_timestamp,
-                (select id from users where uid = $1),
-                (select id from users where uid = $2),
-                $3::numeric,
-                $4,
-                FALSE)
-		RETURNING id;
+		SELECT id, uid, balance::varchar, is_balance_blocked FROM users
+			WHERE uid = $1 OR uid = $2
+			ORDER BY id
+			FOR UPDATE;
 	`
-		var transID int
-		descrText := "Payment +" + amount + " from " + uidA + " for " + uidB
-
-		span.AddEvent("SQL Query", trace.WithAttributes(
-			attribute.String("1_query", sql),
-			attribute.String("1_uidA", uidA),
-			attribute.String("1_uidB", uidB),
-			attribute.String("1_amount", amount),
-		))
-
-		err := dbpool.QueryRow(ctx, sql, uidA, uidB, amount, descrText).Scan(&transID)
-		if err != nil {
-			return err
-		}
-
-		_, err = inTx(ctx, dbpool, func(ctx context.Context, tx pgx.Tx) (string, error) {
-
-			const sql1 = `SELECT balance::varchar, is_balance_blocked from users
-    						WHERE uid = $1;
-			`
+		const sql1 = `
+		UPDATE users SET balance = balance + ($1::numeric) WHERE id = $2;
+	`
+		_, err := inTx(ctx, dbpool, func(ctx context.Context, tx pgx.Tx) (string, error) {
 			span.AddEvent("SQL Query", trace.WithAttributes(
-				attribute.String("2_query", sql1),
-				attribute.String("2_uidA", uidA),
+				attribute.String("1_query", sql),
+				attribute.String("1_uidA", uidA),
+				attribute.String("1_uidB", uidB),
 			))
-			rows, err1 := tx.Query(ctx, sql1, uidA)
-			if err1 != nil {
-				return "", err1
+			rows, err := tx.Query(ctx, sql, uidA, uidB)
+			if err != nil {
+				return "", err
 			}
-			var prebalanceA float64
-			var preisBlockedA bool
+			defer rows.Close()
 
+			users := make(map[string]User, 2)
 			for rows.Next() {
-				var balance string
-				_ = rows.Scan(&balance, &preisBlockedA)
-				prebalanceA, _ = strconv.ParseFloat(balance, 64)
-			}
-
-			if prebalanceA < 0 || preisBlockedA {
-				err1 = fmt.Errorf("balance uidA is less 0 or blocked")
-				return "", err1
-			}
-
-			// uidA pays uidB amount
-			const sql2 = `
-		UPDATE users SET balance = balance + ($1::numeric) where uid = $2;
-		`
-			span.AddEvent("SQL Query", trace.WithAttributes(
-				attribute.String("3_query", sql2),
-				attribute.String("3_amount", amount),
-				attribute.String("3_uidB", uidB),
-			))
-			_, err1 = tx.Exec(ctx, sql2, amount, uidB)
-			if err1 != nil {
-				return "", err1
-			}
-			span.AddEvent("SQL Query", trace.WithAttributes(
-				attribute.String("4_query", sql2),
-				attribute.String("3_amount", "-"+amount),
-				attribute.String("4_uidA", uidA),
-			))
-			_, err1 = tx.Exec(ctx, sql2, "-"+amount, uidA)
-			if err1 != nil {
-				return "", err1
+				var user User
+				if err = rows.Scan(&user.ID, &user.UID, &user.Balance, &user.IsBalanceBlocked); err != nil {
+					return "", fmt.Errorf("failed to scan row: %w", err)
+				}
+				users[user.UID] = user
 			}
-
-			const sql3 = `
-		UPDATE users_transactions
-			SET successful = TRUE
-				WHERE id = $1;
-		`
-			span.AddEvent("SQL Query", trace.WithAttributes(
-				attribute.String("5_query", sql3),
-				attribute.String("5_transID", strconv.Itoa(transID)),
-			))
-			_, err1 = tx.Exec(ctx, sql3, transID)
-			if err1 != nil {
-				return "", err1
+			if rows.Err() != nil {
+				return "", fmt.Errorf("failed to read response: %w", rows.Err())
 			}
-
-			//post update is_balance_blocked of these users
-			const sql4 = `SELECT balance::varchar FROM users
-    						WHERE uid = $1;
-			`
-
-			span.AddEvent("SQL Query", trace.WithAttributes(
-				attribute.String("6_query", sql4),
-				attribute.String("6_uidA", uidA),
-			))
-			rows, err1 = tx.Query(ctx, sql4, uidA)
-			if err1 != nil {
-				return "", err1
+			userA, okA := users[uidA]
+			userB, okB := users[uidB]
+			if !okA || !okB {
+				return "", fmt.Errorf("no such user %s or %s", uidA, uidB)
 			}
-			var balanceA float64
 
-			for rows.Next() {
-				var balance string
-				_ = rows.Scan(&balance)
-				balanceA, _ = strconv.ParseFloat(balance, 64)
-			}
-
-			const sql5 = `
-			UPDATE users
-				SET is_balance_blocked = TRUE
-					WHERE uid = $1;
-			`
-			if balanceA < 0 {
-				span.AddEvent("SQL Query", trace.WithAttributes(
-					attribute.String("7_query", sql5),
-					attribute.String("7_uidA", uidA),
-				))
-				// update user A
-				_, err1 = tx.Exec(ctx, sql5, uidA)
-				if err1 != nil {
-					return "", err1
-				}
+			// uidA pays uidB amount
+			trans, lines, err := pay(&userA, &userB, amount, time.Now())
+			if err != nil {
+				return "", err
 			}
-
 			span.AddEvent("SQL Query", trace.WithAttributes(
-				attribute.String("8_query", sql4),
-				attribute.String("8_uidB", uidB),
+				attribute.String("2_query", sql1),
+				attribute.String("2_amount", amount.String()),
+				attribute.String("2_uidA", uidA),
+				attribute.String("2_uidB", uidB),
 			))
-			rows, err1 = tx.Query(ctx, sql4, uidB)
-			if err1 != nil {
-				return "", err1
-			}
-			var balanceB float64
-
-			for rows.Next() {
-				var balance string
-				_ = rows.Scan(&balance)
-				balanceB, _ = strconv.ParseFloat(balance, 64)
+			if _, err = tx.Exec(ctx, sql1, (-amount).String(), userA.ID); err != nil {
+				return "", err
 			}
-
-			if balanceB < 0 {
-				span.AddEvent("SQL Query", trace.WithAttributes(
-					attribute.String("9_query", sql5),
-					attribute.String("9_uidB", uidB),
-				))
-				// update user B
-				_, err1 = tx.Exec(ctx, sql5, uidB)
-				if err1 != nil {
-					return "", err1
-				}
+			if _, err = tx.Exec(ctx, sql1, amount.String(), userB.ID); err != nil {
+				return "", err
 			}
-
-			return "", nil
+			return "", pgPost(ctx, tx, trans, lines)
 		})
-
-		if err != nil {
-			return err
-		}
-
-		return nil
+		return err
 	}
 
 	err := grPayUser(ctx, pgr.DBPool, uidA, uidB, amount, span)
@@ -1014,7 +1025,31 @@ func (pgr *PgRepo) PayUser(ctx context.Context, uidA, uidB, amount string) error
 	return nil
 }
 
-// GetAll get all data items (with links) from pg db sorted by date
+// pgPost - insert transaction and its lines to ledger, cached balances are changed by caller
+func pgPost(ctx context.Context, tx pgx.Tx, trans UsersTransactions, lines []LedgerLine) error {
+	const sql = `
+	INSERT INTO users_transactions (date_time, user_id_from, user_id_to, amount, description, successful)
+		VALUES ($1, NULLIF($2, 0), NULLIF($3, 0), $4::numeric, $5, TRUE)
+	RETURNING id;
+	`
+	const sql1 = `
+	INSERT INTO ledger_lines (transaction_id, account, amount, date_time)
+		VALUES ($1, $2, $3::numeric, $4);
+	`
+	var transID int
+	err := tx.QueryRow(ctx, sql, trans.DateTime, trans.UserIDFrom, trans.UserIDTo, trans.Amount.String(), trans.Description).Scan(&transID)
+	if err != nil {
+		return fmt.Errorf("failed to add transaction: %w", err)
+	}
+	for _, line := range lines {
+		if _, err = tx.Exec(ctx, sql1, transID, line.Account, line.Amount.String(), line.DateTime); err != nil {
+			return fmt.Errorf("failed to add ledger line: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetAll get all active data items (with links) from pg db sorted by date, links marked by sweeper are not there
 func (pgr *PgRepo) GetAll(ctx context.Context, uid string) (model.Data, error) {
 
 	//span, ctx := opentracing.StartSpanFromContextWithTracer(ctx, pgr.Tracer, "pg_repo.GETALL")
@@ -1025,7 +1060,8 @@ func (pgr *PgRepo) GetAll(ctx context.Context, uid string) (model.Data, error) {
 
 	grGetAll := func(ctx context.Context, dbpool *pgxpool.Pool, span trace.Span) ([]UserData, error) {
 		const sql = `
-	SELECT id, user_id, url, redirs, is_active, short_url, date_time, uid FROM users_data
+	SELECT id, user_id, url, redirs, is_active, short_url, date_time, uid, expires_at, max_redirs, personal FROM users_data
+		WHERE is_active
     	ORDER BY date_time;
 	`
 		span.AddEvent("SQL Query", trace.WithAttributes(
@@ -1051,6 +1087,9 @@ func (pgr *PgRepo) GetAll(ctx context.Context, uid string) (model.Data, error) {
 				&userdata.ShortURL,
 				&userdata.DateTime,
 				&userdata.UID,
+				&userdata.ExpiresAt,
+				&userdata.MaxRedirs,
+				&userdata.Personal,
 			)
 
 			if err != nil {
@@ -1075,22 +1114,554 @@ func (pgr *PgRepo) GetAll(ctx context.Context, uid string) (model.Data, error) {
 	//reload pg usersdata to model datael
 	var alldata model.Data
 	for _, userdata := range usersdata {
-		//adjust field Active db - bool , api - int
-		var activeInt = 0
-		if userdata.IsActive {
-			activeInt = 1
+		alldata.Data = append(alldata.Data, userDataToModel(userdata))
+	}
+	return alldata, nil
+}
+
+// AddClick - save event of link opening, link of click owner or global link if owner is not set
+func (pgr *PgRepo) AddClick(ctx context.Context, click model.Click) error {
+	const sql = `
+	INSERT INTO link_clicks (link_id, date_time, uid, referrer, user_agent, ip)
+		SELECT id, $2, $3, $4, $5, $6 FROM users_data
+			WHERE short_url = $1 AND (uid = $7 OR $7 = '' AND NOT personal);
+	`
+	tag, err := pgr.DBPool.Exec(pgr.CTX, sql,
+		click.Shorturl,
+		click.Datetime,
+		click.UID,
+		click.Referrer,
+		click.UserAgent,
+		click.IP,
+		click.Owner,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add click: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("No such link")
+	}
+	return nil
+}
+
+// GetClickStats - count clicks of link uid:shortlink by time buckets and top referrers / user agents
+// buckets are counted by pg (date_trunc in UTC), empty buckets are added as zero
+func (pgr *PgRepo) GetClickStats(ctx context.Context, uid, shortlink string, q model.StatQuery) (model.ClickStats, error) {
+
+	ctx, span := pgr.Tracer.Start(ctx, "pg_repo.CLICKSTATS")
+	defer span.End()
+
+	stats := model.ClickStats{
+		Shorturl: shortlink,
+		Bucket:   q.Bucket,
+		From:     q.From,
+		To:       q.To,
+	}
+
+	const sqlTotal = `
+	SELECT count(*) FROM link_clicks c
+		JOIN users_data d ON d.id = c.link_id
+		WHERE d.short_url = $1 AND d.uid = $4 AND c.date_time >= $2 AND c.date_time < $3;
+	`
+	err := pgr.DBPool.QueryRow(pgr.CTX, sqlTotal, shortlink, q.From, q.To, uid).Scan(&stats.Total)
+	if err != nil {
+		return model.ClickStats{}, fmt.Errorf("failed to count clicks: %w", err)
+	}
+
+	if q.Bucket != "" {
+		if err = CheckStatBucket(q.Bucket); err != nil {
+			return model.ClickStats{}, err
+		}
+		const sql = `
+	SELECT date_trunc($4, c.date_time AT TIME ZONE 'UTC') AS bucket, count(*) FROM link_clicks c
+		JOIN users_data d ON d.id = c.link_id
+		WHERE d.short_url = $1 AND d.uid = $5 AND c.date_time >= $2 AND c.date_time < $3
+		GROUP BY bucket;
+	`
+		span.AddEvent("SQL Query", trace.WithAttributes(
+			attribute.String("query", sql),
+		))
+		rows, err := pgr.DBPool.Query(pgr.CTX, sql, shortlink, q.From, q.To, q.Bucket, uid)
+		if err != nil {
+			return model.ClickStats{}, fmt.Errorf("failed to query clicks: %w", err)
+		}
+		defer rows.Close()
+
+		counts := make(map[time.Time]int)
+		for rows.Next() {
+			var start time.Time
+			var clicks int
+			if err = rows.Scan(&start, &clicks); err != nil {
+				return model.ClickStats{}, fmt.Errorf("failed to scan row: %w", err)
+			}
+			counts[start.UTC()] = clicks
 		}
+		if rows.Err() != nil {
+			return model.ClickStats{}, fmt.Errorf("failed to read response: %w", rows.Err())
+		}
+		stats.Clicks = fillBuckets(counts, q)
+	}
 
-		modeldata := model.DataEl{UID: userdata.UID,
-			URL:      userdata.URL,
-			Shorturl: userdata.ShortURL,
-			Datetime: userdata.DateTime,
-			Active:   activeInt,
-			Redirs:   userdata.Redirs,
+	if q.Top > 0 {
+		const sqlReferrers = `
+	SELECT c.referrer, count(*) AS clicks FROM link_clicks c
+		JOIN users_data d ON d.id = c.link_id
+		WHERE d.short_url = $1 AND d.uid = $5 AND c.date_time >= $2 AND c.date_time < $3
+		GROUP BY c.referrer ORDER BY clicks DESC, c.referrer LIMIT $4;
+	`
+		const sqlAgents = `
+	SELECT c.user_agent, count(*) AS clicks FROM link_clicks c
+		JOIN users_data d ON d.id = c.link_id
+		WHERE d.short_url = $1 AND d.uid = $5 AND c.date_time >= $2 AND c.date_time < $3
+		GROUP BY c.user_agent ORDER BY clicks DESC, c.user_agent LIMIT $4;
+	`
+		if stats.Referrers, err = pgTop(pgr.CTX, pgr.DBPool, sqlReferrers, uid, shortlink, q); err != nil {
+			return model.ClickStats{}, err
+		}
+		if stats.UserAgents, err = pgTop(pgr.CTX, pgr.DBPool, sqlAgents, uid, shortlink, q); err != nil {
+			return model.ClickStats{}, err
 		}
+	}
 
-		alldata.Data = append(alldata.Data, modeldata)
+	return stats, nil
+}
 
+// pgTop - read value, clicks rows of top query
+func pgTop(ctx context.Context, dbpool *pgxpool.Pool, sql, uid, shortlink string, q model.StatQuery) ([]model.TopEl, error) {
+	rows, err := dbpool.Query(ctx, sql, shortlink, q.From, q.To, q.Top, uid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query top: %w", err)
 	}
-	return alldata, nil
+	defer rows.Close()
+
+	var top []model.TopEl
+	for rows.Next() {
+		var el model.TopEl
+		if err = rows.Scan(&el.Value, &el.Clicks); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		top = append(top, el)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("failed to read response: %w", rows.Err())
+	}
+	return top, nil
+}
+
+// SweepExpired - mark links which are expired or reached max redirs as inactive
+// returns links which have been marked
+func (pgr *PgRepo) SweepExpired(ctx context.Context, now time.Time) ([]model.DataEl, error) {
+	const sql = `
+	UPDATE users_data SET is_active = false
+		WHERE is_active
+			AND ((expires_at IS NOT NULL AND expires_at <= $1) OR (max_redirs > 0 AND redirs >= max_redirs))
+		RETURNING id, user_id, url, redirs, is_active, short_url, date_time, uid, expires_at, max_redirs, personal;
+	`
+	rows, err := pgr.DBPool.Query(pgr.CTX, sql, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sweep links: %w", err)
+	}
+	defer rows.Close()
+
+	var swept []model.DataEl
+	for rows.Next() {
+		var userdata UserData
+		err = rows.Scan(&userdata.ID,
+			&userdata.UserID,
+			&userdata.URL,
+			&userdata.Redirs,
+			&userdata.IsActive,
+			&userdata.ShortURL,
+			&userdata.DateTime,
+			&userdata.UID,
+			&userdata.ExpiresAt,
+			&userdata.MaxRedirs,
+			&userdata.Personal,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		swept = append(swept, userDataToModel(userdata))
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("failed to read response: %w", rows.Err())
+	}
+	return swept, nil
+}
+
+// GetShort - find global link by shortlink whoever owns it, empty if there is no such link
+func (pgr *PgRepo) GetShort(ctx context.Context, shortlink string) (model.DataEl, error) {
+	const sql = `
+	SELECT id, user_id, url, redirs, is_active, short_url, date_time, uid, expires_at, max_redirs, personal FROM users_data
+		WHERE short_url = $1 AND NOT personal;
+	`
+	var userdata UserData
+	err := pgr.DBPool.QueryRow(pgr.CTX, sql, shortlink).Scan(&userdata.ID,
+		&userdata.UserID,
+		&userdata.URL,
+		&userdata.Redirs,
+		&userdata.IsActive,
+		&userdata.ShortURL,
+		&userdata.DateTime,
+		&userdata.UID,
+		&userdata.ExpiresAt,
+		&userdata.MaxRedirs,
+		&userdata.Personal,
+	)
+	if err == pgx.ErrNoRows {
+		return model.DataEl{}, nil
+	}
+	if err != nil {
+		return model.DataEl{}, fmt.Errorf("failed to query data: %w", err)
+	}
+	return userDataToModel(userdata), nil
+}
+
+// pgSessionColumns - columns of user_sessions in order of scanSession
+const pgSessionColumns = `id, uid, jti, created_at, last_used, expires_at, user_agent, ip, revoked`
+
+// scanSession - read user_sessions row
+func scanSession(row pgx.Row) (model.Session, error) {
+	var session model.Session
+	err := row.Scan(&session.ID,
+		&session.UID,
+		&session.JTI,
+		&session.CreatedAt,
+		&session.LastUsed,
+		&session.ExpiresAt,
+		&session.UserAgent,
+		&session.IP,
+		&session.Revoked,
+	)
+	return session, err
+}
+
+// PutSession - save new session
+func (pgr *PgRepo) PutSession(ctx context.Context, session model.Session) error {
+	if err := checkNewSession(session); err != nil {
+		return err
+	}
+	const sql = `
+	INSERT INTO user_sessions (` + pgSessionColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);
+	`
+	_, err := pgr.DBPool.Exec(pgr.CTX, sql,
+		session.ID,
+		session.UID,
+		session.JTI,
+		session.CreatedAt,
+		session.LastUsed,
+		session.ExpiresAt,
+		session.UserAgent,
+		session.IP,
+		session.Revoked,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add session: %w", err)
+	}
+	return nil
+}
+
+// RotateSession - change refresh token of session from oldJTI to newJTI
+// ErrTokenReused if oldJTI is rotated out already (session gets revoked), ErrSessionRevoked if session is dead
+func (pgr *PgRepo) RotateSession(ctx context.Context, sid, oldJTI, newJTI string, expiresAt time.Time) error {
+	// revoke of reused session has to be committed, so rotate error is returned after transaction
+	var rotateErr error
+	err := pgr.DBPool.BeginFunc(pgr.CTX, func(tx pgx.Tx) error {
+		const sql = `SELECT ` + pgSessionColumns + ` FROM user_sessions WHERE id = $1 FOR UPDATE;`
+		session, err := scanSession(tx.QueryRow(pgr.CTX, sql, sid))
+		if err == pgx.ErrNoRows {
+			rotateErr = ErrSessionRevoked
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var changed bool
+		changed, rotateErr = rotateSession(&session, oldJTI, newJTI, expiresAt, time.Now())
+		if !changed {
+			return nil
+		}
+		const sqlUpdate = `
+		UPDATE user_sessions SET jti = $2, last_used = $3, expires_at = $4, revoked = $5
+			WHERE id = $1;
+		`
+		_, err = tx.Exec(pgr.CTX, sqlUpdate, session.ID, session.JTI, session.LastUsed, session.ExpiresAt, session.Revoked)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rotate session: %w", err)
+	}
+	return rotateErr
+}
+
+// ListSessions - alive sessions of user
+func (pgr *PgRepo) ListSessions(ctx context.Context, uid string) ([]model.Session, error) {
+	const sql = `
+	SELECT ` + pgSessionColumns + ` FROM user_sessions
+		WHERE uid = $1 AND NOT revoked AND expires_at > current_timestamp
+		ORDER BY created_at;
+	`
+	rows, err := pgr.DBPool.Query(pgr.CTX, sql, uid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []model.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("failed to read response: %w", rows.Err())
+	}
+	return sessions, nil
+}
+
+// PurgeSessions - delete revoked and expired sessions, returns how many of them
+func (pgr *PgRepo) PurgeSessions(ctx context.Context, now time.Time) (int, error) {
+	const sql = `DELETE FROM user_sessions WHERE revoked OR expires_at <= $1;`
+	tag, err := pgr.DBPool.Exec(ctx, sql, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge sessions: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// RevokeSession - kill session sid of user, all his sessions if sid is empty
+func (pgr *PgRepo) RevokeSession(ctx context.Context, uid, sid string) error {
+	const sql = `
+	UPDATE user_sessions SET revoked = true
+		WHERE uid = $1 AND ($2 = '' OR id = $2) AND NOT revoked;
+	`
+	tag, err := pgr.DBPool.Exec(pgr.CTX, sql, uid, sid)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	if sid != "" && tag.RowsAffected() == 0 {
+		return ErrNoSession
+	}
+	return nil
+}
+
+// pgAPIKeyColumns - columns of user_apikeys in order of scanAPIKey
+const pgAPIKeyColumns = `id, uid, name, hash, scopes, created_at, last_used, expires_at, revoked`
+
+// scanAPIKey - read user_apikeys row, null last_used and expires_at are zero times
+func scanAPIKey(row pgx.Row) (model.APIKey, error) {
+	var key model.APIKey
+	var lastUsed, expiresAt *time.Time
+	err := row.Scan(&key.ID,
+		&key.UID,
+		&key.Name,
+		&key.Hash,
+		&key.Scopes,
+		&key.CreatedAt,
+		&lastUsed,
+		&expiresAt,
+		&key.Revoked,
+	)
+	if lastUsed != nil {
+		key.LastUsed = *lastUsed
+	}
+	if expiresAt != nil {
+		key.ExpiresAt = *expiresAt
+	}
+	return key, err
+}
+
+// pgNullTime - null for zero time
+func pgNullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// PutAPIKey - save new api key, only hash of key is kept
+func (pgr *PgRepo) PutAPIKey(ctx context.Context, key model.APIKey) error {
+	key, err := newAPIKey(key)
+	if err != nil {
+		return err
+	}
+	const sql = `
+	INSERT INTO user_apikeys (` + pgAPIKeyColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);
+	`
+	_, err = pgr.DBPool.Exec(pgr.CTX, sql,
+		key.ID,
+		key.UID,
+		key.Name,
+		key.Hash,
+		key.Scopes,
+		key.CreatedAt,
+		pgNullTime(key.LastUsed),
+		pgNullTime(key.ExpiresAt),
+		key.Revoked,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add api key: %w", err)
+	}
+	return nil
+}
+
+// AuthAPIKey - alive api key by key itself, ErrNoAPIKey if there is no such key
+func (pgr *PgRepo) AuthAPIKey(ctx context.Context, key string) (model.APIKey, error) {
+	const sql = `SELECT ` + pgAPIKeyColumns + ` FROM user_apikeys WHERE hash = $1;`
+	apiKey, err := scanAPIKey(pgr.DBPool.QueryRow(pgr.CTX, sql, HashAPIKey(key)))
+	if err == pgx.ErrNoRows {
+		return model.APIKey{}, ErrNoAPIKey
+	}
+	if err != nil {
+		return model.APIKey{}, fmt.Errorf("failed to query api key: %w", err)
+	}
+	changed, err := touchAPIKey(&apiKey, time.Now())
+	if err != nil {
+		return model.APIKey{}, err
+	}
+	if changed {
+		const sqlUpdate = `UPDATE user_apikeys SET last_used = $2 WHERE id = $1;`
+		if _, err = pgr.DBPool.Exec(pgr.CTX, sqlUpdate, apiKey.ID, apiKey.LastUsed); err != nil {
+			return model.APIKey{}, fmt.Errorf("failed to update api key: %w", err)
+		}
+	}
+	apiKey.Hash = ""
+	return apiKey, nil
+}
+
+// ListAPIKeys - alive api keys of user
+func (pgr *PgRepo) ListAPIKeys(ctx context.Context, uid string) ([]model.APIKey, error) {
+	const sql = `
+	SELECT ` + pgAPIKeyColumns + ` FROM user_apikeys
+		WHERE uid = $1 AND NOT revoked AND (expires_at IS NULL OR expires_at > current_timestamp)
+		ORDER BY created_at;
+	`
+	rows, err := pgr.DBPool.Query(pgr.CTX, sql, uid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []model.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		key.Hash = ""
+		keys = append(keys, key)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("failed to read response: %w", rows.Err())
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey - kill api key id of user
+func (pgr *PgRepo) RevokeAPIKey(ctx context.Context, uid, id string) error {
+	const sql = `
+	UPDATE user_apikeys SET revoked = true
+		WHERE uid = $1 AND id = $2 AND NOT revoked;
+	`
+	tag, err := pgr.DBPool.Exec(pgr.CTX, sql, uid, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoAPIKey
+	}
+	return nil
+}
+
+// PutIdentity - link identity to its user, ErrIdentityTaken if it is linked to other user
+func (pgr *PgRepo) PutIdentity(ctx context.Context, identity model.Identity) error {
+	if err := checkNewIdentity(identity); err != nil {
+		return err
+	}
+	const sql = `
+	INSERT INTO user_identities (issuer, subject, uid, email, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (issuer, subject) DO NOTHING;
+	`
+	tag, err := pgr.DBPool.Exec(pgr.CTX, sql, identity.Issuer, identity.Subject, identity.UID, identity.Email, identity.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to add identity: %w", err)
+	}
+	if tag.RowsAffected() > 0 {
+		return nil
+	}
+	// identity is linked already, to this user or to other one
+	uid, err := pgr.FindIdentity(ctx, identity.Issuer, identity.Subject)
+	if err != nil {
+		return err
+	}
+	if uid != identity.UID {
+		return ErrIdentityTaken
+	}
+	return nil
+}
+
+// FindIdentity - uid of user of identity, "" if it is not linked
+func (pgr *PgRepo) FindIdentity(ctx context.Context, issuer, subject string) (string, error) {
+	const sql = `SELECT uid FROM user_identities WHERE issuer = $1 AND subject = $2;`
+	var uid string
+	err := pgr.DBPool.QueryRow(pgr.CTX, sql, issuer, subject).Scan(&uid)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query identity: %w", err)
+	}
+	return uid, nil
+}
+
+// ListIdentities - identities of user
+func (pgr *PgRepo) ListIdentities(ctx context.Context, uid string) ([]model.Identity, error) {
+	const sql = `
+	SELECT issuer, subject, uid, email, created_at FROM user_identities
+		WHERE uid = $1
+		ORDER BY created_at;
+	`
+	rows, err := pgr.DBPool.Query(pgr.CTX, sql, uid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query identities: %w", err)
+	}
+	defer rows.Close()
+
+	identities := []model.Identity{}
+	for rows.Next() {
+		var identity model.Identity
+		if err := rows.Scan(&identity.Issuer, &identity.Subject, &identity.UID, &identity.Email, &identity.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("failed to read response: %w", rows.Err())
+	}
+	return identities, nil
+}
+
+// FindUserByEmail - uid of user with email (case is ignored), the oldest one if there are some
+// "" if there is no such user
+func (pgr *PgRepo) FindUserByEmail(email string) (string, error) {
+	const sql = `
+	SELECT uid FROM users
+		WHERE lower(email) = lower($1)
+		ORDER BY created_on, uid
+		LIMIT 1;
+	`
+	var uid string
+	err := pgr.DBPool.QueryRow(pgr.CTX, sql, email).Scan(&uid)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to find user by email: %w", err)
+	}
+	return uid, nil
 }
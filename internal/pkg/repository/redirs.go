@@ -0,0 +1,22 @@
+package repository
+
+import (
+	"errors"
+	"time"
+)
+
+// batches of opens helpers - same rules for all repos
+// opens of links are counted by service and added to links in batches (AddRedirs), batch may be added
+// again when its flush is retried or instance is restarted before it is acknowledged,
+// so repo keeps ids of added batches for redirBatchKeep and ignores repeated ones
+
+// redirBatchKeep - time to keep id of added batch
+const redirBatchKeep = 7 * 24 * time.Hour
+
+// errNoBatchID - batch of opens without id can not be checked for repeat
+var errNoBatchID = errors.New("batch of opens should have id")
+
+// batchAlive - id of batch added at is still kept
+func batchAlive(at, now time.Time) bool {
+	return now.Sub(at) < redirBatchKeep
+}
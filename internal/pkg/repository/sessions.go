@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// refresh token sessions helpers - same rules for all repos
+// every refresh gives new jti to session, refresh by older jti means token was stolen - whole session is revoked
+
+var (
+	// ErrSessionRevoked - session is logged out or killed already
+	ErrSessionRevoked = errors.New("session is revoked")
+	// ErrTokenReused - rotated refresh token is used again, session has been revoked because of it
+	ErrTokenReused = errors.New("refresh token is reused, session is revoked")
+	// ErrNoSession - no such session of user
+	ErrNoSession = errors.New("no such session")
+)
+
+// rotateSession - change jti of session from oldJTI to newJTI, session is revoked when oldJTI is not current one
+// changed - session has to be saved (even on error)
+func rotateSession(session *model.Session, oldJTI, newJTI string, expiresAt, now time.Time) (changed bool, err error) {
+	if session.Revoked {
+		return false, ErrSessionRevoked
+	}
+	if !now.Before(session.ExpiresAt) {
+		return false, ErrSessionRevoked
+	}
+	if session.JTI != oldJTI {
+		session.Revoked = true
+		return true, ErrTokenReused
+	}
+	session.JTI = newJTI
+	session.LastUsed = now
+	session.ExpiresAt = expiresAt
+	return true, nil
+}
+
+// sessionAlive - session is not revoked and not expired
+func sessionAlive(session model.Session, now time.Time) bool {
+	return !session.Revoked && now.Before(session.ExpiresAt)
+}
+
+// liveSessions - alive sessions of uid sorted by creation
+func liveSessions(sessions []model.Session, uid string, now time.Time) []model.Session {
+	live := []model.Session{}
+	for _, session := range sessions {
+		if session.UID == uid && sessionAlive(session, now) {
+			live = append(live, session)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].CreatedAt.Before(live[j].CreatedAt)
+	})
+	return live
+}
+
+// checkNewSession - session to be put should have id, uid and jti
+func checkNewSession(session model.Session) error {
+	if session.ID == "" || session.UID == "" || session.JTI == "" {
+		return fmt.Errorf("session should have id, uid and jti")
+	}
+	return nil
+}
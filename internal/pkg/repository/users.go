@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// helpers for repos which keep users in go structs (file, bolt) - same rules as pg sql does
+
+// newUser - user record for PutUser, uid is hash of name+email
+func newUser(value model.User) User {
+	return User{
+		UID:      MyHash256(value.Name + value.Email),
+		Name:     value.Name,
+		Passwd:   value.Passwd,
+		Email:    value.Email,
+		IsActive: true,
+	}
+}
+
+// userToModel - user record to api user (without passwd)
+func userToModel(user User) model.User {
+	return model.User{UID: user.UID,
+		Name:    user.Name,
+		Email:   user.Email,
+		Role:    string(user.UserRole),
+		Balance: user.Balance,
+	}
+}
+
+// usersToModel - all users sorted like pg does ORDER BY user_role, name
+func usersToModel(users []User) model.Users {
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].UserRole != users[j].UserRole {
+			return users[i].UserRole < users[j].UserRole
+		}
+		return users[i].Name < users[j].Name
+	})
+
+	var allusers model.Users
+	for _, user := range users {
+		allusers.Data = append(allusers.Data, userToModel(user))
+	}
+	return allusers
+}
+
+// userByEmail - uid of the oldest user with email (case is ignored), "" if there is none
+func userByEmail(users []User, email string) string {
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].CreatedOn.Equal(users[j].CreatedOn) {
+			return users[i].CreatedOn.Before(users[j].CreatedOn)
+		}
+		return users[i].UID < users[j].UID
+	})
+	for _, user := range users {
+		if strings.EqualFold(user.Email, email) {
+			return user.UID
+		}
+	}
+	return ""
+}
+
+// userDataToModel - bolt/file userdata to api data element
+func userDataToModel(userdata UserData) model.DataEl {
+	//adjust field Active db - bool , api - int
+	var activeInt = 0
+	if userdata.IsActive {
+		activeInt = 1
+	}
+
+	return model.DataEl{UID: userdata.UID,
+		URL:       userdata.URL,
+		Shorturl:  userdata.ShortURL,
+		Datetime:  userdata.DateTime,
+		Active:    activeInt,
+		Redirs:    userdata.Redirs,
+		ExpiresAt: userdata.ExpiresAt,
+		MaxRedirs: userdata.MaxRedirs,
+		Personal:  userdata.Personal,
+	}
+}
@@ -0,0 +1,64 @@
+package shortcode
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+)
+
+// generator of random short codes for links (when shorturl is not given in POST /links)
+
+// DefaultAlphabet - base62 without look-alike characters (0 O o 1 l I)
+const DefaultAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz"
+
+// DefaultLength - 7 chars of DefaultAlphabet are ~40 bits, collisions are rare up to millions of links
+const DefaultLength = 7
+
+// Generator - makes codes of Length chars taken from Alphabet
+type Generator struct {
+	length   int
+	alphabet []rune
+}
+
+// New - generator with length and alphabet, alphabet chars should be unique
+func New(length int, alphabet string) (*Generator, error) {
+	if length < 1 {
+		return nil, fmt.Errorf("short code length should be > 0, got %d", length)
+	}
+	runes := []rune(alphabet)
+	if len(runes) < 2 {
+		return nil, fmt.Errorf("short code alphabet should have at least 2 chars")
+	}
+	seen := make(map[rune]bool, len(runes))
+	for _, r := range runes {
+		if seen[r] {
+			return nil, fmt.Errorf("short code alphabet has duplicate char %q", r)
+		}
+		// codes are part of url path
+		if r == '/' || r == '?' || r == '#' || r == '%' || r <= ' ' {
+			return nil, fmt.Errorf("short code alphabet has char %q which can not be in url path", r)
+		}
+		seen[r] = true
+	}
+	return &Generator{length: length, alphabet: runes}, nil
+}
+
+// Default - generator with DefaultLength and DefaultAlphabet
+func Default() *Generator {
+	gen, _ := New(DefaultLength, DefaultAlphabet)
+	return gen
+}
+
+// Generate - new random code (crypto/rand, every char is uniform)
+func (g *Generator) Generate() (string, error) {
+	max := big.NewInt(int64(len(g.alphabet)))
+	code := make([]rune, g.length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("short code generation error: %w", err)
+		}
+		code[i] = g.alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
@@ -0,0 +1,49 @@
+package shortcode_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/shortcode"
+)
+
+func TestGenerator(t *testing.T) {
+	tests := []struct {
+		name     string
+		length   int
+		alphabet string
+		wantErr  bool
+	}{
+		{name: "default", length: shortcode.DefaultLength, alphabet: shortcode.DefaultAlphabet},
+		{name: "short binary", length: 3, alphabet: "ab"},
+		{name: "zero length", length: 0, alphabet: shortcode.DefaultAlphabet, wantErr: true},
+		{name: "one char alphabet", length: 5, alphabet: "a", wantErr: true},
+		{name: "duplicate chars", length: 5, alphabet: "abca", wantErr: true},
+		{name: "slash in alphabet", length: 5, alphabet: "ab/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			gen, err := shortcode.New(tt.length, tt.alphabet)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			for i := 0; i < 100; i++ {
+				code, err := gen.Generate()
+				require.NoError(t, err)
+				require.Len(t, code, tt.length)
+				for _, r := range code {
+					require.True(t, strings.ContainsRune(tt.alphabet, r), "char %q is not in alphabet", r)
+				}
+			}
+		})
+	}
+
+	// no look-alikes in default alphabet
+	require.False(t, strings.ContainsAny(shortcode.DefaultAlphabet, "0Oo1lI"))
+}
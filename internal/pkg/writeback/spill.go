@@ -0,0 +1,263 @@
+package writeback
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/fileutil"
+)
+
+// durable queue of tasks spilled by worker pool (policy 'spill')
+// task which does not fit in queue of pool is appended to spill journal (json line, fsync) as name of its type
+// and json of its argument, pool takes it back by Next in order of spill when queue has room and reports Done
+// when it is done. tasks which are not done are pending again when journal is opened.
+// journal is rewritten with only pending tasks when it is opened, closed and grows big.
+
+// Spilled - task of worker pool which did not fit in its queue
+// Task - name of type of task, Arg - json of its argument, Background - nobody waits for its result
+type Spilled struct {
+	ID         uint64          `json:"id"`
+	Task       string          `json:"task"`
+	Arg        json.RawMessage `json:"arg"`
+	Background bool            `json:"background,omitempty"`
+	QueuedAt   time.Time       `json:"queued_at"`
+}
+
+// spillRec - one change of spill journal, one line of file
+type spillRec struct {
+	Op   string   `json:"op"`
+	Task *Spilled `json:"task,omitempty"`
+	ID   uint64   `json:"id,omitempty"`
+}
+
+// Spill - pending spilled tasks
+// taken - ids of tasks given by Next which are not done yet (not journaled, after restart they are pending again)
+type Spill struct {
+	mu        sync.Mutex
+	name      string
+	file      *os.File
+	pending   map[uint64]Spilled
+	taken     map[uint64]bool
+	journaled int
+	// seq - last id given to task
+	seq uint64
+	// wake - signal to pool waiting in Next, closed - it is closed by Close
+	wake   chan struct{}
+	closed chan struct{}
+}
+
+// OpenSpill - spill journal of file name, tasks of previous run are pending again
+func OpenSpill(name string) (*Spill, error) {
+	s := &Spill{
+		name:    name,
+		pending: make(map[uint64]Spilled),
+		taken:   make(map[uint64]bool),
+		wake:    make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	err := readJournal(name, func(line []byte) error {
+		var rec spillRec
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		s.apply(&rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// apply - apply change to pending tasks, no lock
+func (s *Spill) apply(rec *spillRec) {
+	switch rec.Op {
+	case opQueue:
+		s.pending[rec.Task.ID] = *rec.Task
+		if rec.Task.ID > s.seq {
+			s.seq = rec.Task.ID
+		}
+	case opDone:
+		delete(s.pending, rec.ID)
+	}
+}
+
+// commit - write change to journal (fsync) then apply it, no lock
+// change is durable when record is written, so failed compaction is only logged and tried again by next commit
+func (s *Spill) commit(rec spillRec) error {
+	if s.file == nil {
+		return ErrClosed
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err = fileutil.AppendRecord(s.file, append(line, '\n')); err != nil {
+		return fmt.Errorf("writeback spill %w", err)
+	}
+	s.apply(&rec)
+	s.journaled++
+	if s.journaled >= journalCompactEvery {
+		if err = s.compact(); err != nil {
+			log.Printf("writeback spill %s: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+// compact - rewrite journal with pending tasks only, reopen it for append, no lock
+func (s *Spill) compact() error {
+	var data []byte
+	for _, task := range s.sortedPending() {
+		task := task
+		line, err := json.Marshal(spillRec{Op: opQueue, Task: &task})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			return err
+		}
+		s.file = nil
+	}
+	file, err := rewriteJournal(s.name, data)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.journaled = 0
+	return nil
+}
+
+// sortedPending - pending tasks in order of spill, no lock
+func (s *Spill) sortedPending() []Spilled {
+	tasks := make([]Spilled, 0, len(s.pending))
+	for _, task := range s.pending {
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(a, b int) bool { return tasks[a].ID < tasks[b].ID })
+	return tasks
+}
+
+// isClosed - Close is called
+func (s *Spill) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// signal - wake up pool waiting in Next
+func (s *Spill) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Push - add task of type name with json of argument arg, background - nobody waits for its result
+func (s *Spill) Push(name string, arg json.RawMessage, background bool) (Spilled, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task := Spilled{ID: s.seq + 1, Task: name, Arg: arg, Background: background, QueuedAt: time.Now().UTC()}
+	if err := s.commit(spillRec{Op: opQueue, Task: &task}); err != nil {
+		return Spilled{}, err
+	}
+	s.signal()
+	return task, nil
+}
+
+// Next - oldest pending task which is not taken, it waits for one until ctx is done,
+// so with done ctx it gives the rest of pending tasks (drain) and then ctx error
+func (s *Spill) Next(ctx context.Context) (Spilled, error) {
+	for {
+		s.mu.Lock()
+		if s.isClosed() {
+			s.mu.Unlock()
+			return Spilled{}, ErrClosed
+		}
+		var next *Spilled
+		for id, task := range s.pending {
+			if s.taken[id] || next != nil && next.ID < id {
+				continue
+			}
+			task := task
+			next = &task
+		}
+		if next != nil {
+			s.taken[next.ID] = true
+			s.mu.Unlock()
+			return *next, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Spilled{}, ctx.Err()
+		case <-s.closed:
+			return Spilled{}, ErrClosed
+		case <-s.wake:
+		}
+	}
+}
+
+// Done - task id is done, it is removed
+func (s *Spill) Done(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.taken, id)
+	if _, ok := s.pending[id]; !ok {
+		return nil
+	}
+	return s.commit(spillRec{Op: opDone, ID: id})
+}
+
+// Release - task id taken by Next is not done, it is pending as it was
+func (s *Spill) Release(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.taken, id)
+	s.signal()
+}
+
+// Pending - number of pending tasks (taken ones as well)
+func (s *Spill) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// Close - rewrite journal with pending tasks and close it
+func (s *Spill) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed() {
+		return nil
+	}
+	var err error
+	if s.file != nil {
+		err = s.compact()
+	}
+	if s.file != nil {
+		if cerr := s.file.Close(); err == nil {
+			err = cerr
+		}
+		s.file = nil
+	}
+	// pool waiting in Next sees closed journal
+	close(s.closed)
+	return err
+}
@@ -0,0 +1,79 @@
+package writeback_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/writeback"
+)
+
+// spilled tasks are taken in order of spill, tasks which are not done are pending after restart
+func TestSpill(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "spill.journal")
+	s, err := writeback.OpenSpill(name)
+	require.NoError(t, err)
+	for _, arg := range []string{`"a"`, `"b"`, `"c"`} {
+		_, err = s.Push("click", json.RawMessage(arg), true)
+		require.NoError(t, err)
+	}
+	_, err = s.Push("list", json.RawMessage(`"u1"`), false)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	first, err := s.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "click", first.Task)
+	require.JSONEq(t, `"a"`, string(first.Arg))
+	require.True(t, first.Background)
+	second, err := s.Next(ctx)
+	require.NoError(t, err)
+	require.JSONEq(t, `"b"`, string(second.Arg))
+	require.NoError(t, s.Done(first.ID))
+	// released task is given again before newer ones
+	s.Release(second.ID)
+	again, err := s.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, second.ID, again.ID)
+	require.Equal(t, 3, s.Pending())
+	require.NoError(t, s.Close())
+	_, err = s.Next(ctx)
+	require.ErrorIs(t, err, writeback.ErrClosed)
+	_, err = s.Push("click", json.RawMessage(`"late"`), true)
+	require.ErrorIs(t, err, writeback.ErrClosed)
+
+	// crash in the middle of record
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"op":"queue","task":{"id":9`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	s, err = writeback.OpenSpill(name)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, 3, s.Pending())
+	pushed, err := s.Push("click", json.RawMessage(`"d"`), true)
+	require.NoError(t, err)
+	require.Greater(t, pushed.ID, second.ID+1)
+
+	// done ctx: the rest of pending tasks is drained, then ctx error
+	done, cancel := context.WithCancel(ctx)
+	cancel()
+	var args []string
+	for {
+		task, err := s.Next(done)
+		if err != nil {
+			require.ErrorIs(t, err, context.Canceled)
+			break
+		}
+		args = append(args, string(task.Arg))
+		require.NoError(t, s.Done(task.ID))
+	}
+	require.Equal(t, []string{`"b"`, `"c"`, `"u1"`, `"d"`}, args)
+	require.Zero(t, s.Pending())
+}
@@ -0,0 +1,547 @@
+package writeback
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/fileutil"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+)
+
+// journal of pending writes of write back cache
+// link put by user is appended to journal (json line, fsync) and then written to repo by worker,
+// so it is not lost when repo is down or app is restarted. pending writes are kept per link (uid:key):
+// next put of the same link replaces value of pending one (coalescing), so only last value goes to repo.
+// failed write is retried after backoff, after MaxAttempts it is moved to dead letters, write which can never be done
+// (e.g. shortlink is taken) is rejected to dead letters at once.
+// pending global shortlink is reserved for its user: put of it by other user is refused until write is done.
+// cancel of write which is taken by worker waits for result of it, so link deleted after cancel is not put back.
+// journal is rewritten with only pending and dead writes when it is opened, closed and grows big.
+
+// journalCompactEvery - how many records trigger rewriting of journal
+const journalCompactEvery = 1000
+
+// journal operations
+const (
+	opQueue = "queue"
+	opDone  = "done"
+	opRetry = "retry"
+	opDead  = "dead"
+	opDrop  = "drop"
+)
+
+// ErrClosed - journal is closed
+var ErrClosed = errors.New("writeback: journal is closed")
+
+// ErrNoWrite - no dead write of id
+var ErrNoWrite = errors.New("writeback: no such write")
+
+// ErrShortlinkPending - global shortlink is pending write of other user
+var ErrShortlinkPending = errors.New("writeback: shortlink is pending for other user")
+
+// Write - pending write of link
+// Version grows with every put (it is sequence of journal), so result of worker which wrote older value does not remove newer one
+// Attempts - failed attempts, NextAt - time of next attempt, LastError - error of last attempt
+type Write struct {
+	ID        string       `json:"id"`
+	UID       string       `json:"uid"`
+	Key       string       `json:"key"`
+	Value     model.DataEl `json:"value"`
+	SU        bool         `json:"su,omitempty"`
+	Version   uint64       `json:"version"`
+	QueuedAt  time.Time    `json:"queued_at"`
+	Attempts  int          `json:"attempts,omitempty"`
+	NextAt    time.Time    `json:"next_at"`
+	LastError string       `json:"last_error,omitempty"`
+}
+
+// Options - retries of failed writes: delay of attempt n is BaseDelay * 2^(n-1), but no more than MaxDelay
+type Options struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultOptions - 8 attempts in about 2 minutes
+func DefaultOptions() Options {
+	return Options{MaxAttempts: 8, BaseDelay: 500 * time.Millisecond, MaxDelay: time.Minute}
+}
+
+// backoff - delay after attempts failed
+func (o Options) backoff(attempts int) time.Duration {
+	delay := o.BaseDelay
+	for i := 1; i < attempts && delay < o.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > o.MaxDelay {
+		delay = o.MaxDelay
+	}
+	return delay
+}
+
+// journalRec - one change of journal, one line of file
+type journalRec struct {
+	Op      string `json:"op"`
+	Write   *Write `json:"write,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+// Journal - pending and dead writes
+// inflight - ids of writes taken by workers (not journaled, after restart they are pending again),
+// channel of write is closed when worker reports its result
+type Journal struct {
+	mu        sync.Mutex
+	name      string
+	file      *os.File
+	opts      Options
+	pending   map[string]*Write
+	dead      map[string]Write
+	inflight  map[string]chan struct{}
+	journaled int
+	// seq - last version given to write
+	seq uint64
+	// wake - signal to workers waiting in Next, closed - it is closed by Close
+	wake   chan struct{}
+	closed chan struct{}
+}
+
+// Open - journal of file name, writes of previous run are pending again
+func Open(name string, opts Options) (*Journal, error) {
+	if opts.MaxAttempts < 1 || opts.BaseDelay <= 0 || opts.MaxDelay < opts.BaseDelay {
+		return nil, fmt.Errorf("writeback: max attempts %d, base delay %v, max delay %v: should be positive, max delay >= base delay",
+			opts.MaxAttempts, opts.BaseDelay, opts.MaxDelay)
+	}
+	j := &Journal{
+		name:     name,
+		opts:     opts,
+		pending:  make(map[string]*Write),
+		dead:     make(map[string]Write),
+		inflight: make(map[string]chan struct{}),
+		wake:     make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// replay - apply records of file
+func (j *Journal) replay() error {
+	return readJournal(j.name, func(line []byte) error {
+		var rec journalRec
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		j.apply(&rec)
+		return nil
+	})
+}
+
+// readJournal - lines of journal file name are given to apply,
+// broken tail (crash in the middle of write) is ignored: unfinished line or line apply fails on
+func readJournal(name string, apply func(line []byte) error) error {
+	file, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("writeback journal open error: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, errRead := reader.ReadBytes('\n')
+		if errRead != nil {
+			if len(line) != 0 {
+				log.Printf("writeback journal %s: cut off unfinished record", name)
+			}
+			return nil
+		}
+		if err = apply(line); err != nil {
+			log.Printf("writeback journal %s: cut off broken record: %v", name, err)
+			return nil
+		}
+	}
+}
+
+// rewriteJournal - journal file name is replaced by data (temp file + rename), then it is opened for append
+func rewriteJournal(name string, data []byte) (*os.File, error) {
+	if err := fileutil.WriteFileAtomic(name, data, 0644); err != nil {
+		return nil, fmt.Errorf("writeback journal compact error: %w", err)
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("writeback journal open error: %w", err)
+	}
+	return file, nil
+}
+
+// apply - apply change to maps, no lock, as its has been done in upper level
+func (j *Journal) apply(rec *journalRec) {
+	if rec.Write != nil && rec.Write.Version > j.seq {
+		j.seq = rec.Write.Version
+	}
+	switch rec.Op {
+	case opQueue, opRetry:
+		write := *rec.Write
+		j.pending[write.ID] = &write
+	case opDone:
+		if write, ok := j.pending[rec.ID]; ok && write.Version == rec.Version {
+			delete(j.pending, rec.ID)
+		}
+	case opDead:
+		delete(j.pending, rec.Write.ID)
+		j.dead[rec.Write.ID] = *rec.Write
+	case opDrop:
+		delete(j.dead, rec.ID)
+	}
+}
+
+// commit - write change to journal (fsync) then apply it, no lock, as its has been done in upper level
+func (j *Journal) commit(rec journalRec) error {
+	if j.file == nil {
+		return ErrClosed
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	// record which is not written is cut off, so it is not replayed and next one is not appended to half of it
+	if err = fileutil.AppendRecord(j.file, line); err != nil {
+		return fmt.Errorf("writeback %w", err)
+	}
+	j.apply(&rec)
+	j.journaled++
+	if j.journaled >= journalCompactEvery {
+		return j.compact()
+	}
+	return nil
+}
+
+// compact - rewrite journal with pending and dead writes only (temp file + rename), reopen it for append
+func (j *Journal) compact() error {
+	var data []byte
+	for _, write := range j.sortedPending() {
+		line, err := json.Marshal(journalRec{Op: opQueue, Write: write})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	for _, write := range j.deadLetters() {
+		write := write
+		line, err := json.Marshal(journalRec{Op: opDead, Write: &write})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if j.file != nil {
+		if err := j.file.Close(); err != nil {
+			return err
+		}
+		j.file = nil
+	}
+	file, err := rewriteJournal(j.name, data)
+	if err != nil {
+		return err
+	}
+	j.file = file
+	j.journaled = 0
+	return nil
+}
+
+// sortedPending - pending writes in order of queue time, no lock
+func (j *Journal) sortedPending() []*Write {
+	writes := make([]*Write, 0, len(j.pending))
+	for _, write := range j.pending {
+		writes = append(writes, write)
+	}
+	sort.Slice(writes, func(a, b int) bool {
+		if !writes[a].QueuedAt.Equal(writes[b].QueuedAt) {
+			return writes[a].QueuedAt.Before(writes[b].QueuedAt)
+		}
+		return writes[a].ID < writes[b].ID
+	})
+	return writes
+}
+
+// isClosed - Close is called
+func (j *Journal) isClosed() bool {
+	select {
+	case <-j.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// signal - wake up worker waiting in Next
+func (j *Journal) signal() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Queue - add write of link key of user uid, pending write of the same link gets new value
+func (j *Journal) Queue(uid, key string, value model.DataEl, su bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !value.Personal {
+		for _, other := range j.pending {
+			if other.UID != uid && !other.Value.Personal && other.Value.Shorturl == value.Shorturl {
+				return ErrShortlinkPending
+			}
+		}
+	}
+	now := time.Now().UTC()
+	write := Write{ID: uid + ":" + key, UID: uid, Key: key, Value: value, SU: su, Version: j.seq + 1, QueuedAt: now, NextAt: now}
+	if old, ok := j.pending[write.ID]; ok {
+		// coalescing: one pending write of link, it keeps its place in queue
+		write.QueuedAt = old.QueuedAt
+	}
+	if err := j.commit(journalRec{Op: opQueue, Write: &write}); err != nil {
+		return err
+	}
+	j.signal()
+	return nil
+}
+
+// Next - due pending write which is not taken by other worker, it waits for one until ctx is done
+// worker reports result of write by Done or Fail (or Release, if it was not tried)
+func (j *Journal) Next(ctx context.Context) (Write, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return Write{}, err
+		}
+		j.mu.Lock()
+		if j.isClosed() {
+			j.mu.Unlock()
+			return Write{}, ErrClosed
+		}
+		now := time.Now()
+		var next *Write
+		var wait time.Duration = -1
+		for _, write := range j.sortedPending() {
+			if _, ok := j.inflight[write.ID]; ok {
+				continue
+			}
+			if !write.NextAt.After(now) {
+				next = write
+				break
+			}
+			if until := write.NextAt.Sub(now); wait < 0 || until < wait {
+				wait = until
+			}
+		}
+		if next != nil {
+			j.inflight[next.ID] = make(chan struct{})
+			write := *next
+			j.mu.Unlock()
+			// there may be more due writes for other workers
+			j.signal()
+			return write, nil
+		}
+		j.mu.Unlock()
+
+		if err := j.wait(ctx, wait); err != nil {
+			return Write{}, err
+		}
+	}
+}
+
+// wait - wait for signal, close of journal or end of ctx, but no longer than wait (if it is not negative)
+func (j *Journal) wait(ctx context.Context, wait time.Duration) error {
+	var timer <-chan time.Time
+	if wait >= 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		timer = t.C
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-j.closed:
+		return ErrClosed
+	case <-j.wake:
+	case <-timer:
+	}
+	return nil
+}
+
+// Done - write is in repo, it is removed if it was not changed by newer put
+func (j *Journal) Done(write Write) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finish(write.ID)
+	defer j.signal()
+	if pending, ok := j.pending[write.ID]; !ok || pending.Version != write.Version {
+		return nil
+	}
+	return j.commit(journalRec{Op: opDone, ID: write.ID, Version: write.Version})
+}
+
+// Fail - write failed, it is retried after backoff or moved to dead letters after MaxAttempts
+// returns true if write is dead
+func (j *Journal) Fail(write Write, cause error) (bool, error) {
+	return j.fail(write, cause, false)
+}
+
+// Reject - write failed and it would fail every time, it is moved to dead letters at once
+// returns true if write is dead (false if newer value is pending)
+func (j *Journal) Reject(write Write, cause error) (bool, error) {
+	return j.fail(write, cause, true)
+}
+
+// fail - failed attempt of write, permanent - write is dead at once
+func (j *Journal) fail(write Write, cause error, permanent bool) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finish(write.ID)
+	defer j.signal()
+	pending, ok := j.pending[write.ID]
+	if !ok || pending.Version != write.Version {
+		// newer value is pending, it gets own attempts
+		return false, nil
+	}
+	failed := *pending
+	failed.Attempts++
+	failed.LastError = cause.Error()
+	if permanent || failed.Attempts >= j.opts.MaxAttempts {
+		return true, j.commit(journalRec{Op: opDead, Write: &failed})
+	}
+	failed.NextAt = time.Now().UTC().Add(j.opts.backoff(failed.Attempts))
+	return false, j.commit(journalRec{Op: opRetry, Write: &failed})
+}
+
+// finish - worker reported result of write id, cancel waiting for it goes on, no lock
+func (j *Journal) finish(id string) {
+	if finished, ok := j.inflight[id]; ok {
+		close(finished)
+		delete(j.inflight, id)
+	}
+}
+
+// Cancel - pending write of link key of user uid is not needed any more (link is deleted)
+// if write is taken by worker, it waits until worker reports result of it (or ctx is done),
+// so link is deleted from repo after it is put there, not before
+func (j *Journal) Cancel(ctx context.Context, uid, key string) error {
+	id := uid + ":" + key
+	j.mu.Lock()
+	if write, ok := j.pending[id]; ok {
+		if err := j.commit(journalRec{Op: opDone, ID: write.ID, Version: write.Version}); err != nil {
+			j.mu.Unlock()
+			return err
+		}
+	}
+	finished, ok := j.inflight[id]
+	j.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release - write taken by Next is not tried (e.g. app is stopping), it is pending as it was
+func (j *Journal) Release(write Write) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finish(write.ID)
+	j.signal()
+}
+
+// Pending - number of pending writes
+func (j *Journal) Pending() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.pending)
+}
+
+// DeadLetters - writes which failed MaxAttempts times, in order of queue time
+func (j *Journal) DeadLetters() []Write {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.deadLetters()
+}
+
+// deadLetters - dead writes in order of queue time, no lock
+func (j *Journal) deadLetters() []Write {
+	writes := make([]Write, 0, len(j.dead))
+	for _, write := range j.dead {
+		writes = append(writes, write)
+	}
+	sort.Slice(writes, func(a, b int) bool {
+		if !writes[a].QueuedAt.Equal(writes[b].QueuedAt) {
+			return writes[a].QueuedAt.Before(writes[b].QueuedAt)
+		}
+		return writes[a].ID < writes[b].ID
+	})
+	return writes
+}
+
+// Requeue - dead write of id is pending again with new attempts, unless link has newer pending write
+func (j *Journal) Requeue(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	write, ok := j.dead[id]
+	if !ok {
+		return ErrNoWrite
+	}
+	if _, ok = j.pending[id]; !ok {
+		write.Attempts = 0
+		write.LastError = ""
+		write.NextAt = time.Now().UTC()
+		if err := j.commit(journalRec{Op: opQueue, Write: &write}); err != nil {
+			return err
+		}
+	}
+	if err := j.commit(journalRec{Op: opDrop, ID: id}); err != nil {
+		return err
+	}
+	j.signal()
+	return nil
+}
+
+// Close - rewrite journal with pending writes and close it
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.isClosed() {
+		return nil
+	}
+	var err error
+	if j.file != nil {
+		err = j.compact()
+	}
+	if j.file != nil {
+		if cerr := j.file.Close(); err == nil {
+			err = cerr
+		}
+		j.file = nil
+	}
+	// workers waiting in Next see closed journal
+	close(j.closed)
+	return err
+}
@@ -0,0 +1,323 @@
+package writeback_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/model"
+	"github.com/pehks1980/go_gb_be1_kurs/web-link/internal/pkg/writeback"
+)
+
+// fastRetries - retries of tests
+var fastRetries = writeback.Options{MaxAttempts: 3, BaseDelay: 20 * time.Millisecond, MaxDelay: 40 * time.Millisecond}
+
+func openJournal(t *testing.T, name string, opts writeback.Options) *writeback.Journal {
+	j, err := writeback.Open(name, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = j.Close() })
+	return j
+}
+
+func link(url string) model.DataEl {
+	return model.DataEl{UID: "u1", URL: url, Shorturl: "l1", Active: 1}
+}
+
+// next - due write, test fails if there is none for long
+func next(t *testing.T, j *writeback.Journal) writeback.Write {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	write, err := j.Next(ctx)
+	require.NoError(t, err)
+	return write
+}
+
+// noNext - there is no due write during wait
+func noNext(t *testing.T, j *writeback.Journal, wait time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	_, err := j.Next(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestOpen(t *testing.T) {
+	_, err := writeback.Open(filepath.Join(t.TempDir(), "wb.journal"), writeback.Options{})
+	require.Error(t, err)
+	_, err = writeback.Open(filepath.Join(t.TempDir(), "wb.journal"),
+		writeback.Options{MaxAttempts: 1, BaseDelay: time.Second, MaxDelay: time.Millisecond})
+	require.Error(t, err)
+	_, err = writeback.Open(filepath.Join(t.TempDir(), "no", "dir", "wb.journal"), writeback.DefaultOptions())
+	require.Error(t, err)
+}
+
+// puts of one link are one pending write with last value
+func TestCoalescing(t *testing.T) {
+	j := openJournal(t, filepath.Join(t.TempDir(), "wb.journal"), writeback.DefaultOptions())
+	require.NoError(t, j.Queue("u1", "l1", link("v1"), false))
+	require.NoError(t, j.Queue("u1", "l1", link("v2"), false))
+	require.NoError(t, j.Queue("u1", "l2", link("other"), true))
+	require.Equal(t, 2, j.Pending())
+
+	write := next(t, j)
+	require.Equal(t, "u1:l1", write.ID)
+	require.Equal(t, "v2", write.Value.URL)
+	require.Equal(t, uint64(2), write.Version)
+
+	// taken write is not given to other worker, newer put of it waits for result of first one
+	require.NoError(t, j.Queue("u1", "l1", link("v3"), false))
+	other := next(t, j)
+	require.Equal(t, "u1:l2", other.ID)
+	require.True(t, other.SU)
+	require.NoError(t, j.Done(other))
+	noNext(t, j, 30*time.Millisecond)
+
+	// v2 is written, v3 is still pending
+	require.NoError(t, j.Done(write))
+	require.Equal(t, 1, j.Pending())
+	write = next(t, j)
+	require.Equal(t, "v3", write.Value.URL)
+	require.NoError(t, j.Done(write))
+	require.Equal(t, 0, j.Pending())
+}
+
+// failed write is retried after backoff, then it is dead
+func TestRetries(t *testing.T) {
+	j := openJournal(t, filepath.Join(t.TempDir(), "wb.journal"), fastRetries)
+	require.NoError(t, j.Queue("u1", "l1", link("v1"), false))
+
+	for attempt := 1; attempt <= fastRetries.MaxAttempts; attempt++ {
+		started := time.Now()
+		write := next(t, j)
+		if attempt > 1 {
+			require.GreaterOrEqual(t, time.Since(started), 15*time.Millisecond, "attempt %d", attempt)
+		}
+		require.Equal(t, attempt-1, write.Attempts)
+		dead, err := j.Fail(write, fmt.Errorf("repo is down %d", attempt))
+		require.NoError(t, err)
+		require.Equal(t, attempt == fastRetries.MaxAttempts, dead)
+	}
+	require.Equal(t, 0, j.Pending())
+	noNext(t, j, 60*time.Millisecond)
+
+	dead := j.DeadLetters()
+	require.Len(t, dead, 1)
+	require.Equal(t, "u1:l1", dead[0].ID)
+	require.Equal(t, 3, dead[0].Attempts)
+	require.Equal(t, "repo is down 3", dead[0].LastError)
+
+	// dead write is tried again by operator
+	require.ErrorIs(t, j.Requeue("u1:none"), writeback.ErrNoWrite)
+	require.NoError(t, j.Requeue("u1:l1"))
+	require.Empty(t, j.DeadLetters())
+	write := next(t, j)
+	require.Equal(t, 0, write.Attempts)
+	require.Equal(t, "v1", write.Value.URL)
+	require.NoError(t, j.Done(write))
+}
+
+// write of deleted link is cancelled
+func TestCancel(t *testing.T) {
+	j := openJournal(t, filepath.Join(t.TempDir(), "wb.journal"), writeback.DefaultOptions())
+	ctx := context.Background()
+	require.NoError(t, j.Queue("u1", "l1", link("v1"), false))
+	require.NoError(t, j.Cancel(ctx, "u1", "l1"))
+	require.NoError(t, j.Cancel(ctx, "u1", "none"))
+	require.Equal(t, 0, j.Pending())
+
+	// cancel of taken write waits for worker, then write is done without error
+	require.NoError(t, j.Queue("u1", "l1", link("v2"), false))
+	write := next(t, j)
+	cancelled := make(chan error, 1)
+	go func() { cancelled <- j.Cancel(ctx, "u1", "l1") }()
+	select {
+	case err := <-cancelled:
+		t.Fatalf("cancel of taken write returned before worker: %v", err)
+	case <-time.After(30 * time.Millisecond):
+	}
+	require.NoError(t, j.Done(write))
+	require.NoError(t, <-cancelled)
+	require.Equal(t, 0, j.Pending())
+
+	// waiting cancel ends with ctx, newer put is pending
+	require.NoError(t, j.Queue("u1", "l1", link("v3"), false))
+	write = next(t, j)
+	short, stop := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer stop()
+	require.ErrorIs(t, j.Cancel(short, "u1", "l1"), context.DeadlineExceeded)
+	require.NoError(t, j.Queue("u1", "l1", link("v4"), false))
+	require.NoError(t, j.Done(write))
+	require.Equal(t, 1, j.Pending())
+}
+
+// write which would fail every time is dead at once, pending global shortlink is kept for its user
+func TestReject(t *testing.T) {
+	j := openJournal(t, filepath.Join(t.TempDir(), "wb.journal"), fastRetries)
+	require.NoError(t, j.Queue("u1", "l1", link("v1"), false))
+	other := link("v2")
+	other.UID = "u2"
+	require.ErrorIs(t, j.Queue("u2", "l1", other, false), writeback.ErrShortlinkPending)
+	other.Personal = true
+	require.NoError(t, j.Queue("u2", "l1", other, false))
+
+	write := next(t, j)
+	require.Equal(t, "u1:l1", write.ID)
+	dead, err := j.Reject(write, errors.New("shortlink is taken already"))
+	require.NoError(t, err)
+	require.True(t, dead)
+	letters := j.DeadLetters()
+	require.Len(t, letters, 1)
+	require.Equal(t, 1, letters[0].Attempts)
+	require.Equal(t, "shortlink is taken already", letters[0].LastError)
+
+	// shortlink of dead write is free
+	other.UID, other.Personal = "u3", false
+	require.NoError(t, j.Queue("u3", "l1", other, false))
+}
+
+// failure of older value does not count for newer one
+func TestFailOfOlderVersion(t *testing.T) {
+	j := openJournal(t, filepath.Join(t.TempDir(), "wb.journal"), fastRetries)
+	require.NoError(t, j.Queue("u1", "l1", link("v1"), false))
+	write := next(t, j)
+	require.NoError(t, j.Queue("u1", "l1", link("v2"), false))
+	dead, err := j.Fail(write, errors.New("repo is down"))
+	require.NoError(t, err)
+	require.False(t, dead)
+
+	write = next(t, j)
+	require.Equal(t, "v2", write.Value.URL)
+	require.Equal(t, 0, write.Attempts)
+	require.Empty(t, write.LastError)
+}
+
+// pending, taken and dead writes are kept after restart, broken tail of journal is ignored
+func TestDurable(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "wb.journal")
+	opts := writeback.Options{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	j, err := writeback.Open(name, opts)
+	require.NoError(t, err)
+	require.NoError(t, j.Queue("u1", "l1", link("v1"), false))
+	require.NoError(t, j.Queue("u1", "l2", link("v2"), false))
+	require.NoError(t, j.Queue("u1", "l3", link("v3"), false))
+
+	// l1 is dead, l2 failed once, l3 is taken when app is stopped
+	for i := 0; i < 2; i++ {
+		write := next(t, j)
+		require.Equal(t, "u1:l1", write.ID)
+		_, err = j.Fail(write, errors.New("repo is down"))
+		require.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+	}
+	write := next(t, j)
+	require.Equal(t, "u1:l2", write.ID)
+	_, err = j.Fail(write, errors.New("repo is down"))
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	write = next(t, j)
+	require.Equal(t, "u1:l2", write.ID)
+	j.Release(write)
+	write = next(t, j)
+	require.Equal(t, "u1:l2", write.ID)
+	taken := next(t, j)
+	require.Equal(t, "u1:l3", taken.ID)
+
+	// crash: records are in file without compaction, and last one is cut in the middle
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"queue","write":{"id":"u1:l9"`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	j2 := openJournal(t, name, opts)
+	require.Equal(t, 2, j2.Pending())
+	require.Len(t, j2.DeadLetters(), 1)
+	write = next(t, j2)
+	require.Equal(t, "u1:l2", write.ID)
+	require.Equal(t, 1, write.Attempts)
+	require.Equal(t, "repo is down", write.LastError)
+	require.NoError(t, j2.Done(write))
+	write = next(t, j2)
+	require.Equal(t, "u1:l3", write.ID)
+	require.Equal(t, "v3", write.Value.URL)
+	require.NoError(t, j2.Done(write))
+
+	// done ctx, due write is not taken
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, j2.Queue("u1", "l5", link("v5"), false))
+	_, err = j2.Next(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoError(t, j2.Cancel(context.Background(), "u1", "l5"))
+
+	require.NoError(t, j2.Close())
+
+	// closed journal
+	require.ErrorIs(t, j2.Queue("u1", "l4", link("v4"), false), writeback.ErrClosed)
+	j3 := openJournal(t, name, opts)
+	require.Equal(t, 0, j3.Pending())
+	require.Len(t, j3.DeadLetters(), 1)
+	require.NoError(t, j.Close())
+}
+
+// workers waiting for writes are woken by queue and by close
+func TestWorkers(t *testing.T) {
+	j, err := writeback.Open(filepath.Join(t.TempDir(), "wb.journal"), writeback.DefaultOptions())
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	written := make(map[string]string)
+	busy := make(map[string]bool)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				write, err := j.Next(context.Background())
+				if errors.Is(err, writeback.ErrClosed) {
+					return
+				}
+				if err != nil {
+					t.Errorf("next error: %v", err)
+					return
+				}
+				mu.Lock()
+				if busy[write.ID] {
+					t.Errorf("write %s is taken twice", write.ID)
+				}
+				busy[write.ID] = true
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				written[write.ID] = write.Value.URL
+				busy[write.ID] = false
+				mu.Unlock()
+				if err := j.Done(write); err != nil {
+					t.Errorf("done error: %v", err)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("l%d", i%10)
+		require.NoError(t, j.Queue("u1", key, link(fmt.Sprintf("v%d", i)), false))
+	}
+	require.Eventually(t, func() bool { return j.Pending() == 0 }, 5*time.Second, 5*time.Millisecond)
+	require.NoError(t, j.Close())
+	wg.Wait()
+
+	// last value of every link is written
+	require.Len(t, written, 10)
+	for i := 90; i < 100; i++ {
+		require.Equal(t, fmt.Sprintf("v%d", i), written[fmt.Sprintf("u1:l%d", i%10)])
+	}
+}